@@ -0,0 +1,836 @@
+// Package acmetest provides a minimal in-memory ACME (RFC 8555) server in the spirit of
+// Pebble, so ACME clients can be tested end-to-end without a real CA.
+package acmetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RootName          = "Certbuddy Test Root"
+	AlternateRootName = "Certbuddy Alternate Test Root"
+	IntermediateName  = "Certbuddy Test Intermediate"
+)
+
+// ValidatorFunc checks whether the challenge of the given type for the domain has been
+// solved correctly, e.g. by fetching the HTTP-01 resource. keyAuth is the expected key
+// authorization.
+type ValidatorFunc func(challengeType, domain, token, keyAuth string) error
+
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Status string   `json:"status"`
+	Token  string   `json:"token"`
+	Error  *problem `json:"error,omitempty"`
+}
+
+type authorization struct {
+	Status     string       `json:"status"`
+	Identifier identifier   `json:"identifier"`
+	Challenges []*challenge `json:"challenges"`
+	Wildcard   bool         `json:"wildcard,omitempty"`
+
+	account string
+}
+
+type order struct {
+	Status         string       `json:"status"`
+	Identifiers    []identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *problem     `json:"error,omitempty"`
+
+	account string
+	polls   int
+}
+
+type account struct {
+	Status  string   `json:"status"`
+	Contact []string `json:"contact,omitempty"`
+
+	key crypto.PublicKey
+}
+
+type issuer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// Server is an ACME server issuing certificates from an in-memory test CA. Every
+// certificate is offered with a default chain up to RootName and an alternate chain
+// up to AlternateRootName.
+type Server struct {
+	*httptest.Server
+
+	// Validator is called to validate challenges. If nil, all challenges are valid.
+	Validator ValidatorFunc
+	// ChallengeTypes are offered for every authorization, defaults to http-01,
+	// tls-alpn-01 and dns-01.
+	ChallengeTypes []string
+
+	nonceLock sync.Mutex
+	nonces    map[string]bool
+
+	lock           sync.Mutex
+	accounts       map[string]*account
+	orders         map[string]*order
+	authorizations map[string]*authorization
+	challenges     map[string]*challenge
+	certificates   map[string][]byte
+	issued         map[string]*x509.Certificate
+	owners         map[string]string
+	revoked        map[string]int
+	revokedByKey   map[string]bool
+	counter        int
+
+	root         issuer
+	alternate    issuer
+	intermediate issuer
+	crossSigned  *x509.Certificate
+}
+
+// NewServer starts a new ACME test server. It has to be closed by the caller.
+func NewServer() *Server {
+	return newServer(httptest.NewServer)
+}
+
+// NewTLSServer starts a new ACME test server using HTTPS with a self signed certificate,
+// see httptest.Server.Certificate. It has to be closed by the caller.
+func NewTLSServer() *Server {
+	return newServer(httptest.NewTLSServer)
+}
+
+func newServer(start func(http.Handler) *httptest.Server) *Server {
+	s := &Server{
+		ChallengeTypes: []string{"http-01", "tls-alpn-01", "dns-01"},
+		nonces:         make(map[string]bool),
+		accounts:       make(map[string]*account),
+		orders:         make(map[string]*order),
+		authorizations: make(map[string]*authorization),
+		challenges:     make(map[string]*challenge),
+		certificates:   make(map[string][]byte),
+		issued:         make(map[string]*x509.Certificate),
+		owners:         make(map[string]string),
+		revoked:        make(map[string]int),
+		revokedByKey:   make(map[string]bool),
+	}
+	s.root = newIssuer(RootName, nil)
+	s.alternate = newIssuer(AlternateRootName, nil)
+	s.intermediate = newIssuer(IntermediateName, &s.root)
+	s.crossSigned = signCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: IntermediateName},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, s.intermediate.key.Public(), &s.alternate)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", s.handleDirectory)
+	mux.HandleFunc("/nonce", s.handleNonce)
+	mux.HandleFunc("/account", s.handleNewAccount)
+	mux.HandleFunc("/order", s.handleNewOrder)
+	mux.HandleFunc("/order/", s.handleOrder)
+	mux.HandleFunc("/authz/", s.handleAuthorization)
+	mux.HandleFunc("/challenge/", s.handleChallenge)
+	mux.HandleFunc("/finalize/", s.handleFinalize)
+	mux.HandleFunc("/cert/", s.handleCertificate)
+	mux.HandleFunc("/revoke", s.handleRevoke)
+	s.Server = start(mux)
+	return s
+}
+
+// DirectoryURL returns the URL of the ACME directory.
+func (s *Server) DirectoryURL() string {
+	return s.URL + "/directory"
+}
+
+// Roots returns a pool containing both root certificates of the test CA.
+func (s *Server) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.root.cert)
+	pool.AddCert(s.alternate.cert)
+	return pool
+}
+
+// Revoked returns the reason code if the certificate has been revoked.
+func (s *Server) Revoked(cert *x509.Certificate) (int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	reason, revoked := s.revoked[cert.SerialNumber.String()]
+	return reason, revoked
+}
+
+// RevokedWithCertKey returns whether the revocation of the certificate was signed with
+// the key of the certificate instead of an account key.
+func (s *Server) RevokedWithCertKey(cert *x509.Certificate) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.revokedByKey[cert.SerialNumber.String()]
+}
+
+// Accounts returns the number of registered accounts.
+func (s *Server) Accounts() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.accounts)
+}
+
+func newIssuer(name string, parent *issuer) issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	self := issuer{key: key}
+	if parent == nil {
+		parent = &self
+		template.Issuer = template.Subject
+		self.cert = template
+	}
+	self.cert = signCertificate(template, key.Public(), parent)
+	return self
+}
+
+func signCertificate(template *x509.Certificate, pub crypto.PublicKey, parent *issuer) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		panic(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(time.Hour * 24 * 365)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent.cert, pub, parent.key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+func (s *Server) newNonce() string {
+	data := make([]byte, 16)
+	rand.Read(data)
+	nonce := base64.RawURLEncoding.EncodeToString(data)
+	s.nonceLock.Lock()
+	s.nonces[nonce] = true
+	s.nonceLock.Unlock()
+	return nonce
+}
+
+func (s *Server) nextID() string {
+	s.counter++
+	return fmt.Sprintf("%d", s.counter)
+}
+
+func (s *Server) writeJson(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *Server) writeProblem(w http.ResponseWriter, status int, problemType, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type:   "urn:ietf:params:acme:error:" + problemType,
+		Detail: detail,
+		Status: status,
+	})
+}
+
+func (s *Server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	s.writeJson(w, http.StatusOK, map[string]interface{}{
+		"newNonce":   s.URL + "/nonce",
+		"newAccount": s.URL + "/account",
+		"newOrder":   s.URL + "/order",
+		"revokeCert": s.URL + "/revoke",
+		"keyChange":  s.URL + "/key-change",
+		"meta": map[string]string{
+			"termsOfService": s.URL + "/terms",
+		},
+	})
+}
+
+func (s *Server) handleNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	Jwk   json.RawMessage `json:"jwk"`
+	Kid   string          `json:"kid"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+}
+
+type jwsRequest struct {
+	header  jwsHeader
+	payload []byte
+	key     crypto.PublicKey
+	account string
+}
+
+// verify checks the JWS of a request and returns its content. If it fails, a problem
+// has already been written to the response.
+func (s *Server) verify(w http.ResponseWriter, r *http.Request, allowJwk bool) (*jwsRequest, bool) {
+	if r.Method != "POST" {
+		s.writeProblem(w, http.StatusMethodNotAllowed, "malformed", "Only POST is allowed")
+		return nil, false
+	}
+	if r.Header.Get("Content-Type") != "application/jose+json" {
+		s.writeProblem(w, http.StatusUnsupportedMediaType, "malformed", "Invalid content type")
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return nil, false
+	}
+	var msg struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return nil, false
+	}
+	headerData, err1 := base64.RawURLEncoding.DecodeString(msg.Protected)
+	payload, err2 := base64.RawURLEncoding.DecodeString(msg.Payload)
+	signature, err3 := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", "Invalid base64url encoding")
+		return nil, false
+	}
+	req := &jwsRequest{payload: payload}
+	if err := json.Unmarshal(headerData, &req.header); err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return nil, false
+	}
+
+	s.nonceLock.Lock()
+	validNonce := s.nonces[req.header.Nonce]
+	delete(s.nonces, req.header.Nonce)
+	s.nonceLock.Unlock()
+	if !validNonce {
+		s.writeProblem(w, http.StatusBadRequest, "badNonce", "Invalid nonce")
+		return nil, false
+	}
+	if req.header.URL != s.URL+r.URL.Path {
+		s.writeProblem(w, http.StatusUnauthorized, "unauthorized", "URL in JWS header doesn't match request")
+		return nil, false
+	}
+
+	if req.header.Kid != "" {
+		s.lock.Lock()
+		acc, exists := s.accounts[req.header.Kid]
+		s.lock.Unlock()
+		if !exists {
+			s.writeProblem(w, http.StatusBadRequest, "accountDoesNotExist", "Unknown account")
+			return nil, false
+		}
+		req.key = acc.key
+		req.account = req.header.Kid
+	} else if allowJwk && len(req.header.Jwk) > 0 {
+		req.key, err = parseJwk(req.header.Jwk)
+		if err != nil {
+			s.writeProblem(w, http.StatusBadRequest, "badPublicKey", err.Error())
+			return nil, false
+		}
+	} else {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", "Either kid or jwk has to be used")
+		return nil, false
+	}
+
+	if err := verifySignature(req.header.Alg, req.key, []byte(msg.Protected+"."+msg.Payload), signature); err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return nil, false
+	}
+	return req, true
+}
+
+func parseJwk(data []byte) (crypto.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, err
+	}
+	decode := func(v string) *big.Int {
+		data, _ := base64.RawURLEncoding.DecodeString(v)
+		return new(big.Int).SetBytes(data)
+	}
+	switch jwk.Kty {
+	case "RSA":
+		return &rsa.PublicKey{N: decode(jwk.N), E: int(decode(jwk.E).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %s", jwk.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: decode(jwk.X), Y: decode(jwk.Y)}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("Unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", jwk.Kty)
+}
+
+// jwkThumbprint calculates the RFC 7638 thumbprint of the given public key.
+func jwkThumbprint(pub crypto.PublicKey) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	var input string
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		input = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, enc(big.NewInt(int64(key.E)).Bytes()), enc(key.N.Bytes()))
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		x := make([]byte, size)
+		y := make([]byte, size)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		input = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, key.Curve.Params().Name, enc(x), enc(y))
+	case ed25519.PublicKey:
+		input = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, enc(key))
+	}
+	sum := sha256.Sum256([]byte(input))
+	return enc(sum[:])
+}
+
+func verifySignature(alg string, pub crypto.PublicKey, data, signature []byte) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("Algorithm %s doesn't match RSA key", alg)
+		}
+		sum := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature)
+	case *ecdsa.PublicKey:
+		hash := crypto.SHA256
+		if alg == "ES384" {
+			hash = crypto.SHA384
+		} else if alg != "ES256" {
+			return fmt.Errorf("Algorithm %s doesn't match EC key", alg)
+		}
+		h := hash.New()
+		h.Write(data)
+		size := len(signature) / 2
+		r := new(big.Int).SetBytes(signature[:size])
+		sig := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, sig) {
+			return fmt.Errorf("Invalid signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("Algorithm %s doesn't match Ed25519 key", alg)
+		}
+		if !ed25519.Verify(key, data, signature) {
+			return fmt.Errorf("Invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported key type %T", pub)
+}
+
+func (s *Server) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, true)
+	if !ok {
+		return
+	}
+	var acc account
+	if err := json.Unmarshal(req.payload, &acc); err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	thumbprint := jwkThumbprint(req.key)
+	for url, existing := range s.accounts {
+		if jwkThumbprint(existing.key) == thumbprint {
+			w.Header().Set("Location", url)
+			s.writeJson(w, http.StatusOK, existing)
+			return
+		}
+	}
+	url := s.URL + "/account/" + s.nextID()
+	acc.Status = "valid"
+	acc.key = req.key
+	s.accounts[url] = &acc
+	w.Header().Set("Location", url)
+	s.writeJson(w, http.StatusCreated, acc)
+}
+
+func (s *Server) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	var o order
+	if err := json.Unmarshal(req.payload, &o); err != nil || len(o.Identifiers) == 0 {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", "Invalid order")
+		return
+	}
+	// The expiration of an order is set by the server, RFC 8555 section 7.4
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(req.payload, &fields); err == nil {
+		if _, ok := fields["expires"]; ok {
+			s.writeProblem(w, http.StatusBadRequest, "malformed", "The client may not set expires")
+			return
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := s.nextID()
+	o.Status = "pending"
+	o.account = req.account
+	o.Finalize = s.URL + "/finalize/" + id
+	for _, ident := range o.Identifiers {
+		if ident.Type != "dns" {
+			s.writeProblem(w, http.StatusBadRequest, "unsupportedIdentifier", ident.Type)
+			return
+		}
+		authzID := s.nextID()
+		authz := &authorization{
+			Status:     "pending",
+			Identifier: ident,
+			account:    req.account,
+		}
+		if strings.HasPrefix(ident.Value, "*.") {
+			authz.Identifier.Value = strings.TrimPrefix(ident.Value, "*.")
+			authz.Wildcard = true
+		}
+		for _, typ := range s.ChallengeTypes {
+			if authz.Wildcard && typ != "dns-01" {
+				// RFC 8555 section 7.1.3, wildcards can only be validated via DNS
+				continue
+			}
+			chURL := s.URL + "/challenge/" + s.nextID()
+			ch := &challenge{Type: typ, URL: chURL, Status: "pending", Token: s.nextToken()}
+			authz.Challenges = append(authz.Challenges, ch)
+			s.challenges[chURL] = ch
+		}
+		authzURL := s.URL + "/authz/" + authzID
+		s.authorizations[authzURL] = authz
+		o.Authorizations = append(o.Authorizations, authzURL)
+	}
+	orderURL := s.URL + "/order/" + id
+	s.orders[orderURL] = &o
+	w.Header().Set("Location", orderURL)
+	s.writeJson(w, http.StatusCreated, o)
+}
+
+func (s *Server) nextToken() string {
+	data := make([]byte, 24)
+	rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	o, exists := s.orders[s.URL+r.URL.Path]
+	if !exists || o.account != req.account {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "Unknown order")
+		return
+	}
+	if o.Status == "processing" {
+		// Orders are issued on the second poll, so clients have to poll.
+		o.polls++
+		if o.polls > 1 {
+			o.Status = "valid"
+		}
+	}
+	s.writeJson(w, http.StatusOK, o)
+}
+
+func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	authz, exists := s.authorizations[s.URL+r.URL.Path]
+	if !exists || authz.account != req.account {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "Unknown authorization")
+		return
+	}
+	s.writeJson(w, http.StatusOK, authz)
+}
+
+func (s *Server) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	chURL := s.URL + r.URL.Path
+	s.lock.Lock()
+	ch, exists := s.challenges[chURL]
+	var authz *authorization
+	for _, a := range s.authorizations {
+		for _, c := range a.Challenges {
+			if c == ch {
+				authz = a
+			}
+		}
+	}
+	s.lock.Unlock()
+	if !exists || authz == nil || authz.account != req.account {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "Unknown challenge")
+		return
+	}
+
+	s.lock.Lock()
+	key := s.accounts[req.account].key
+	s.lock.Unlock()
+	keyAuth := ch.Token + "." + jwkThumbprint(key)
+
+	var err error
+	if s.Validator != nil {
+		err = s.Validator(ch.Type, authz.Identifier.Value, ch.Token, keyAuth)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		ch.Status = "invalid"
+		ch.Error = &problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: err.Error(), Status: 403}
+		authz.Status = "invalid"
+	} else {
+		ch.Status = "valid"
+		authz.Status = "valid"
+	}
+	s.writeJson(w, http.StatusOK, ch)
+}
+
+func (s *Server) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	var finalize struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &finalize); err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(finalize.CSR)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	orderURL := s.URL + "/order/" + strings.TrimPrefix(r.URL.Path, "/finalize/")
+	o, exists := s.orders[orderURL]
+	if !exists || o.account != req.account {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "Unknown order")
+		return
+	}
+	for _, authzURL := range o.Authorizations {
+		if s.authorizations[authzURL].Status != "valid" {
+			s.writeProblem(w, http.StatusForbidden, "orderNotReady", "Not all authorizations are valid")
+			return
+		}
+	}
+	if !sameNames(o.Identifiers, csr.DNSNames) {
+		s.writeProblem(w, http.StatusBadRequest, "badCSR", "CSR doesn't match order identifiers")
+		return
+	}
+
+	cert := signCertificate(&x509.Certificate{
+		Subject:     csr.Subject,
+		DNSNames:    csr.DNSNames,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotAfter:    time.Now().Add(time.Hour * 24 * 90),
+	}, csr.PublicKey, &s.intermediate)
+	certID := s.nextID()
+	s.certificates[certID] = cert.Raw
+	s.issued[cert.SerialNumber.String()] = cert
+	s.owners[cert.SerialNumber.String()] = req.account
+	o.Certificate = s.URL + "/cert/" + certID
+	o.Status = "processing"
+	s.writeJson(w, http.StatusOK, o)
+}
+
+func sameNames(ids []identifier, names []string) bool {
+	if len(ids) != len(names) {
+		return false
+	}
+	expected := make(map[string]bool)
+	for _, id := range ids {
+		expected[id.Value] = true
+	}
+	for _, name := range names {
+		if !expected[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) handleCertificate(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.verify(w, r, false); !ok {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/cert/")
+	alternate := strings.HasSuffix(id, "/1")
+	id = strings.TrimSuffix(id, "/1")
+
+	s.lock.Lock()
+	der, exists := s.certificates[id]
+	s.lock.Unlock()
+	if !exists {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "Unknown certificate")
+		return
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if alternate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.crossSigned.Raw})...)
+	} else {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.intermediate.cert.Raw})...)
+		w.Header().Add("Link", fmt.Sprintf(`<%s/cert/%s/1>;rel="alternate"`, s.URL, id))
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.WriteHeader(http.StatusOK)
+	w.Write(chain)
+}
+
+// handleRevoke revokes a certificate as described in RFC 8555 section 7.6. The request
+// has to be signed by the account which ordered the certificate or with the key of the
+// certificate.
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, true)
+	if !ok {
+		return
+	}
+	var revocation struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if err := json.Unmarshal(req.payload, &revocation); err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(revocation.Certificate)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	if revocation.Reason < 0 || revocation.Reason > 10 || revocation.Reason == 7 {
+		s.writeProblem(w, http.StatusBadRequest, "badRevocationReason", "Unsupported reason")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	serial := cert.SerialNumber.String()
+	issued, exists := s.issued[serial]
+	if !exists || string(issued.Raw) != string(cert.Raw) {
+		s.writeProblem(w, http.StatusNotFound, "malformed", "Unknown certificate")
+		return
+	}
+	authorized := req.account != "" && s.owners[serial] == req.account
+	if req.account == "" {
+		authorized = jwkThumbprint(req.key) == jwkThumbprint(cert.PublicKey)
+	}
+	if !authorized {
+		s.writeProblem(w, http.StatusForbidden, "unauthorized", "Not authorized to revoke this certificate")
+		return
+	}
+	if _, revoked := s.revoked[serial]; revoked {
+		s.writeProblem(w, http.StatusBadRequest, "alreadyRevoked", "Certificate is already revoked")
+		return
+	}
+	s.revoked[serial] = revocation.Reason
+	s.revokedByKey[serial] = req.account == ""
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.WriteHeader(http.StatusOK)
+}
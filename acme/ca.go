@@ -1,123 +1,288 @@
 package acme
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"fmt"
 	"github.com/connctd/certbuddy"
 	"github.com/pkg/errors"
-	"github.com/xenolf/lego/acme"
 	"github.com/xenolf/lego/providers/http/webroot"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	stateBaseDir = "./.letsencrypt"
-	defaultPerm  = 0600
+
+	accountMetaName = "account.meta"
+	userAgent       = "certbuddy"
+
+	maxBadNonceRetries  = 3
+	defaultPollInterval = time.Second
+	defaultPollTimeout  = time.Minute * 2
 )
 
 var (
 	NotImplemented = errors.New("Not implemented")
+
+	// challengePreference is the order in which challenges are chosen, if providers for
+	// multiple challenges offered by the CA are configured.
+	challengePreference = []string{ChallengeHTTP01, ChallengeTLSALPN01, ChallengeDNS01}
+
+	linkAlternateRegexp = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?alternate"?`)
 )
 
 type User struct {
-	Email        string
-	PrivateKey   crypto.PrivateKey
-	registration *acme.RegistrationResource
+	Email      string
+	PrivateKey crypto.PrivateKey
 }
 
 func (u *User) GetEmail() string {
 	return u.Email
 }
 
-func (u *User) GetRegistration() *acme.RegistrationResource {
-	return u.registration
-}
-
 func (u *User) GetPrivateKey() crypto.PrivateKey {
 	return u.PrivateKey
 }
 
-func NewAcmeClient(user *User, webrootPath string) (certbuddy.AutomatedCA, error) {
-	client, err := acme.NewClient(letsencryptCaServer, user, acme.RSA4096)
+// ChallengeProvider solves a challenge for a domain by making the key authorization
+// available to the CA. It is compatible with the challenge providers of lego.
+type ChallengeProvider interface {
+	Present(domain, token, keyAuth string) error
+	CleanUp(domain, token, keyAuth string) error
+}
+
+// accountMeta is persisted in the state directory so the account URL doesn't need to
+// be looked up on every start.
+type accountMeta struct {
+	Directory string `json:"directory"`
+	URL       string `json:"url"`
+}
+
+// Options configure the ACME client.
+type Options struct {
+	// Directory is the name of a preset from DirectoryPresets or the URL of the
+	// directory of an ACME CA. Defaults to DefaultDirectory.
+	Directory string
+	// CABundlePath is an optional PEM file with root certificates to trust when
+	// talking to the ACME server, e.g. for a private CA.
+	CABundlePath string
+	// WebrootPath is the directory HTTP-01 challenges are written to. HTTP-01 challenges
+	// are not used if empty.
+	WebrootPath string
+	// StandaloneAddress is the address certbuddy listens on to answer HTTP-01 challenges
+	// itself, e.g. ":80". It can't be combined with WebrootPath.
+	StandaloneAddress string
+	// TLSALPNAddress is the address certbuddy listens on to answer TLS-ALPN-01
+	// challenges, e.g. ":443".
+	TLSALPNAddress string
+	// TLSALPNHook is a command handing TLS-ALPN-01 challenge certificates to an external
+	// TLS terminator, see TLSALPNHook. It can't be combined with TLSALPNAddress.
+	TLSALPNHook string
+	// DNSProvider solves DNS-01 challenges. DNS-01 challenges are not used if nil.
+	DNSProvider ChallengeProvider
+	// DNSResolvers are checked for the TXT record of a DNS-01 challenge before the CA is
+	// asked to validate it. Defaults to the resolvers of the system.
+	DNSResolvers []string
+	// DNSPropagationTimeout is the maximum time to wait for the TXT record to be visible
+	// on all DNSResolvers.
+	DNSPropagationTimeout time.Duration
+	// PreferredChain is the common name of an issuer. If not empty, the certificate chain
+	// containing this issuer is chosen from the chains offered by the CA.
+	PreferredChain string
+	// RevocationOnly allows a client without any challenge provider, which can revoke
+	// but not obtain certificates.
+	RevocationOnly bool
+}
+
+// NewAcmeClient creates a client for an ACME (RFC 8555) CA, which solves HTTP-01
+// challenges by writing to the webroot or with a standalone server, TLS-ALPN-01 challenges
+// with a TLS listener or hook and DNS-01 challenges with the DNS provider.
+func NewAcmeClient(user *User, opts Options) (certbuddy.AutomatedCA, error) {
+	directoryURL, err := ResolveDirectoryURL(opts.Directory)
 	if err != nil {
 		return nil, err
 	}
-
-	acmeClient := &acmeClient{
-		client: client,
-		user:   user,
-	}
-	stateDir, err := acmeClient.getStateDir()
+	httpClient, err := newHttpClient(opts.CABundlePath)
 	if err != nil {
 		return nil, err
 	}
-	var regData acme.RegistrationResource
-	regPath := path.Join(stateDir, "account.meta")
-	if err := certbuddy.LoadJsonFromDisk(regPath, &regData); err != nil {
-		log.Println("Registering new account")
-		reg, err := client.Register()
+	providers := make(map[string]ChallengeProvider)
+	if opts.WebrootPath != "" && opts.StandaloneAddress != "" {
+		return nil, errors.New("Only one of webroot and standalone server can be used for HTTP challenges")
+	}
+	if opts.StandaloneAddress != "" {
+		providers[ChallengeHTTP01] = GetStandaloneServer(opts.StandaloneAddress)
+	}
+	if opts.TLSALPNAddress != "" && opts.TLSALPNHook != "" {
+		return nil, errors.New("Only one of TLS-ALPN address and hook can be used for TLS-ALPN challenges")
+	}
+	if opts.TLSALPNAddress != "" {
+		providers[ChallengeTLSALPN01] = GetTLSALPNServer(opts.TLSALPNAddress)
+	}
+	if opts.TLSALPNHook != "" {
+		providers[ChallengeTLSALPN01] = &TLSALPNHook{Command: opts.TLSALPNHook}
+	}
+	if opts.WebrootPath != "" {
+		provider, err := webroot.NewHTTPProvider(opts.WebrootPath)
 		if err != nil {
 			return nil, err
 		}
-		if err := certbuddy.StoreJsonToDisk(regPath, reg); err != nil {
-			return nil, err
-		}
-		user.registration = reg
-		if err := client.AgreeToTOS(); err != nil {
-			return nil, err
-		}
-	} else {
-		log.Println("Using existing account")
-		user.registration = &regData
+		providers[ChallengeHTTP01] = provider
 	}
-	provider, err := webroot.NewHTTPProvider(webrootPath)
-	if err != nil {
-		return nil, err
+	if opts.DNSProvider != nil {
+		providers[ChallengeDNS01] = NewDNSPropagationCheck(opts.DNSProvider, opts.DNSResolvers, opts.DNSPropagationTimeout)
 	}
-	err = client.SetChallengeProvider(acme.HTTP01, provider)
+	if len(providers) == 0 && !opts.RevocationOnly {
+		return nil, errors.New("No provider for any challenge is configured")
+	}
+	client, err := newAcmeClient(user, directoryURL, httpClient, providers)
 	if err != nil {
 		return nil, err
 	}
-	client.ExcludeChallenges([]acme.Challenge{acme.DNS01, acme.TLSSNI01})
-
-	return acmeClient, nil
+	client.preferredChain = opts.PreferredChain
+	return client, nil
 }
 
 type acmeClient struct {
-	client *acme.Client
-	user   *User
+	httpClient     *http.Client
+	directoryURL   string
+	dir            directory
+	user           *User
+	signer         *jwsSigner
+	accountURL     string
+	providers      map[string]ChallengeProvider
+	preferredChain string
+	pollInterval   time.Duration
+	pollTimeout    time.Duration
+
+	nonceLock sync.Mutex
+	nonces    []string
 }
 
-func (a *acmeClient) ObtainCertificate(domains []string, privKey crypto.PrivateKey) (*certbuddy.CAResult, map[string]error) {
-	certs, failures := a.client.ObtainCertificate(domains, true, privKey)
-	if len(failures) > 0 {
-		return nil, failures
+func newAcmeClient(user *User, directoryURL string, httpClient *http.Client, providers map[string]ChallengeProvider) (*acmeClient, error) {
+	signer, err := newJwsSigner(user.PrivateKey)
+	if err != nil {
+		return nil, err
 	}
+	a := &acmeClient{
+		httpClient:   httpClient,
+		directoryURL: directoryURL,
+		user:         user,
+		signer:       signer,
+		providers:    providers,
+		pollInterval: defaultPollInterval,
+		pollTimeout:  defaultPollTimeout,
+	}
+	if err := a.loadDirectory(); err != nil {
+		return nil, errors.Wrap(err, "Unable to load ACME directory")
+	}
+	if err := a.ensureAccount(); err != nil {
+		return nil, errors.Wrap(err, "Unable to register ACME account")
+	}
+	return a, nil
+}
+
+func (a *acmeClient) loadDirectory() error {
+	req, err := http.NewRequest("GET", a.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %s for directory %s", resp.Status, a.directoryURL)
+	}
+	return json.NewDecoder(resp.Body).Decode(&a.dir)
+}
+
+func (a *acmeClient) ensureAccount() error {
 	stateDir, err := a.getStateDir()
 	if err != nil {
-		return nil, wrapErr(err)
+		return err
+	}
+	metaPath := path.Join(stateDir, accountMetaName)
+	var meta accountMeta
+	if err := certbuddy.LoadJsonFromDisk(metaPath, &meta); err == nil && meta.Directory == a.directoryURL && meta.URL != "" {
+		log.Println("Using existing account")
+		a.accountURL = meta.URL
+		return nil
+	}
+
+	log.Println("Registering new account")
+	acc := account{TermsOfServiceAgreed: true}
+	if a.user.Email != "" {
+		acc.Contact = []string{"mailto:" + a.user.Email}
 	}
-	certMetaPath := path.Join(stateDir, "certs.meta")
-	certMetaData, err := json.Marshal(certs)
+	// Registering an already existing key returns the existing account, so we
+	// end up with the correct account URL even if the state got lost.
+	resp, _, err := a.post(a.dir.NewAccount, acc, nil)
 	if err != nil {
-		return nil, wrapErr(err)
+		return err
+	}
+	a.accountURL = resp.Header.Get("Location")
+	if a.accountURL == "" {
+		return errors.New("ACME server didn't return an account URL")
+	}
+	return certbuddy.StoreJsonToDisk(metaPath, accountMeta{Directory: a.directoryURL, URL: a.accountURL})
+}
+
+func (a *acmeClient) ObtainCertificate(domains []string, privKey crypto.PrivateKey) (*certbuddy.CAResult, map[string]error) {
+	configured := make([]string, 0, len(a.providers))
+	for typ := range a.providers {
+		configured = append(configured, typ)
+	}
+	for _, domain := range domains {
+		if err := ValidateDomains([]string{domain}, configured); err != nil {
+			return nil, map[string]error{domain: err}
+		}
 	}
-	err = ioutil.WriteFile(certMetaPath, certMetaData, defaultPerm)
+
+	ids := make([]identifier, 0, len(domains))
+	for _, domain := range domains {
+		ids = append(ids, identifier{Type: "dns", Value: domain})
+	}
+	var o order
+	resp, _, err := a.post(a.dir.NewOrder, order{Identifiers: ids}, &o)
 	if err != nil {
-		return nil, wrapErr(err)
+		return nil, wrapErr(errors.Wrap(err, "Unable to create new order"))
+	}
+	orderURL := resp.Header.Get("Location")
+
+	failures := make(map[string]error)
+	for _, authzURL := range o.Authorizations {
+		domain, err := a.authorize(authzURL)
+		if err != nil {
+			if domain == "" {
+				domain = authzURL
+			}
+			failures[domain] = err
+		}
 	}
-	x509Certs, err := certbuddy.PemBlockToX509Certificate(certs.Certificate)
+	if len(failures) > 0 {
+		return nil, failures
+	}
+
+	result, err := a.finalize(orderURL, &o, domains, privKey)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
-	result := &certbuddy.CAResult{}
-	result.Certificate = x509Certs[0]
-	if len(x509Certs) > 1 {
-		result.IssuerChain = x509Certs[1:]
-	}
 	return result, nil
 }
 
@@ -127,19 +292,157 @@ func wrapErr(err error) map[string]error {
 	return failures
 }
 
-func (a *acmeClient) Renew(cert *x509.Certificate, privKey crypto.PrivateKey) (*certbuddy.CAResult, error) {
-	oldCertResource, err := a.toCertificateResource(cert, privKey)
+// authorize solves a challenge for the given authorization if necessary and returns
+// the domain of the authorization. For wildcard names the challenge is solved for the
+// base domain, but the wildcard name is returned.
+func (a *acmeClient) authorize(authzURL string) (string, error) {
+	var authz authorization
+	if _, _, err := a.post(authzURL, nil, &authz); err != nil {
+		return "", errors.Wrap(err, "Unable to fetch authorization")
+	}
+	name := authz.Identifier.Value
+	if authz.Wildcard {
+		name = wildcardPrefix + name
+	}
+	if authz.Status == statusValid {
+		return name, nil
+	}
+	return name, a.solve(authzURL, &authz)
+}
+
+// solve presents the preferred challenge of the authorization and waits until the CA
+// validated it.
+func (a *acmeClient) solve(authzURL string, authz *authorization) error {
+	domain := authz.Identifier.Value
+
+	ch, provider, err := a.selectChallenge(authz)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	renewedCerts, err := a.client.RenewCertificate(oldCertResource, true)
+	thumbprint, err := a.signer.thumbprint()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	keyAuth := ch.Token + "." + thumbprint
+
+	if err := provider.Present(domain, ch.Token, keyAuth); err != nil {
+		return errors.Wrapf(err, "Unable to present %s challenge", ch.Type)
 	}
-	certs, err := certbuddy.PemBlockToX509Certificate(renewedCerts.Certificate)
+	defer func() {
+		if err := provider.CleanUp(domain, ch.Token, keyAuth); err != nil {
+			log.Printf("Unable to clean up %s challenge for %s: %+v", ch.Type, domain, err)
+		}
+	}()
+
+	if _, _, err := a.post(ch.URL, struct{}{}, nil); err != nil {
+		return errors.Wrapf(err, "Unable to respond to %s challenge", ch.Type)
+	}
+
+	err = a.poll(authzURL, authz, func() (bool, error) {
+		switch authz.Status {
+		case statusValid:
+			return true, nil
+		case statusPending, statusProcessing:
+			return false, nil
+		}
+		for _, c := range authz.Challenges {
+			if c.Error != nil {
+				return true, c.Error
+			}
+		}
+		return true, fmt.Errorf("Authorization for %s is %s", domain, authz.Status)
+	})
+	return err
+}
+
+// selectChallenge chooses the challenge to solve from the challenges offered by the CA
+// according to challengePreference and the configured providers.
+func (a *acmeClient) selectChallenge(authz *authorization) (*challenge, ChallengeProvider, error) {
+	preference := challengePreference
+	if authz.Wildcard {
+		preference = ChallengesFor(wildcardPrefix + authz.Identifier.Value)
+	}
+	for _, typ := range preference {
+		provider, exists := a.providers[typ]
+		if !exists {
+			continue
+		}
+		for i := range authz.Challenges {
+			if authz.Challenges[i].Type == typ {
+				return &authz.Challenges[i], provider, nil
+			}
+		}
+	}
+	offered := make([]string, 0, len(authz.Challenges))
+	for _, ch := range authz.Challenges {
+		offered = append(offered, ch.Type)
+	}
+	return nil, nil, fmt.Errorf("No provider for any of the offered challenges %s", strings.Join(offered, ", "))
+}
+
+func (a *acmeClient) finalize(orderURL string, o *order, domains []string, privKey crypto.PrivateKey) (*certbuddy.CAResult, error) {
+	template := &x509.CertificateRequest{DNSNames: domains}
+	if len(domains[0]) <= 64 {
+		template.Subject = pkix.Name{CommonName: domains[0]}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, privKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create certificate request")
+	}
+	if _, _, err := a.post(o.Finalize, finalizeRequest{CSR: b64(csr)}, o); err != nil {
+		return nil, errors.Wrap(err, "Unable to finalize order")
+	}
+
+	err = a.poll(orderURL, o, func() (bool, error) {
+		switch o.Status {
+		case statusValid:
+			return true, nil
+		case statusPending, statusReady, statusProcessing:
+			return false, nil
+		}
+		if o.Error != nil {
+			return true, o.Error
+		}
+		return true, fmt.Errorf("Order is %s", o.Status)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return a.downloadCertificate(o.Certificate)
+}
+
+// downloadCertificate fetches the certificate chain and, if a preferred chain is
+// configured, the alternate chains offered by the CA.
+func (a *acmeClient) downloadCertificate(certURL string) (*certbuddy.CAResult, error) {
+	resp, data, err := a.post(certURL, nil, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to download certificate")
+	}
+	certs, err := certbuddy.ParseCertificateChain(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid certificate chain")
+	}
+
+	if a.preferredChain != "" && !chainMatches(certs, a.preferredChain) {
+		for _, alternateURL := range alternateLinks(resp) {
+			_, data, err := a.post(alternateURL, nil, nil)
+			if err != nil {
+				return nil, errors.Wrap(err, "Unable to download alternate certificate chain")
+			}
+			alternate, err := certbuddy.ParseCertificateChain(data)
+			if err != nil {
+				return nil, errors.Wrap(err, "Invalid alternate certificate chain")
+			}
+			if chainMatches(alternate, a.preferredChain) {
+				certs = alternate
+				break
+			}
+		}
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("CA returned no certificate")
+	}
 	result := &certbuddy.CAResult{}
 	result.Certificate = certs[0]
 	if len(certs) > 1 {
@@ -148,38 +451,204 @@ func (a *acmeClient) Renew(cert *x509.Certificate, privKey crypto.PrivateKey) (*
 	return result, nil
 }
 
-func (a *acmeClient) Revoke(cert *x509.Certificate, privKey crypto.PrivateKey) error {
-	return NotImplemented
+// chainMatches returns true if an issuer in the chain has the given common name.
+func chainMatches(certs []*x509.Certificate, issuer string) bool {
+	for _, cert := range certs {
+		if cert.Issuer.CommonName == issuer {
+			return true
+		}
+	}
+	return false
+}
+
+func alternateLinks(resp *http.Response) []string {
+	links := make([]string, 0, 1)
+	for _, header := range resp.Header["Link"] {
+		for _, match := range linkAlternateRegexp.FindAllStringSubmatch(header, -1) {
+			links = append(links, match[1])
+		}
+	}
+	return links
+}
+
+func (a *acmeClient) Renew(cert *x509.Certificate, privKey crypto.PrivateKey) (*certbuddy.CAResult, error) {
+	domains := cert.DNSNames
+	if len(domains) == 0 {
+		domains = []string{cert.Subject.CommonName}
+	}
+	result, failures := a.ObtainCertificate(domains, privKey)
+	for domain, err := range failures {
+		return nil, errors.Wrapf(err, "Unable to renew certificate (%s)", domain)
+	}
+	return result, nil
+}
+
+func (a *acmeClient) Revoke(cert *x509.Certificate, privKey crypto.PrivateKey, reason certbuddy.RevocationReason) error {
+	if a.dir.RevokeCert == "" {
+		return errors.New("ACME server doesn't support revocation")
+	}
+	signer, kid := a.signer, a.accountURL
+	if privKey != nil {
+		// Proves the possession of the certificate key instead of the account
+		var err error
+		if signer, err = newJwsSigner(privKey); err != nil {
+			return errors.Wrap(err, "Unable to sign revocation with certificate key")
+		}
+		kid = ""
+	}
+	req := revocationRequest{Certificate: b64(cert.Raw), Reason: int(reason)}
+	if _, _, err := a.signedPost(signer, kid, a.dir.RevokeCert, req, nil); err != nil {
+		return errors.Wrap(err, "Unable to revoke certificate")
+	}
+	return nil
 }
 
+// getStateDir returns the directory for the state of the account, which is specific
+// for every CA.
 func (a *acmeClient) getStateDir() (string, error) {
-	dir := path.Join(stateBaseDir, a.user.GetEmail())
+	u, err := url.Parse(a.directoryURL)
+	if err != nil {
+		return "", err
+	}
+	dir := path.Join(stateBaseDir, u.Host, a.user.GetEmail())
 	return dir, certbuddy.CreateDirIfNotExists(dir)
 }
 
-func (a *acmeClient) toCertificateResource(cert *x509.Certificate, privKey crypto.PrivateKey) (acme.CertificateResource, error) {
-	var certMeta acme.CertificateResource
-	stateDir, err := a.getStateDir()
+// poll fetches url into out until done returns true or the poll timeout is reached.
+func (a *acmeClient) poll(url string, out interface{}, done func() (bool, error)) error {
+	deadline := time.Now().Add(a.pollTimeout)
+	for {
+		if finished, err := done(); finished {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timeout while waiting for %s", url)
+		}
+		resp, _, err := a.post(url, nil, out)
+		if err != nil {
+			return err
+		}
+		if finished, err := done(); finished {
+			return err
+		}
+		time.Sleep(a.retryAfter(resp))
+	}
+}
+
+func (a *acmeClient) retryAfter(resp *http.Response) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		wait := time.Duration(seconds) * time.Second
+		if wait < a.pollTimeout {
+			return wait
+		}
+	}
+	return a.pollInterval
+}
+
+// post sends a signed request to the ACME server. A nil payload results in a
+// POST-as-GET request. If out is not nil, the JSON response is decoded into it.
+// Requests failing because of a bad nonce are retried.
+func (a *acmeClient) post(url string, payload interface{}, out interface{}) (*http.Response, []byte, error) {
+	return a.signedPost(a.signer, a.accountURL, url, payload, out)
+}
+
+// signedPost is like post, but signs the request with the given signer. The public key
+// is embedded if kid is empty.
+func (a *acmeClient) signedPost(signer *jwsSigner, kid, url string, payload interface{}, out interface{}) (*http.Response, []byte, error) {
+	var payloadData []byte
+	if payload != nil {
+		var err error
+		payloadData, err = json.Marshal(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for i := 0; ; i++ {
+		resp, data, err := a.doPost(signer, kid, url, payloadData)
+		if err != nil {
+			if problem, ok := err.(*Problem); ok && problem.Type == problemBadNonce && i < maxBadNonceRetries {
+				continue
+			}
+			return nil, nil, err
+		}
+		if out != nil && len(data) > 0 {
+			if err := json.Unmarshal(data, out); err != nil {
+				return nil, nil, errors.Wrapf(err, "Unable to decode response from %s", url)
+			}
+		}
+		return resp, data, nil
+	}
+}
+
+func (a *acmeClient) doPost(signer *jwsSigner, kid, url string, payload []byte) (*http.Response, []byte, error) {
+	nonce, err := a.nonce()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to get nonce")
+	}
+	body, err := signer.sign(url, nonce, kid, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
-		return certMeta, err
+		return nil, nil, err
 	}
-	certMetaPath := path.Join(stateDir, "certs.meta")
-	certMetaData, err := ioutil.ReadFile(certMetaPath)
+	req.Header.Set("Content-Type", contentTypeJose)
+	req.Header.Set("Accept", contentTypeChain+", application/json")
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := a.httpClient.Do(req)
 	if err != nil {
-		return certMeta, err
+		return nil, nil, err
 	}
+	defer resp.Body.Close()
+	a.saveNonce(resp)
 
-	err = json.Unmarshal(certMetaData, &certMeta)
-	certificatePem, err := certbuddy.ToPemBlock(cert)
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return certMeta, nil
+		return nil, nil, err
 	}
-	privateKeyPem, err := certbuddy.ToPemBlock(privKey)
+	if resp.StatusCode >= 400 {
+		problem := &Problem{}
+		if err := json.Unmarshal(data, problem); err != nil || problem.Type == "" {
+			return nil, nil, fmt.Errorf("Unexpected status %s from %s", resp.Status, url)
+		}
+		return nil, nil, problem
+	}
+	return resp, data, nil
+}
+
+func (a *acmeClient) nonce() (string, error) {
+	a.nonceLock.Lock()
+	if len(a.nonces) > 0 {
+		nonce := a.nonces[len(a.nonces)-1]
+		a.nonces = a.nonces[:len(a.nonces)-1]
+		a.nonceLock.Unlock()
+		return nonce, nil
+	}
+	a.nonceLock.Unlock()
+
+	req, err := http.NewRequest("HEAD", a.dir.NewNonce, nil)
 	if err != nil {
-		return certMeta, nil
+		return "", err
 	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("ACME server didn't return a nonce")
+	}
+	return nonce, nil
+}
 
-	certMeta.Certificate = certificatePem
-	certMeta.PrivateKey = privateKeyPem
-	return certMeta, nil
+func (a *acmeClient) saveNonce(resp *http.Response) {
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		a.nonceLock.Lock()
+		a.nonces = append(a.nonces, nonce)
+		a.nonceLock.Unlock()
+	}
 }
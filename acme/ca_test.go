@@ -0,0 +1,188 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/acme/acmetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/xenolf/lego/providers/http/webroot"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+var testWebroot = "./webroottest"
+
+func newTestClient(t *testing.T, server *acmetest.Server, providers map[string]ChallengeProvider) *acmeClient {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Email: "test@example.com", PrivateKey: key}
+	client, err := newAcmeClient(user, server.DirectoryURL(), http.DefaultClient, providers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.pollInterval = time.Millisecond * 10
+	return client
+}
+
+func TestObtainCertificateWithWebroot(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	os.MkdirAll(testWebroot, 0700)
+	defer os.RemoveAll(testWebroot)
+
+	server := acmetest.NewServer()
+	defer server.Close()
+	// Serve the challenge like a web server serving the webroot would do
+	server.Validator = func(challengeType, domain, token, keyAuth string) error {
+		data, err := ioutil.ReadFile(path.Join(testWebroot, ".well-known/acme-challenge", token))
+		if err != nil {
+			return err
+		}
+		if string(data) != keyAuth {
+			return errors.New("Invalid key authorization")
+		}
+		return nil
+	}
+
+	provider, err := webroot.NewHTTPProvider(testWebroot)
+	assert.Nil(err)
+	client := newTestClient(t, server, map[string]ChallengeProvider{ChallengeHTTP01: provider})
+
+	certKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+	domains := []string{"example.com", "www.example.com"}
+	result, failures := client.ObtainCertificate(domains, certKey)
+	assert.Len(failures, 0)
+	if !assert.NotNil(result) {
+		return
+	}
+	assert.Equal(domains, result.Certificate.DNSNames)
+	assert.Len(result.IssuerChain, 1)
+	assert.Equal(acmetest.RootName, result.IssuerChain[0].Issuer.CommonName)
+
+	_, err = result.Certificate.Verify(x509.VerifyOptions{
+		DNSName:       "www.example.com",
+		Roots:         server.Roots(),
+		Intermediates: certPool(result.IssuerChain),
+	})
+	assert.Nil(err)
+
+	// Challenge files have to be cleaned up
+	files, _ := ioutil.ReadDir(path.Join(testWebroot, ".well-known/acme-challenge"))
+	assert.Len(files, 0)
+
+	renewed, err := client.Renew(result.Certificate, certKey)
+	assert.Nil(err)
+	assert.Equal(domains, renewed.Certificate.DNSNames)
+	assert.NotEqual(result.Certificate.SerialNumber, renewed.Certificate.SerialNumber)
+}
+
+func TestKeyTypes(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	providers := map[string]ChallengeProvider{ChallengeHTTP01: &nopProvider{}}
+	for _, keyType := range []certbuddy.KeyType{certbuddy.RSA2048, certbuddy.EC256, certbuddy.EC384, certbuddy.Ed25519} {
+		accountKey, err := certbuddy.GenerateKey(keyType)
+		assert.Nil(err)
+		user := &User{Email: string(keyType) + "@example.com", PrivateKey: accountKey}
+		client, err := newAcmeClient(user, server.DirectoryURL(), http.DefaultClient, providers)
+		if !assert.Nil(err, "account key %s", keyType) {
+			continue
+		}
+		client.pollInterval = time.Millisecond * 10
+
+		certKey, err := certbuddy.GenerateKey(keyType)
+		assert.Nil(err)
+		result, failures := client.ObtainCertificate([]string{"example.com"}, certKey)
+		assert.Len(failures, 0, "certificate key %s", keyType)
+		if assert.NotNil(result) {
+			assert.Equal(certKey.(crypto.Signer).Public(), result.Certificate.PublicKey)
+		}
+	}
+}
+
+func TestPreferredChain(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	client := newTestClient(t, server, map[string]ChallengeProvider{ChallengeHTTP01: &nopProvider{}})
+	client.preferredChain = acmetest.AlternateRootName
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	result, failures := client.ObtainCertificate([]string{"example.com"}, certKey)
+	assert.Len(failures, 0)
+	if assert.NotNil(result) {
+		assert.Equal(acmetest.AlternateRootName, result.IssuerChain[0].Issuer.CommonName)
+	}
+}
+
+func TestAccountIsReused(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	client := newTestClient(t, server, nil)
+	// The account URL is looked up again, even if the state got lost
+	os.RemoveAll(stateBaseDir)
+	again, err := newAcmeClient(client.user, server.DirectoryURL(), http.DefaultClient, nil)
+	assert.Nil(err)
+	assert.Equal(client.accountURL, again.accountURL)
+	assert.Equal(1, server.Accounts())
+}
+
+func TestFailedChallenge(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	server := acmetest.NewServer()
+	defer server.Close()
+	server.Validator = func(challengeType, domain, token, keyAuth string) error {
+		if domain == "bad.example.com" {
+			return errors.New("Connection refused")
+		}
+		return nil
+	}
+
+	client := newTestClient(t, server, map[string]ChallengeProvider{ChallengeHTTP01: &nopProvider{}})
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	result, failures := client.ObtainCertificate([]string{"example.com", "bad.example.com"}, certKey)
+	assert.Nil(result)
+	assert.Len(failures, 1)
+	if assert.NotNil(failures["bad.example.com"]) {
+		assert.Contains(failures["bad.example.com"].Error(), "Connection refused")
+	}
+}
+
+type nopProvider struct{}
+
+func (n *nopProvider) Present(domain, token, keyAuth string) error {
+	return nil
+}
+
+func (n *nopProvider) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+func certPool(certs []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool
+}
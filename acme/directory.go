@@ -0,0 +1,65 @@
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const DefaultDirectory = "letsencrypt"
+
+// DirectoryPresets maps names of well known ACME CAs to their directory URL.
+var DirectoryPresets = map[string]string{
+	"letsencrypt":         "https://acme-v02.api.letsencrypt.org/directory",
+	"letsencrypt-staging": "https://acme-staging-v02.api.letsencrypt.org/directory",
+}
+
+// ResolveDirectoryURL returns the directory URL for the name of a preset or checks that
+// the given value is a valid http(s) URL. An empty value resolves to DefaultDirectory.
+func ResolveDirectoryURL(nameOrURL string) (string, error) {
+	if nameOrURL == "" {
+		nameOrURL = DefaultDirectory
+	}
+	if directoryURL, exists := DirectoryPresets[nameOrURL]; exists {
+		return directoryURL, nil
+	}
+	u, err := url.Parse(nameOrURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		presets := make([]string, 0, len(DirectoryPresets))
+		for name := range DirectoryPresets {
+			presets = append(presets, name)
+		}
+		sort.Strings(presets)
+		return "", fmt.Errorf("%q is neither a known CA (%s) nor a valid directory URL",
+			nameOrURL, strings.Join(presets, ", "))
+	}
+	return nameOrURL, nil
+}
+
+// newHttpClient returns the HTTP client used to talk to the ACME server. If caBundlePath
+// is not empty, only the root certificates in this PEM file are trusted.
+func newHttpClient(caBundlePath string) (*http.Client, error) {
+	if caBundlePath == "" {
+		return http.DefaultClient, nil
+	}
+	certs, err := certbuddy.LoadCertificateFromDisk(caBundlePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load CA bundle")
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("CA bundle %s contains no certificates", caBundlePath)
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,59 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/acme/acmetest"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestResolveDirectoryURL(t *testing.T) {
+	assert := assert.New(t)
+
+	directoryURL, err := ResolveDirectoryURL("")
+	assert.Nil(err)
+	assert.Equal(DirectoryPresets[DefaultDirectory], directoryURL)
+
+	directoryURL, err = ResolveDirectoryURL("letsencrypt-staging")
+	assert.Nil(err)
+	assert.Equal("https://acme-staging-v02.api.letsencrypt.org/directory", directoryURL)
+
+	directoryURL, err = ResolveDirectoryURL("https://acme.internal.example.com/directory")
+	assert.Nil(err)
+	assert.Equal("https://acme.internal.example.com/directory", directoryURL)
+
+	_, err = ResolveDirectoryURL("letsencrypt-stagin")
+	assert.NotNil(err)
+	_, err = ResolveDirectoryURL("ftp://example.com/directory")
+	assert.NotNil(err)
+}
+
+func TestCustomCABundle(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	os.MkdirAll(testWebroot, 0700)
+	defer os.RemoveAll(testWebroot)
+
+	server := acmetest.NewTLSServer()
+	defer server.Close()
+	bundlePath := path.Join(testWebroot, "bundle.pem")
+	assert.Nil(certbuddy.WritePEMBlock(server.Certificate(), bundlePath))
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	user := &User{Email: "test@example.com", PrivateKey: key}
+
+	_, err := NewAcmeClient(user, Options{Directory: server.DirectoryURL(), WebrootPath: testWebroot})
+	assert.NotNil(err, "Connection to the CA should fail without trusting its certificate")
+
+	_, err = NewAcmeClient(user, Options{
+		Directory:    server.DirectoryURL(),
+		CABundlePath: bundlePath,
+		WebrootPath:  testWebroot,
+	})
+	assert.Nil(err)
+}
@@ -0,0 +1,109 @@
+package acme
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	lego "github.com/xenolf/lego/acme"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPropagationTimeout  = time.Minute * 2
+	defaultPropagationInterval = time.Second * 2
+	fallbackResolver           = "8.8.8.8:53"
+)
+
+// dnsPropagationProvider wraps a provider for DNS-01 challenges, so Present returns only
+// after the TXT record is visible on all resolvers. Otherwise the CA might look up the
+// record before it has been propagated to all authoritative name servers.
+type dnsPropagationProvider struct {
+	ChallengeProvider
+	resolvers []string
+	timeout   time.Duration
+	interval  time.Duration
+}
+
+// NewDNSPropagationCheck wraps the DNS-01 provider with a check that the TXT record
+// has been propagated to the given resolvers. If no resolvers are given, the resolvers
+// of the system are used.
+func NewDNSPropagationCheck(provider ChallengeProvider, resolvers []string, timeout time.Duration) ChallengeProvider {
+	if len(resolvers) == 0 {
+		resolvers = systemResolvers()
+	}
+	withPorts := make([]string, 0, len(resolvers))
+	for _, resolver := range resolvers {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		withPorts = append(withPorts, resolver)
+	}
+	if timeout == 0 {
+		timeout = defaultPropagationTimeout
+	}
+	return &dnsPropagationProvider{
+		ChallengeProvider: provider,
+		resolvers:         withPorts,
+		timeout:           timeout,
+		interval:          defaultPropagationInterval,
+	}
+}
+
+func systemResolvers() []string {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(config.Servers) == 0 {
+		return []string{fallbackResolver}
+	}
+	resolvers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		resolvers = append(resolvers, net.JoinHostPort(server, config.Port))
+	}
+	return resolvers
+}
+
+func (d *dnsPropagationProvider) Present(domain, token, keyAuth string) error {
+	if err := d.ChallengeProvider.Present(domain, token, keyAuth); err != nil {
+		return err
+	}
+	fqdn, value, _ := lego.DNS01Record(domain, keyAuth)
+	deadline := time.Now().Add(d.timeout)
+	for {
+		pending := d.pendingResolvers(fqdn, value)
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("TXT record %s was not propagated to %s within %s",
+				fqdn, strings.Join(pending, ", "), d.timeout.String())
+		}
+		log.Printf("Waiting for TXT record %s to propagate to %s", fqdn, strings.Join(pending, ", "))
+		time.Sleep(d.interval)
+	}
+}
+
+// pendingResolvers returns all resolvers which don't return the TXT record yet.
+func (d *dnsPropagationProvider) pendingResolvers(fqdn, value string) []string {
+	pending := make([]string, 0, len(d.resolvers))
+	for _, resolver := range d.resolvers {
+		m := new(dns.Msg)
+		m.SetQuestion(fqdn, dns.TypeTXT)
+		m.RecursionDesired = true
+		client := &dns.Client{Timeout: time.Second * 5}
+		reply, _, err := client.Exchange(m, resolver)
+		if err != nil || !containsTXT(reply, value) {
+			pending = append(pending, resolver)
+		}
+	}
+	return pending
+}
+
+func containsTXT(reply *dns.Msg, value string) bool {
+	for _, rr := range reply.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true
+		}
+	}
+	return false
+}
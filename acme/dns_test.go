@@ -0,0 +1,71 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"github.com/connctd/certbuddy/acme/acmetest"
+	"github.com/connctd/certbuddy/acme/dnstest"
+	"github.com/connctd/certbuddy/acme/rfc2136"
+	"github.com/stretchr/testify/assert"
+	lego "github.com/xenolf/lego/acme"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestObtainCertificateWithDNS(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+
+	dnsServer, err := dnstest.NewServer("example.com", "", "")
+	if !assert.Nil(err) {
+		return
+	}
+	defer dnsServer.Close()
+
+	server := acmetest.NewServer()
+	defer server.Close()
+	server.ChallengeTypes = []string{ChallengeDNS01}
+	server.Validator = func(challengeType, domain, token, keyAuth string) error {
+		fqdn, value, _ := lego.DNS01Record(domain, keyAuth)
+		for _, txt := range dnsServer.TXT(fqdn) {
+			if txt == value {
+				return nil
+			}
+		}
+		return errors.New("TXT record not found")
+	}
+
+	provider, err := rfc2136.NewDNSProvider(rfc2136.Config{Nameserver: dnsServer.Addr})
+	assert.Nil(err)
+	check := NewDNSPropagationCheck(provider, []string{dnsServer.Addr}, time.Second)
+	client := newTestClient(t, server, map[string]ChallengeProvider{ChallengeDNS01: check})
+
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	result, failures := client.ObtainCertificate([]string{"example.com", "www.example.com"}, certKey)
+	assert.Len(failures, 0)
+	assert.NotNil(result)
+
+	// TXT records are removed after validation
+	fqdn, _, _ := lego.DNS01Record("www.example.com", "")
+	assert.Len(dnsServer.TXT(fqdn), 0)
+}
+
+func TestDNSPropagationTimeout(t *testing.T) {
+	assert := assert.New(t)
+	dnsServer, err := dnstest.NewServer("example.com", "", "")
+	if !assert.Nil(err) {
+		return
+	}
+	defer dnsServer.Close()
+
+	// The record is never created, so it is never propagated
+	check := NewDNSPropagationCheck(&nopProvider{}, []string{dnsServer.Addr}, time.Millisecond*100)
+	check.(*dnsPropagationProvider).interval = time.Millisecond * 10
+	err = check.Present("www.example.com", "token", "token.thumbprint")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "was not propagated")
+	}
+}
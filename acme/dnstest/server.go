@@ -0,0 +1,186 @@
+// Package dnstest provides a minimal authoritative DNS server supporting TSIG signed
+// dynamic updates (RFC 2136), so DNS-01 challenge providers can be tested without a
+// real name server.
+package dnstest
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an authoritative name server for a single zone keeping all records in memory.
+type Server struct {
+	// Addr is the UDP address the server listens on.
+	Addr string
+	Zone string
+
+	tsigKey string
+	server  *dns.Server
+	lock    sync.Mutex
+	records map[string][]dns.RR
+	updates int
+}
+
+// NewServer starts a name server for the given zone on a random local UDP port. If
+// tsigKey is not empty, updates have to be signed with this key and the base64 encoded
+// secret. The server has to be closed by the caller.
+func NewServer(zone, tsigKey, tsigSecret string) (*Server, error) {
+	s := &Server{
+		Zone:    dns.Fqdn(zone),
+		records: make(map[string][]dns.RR),
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.Addr = conn.LocalAddr().String()
+	started := make(chan struct{})
+	s.server = &dns.Server{
+		PacketConn:        conn,
+		Handler:           s,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	if tsigKey != "" {
+		s.tsigKey = dns.Fqdn(tsigKey)
+		s.server.TsigSecret = map[string]string{s.tsigKey: tsigSecret}
+	}
+	go s.server.ActivateAndServe()
+	select {
+	case <-started:
+	case <-time.After(time.Second * 5):
+		return nil, net.UnknownNetworkError("DNS server didn't start")
+	}
+	return s, nil
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.server.Shutdown()
+}
+
+// TXT returns the values of all TXT records for the given name.
+func (s *Server) TXT(name string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	values := make([]string, 0, 1)
+	for _, rr := range s.records[strings.ToLower(dns.Fqdn(name))] {
+		if txt, ok := rr.(*dns.TXT); ok {
+			values = append(values, strings.Join(txt.Txt, ""))
+		}
+	}
+	return values
+}
+
+// Updates returns the number of accepted updates.
+func (s *Server) Updates() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.updates
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if r.Opcode == dns.OpcodeUpdate {
+		m.Rcode = s.update(w, r)
+	} else {
+		for _, q := range r.Question {
+			m.Answer = append(m.Answer, s.lookup(q)...)
+		}
+		if len(m.Answer) == 0 && !dns.IsSubDomain(s.Zone, r.Question[0].Name) {
+			m.Rcode = dns.RcodeRefused
+		}
+	}
+
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+func (s *Server) update(w dns.ResponseWriter, r *dns.Msg) int {
+	if s.tsigKey != "" {
+		tsig := r.IsTsig()
+		if tsig == nil || tsig.Hdr.Name != s.tsigKey || w.TsigStatus() != nil {
+			return dns.RcodeNotAuth
+		}
+	}
+	if len(r.Question) != 1 || !strings.EqualFold(r.Question[0].Name, s.Zone) {
+		return dns.RcodeNotZone
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if !dns.IsSubDomain(s.Zone, name) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassANY:
+			// Delete an RRset or all RRsets of a name
+			kept := make([]dns.RR, 0, len(s.records[name]))
+			for _, existing := range s.records[name] {
+				if hdr.Rrtype != dns.TypeANY && existing.Header().Rrtype != hdr.Rrtype {
+					kept = append(kept, existing)
+				}
+			}
+			s.records[name] = kept
+		case dns.ClassNONE:
+			// Delete a single RR
+			kept := make([]dns.RR, 0, len(s.records[name]))
+			for _, existing := range s.records[name] {
+				if !sameData(existing, rr) {
+					kept = append(kept, existing)
+				}
+			}
+			s.records[name] = kept
+		default:
+			s.records[name] = append(s.records[name], rr)
+		}
+	}
+	s.updates++
+	return dns.RcodeSuccess
+}
+
+func sameData(a, b dns.RR) bool {
+	txtA, okA := a.(*dns.TXT)
+	txtB, okB := b.(*dns.TXT)
+	if okA && okB {
+		return strings.Join(txtA.Txt, "") == strings.Join(txtB.Txt, "")
+	}
+	// Compare the record data without the header, which differs in class and TTL
+	return a.Header().Rrtype == b.Header().Rrtype &&
+		a.String()[len(a.Header().String()):] == b.String()[len(b.Header().String()):]
+}
+
+func (s *Server) lookup(q dns.Question) []dns.RR {
+	name := strings.ToLower(q.Name)
+	if q.Qtype == dns.TypeSOA && name == strings.ToLower(s.Zone) {
+		return []dns.RR{&dns.SOA{
+			Hdr:     dns.RR_Header{Name: s.Zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:      "ns." + s.Zone,
+			Mbox:    "hostmaster." + s.Zone,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  60,
+		}}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	answer := make([]dns.RR, 0, 1)
+	for _, rr := range s.records[name] {
+		if q.Qtype == dns.TypeANY || rr.Header().Rrtype == q.Qtype {
+			answer = append(answer, rr)
+		}
+	}
+	return answer
+}
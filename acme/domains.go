@@ -0,0 +1,49 @@
+package acme
+
+import (
+	"fmt"
+	"strings"
+)
+
+const wildcardPrefix = "*."
+
+// IsWildcard returns true if the domain is a wildcard name like *.example.com.
+func IsWildcard(domain string) bool {
+	return strings.HasPrefix(domain, wildcardPrefix)
+}
+
+// ChallengesFor returns the challenge types which can be used to validate the domain.
+// Wildcard names can only be validated via DNS-01 (RFC 8555 section 7.1.3).
+func ChallengesFor(domain string) []string {
+	if IsWildcard(domain) {
+		return []string{ChallengeDNS01}
+	}
+	return challengePreference
+}
+
+// ValidateDomains checks that all domains are valid names for a certificate and that
+// each of them can be validated with at least one of the given challenge types.
+func ValidateDomains(domains []string, challenges []string) error {
+	for _, domain := range domains {
+		base := strings.TrimPrefix(domain, wildcardPrefix)
+		if base == "" || strings.Contains(base, "*") {
+			return fmt.Errorf("Invalid domain %s, a wildcard is only allowed as the complete leftmost label", domain)
+		}
+		if !supportsAny(ChallengesFor(domain), challenges) {
+			if IsWildcard(domain) {
+				return fmt.Errorf("Wildcard domain %s requires a DNS challenge provider", domain)
+			}
+			return fmt.Errorf("No challenge provider configured for domain %s", domain)
+		}
+	}
+	return nil
+}
+
+func supportsAny(required []string, available []string) bool {
+	for _, typ := range required {
+		if contains(available, typ) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/connctd/certbuddy/acme/acmetest"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestValidateDomains(t *testing.T) {
+	assert := assert.New(t)
+	both := []string{ChallengeHTTP01, ChallengeDNS01}
+	assert.Nil(ValidateDomains([]string{"example.com", "*.example.com"}, both))
+	assert.Nil(ValidateDomains([]string{"example.com"}, []string{ChallengeHTTP01}))
+	assert.Nil(ValidateDomains([]string{"*.example.com"}, []string{ChallengeDNS01}))
+
+	err := ValidateDomains([]string{"example.com", "*.example.com"}, []string{ChallengeHTTP01})
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "*.example.com requires a DNS challenge provider")
+	}
+	assert.NotNil(ValidateDomains([]string{"www.*.example.com"}, both))
+	assert.NotNil(ValidateDomains([]string{"*example.com"}, both))
+	assert.NotNil(ValidateDomains([]string{"*."}, both))
+	assert.NotNil(ValidateDomains([]string{"example.com"}, nil))
+}
+
+type recordingProvider struct {
+	lock    sync.Mutex
+	domains []string
+}
+
+func (r *recordingProvider) Present(domain, token, keyAuth string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.domains = append(r.domains, domain)
+	return nil
+}
+
+func (r *recordingProvider) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+func TestObtainWildcardCertificate(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	httpProvider := &recordingProvider{}
+	dnsProvider := &recordingProvider{}
+	client := newTestClient(t, server, map[string]ChallengeProvider{
+		ChallengeHTTP01: httpProvider,
+		ChallengeDNS01:  dnsProvider,
+	})
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	domains := []string{"example.com", "*.example.com", "www.other.com"}
+	result, failures := client.ObtainCertificate(domains, certKey)
+	assert.Len(failures, 0)
+	if assert.NotNil(result) {
+		assert.Equal(domains, result.Certificate.DNSNames)
+	}
+
+	// Plain names prefer HTTP-01, the wildcard has to use DNS-01 for the base domain
+	sort.Strings(httpProvider.domains)
+	assert.Equal([]string{"example.com", "www.other.com"}, httpProvider.domains)
+	assert.Equal([]string{"example.com"}, dnsProvider.domains)
+}
+
+func TestWildcardWithoutDNSProvider(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	client := newTestClient(t, server, map[string]ChallengeProvider{ChallengeHTTP01: &nopProvider{}})
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	result, failures := client.ObtainCertificate([]string{"example.com", "*.example.com"}, certKey)
+	assert.Nil(result)
+	if assert.NotNil(failures["*.example.com"]) {
+		assert.Contains(failures["*.example.com"].Error(), "requires a DNS challenge provider")
+	}
+}
@@ -1,7 +0,0 @@
-// +build debug
-
-package acme
-
-const (
-	letsencryptCaServer = "https://acme-staging.api.letsencrypt.org/directory"
-)
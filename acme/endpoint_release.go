@@ -1,7 +0,0 @@
-// +build !debug
-
-package acme
-
-const (
-	letsencryptCaServer = "https://acme-v01.api.letsencrypt.org/directory"
-)
@@ -0,0 +1,190 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// jsonWebKey is the public part of an account key as defined in RFC 7517. The fields
+// are ordered lexicographically, so the JSON encoding can be used directly to
+// calculate the thumbprint defined in RFC 7638.
+type jsonWebKey struct {
+	Crv string `json:"crv,omitempty"`
+	E   string `json:"e,omitempty"`
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jwsProtectedHeader struct {
+	Alg   string      `json:"alg"`
+	Jwk   *jsonWebKey `json:"jwk,omitempty"`
+	Kid   string      `json:"kid,omitempty"`
+	Nonce string      `json:"nonce,omitempty"`
+	URL   string      `json:"url"`
+}
+
+type jwsMessage struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// paddedBytes returns the big endian representation of n left padded with zeros
+// to the given size, as required for EC coordinates and signatures.
+func paddedBytes(n *big.Int, size int) []byte {
+	data := n.Bytes()
+	if len(data) >= size {
+		return data
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(data):], data)
+	return padded
+}
+
+func curveSize(curve elliptic.Curve) int {
+	return (curve.Params().BitSize + 7) / 8
+}
+
+func newJsonWebKey(pub crypto.PublicKey) (*jsonWebKey, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return &jsonWebKey{
+			Kty: "RSA",
+			E:   b64(big.NewInt(int64(key.E)).Bytes()),
+			N:   b64(key.N.Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := curveSize(key.Curve)
+		return &jsonWebKey{
+			Kty: "EC",
+			Crv: key.Curve.Params().Name,
+			X:   b64(paddedBytes(key.X, size)),
+			Y:   b64(paddedBytes(key.Y, size)),
+		}, nil
+	case ed25519.PublicKey:
+		return &jsonWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   b64(key),
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported account key type %T", pub)
+	}
+}
+
+// jwsSigner signs requests to an ACME server with the account key.
+type jwsSigner struct {
+	key crypto.Signer
+	jwk *jsonWebKey
+	alg string
+}
+
+func newJwsSigner(privKey crypto.PrivateKey) (*jwsSigner, error) {
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported account key type %T", privKey)
+	}
+	jwk, err := newJsonWebKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	var alg string
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			alg = "ES256"
+		case elliptic.P384():
+			alg = "ES384"
+		default:
+			return nil, fmt.Errorf("Unsupported curve %s for account key", key.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		alg = "EdDSA"
+	default:
+		return nil, fmt.Errorf("Unsupported account key type %T", privKey)
+	}
+	return &jwsSigner{key: signer, jwk: jwk, alg: alg}, nil
+}
+
+// thumbprint returns the base64url encoded SHA-256 JWK thumbprint of the account key,
+// which is part of every key authorization.
+func (s *jwsSigner) thumbprint() (string, error) {
+	data, err := json.Marshal(s.jwk)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return b64(sum[:]), nil
+}
+
+// sign creates a JWS in flattened JSON serialization. If kid is empty the public key
+// is embedded, as required for new account and some revocation requests. A nil payload
+// results in a POST-as-GET request.
+func (s *jwsSigner) sign(url, nonce, kid string, payload []byte) ([]byte, error) {
+	header := jwsProtectedHeader{
+		Alg:   s.alg,
+		Nonce: nonce,
+		URL:   url,
+	}
+	if kid != "" {
+		header.Kid = kid
+	} else {
+		header.Jwk = s.jwk
+	}
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	msg := jwsMessage{
+		Protected: b64(headerData),
+		Payload:   b64(payload),
+	}
+	signature, err := s.signData([]byte(msg.Protected + "." + msg.Payload))
+	if err != nil {
+		return nil, err
+	}
+	msg.Signature = b64(signature)
+	return json.Marshal(msg)
+}
+
+func (s *jwsSigner) signData(data []byte) ([]byte, error) {
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		hash := crypto.SHA256
+		if s.alg == "ES384" {
+			hash = crypto.SHA384
+		}
+		h := hash.New()
+		h.Write(data)
+		r, sig, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		size := curveSize(key.Curve)
+		return append(paddedBytes(r, size), paddedBytes(sig, size)...), nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, data), nil
+	}
+	return nil, fmt.Errorf("Unsupported account key type %T", s.key)
+}
@@ -0,0 +1,96 @@
+package acme
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeDNS01     = "dns-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+
+	statusPending      = "pending"
+	statusProcessing   = "processing"
+	statusReady        = "ready"
+	statusValid        = "valid"
+	statusInvalid      = "invalid"
+	problemBadNonce    = "urn:ietf:params:acme:error:badNonce"
+	contentTypeJose    = "application/jose+json"
+	contentTypeChain   = "application/pem-certificate-chain"
+	contentTypeProblem = "application/problem+json"
+)
+
+// directory contains the endpoints of an ACME server as described in RFC 8555 section 7.1.1
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+	RevokeCert string `json:"revokeCert"`
+	KeyChange  string `json:"keyChange"`
+	Meta       struct {
+		TermsOfService string `json:"termsOfService"`
+	} `json:"meta"`
+}
+
+type account struct {
+	Status               string   `json:"status,omitempty"`
+	Contact              []string `json:"contact,omitempty"`
+	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed,omitempty"`
+	Orders               string   `json:"orders,omitempty"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	Status         string       `json:"status,omitempty"`
+	Expires        *time.Time   `json:"expires,omitempty"`
+	Identifiers    []identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations,omitempty"`
+	Finalize       string       `json:"finalize,omitempty"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *Problem     `json:"error,omitempty"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Identifier identifier  `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+	Wildcard   bool        `json:"wildcard,omitempty"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Status string   `json:"status"`
+	Token  string   `json:"token"`
+	Error  *Problem `json:"error,omitempty"`
+}
+
+type finalizeRequest struct {
+	CSR string `json:"csr"`
+}
+
+type revocationRequest struct {
+	Certificate string `json:"certificate"`
+	Reason      int    `json:"reason,omitempty"`
+}
+
+// Problem is an error returned by the ACME server as described in RFC 7807.
+type Problem struct {
+	Type        string    `json:"type"`
+	Detail      string    `json:"detail"`
+	Status      int       `json:"status,omitempty"`
+	Subproblems []Problem `json:"subproblems,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	msg := fmt.Sprintf("ACME error %s: %s", p.Type, p.Detail)
+	for _, sub := range p.Subproblems {
+		msg = fmt.Sprintf("%s; %s", msg, sub.Error())
+	}
+	return msg
+}
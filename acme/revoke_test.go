@@ -0,0 +1,67 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/acme/acmetest"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestRevoke(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	client := newTestClient(t, server, map[string]ChallengeProvider{ChallengeHTTP01: &nopProvider{}})
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	first, failures := client.ObtainCertificate([]string{"example.com"}, certKey)
+	assert.Len(failures, 0)
+	second, failures := client.ObtainCertificate([]string{"example.com"}, certKey)
+	assert.Len(failures, 0)
+	if first == nil || second == nil {
+		t.FailNow()
+	}
+
+	// Signed with the account key
+	assert.Nil(client.Revoke(first.Certificate, nil, certbuddy.ReasonSuperseded))
+	reason, revoked := server.Revoked(first.Certificate)
+	assert.True(revoked)
+	assert.Equal(int(certbuddy.ReasonSuperseded), reason)
+	err := client.Revoke(first.Certificate, nil, certbuddy.ReasonSuperseded)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "alreadyRevoked")
+	}
+
+	// Signed with a key not belonging to the certificate
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NotNil(client.Revoke(second.Certificate, otherKey, certbuddy.ReasonKeyCompromise))
+	_, revoked = server.Revoked(second.Certificate)
+	assert.False(revoked)
+
+	// Signed with the certificate key
+	assert.Nil(client.Revoke(second.Certificate, certKey, certbuddy.ReasonKeyCompromise))
+	reason, revoked = server.Revoked(second.Certificate)
+	assert.True(revoked)
+	assert.Equal(int(certbuddy.ReasonKeyCompromise), reason)
+}
+
+func TestRevocationOnlyClient(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	server := acmetest.NewServer()
+	defer server.Close()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	user := &User{Email: "test@example.com", PrivateKey: key}
+
+	_, err := NewAcmeClient(user, Options{Directory: server.DirectoryURL()})
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "No provider for any challenge is configured")
+	}
+	_, err = NewAcmeClient(user, Options{Directory: server.DirectoryURL(), RevocationOnly: true})
+	assert.Nil(err)
+}
@@ -0,0 +1,156 @@
+// Package rfc2136 implements a challenge provider solving DNS-01 challenges by adding
+// and removing TXT records via TSIG signed dynamic updates (RFC 2136), as supported by
+// BIND, Knot, PowerDNS and others.
+package rfc2136
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/xenolf/lego/acme"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTTL     = 120
+	defaultTimeout = time.Second * 10
+)
+
+var algorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+type Config struct {
+	// Nameserver is the address of the primary name server accepting updates. The
+	// port defaults to 53.
+	Nameserver string
+	// Zone to update. If empty it is determined by querying the name server for the
+	// SOA record of the challenge domain and its parents.
+	Zone string
+	// TSIGKey is the name of the TSIG key. Updates are unsigned if empty.
+	TSIGKey string
+	// TSIGSecret is the base64 encoded secret of the TSIG key.
+	TSIGSecret string
+	// TSIGAlgorithm is one of hmac-md5, hmac-sha1, hmac-sha256 or hmac-sha512 and
+	// defaults to hmac-sha256.
+	TSIGAlgorithm string
+	// TTL of the TXT records, defaults to 120 seconds.
+	TTL int
+	// Timeout for requests to the name server, defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+type DNSProvider struct {
+	config    Config
+	algorithm string
+}
+
+// NewDNSProvider validates the config and returns a provider for DNS-01 challenges.
+func NewDNSProvider(config Config) (*DNSProvider, error) {
+	if config.Nameserver == "" {
+		return nil, errors.New("RFC 2136 name server may not be empty")
+	}
+	if _, _, err := net.SplitHostPort(config.Nameserver); err != nil {
+		config.Nameserver = net.JoinHostPort(config.Nameserver, "53")
+	}
+	if (config.TSIGKey == "") != (config.TSIGSecret == "") {
+		return nil, errors.New("Both TSIG key and secret have to be specified")
+	}
+	if config.TSIGKey != "" {
+		config.TSIGKey = dns.Fqdn(config.TSIGKey)
+	}
+	if config.TSIGAlgorithm == "" {
+		config.TSIGAlgorithm = "hmac-sha256"
+	}
+	algorithm, exists := algorithms[strings.ToLower(strings.TrimSuffix(config.TSIGAlgorithm, "."))]
+	if !exists {
+		return nil, fmt.Errorf("Unsupported TSIG algorithm %s", config.TSIGAlgorithm)
+	}
+	if config.Zone != "" {
+		config.Zone = dns.Fqdn(config.Zone)
+	}
+	if config.TTL == 0 {
+		config.TTL = defaultTTL
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	return &DNSProvider{config: config, algorithm: algorithm}, nil
+}
+
+// Present adds the TXT record for the challenge.
+func (d *DNSProvider) Present(domain, token, keyAuth string) error {
+	fqdn, value, _ := acme.DNS01Record(domain, keyAuth)
+	return d.update(fqdn, value, true)
+}
+
+// CleanUp removes the TXT record of the challenge.
+func (d *DNSProvider) CleanUp(domain, token, keyAuth string) error {
+	fqdn, value, _ := acme.DNS01Record(domain, keyAuth)
+	return d.update(fqdn, value, false)
+}
+
+func (d *DNSProvider) update(fqdn, value string, insert bool) error {
+	zone, err := d.findZone(fqdn)
+	if err != nil {
+		return err
+	}
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(d.config.TTL)},
+		Txt: []string{value},
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+	reply, err := d.exchange(m)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to update TXT record %s", fqdn)
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("Unable to update TXT record %s: %s", fqdn, dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+// findZone returns the configured zone or the closest zone containing the fqdn
+// according to the name server.
+func (d *DNSProvider) findZone(fqdn string) (string, error) {
+	if d.config.Zone != "" {
+		return d.config.Zone, nil
+	}
+	labels := dns.SplitDomainName(fqdn)
+	for i := range labels {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		m := new(dns.Msg)
+		m.SetQuestion(candidate, dns.TypeSOA)
+		reply, err := d.exchange(m)
+		if err != nil {
+			return "", errors.Wrapf(err, "Unable to find zone for %s", fqdn)
+		}
+		for _, rr := range reply.Answer {
+			if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, candidate) {
+				return candidate, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Unable to find zone for %s on %s", fqdn, d.config.Nameserver)
+}
+
+func (d *DNSProvider) exchange(m *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Timeout: d.config.Timeout}
+	if d.config.TSIGKey != "" {
+		m.SetTsig(d.config.TSIGKey, d.algorithm, 300, time.Now().Unix())
+		client.TsigSecret = map[string]string{d.config.TSIGKey: d.config.TSIGSecret}
+	}
+	reply, _, err := client.Exchange(m, d.config.Nameserver)
+	return reply, err
+}
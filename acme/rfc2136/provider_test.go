@@ -0,0 +1,70 @@
+package rfc2136
+
+import (
+	"github.com/connctd/certbuddy/acme/dnstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/xenolf/lego/acme"
+	"testing"
+)
+
+var (
+	testKey    = "certbuddy-key"
+	testSecret = "c2VjcmV0LXRzaWcta2V5LWZvci10ZXN0cw=="
+)
+
+func TestPresentAndCleanUp(t *testing.T) {
+	assert := assert.New(t)
+	server, err := dnstest.NewServer("example.com", testKey, testSecret)
+	if !assert.Nil(err) {
+		return
+	}
+	defer server.Close()
+
+	provider, err := NewDNSProvider(Config{
+		Nameserver: server.Addr,
+		TSIGKey:    testKey,
+		TSIGSecret: testSecret,
+	})
+	assert.Nil(err)
+
+	fqdn, value, _ := acme.DNS01Record("www.example.com", "token.thumbprint")
+	assert.Nil(provider.Present("www.example.com", "token", "token.thumbprint"))
+	assert.Equal([]string{value}, server.TXT(fqdn))
+
+	assert.Nil(provider.CleanUp("www.example.com", "token", "token.thumbprint"))
+	assert.Len(server.TXT(fqdn), 0)
+	assert.Equal(2, server.Updates())
+}
+
+func TestWrongTSIGSecret(t *testing.T) {
+	assert := assert.New(t)
+	server, err := dnstest.NewServer("example.com", testKey, testSecret)
+	if !assert.Nil(err) {
+		return
+	}
+	defer server.Close()
+
+	provider, err := NewDNSProvider(Config{
+		Nameserver: server.Addr,
+		Zone:       "example.com",
+		TSIGKey:    testKey,
+		TSIGSecret: "d3Jvbmctc2VjcmV0",
+	})
+	assert.Nil(err)
+	assert.NotNil(provider.Present("www.example.com", "token", "token.thumbprint"))
+	assert.Equal(0, server.Updates())
+}
+
+func TestInvalidConfig(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewDNSProvider(Config{})
+	assert.NotNil(err)
+	_, err = NewDNSProvider(Config{Nameserver: "127.0.0.1", TSIGKey: testKey})
+	assert.NotNil(err)
+	_, err = NewDNSProvider(Config{Nameserver: "127.0.0.1", TSIGKey: testKey, TSIGSecret: testSecret, TSIGAlgorithm: "hmac-sha3"})
+	assert.NotNil(err)
+
+	provider, err := NewDNSProvider(Config{Nameserver: "127.0.0.1"})
+	assert.Nil(err)
+	assert.Equal("127.0.0.1:53", provider.config.Nameserver)
+}
@@ -0,0 +1,148 @@
+package acme
+
+import (
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const challengePathPrefix = "/.well-known/acme-challenge/"
+
+var (
+	standaloneLock    sync.Mutex
+	standaloneServers = make(map[string]*StandaloneServer)
+)
+
+// StandaloneServer solves HTTP-01 challenges by serving the key authorizations itself.
+// By default it only listens while challenges are pending. If it is kept running, all
+// requests not belonging to a challenge are redirected to HTTPS.
+type StandaloneServer struct {
+	address string
+
+	lock        sync.Mutex
+	tokens      map[string]string
+	keepRunning bool
+	listener    net.Listener
+	server      *http.Server
+}
+
+// GetStandaloneServer returns the server listening on the given address. Servers are
+// shared, so several certificates can be validated via the same address.
+func GetStandaloneServer(address string) *StandaloneServer {
+	standaloneLock.Lock()
+	defer standaloneLock.Unlock()
+	server, exists := standaloneServers[address]
+	if !exists {
+		server = &StandaloneServer{address: address, tokens: make(map[string]string)}
+		standaloneServers[address] = server
+	}
+	return server
+}
+
+// Addr returns the address the server is listening on or nil if it is not running.
+func (s *StandaloneServer) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// KeepRunning starts the server if necessary and keeps it running after challenges
+// are solved, redirecting all other requests to HTTPS.
+func (s *StandaloneServer) KeepRunning() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keepRunning = true
+	return s.start()
+}
+
+// Close stops the server, even if it is kept running.
+func (s *StandaloneServer) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keepRunning = false
+	return s.stop()
+}
+
+func (s *StandaloneServer) Present(domain, token, keyAuth string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens[token] = keyAuth
+	if err := s.start(); err != nil {
+		delete(s.tokens, token)
+		return err
+	}
+	return nil
+}
+
+func (s *StandaloneServer) CleanUp(domain, token, keyAuth string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.tokens, token)
+	if len(s.tokens) == 0 && !s.keepRunning {
+		return s.stop()
+	}
+	return nil
+}
+
+func (s *StandaloneServer) start() error {
+	if s.listener != nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to listen on %s for HTTP challenges", s.address)
+	}
+	s.listener = listener
+	s.server = &http.Server{Handler: s, ReadTimeout: time.Second * 10, WriteTimeout: time.Second * 10}
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP challenge server on %s stopped: %+v", s.address, err)
+		}
+	}(s.server)
+	return nil
+}
+
+func (s *StandaloneServer) stop() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.server.Close()
+	s.listener = nil
+	s.server = nil
+	return err
+}
+
+func (s *StandaloneServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, challengePathPrefix) {
+		s.lock.Lock()
+		keyAuth, exists := s.tokens[strings.TrimPrefix(r.URL.Path, challengePathPrefix)]
+		s.lock.Unlock()
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+		return
+	}
+
+	s.lock.Lock()
+	redirect := s.keepRunning
+	s.lock.Unlock()
+	if !redirect || r.Host == "" {
+		http.NotFound(w, r)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,82 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"github.com/connctd/certbuddy/acme/acmetest"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestObtainCertificateWithStandaloneServer(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	standalone := GetStandaloneServer("127.0.0.1:0")
+	defer standalone.Close()
+
+	server := acmetest.NewServer()
+	defer server.Close()
+	server.Validator = func(challengeType, domain, token, keyAuth string) error {
+		addr := standalone.Addr()
+		if addr == nil {
+			return errors.New("Standalone server is not listening")
+		}
+		resp, err := http.Get("http://" + addr.String() + challengePathPrefix + token)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		if string(data) != keyAuth {
+			return errors.New("Invalid key authorization")
+		}
+		return nil
+	}
+
+	client := newTestClient(t, server, map[string]ChallengeProvider{ChallengeHTTP01: standalone})
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	result, failures := client.ObtainCertificate([]string{"example.com", "www.example.com"}, certKey)
+	assert.Len(failures, 0)
+	assert.NotNil(result)
+
+	// The server only listens while challenges are pending
+	assert.Nil(standalone.Addr())
+}
+
+func TestStandaloneServerRedirect(t *testing.T) {
+	assert := assert.New(t)
+	standalone := GetStandaloneServer("127.0.0.1:0")
+	defer standalone.Close()
+	if !assert.Nil(standalone.KeepRunning()) {
+		return
+	}
+	assert.Nil(standalone.Present("example.com", "token", "token.thumbprint"))
+	assert.Nil(standalone.CleanUp("example.com", "token", "token.thumbprint"))
+	if !assert.NotNil(standalone.Addr()) {
+		return
+	}
+	base := "http://" + standalone.Addr().String()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	req, _ := http.NewRequest("GET", base+"/index.html?q=1", nil)
+	req.Host = "www.example.com:80"
+	resp, err := client.Do(req)
+	if assert.Nil(err) {
+		assert.Equal(http.StatusMovedPermanently, resp.StatusCode)
+		assert.Equal("https://www.example.com/index.html?q=1", resp.Header.Get("Location"))
+		resp.Body.Close()
+	}
+
+	resp, err = client.Get(base + challengePathPrefix + "token")
+	if assert.Nil(err) {
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,237 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ALPNProtocol is the protocol a TLS-ALPN-01 challenge is validated with (RFC 8737).
+const ALPNProtocol = "acme-tls/1"
+
+var (
+	idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+	tlsALPNLock    sync.Mutex
+	tlsALPNServers = make(map[string]*TLSALPNServer)
+)
+
+// TLSALPNChallengeCert creates the self-signed certificate for a TLS-ALPN-01 challenge,
+// which contains the domain and the SHA-256 digest of the key authorization in the
+// critical acmeIdentifier extension.
+func TLSALPNChallengeCert(domain, keyAuth string) (*tls.Certificate, error) {
+	sum := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to generate key for challenge certificate")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "ACME challenge"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24),
+		DNSNames:     []string{domain},
+		ExtraExtensions: []pkix.Extension{
+			{Id: idPeAcmeIdentifier, Critical: true, Value: value},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create challenge certificate")
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// TLSALPNServer solves TLS-ALPN-01 challenges by serving the challenge certificates on
+// a TLS listener. It only listens while challenges are pending.
+type TLSALPNServer struct {
+	address string
+
+	lock     sync.Mutex
+	certs    map[string]*tls.Certificate
+	listener net.Listener
+}
+
+// GetTLSALPNServer returns the server listening on the given address. Servers are
+// shared, so several certificates can be validated via the same address.
+func GetTLSALPNServer(address string) *TLSALPNServer {
+	tlsALPNLock.Lock()
+	defer tlsALPNLock.Unlock()
+	server, exists := tlsALPNServers[address]
+	if !exists {
+		server = &TLSALPNServer{address: address, certs: make(map[string]*tls.Certificate)}
+		tlsALPNServers[address] = server
+	}
+	return server
+}
+
+// Addr returns the address the server is listening on or nil if it is not running.
+func (s *TLSALPNServer) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *TLSALPNServer) Present(domain, token, keyAuth string) error {
+	cert, err := TLSALPNChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.certs[strings.ToLower(domain)] = cert
+	if s.listener != nil {
+		return nil
+	}
+	listener, err := tls.Listen("tcp", s.address, &tls.Config{
+		NextProtos:     []string{ALPNProtocol},
+		GetCertificate: s.getCertificate,
+	})
+	if err != nil {
+		delete(s.certs, strings.ToLower(domain))
+		return errors.Wrapf(err, "Unable to listen on %s for TLS-ALPN challenges", s.address)
+	}
+	s.listener = listener
+	go s.serve(listener)
+	return nil
+}
+
+func (s *TLSALPNServer) CleanUp(domain, token, keyAuth string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.certs, strings.ToLower(domain))
+	if len(s.certs) > 0 || s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.listener = nil
+	return err
+}
+
+// serve completes the handshake of every connection, which is all the CA needs to
+// validate the challenge.
+func (s *TLSALPNServer) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second * 10))
+			if err := conn.(*tls.Conn).Handshake(); err != nil {
+				log.Printf("TLS-ALPN challenge handshake failed: %v", err)
+			}
+		}()
+	}
+}
+
+func (s *TLSALPNServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !contains(hello.SupportedProtos, ALPNProtocol) {
+		return nil, fmt.Errorf("Client doesn't support %s", ALPNProtocol)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cert, exists := s.certs[strings.ToLower(hello.ServerName)]
+	if !exists {
+		return nil, fmt.Errorf("No challenge pending for %s", hello.ServerName)
+	}
+	return cert, nil
+}
+
+// TLSALPNHook hands TLS-ALPN-01 challenge certificates to an external TLS terminator.
+// The command is called with the arguments "present" or "cleanup", the domain and the
+// paths of the PEM encoded certificate and private key. It has to serve the certificate
+// for connections negotiating the acme-tls/1 protocol when called with "present".
+type TLSALPNHook struct {
+	Command string
+	// Dir is the directory the certificates are written to, defaults to a temporary
+	// directory.
+	Dir string
+}
+
+func (h *TLSALPNHook) Present(domain, token, keyAuth string) error {
+	cert, err := TLSALPNChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+	certPath, keyPath := h.paths(domain)
+	if err := os.MkdirAll(path.Dir(certPath), 0700); err != nil {
+		return errors.Wrap(err, "Can't create directory for challenge certificates")
+	}
+	keyData, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyData})
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		return errors.Wrap(err, "Unable to write challenge certificate")
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return errors.Wrap(err, "Unable to write challenge key")
+	}
+	return h.run("present", domain, certPath, keyPath)
+}
+
+func (h *TLSALPNHook) CleanUp(domain, token, keyAuth string) error {
+	certPath, keyPath := h.paths(domain)
+	err := h.run("cleanup", domain, certPath, keyPath)
+	os.Remove(certPath)
+	os.Remove(keyPath)
+	return err
+}
+
+func (h *TLSALPNHook) paths(domain string) (string, string) {
+	dir := h.Dir
+	if dir == "" {
+		dir = path.Join(os.TempDir(), "certbuddy-tls-alpn")
+	}
+	return path.Join(dir, domain+".crt"), path.Join(dir, domain+".key")
+}
+
+func (h *TLSALPNHook) run(action, domain, certPath, keyPath string) error {
+	out, err := exec.Command(h.Command, action, domain, certPath, keyPath).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "TLS-ALPN hook failed to %s challenge for %s: %s", action, domain, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/acme/acmetest"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// verifyTLSALPN validates a TLS-ALPN-01 challenge like a CA does as described in
+// RFC 8737 section 3.
+func verifyTLSALPN(address, domain, keyAuth string) error {
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{ALPNProtocol},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != ALPNProtocol {
+		return errors.New("acme-tls/1 was not negotiated")
+	}
+	return verifyChallengeCert(state.PeerCertificates[0], domain, keyAuth)
+}
+
+func verifyChallengeCert(cert *x509.Certificate, domain, keyAuth string) error {
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != domain {
+		return fmt.Errorf("Challenge certificate is not valid for %s", domain)
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	expected, _ := asn1.Marshal(sum[:])
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(idPeAcmeIdentifier) && ext.Critical && bytes.Equal(ext.Value, expected) {
+			return nil
+		}
+	}
+	return errors.New("No valid acmeIdentifier extension")
+}
+
+func TestObtainCertificateWithTLSALPN(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(stateBaseDir)
+	alpn := GetTLSALPNServer("127.0.0.1:0")
+
+	server := acmetest.NewServer()
+	defer server.Close()
+	server.Validator = func(challengeType, domain, token, keyAuth string) error {
+		if challengeType != ChallengeTLSALPN01 {
+			return fmt.Errorf("Unexpected challenge %s", challengeType)
+		}
+		addr := alpn.Addr()
+		if addr == nil {
+			return errors.New("TLS-ALPN server is not listening")
+		}
+		return verifyTLSALPN(addr.String(), domain, keyAuth)
+	}
+
+	client := newTestClient(t, server, map[string]ChallengeProvider{ChallengeTLSALPN01: alpn})
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	result, failures := client.ObtainCertificate([]string{"example.com", "www.example.com"}, certKey)
+	assert.Len(failures, 0)
+	assert.NotNil(result)
+	assert.Nil(alpn.Addr())
+}
+
+func TestTLSALPNServerRequiresProtocol(t *testing.T) {
+	assert := assert.New(t)
+	alpn := GetTLSALPNServer("127.0.0.1:0")
+	if !assert.Nil(alpn.Present("example.com", "token", "token.thumbprint")) {
+		return
+	}
+	defer alpn.CleanUp("example.com", "token", "token.thumbprint")
+
+	_, err := tls.Dial("tcp", alpn.Addr().String(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	assert.NotNil(err)
+	_, err = tls.Dial("tcp", alpn.Addr().String(), &tls.Config{
+		ServerName:         "other.com",
+		NextProtos:         []string{ALPNProtocol},
+		InsecureSkipVerify: true,
+	})
+	assert.NotNil(err)
+	assert.Nil(verifyTLSALPN(alpn.Addr().String(), "example.com", "token.thumbprint"))
+}
+
+func TestTLSALPNHook(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy-hook")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	// The hook copies the certificate, so it can be inspected after cleanup
+	script := path.Join(dir, "hook.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$1 $2\" >> "+dir+"/calls\n"+
+		"[ \"$1\" = present ] && cp \"$3\" "+dir+"/presented.crt\nexit 0\n"), 0700)
+
+	hook := &TLSALPNHook{Command: script, Dir: path.Join(dir, "certs")}
+	assert.Nil(hook.Present("example.com", "token", "token.thumbprint"))
+	assert.Nil(hook.CleanUp("example.com", "token", "token.thumbprint"))
+
+	calls, _ := ioutil.ReadFile(path.Join(dir, "calls"))
+	assert.Equal([]string{"present example.com", "cleanup example.com"}, strings.Split(strings.TrimSpace(string(calls)), "\n"))
+	files, _ := ioutil.ReadDir(path.Join(dir, "certs"))
+	assert.Len(files, 0)
+
+	certs, err := certbuddy.LoadCertificateFromDisk(path.Join(dir, "presented.crt"))
+	if assert.Nil(err) && assert.Len(certs, 1) {
+		assert.Nil(verifyChallengeCert(certs[0], "example.com", "token.thumbprint"))
+	}
+
+	failing := &TLSALPNHook{Command: "/bin/false", Dir: path.Join(dir, "certs")}
+	assert.NotNil(failing.Present("example.com", "token", "token.thumbprint"))
+}
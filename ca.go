@@ -3,6 +3,9 @@ package certbuddy
 import (
 	"crypto"
 	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
 )
 
 type CAResult struct {
@@ -17,8 +20,53 @@ func (c *CAResult) AllCerts() []*x509.Certificate {
 	return allCerts
 }
 
+// RevocationReason is the reason for revoking a certificate as defined in RFC 5280
+// section 5.3.1.
+type RevocationReason int
+
+const (
+	ReasonUnspecified          RevocationReason = 0
+	ReasonKeyCompromise        RevocationReason = 1
+	ReasonAffiliationChanged   RevocationReason = 3
+	ReasonSuperseded           RevocationReason = 4
+	ReasonCessationOfOperation RevocationReason = 5
+)
+
+var revocationReasonNames = map[string]RevocationReason{
+	"unspecified":          ReasonUnspecified,
+	"keyCompromise":        ReasonKeyCompromise,
+	"affiliationChanged":   ReasonAffiliationChanged,
+	"superseded":           ReasonSuperseded,
+	"cessationOfOperation": ReasonCessationOfOperation,
+}
+
+// ParseRevocationReason returns the reason for the given name, e.g. keyCompromise.
+func ParseRevocationReason(name string) (RevocationReason, error) {
+	reason, exists := revocationReasonNames[name]
+	if !exists {
+		names := make([]string, 0, len(revocationReasonNames))
+		for n := range revocationReasonNames {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("Unknown revocation reason %s, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return reason, nil
+}
+
+func (r RevocationReason) String() string {
+	for name, reason := range revocationReasonNames {
+		if reason == r {
+			return name
+		}
+	}
+	return fmt.Sprintf("reason %d", int(r))
+}
+
 type AutomatedCA interface {
 	ObtainCertificate(domains []string, privKey crypto.PrivateKey) (*CAResult, map[string]error)
 	Renew(cert *x509.Certificate, privKey crypto.PrivateKey) (*CAResult, error)
-	Revoke(cert *x509.Certificate, privKey crypto.PrivateKey) error
+	// Revoke revokes the certificate. The request is signed with the private key of the
+	// certificate if privKey is not nil, otherwise with the account key.
+	Revoke(cert *x509.Certificate, privKey crypto.PrivateKey, reason RevocationReason) error
 }
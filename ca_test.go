@@ -0,0 +1,19 @@
+package certbuddy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRevocationReason(t *testing.T) {
+	assert := assert.New(t)
+	reason, err := ParseRevocationReason("keyCompromise")
+	assert.Nil(err)
+	assert.Equal(ReasonKeyCompromise, reason)
+	assert.Equal("keyCompromise", reason.String())
+
+	_, err = ParseRevocationReason("stolen")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "expected one of affiliationChanged, cessationOfOperation")
+	}
+}
@@ -0,0 +1,79 @@
+// Package certtest creates certificates and chains for tests, so storages and outputs can
+// be tested with real certificates without a CA.
+package certtest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// RootName is the common name of the root certificate of chains created by Chain.
+const RootName = "Certbuddy Test Root"
+
+var serialLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// Cert creates a certificate for name with a new P-256 key, valid for an hour. It is
+// signed by issuer and issuerKey, or self-signed if issuer is nil. Only CA certificates
+// may issue further certificates.
+func Cert(t testing.TB, name string, isCA bool, issuer *x509.Certificate, issuerKey crypto.Signer, dnsNames ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if issuer == nil {
+		issuer, issuerKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// Chain creates a chain of n certificates, starting with a leaf for name and dnsNames
+// followed by its intermediates up to a self-signed root, and returns it with the key
+// of the leaf. A chain of one certificate is a self-signed leaf.
+func Chain(t testing.TB, n int, name string, dnsNames ...string) ([]*x509.Certificate, *ecdsa.PrivateKey) {
+	if n < 1 {
+		t.Fatalf("A chain needs at least one certificate, not %d", n)
+	}
+	chain := make([]*x509.Certificate, n)
+	var issuer *x509.Certificate
+	var issuerKey *ecdsa.PrivateKey
+	for i := n - 1; i > 0; i-- {
+		caName := RootName
+		if issuer != nil {
+			caName = fmt.Sprintf("Certbuddy Test Intermediate %d", i)
+		}
+		chain[i], issuerKey = Cert(t, caName, true, issuer, issuerKey)
+		issuer = chain[i]
+	}
+	leaf, key := Cert(t, name, false, issuer, issuerKey, dnsNames...)
+	chain[0] = leaf
+	return chain, key
+}
@@ -0,0 +1,116 @@
+package certbuddy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// CertificateError reports a PEM block which doesn't contain a valid certificate. It
+// matches UnparseableCertificate with errors.Is.
+type CertificateError struct {
+	// Block is the number of the PEM block, starting with 1.
+	Block int
+	Err   error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("Unparseable certificate in PEM block %d: %s", e.Block, e.Err)
+}
+
+func (e *CertificateError) Is(target error) bool {
+	return target == UnparseableCertificate
+}
+
+// ParseCertificateChain parses the certificates in the PEM data and orders them as a
+// chain starting with the leaf certificate, see OrderChain.
+func ParseCertificateChain(pemBlockData []byte) ([]*x509.Certificate, error) {
+	certs, err := PemBlockToX509Certificate(pemBlockData)
+	if err != nil {
+		return nil, err
+	}
+	return OrderChain(certs)
+}
+
+// OrderChain orders certificates in any order as a chain, starting with the leaf
+// certificate followed by its issuers. Issuers are found by subject and authority key
+// ID and the signature of every certificate is verified with the public key of its
+// issuer. Certificates which aren't part of the chain and duplicates are rejected.
+func OrderChain(certs []*x509.Certificate) ([]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, NoCertificates
+	}
+	for i := range certs {
+		for j := i + 1; j < len(certs); j++ {
+			if certs[i].Equal(certs[j]) {
+				return nil, fmt.Errorf("Certificate %d (%s) is a duplicate of certificate %d", j+1, certs[j].Subject, i+1)
+			}
+		}
+	}
+
+	// The leaf is the only certificate which isn't the issuer of another one
+	leaf := -1
+	for i := range certs {
+		isIssuer := false
+		for j := range certs {
+			if i != j && issuedBy(certs[j], certs[i]) {
+				isIssuer = true
+				break
+			}
+		}
+		if isIssuer {
+			continue
+		}
+		if leaf >= 0 {
+			return nil, fmt.Errorf("Certificates %d (%s) and %d (%s) are both leaf certificates, expected a single chain",
+				leaf+1, certs[leaf].Subject, i+1, certs[i].Subject)
+		}
+		leaf = i
+	}
+	if leaf < 0 {
+		return nil, errors.New("Certificates don't contain a leaf certificate")
+	}
+
+	chain := []*x509.Certificate{certs[leaf]}
+	used := map[int]bool{leaf: true}
+	current := leaf
+	for !selfSigned(certs[current]) {
+		next := -1
+		for i := range certs {
+			if !used[i] && issuedBy(certs[current], certs[i]) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		if err := certs[current].CheckSignatureFrom(certs[next]); err != nil {
+			return nil, fmt.Errorf("Signature of certificate %d (%s) can't be verified with its issuer, certificate %d (%s): %s",
+				current+1, certs[current].Subject, next+1, certs[next].Subject, err)
+		}
+		chain = append(chain, certs[next])
+		used[next] = true
+		current = next
+	}
+	for i := range certs {
+		if !used[i] {
+			return nil, fmt.Errorf("Certificate %d (%s) isn't part of the chain of %s", i+1, certs[i].Subject, certs[leaf].Subject)
+		}
+	}
+	return chain, nil
+}
+
+// issuedBy returns true if the subject and key ID of issuer match the issuer of cert.
+func issuedBy(cert, issuer *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+		return false
+	}
+	return len(cert.AuthorityKeyId) == 0 || len(issuer.SubjectKeyId) == 0 ||
+		bytes.Equal(cert.AuthorityKeyId, issuer.SubjectKeyId)
+}
+
+func selfSigned(cert *x509.Certificate) bool {
+	return issuedBy(cert, cert)
+}
@@ -0,0 +1,77 @@
+package certbuddy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"github.com/connctd/certbuddy/certtest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func pemChain(certs ...*x509.Certificate) []byte {
+	var data []byte
+	for _, cert := range certs {
+		block, _ := ToPemBlock(cert)
+		data = append(data, block...)
+	}
+	return data
+}
+
+func TestParseCertificateChain(t *testing.T) {
+	assert := assert.New(t)
+	root, rootKey := certtest.Cert(t, "root", true, nil, nil)
+	intermediate, intermediateKey := certtest.Cert(t, "intermediate", true, root, rootKey)
+	leaf, _ := certtest.Cert(t, "leaf", false, intermediate, intermediateKey)
+
+	// Comments, blank lines and trailing text are ignored, the order is fixed
+	data := append([]byte("# Bundle\n\n"), pemChain(root, leaf)...)
+	data = append(data, []byte("\n# intermediate\n")...)
+	data = append(data, pemChain(intermediate)...)
+	data = append(data, []byte("\n\ntrailing garbage")...)
+	chain, err := ParseCertificateChain(data)
+	if assert.Nil(err) && assert.Len(chain, 3) {
+		assert.Equal(leaf, chain[0])
+		assert.Equal(intermediate, chain[1])
+		assert.Equal(root, chain[2])
+	}
+
+	// The chain doesn't have to contain the root
+	chain, err = ParseCertificateChain(pemChain(intermediate, leaf))
+	if assert.Nil(err) && assert.Len(chain, 2) {
+		assert.Equal(leaf, chain[0])
+	}
+
+	_, err = ParseCertificateChain([]byte("  \n"))
+	assert.Equal(NoCertificates, err)
+
+	data = append(pemChain(leaf), []byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n")...)
+	_, err = ParseCertificateChain(data)
+	certErr := &CertificateError{}
+	if assert.True(errors.As(err, &certErr)) {
+		assert.Equal(2, certErr.Block)
+	}
+	assert.True(errors.Is(err, UnparseableCertificate))
+
+	// An intermediate with the same name and key ID but another key doesn't verify the leaf
+	forgedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	forgedTemplate := *intermediate
+	der, err := x509.CreateCertificate(rand.Reader, &forgedTemplate, root, forgedKey.Public(), rootKey)
+	assert.Nil(err)
+	forged, _ := x509.ParseCertificate(der)
+	_, err = ParseCertificateChain(pemChain(forged, leaf))
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "Signature of certificate 2")
+	}
+
+	other, _ := certtest.Cert(t, "other", false, nil, nil)
+	_, err = ParseCertificateChain(pemChain(leaf, intermediate, other))
+	assert.NotNil(err)
+
+	_, err = ParseCertificateChain(pemChain(leaf, intermediate, intermediate))
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "duplicate")
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
+	"fmt"
 	"github.com/connctd/certbuddy"
 	"github.com/connctd/certbuddy/acme"
+	"github.com/connctd/certbuddy/acme/rfc2136"
 	"github.com/connctd/certbuddy/consul"
 	"github.com/connctd/certbuddy/file"
+	"github.com/connctd/certbuddy/hook"
+	"github.com/connctd/certbuddy/kubernetes"
+	"github.com/connctd/certbuddy/mail"
+	"github.com/connctd/certbuddy/vault"
+	"github.com/connctd/certbuddy/webhook"
 	"github.com/pkg/errors"
 	"log"
 	"path"
@@ -16,6 +21,7 @@ import (
 )
 
 type BuddyConfig struct {
+	Name            string
 	Email           string
 	Domains         []string
 	KeyPath         string
@@ -25,6 +31,95 @@ type BuddyConfig struct {
 	AccountKeyPath  string
 	ServiceName     string
 	RegistryAddress string
+	RetryPolicy     certbuddy.RetryPolicy
+	PreferredChain  string
+	Directory       string
+	CABundlePath    string
+	// RFC2136 enables DNS-01 challenges via dynamic DNS updates if not nil
+	RFC2136               *rfc2136.Config
+	DNSResolvers          []string
+	DNSPropagationTimeout time.Duration
+	// StandaloneAddress is the address to answer HTTP-01 challenges on instead of
+	// writing them to the webroot
+	StandaloneAddress     string
+	StandaloneKeepRunning bool
+	// TLSALPNAddress or TLSALPNHook enable TLS-ALPN-01 challenges
+	TLSALPNAddress string
+	TLSALPNHook    string
+	// RevokeOnReissue revokes the old certificate after it has been replaced by Reissue
+	RevokeOnReissue bool
+	// KeyType of newly generated private keys for the certificate and the account
+	KeyType        certbuddy.KeyType
+	AccountKeyType certbuddy.KeyType
+	// KeyFormat and AccountKeyFormat of stored unencrypted private keys
+	KeyFormat        certbuddy.KeyFormat
+	AccountKeyFormat certbuddy.KeyFormat
+	// KeyPassphrase and AccountKeyPassphrase encrypt the stored private keys if set
+	KeyPassphrase        certbuddy.PassphraseSource
+	AccountKeyPassphrase certbuddy.PassphraseSource
+	// KeyRotation defines when the private key of the certificate is replaced
+	KeyRotation certbuddy.KeyRotationPolicy
+	// ArchiveVersions is the number of issued certificates kept in the archive, 0
+	// disables the archive
+	ArchiveVersions int
+	// ConsulKVPrefix stores the certificate and private key in the Consul KV store below
+	// this prefix instead of KeyPath and CertPath, which still hold the local records
+	ConsulKVAddress string
+	ConsulKVToken   string
+	ConsulKVPrefix  string
+	// Vault stores the certificate and private key in a Vault KV v2 secret if not nil
+	Vault *vault.Config
+	// KubernetesSecret additionally writes the certificate and key to a TLS Secret,
+	// using the in-cluster credentials or the Kubeconfig
+	KubernetesSecret *kubernetes.Config
+	Kubeconfig       string
+	KubeContext      string
+	// CertFileName and KeyFileName replace the default file names server.crt and
+	// private.key in CertPath and KeyPath, LeafFileName and ChainFileName additionally
+	// write the leaf and the issuer certificates to CertPath. All file names and output
+	// paths may contain the placeholders {domain}, {name} and {key_type}.
+	CertFileName  string
+	KeyFileName   string
+	LeafFileName  string
+	ChainFileName string
+	// Permissions of the files in CertPath and KeyPath
+	Permissions file.Permissions
+	// Outputs additionally write the certificate and key in other formats
+	Outputs []file.OutputConfig
+	// Hooks run commands before and after certificates are requested and after new
+	// certificates have been stored
+	Hooks hook.Config
+	// Webhooks receive lifecycle events of the certificate
+	Webhooks []webhook.Config
+	// ExpiryWarning is the time before expiration from which on an expiring-soon event
+	// is emitted, 0 disables the event
+	ExpiryWarning time.Duration
+	// EmailAlerts send emails when the certificate can't be renewed or expires soon
+	EmailAlerts []mail.Config
+}
+
+// challengeTypes returns the ACME challenges which can be solved with this config.
+func (c BuddyConfig) challengeTypes() []string {
+	var types []string
+	if c.WebrootPath != "" || c.StandaloneAddress != "" {
+		types = append(types, acme.ChallengeHTTP01)
+	}
+	if c.TLSALPNAddress != "" || c.TLSALPNHook != "" {
+		types = append(types, acme.ChallengeTLSALPN01)
+	}
+	if c.RFC2136 != nil {
+		types = append(types, acme.ChallengeDNS01)
+	}
+	return types
+}
+
+// placeholders returns the values of the placeholders in file name templates.
+func (c BuddyConfig) placeholders() file.Placeholders {
+	names := file.Placeholders{Name: c.Name, KeyType: string(c.KeyType)}
+	if len(c.Domains) > 0 {
+		names.Domain = c.Domains[0]
+	}
+	return names
 }
 
 type Buddy struct {
@@ -36,6 +131,13 @@ type Buddy struct {
 	certStore       certbuddy.CertStorage
 	privateKeyStore certbuddy.KeyStorage
 	accountKeyStore certbuddy.KeyStorage
+	archive         *file.Archive
+	versions        certbuddy.VersionedStorage
+	outputs         *certbuddy.MultiOutputCertStorage
+	failures        *certbuddy.FailureRecord
+	// issued is the event of a newly stored certificate the registry hasn't been
+	// notified about yet
+	issued *certbuddy.Event
 }
 
 type dummyRegistry struct{}
@@ -49,7 +151,14 @@ func (d dummyRegistry) CertsExpired(cert *x509.Certificate) error {
 }
 
 var (
-	rsaKeyLength = 4096
+	failureRecordName = ".failures.json"
+	keyRecordName     = ".key.json"
+	alertRecordName   = ".alerts.json"
+	expiryRecordName  = ".expiry.json"
+
+	// expiryWarningInterval is the minimum time between two expiring-soon events about
+	// the same certificate.
+	expiryWarningInterval = 24 * time.Hour
 )
 
 func NewBuddy(config BuddyConfig) (*Buddy, error) {
@@ -61,20 +170,30 @@ func NewBuddy(config BuddyConfig) (*Buddy, error) {
 		return nil, errors.Wrap(err, "Can't create parent path for certificate")
 	}
 
-	// Append an imaginary file name so filepath.Dir returns the correct path in
-	// EnsureParentPathExists
-	if err := certbuddy.EnsureParentPathExists(path.Join(config.WebrootPath, ".keep")); err != nil {
-		return nil, errors.Wrap(err, "Can't create parent directory for webroot")
+	if config.WebrootPath != "" {
+		// Append an imaginary file name so filepath.Dir returns the correct path in
+		// EnsureParentPathExists
+		if err := certbuddy.EnsureParentPathExists(path.Join(config.WebrootPath, ".keep")); err != nil {
+			return nil, errors.Wrap(err, "Can't create parent directory for webroot")
+		}
+	}
+
+	accountKeyPassphrase, err := config.AccountKeyPassphrase.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load account key passphrase")
+	}
+	keyPassphrase, err := config.KeyPassphrase.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load private key passphrase")
 	}
 
-	accountKeyStore := &file.FileStorage{BasePath: config.AccountKeyPath, Concat: false}
+	accountKeyStore := &file.FileStorage{BasePath: config.AccountKeyPath, Concat: false, KeyFormat: config.AccountKeyFormat, Passphrase: accountKeyPassphrase}
 	var accountKey crypto.PrivateKey
-	var err error
 	if !accountKeyStore.KeyExists() {
-		log.Printf("Account key %s does not exists, generating new key", config.AccountKeyPath)
-		accountKey, err = rsa.GenerateKey(rand.Reader, rsaKeyLength)
+		log.Printf("Account key %s does not exists, generating new %s key", config.AccountKeyPath, config.AccountKeyType)
+		accountKey, err = certbuddy.GenerateKey(config.AccountKeyType)
 		if err != nil {
-			return nil, errors.Wrap(err, "Can't generate new RSA account key")
+			return nil, errors.Wrap(err, "Can't generate new account key")
 		}
 		if err := accountKeyStore.SaveKey(accountKey); err != nil {
 			return nil, errors.Wrap(err, "Can't write private account key")
@@ -94,14 +213,124 @@ func NewBuddy(config BuddyConfig) (*Buddy, error) {
 
 	checker := certbuddy.TimeExpirationChecker{BestBefore: config.ValidBefore}
 
-	var registry certbuddy.Registry
+	var registries certbuddy.MultiRegistry
 	if config.RegistryAddress != "" {
-		registry, err = consul.NewConsulRegistry(config.RegistryAddress, config.ServiceName)
+		consulRegistry, err := consul.NewConsulRegistry(config.RegistryAddress, config.ServiceName)
 		if err != nil {
 			return nil, errors.Wrap(err, "Unable to connect to Consul Registry")
 		}
+		registries = append(registries, consulRegistry)
+	}
+
+	if config.RetryPolicy == (certbuddy.RetryPolicy{}) {
+		config.RetryPolicy = certbuddy.DefaultRetryPolicy
+	}
+
+	failures, err := certbuddy.LoadFailureRecord(failureRecordPath(config))
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't load failure record")
+	}
+
+	var certStore certbuddy.CertStorage
+	var privateKeyStore certbuddy.KeyStorage
+	var archive *file.Archive
+	var versions certbuddy.VersionedStorage
+	if config.Vault != nil {
+		vaultConfig := *config.Vault
+		vaultConfig.KeyFormat, vaultConfig.Passphrase = config.KeyFormat, keyPassphrase
+		vaultStore, err := vault.NewStorage(vaultConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to create Vault storage")
+		}
+		certStore, privateKeyStore, versions = vaultStore, vaultStore, vaultStore
+	} else if config.ConsulKVPrefix != "" {
+		kvStore, err := consul.NewKVStorage(config.ConsulKVAddress, config.ConsulKVToken, config.ConsulKVPrefix)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to create Consul KV storage")
+		}
+		kvStore.KeyFormat, kvStore.Passphrase = config.KeyFormat, keyPassphrase
+		certStore, privateKeyStore = kvStore, kvStore
 	} else {
-		registry = dummyRegistry{}
+		names := config.placeholders()
+		certFiles := &file.FileStorage{
+			BasePath:      config.CertPath,
+			Concat:        true,
+			CertFileName:  names.Expand(config.CertFileName),
+			LeafFileName:  names.Expand(config.LeafFileName),
+			ChainFileName: names.Expand(config.ChainFileName),
+			Permissions:   config.Permissions,
+		}
+		keyFiles := &file.FileStorage{
+			BasePath:    config.KeyPath,
+			Concat:      false,
+			KeyFileName: names.Expand(config.KeyFileName),
+			KeyFormat:   config.KeyFormat,
+			Passphrase:  keyPassphrase,
+			Permissions: config.Permissions,
+		}
+		if config.ArchiveVersions > 0 {
+			archive = &file.Archive{KeyStore: keyFiles, CertStore: certFiles, Retention: config.ArchiveVersions}
+			versions = archive
+		}
+		certStore, privateKeyStore = certFiles, keyFiles
+	}
+
+	var outputs []certbuddy.CertStorage
+	if config.KubernetesSecret != nil {
+		cluster, err := kubernetes.LoadClusterConfig(config.Kubeconfig, config.KubeContext)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to load Kubernetes credentials")
+		}
+		secretConfig := *config.KubernetesSecret
+		secretConfig.Cluster = *cluster
+		secretConfig.KeyFormat = config.KeyFormat
+		secretStore, err := kubernetes.NewSecretStorage(secretConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to create Kubernetes Secret storage")
+		}
+		outputs = append(outputs, secretStore)
+	}
+	for _, outputConfig := range config.Outputs {
+		outputConfig.Path = config.placeholders().Expand(outputConfig.Path)
+		outputConfig.KeyPath = config.placeholders().Expand(outputConfig.KeyPath)
+		output, err := file.NewOutput(outputConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to create output %s", outputConfig.Path)
+		}
+		outputs = append(outputs, output)
+	}
+
+	if config.Hooks.Enabled() {
+		hookConfig := config.Hooks
+		hookConfig.Name = config.Name
+		if certFiles, ok := certStore.(*file.FileStorage); ok {
+			hookConfig.CertPath = certFiles.CertFilePath()
+		}
+		if keyFiles, ok := privateKeyStore.(*file.FileStorage); ok {
+			hookConfig.KeyPath = keyFiles.KeyFilePath()
+		}
+		registries = append(registries, hook.NewRegistry(hookConfig))
+	}
+	for _, webhookConfig := range config.Webhooks {
+		webhookRegistry, err := webhook.NewRegistry(webhookConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to create webhook %s", webhookConfig.URL)
+		}
+		registries = append(registries, webhookRegistry)
+	}
+	for _, alertConfig := range config.EmailAlerts {
+		alertConfig.RecordPath = path.Join(config.CertPath, alertRecordName)
+		alertRegistry, err := mail.NewRegistry(alertConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to create email alerts %s", alertConfig.Name)
+		}
+		registries = append(registries, alertRegistry)
+	}
+	var registry certbuddy.Registry = dummyRegistry{}
+	if len(registries) == 1 {
+		registry = registries[0]
+	} else if len(registries) > 1 {
+		registry = registries
 	}
 
 	return &Buddy{
@@ -110,57 +339,232 @@ func NewBuddy(config BuddyConfig) (*Buddy, error) {
 		checker:         checker,
 		user:            user,
 		accountKeyStore: accountKeyStore,
-		certStore:       &file.FileStorage{BasePath: config.CertPath, Concat: true},
-		privateKeyStore: &file.FileStorage{BasePath: config.KeyPath, Concat: false},
+		certStore:       certStore,
+		privateKeyStore: privateKeyStore,
+		archive:         archive,
+		versions:        versions,
+		outputs:         certbuddy.NewMultiOutputCertStorage(certStore, outputs...),
+		failures:        failures,
 	}, nil
 
 }
 
+// Start starts services which keep running in background mode, like a standalone
+// HTTP challenge server redirecting to HTTPS.
+func (b *Buddy) Start() error {
+	if b.config.StandaloneAddress != "" && b.config.StandaloneKeepRunning {
+		log.Printf("Keeping HTTP challenge server on %s running", b.config.StandaloneAddress)
+		return acme.GetStandaloneServer(b.config.StandaloneAddress).KeepRunning()
+	}
+	return nil
+}
+
+// Name returns the name of the managed certificate, used for logging.
+func (b *Buddy) Name() string {
+	return b.config.Name
+}
+
+// NextRenewal returns the point in time at which the stored certificate needs to be
+// renewed. If no certificate is stored yet, it needs to be obtained immediately.
+func (b *Buddy) NextRenewal() (time.Time, error) {
+	if !b.certStore.CertsExist() {
+		return time.Now(), nil
+	}
+	certs, err := b.certStore.LoadCerts()
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "Unable to load certificates")
+	}
+	if len(certs) == 0 {
+		return time.Now(), nil
+	}
+	renewal := certs[0].NotAfter.Add(-b.config.ValidBefore)
+	if due, rotate := b.config.KeyRotation.RotationDue(b.keyCreated(certs[0])); rotate && due.Before(renewal) {
+		return due, nil
+	}
+	return renewal, nil
+}
+
+// RetryAt returns the time of the next attempt if the last attempt to ensure valid
+// certificates failed and the retry is not due yet.
+func (b *Buddy) RetryAt() (time.Time, bool) {
+	return b.failures.NextAttempt, b.failures.Pending()
+}
+
+// EnsureCerts makes sure that a valid certificate exists and obtains or renews it if
+// necessary. Failures are recorded, so the next attempt can be delayed according to the
+// retry policy of this Buddy.
 func (b *Buddy) EnsureCerts() error {
-	log.Printf("Ensuring valid certificates for %+v", b.config.Domains)
-	obtainCerts := false
+	err := b.ensureCerts()
+	if err == nil {
+		err = b.syncOutputs()
+	}
+	b.notifyIssued()
+	if err == nil {
+		if b.failures.ConsecutiveFailures > 0 {
+			log.Printf("Recovered after %d failed attempt(s) for %s", b.failures.ConsecutiveFailures, b.Name())
+		}
+		b.failures = &certbuddy.FailureRecord{}
+	} else {
+		b.failures.Failed(err, b.config.RetryPolicy)
+		log.Printf("Attempt for %s failed %d time(s) in a row, next attempt at %s",
+			b.Name(), b.failures.ConsecutiveFailures, b.failures.NextAttempt.Format(time.RFC3339))
+	}
+	if storeErr := certbuddy.StoreFailureRecord(failureRecordPath(*b.config), b.failures); storeErr != nil {
+		log.Printf("Unable to store failure record for %s: %+v", b.Name(), storeErr)
+	}
+	current := b.currentCert()
+	if err != nil {
+		b.notify(certbuddy.Event{
+			Type:                certbuddy.EventRenewalFailed,
+			Certificate:         current,
+			Err:                 err,
+			ConsecutiveFailures: b.failures.ConsecutiveFailures,
+		})
+	}
+	if b.expiringSoon(current) {
+		log.Printf("Certificate %s for %s expires at %s", current.SerialNumber, b.Name(), current.NotAfter.Format(time.RFC3339))
+		b.warnExpiry(current)
+	}
+	return err
+}
 
-	var privateKey crypto.PrivateKey
-	if !b.privateKeyStore.KeyExists() {
-		log.Println("Private key for ACME account doesn't exist, generating new key")
-		obtainCerts = true
-		privateKey, err := rsa.GenerateKey(rand.Reader, rsaKeyLength)
-		if err != nil {
-			return errors.Wrap(err, "Unable to generate missing private key")
+// expiringSoon tells whether the certificate expires within the expiry warning period.
+// It is always false if the warning is disabled.
+func (b *Buddy) expiringSoon(cert *x509.Certificate) bool {
+	return cert != nil && b.config.ExpiryWarning > 0 && time.Until(cert.NotAfter) < b.config.ExpiryWarning
+}
+
+// warnExpiry emits an expiring-soon event about the certificate unless one has been
+// emitted within the expiryWarningInterval. The time of the last event is persisted, so
+// restarts don't emit it again.
+func (b *Buddy) warnExpiry(cert *x509.Certificate) {
+	recordPath := expiryRecordPath(*b.config)
+	record, err := certbuddy.LoadExpiryRecord(recordPath)
+	if err != nil {
+		log.Printf("Unable to load expiry record for %s: %+v", b.Name(), err)
+	}
+	now := time.Now()
+	if !record.WarningDue(cert, expiryWarningInterval, now) {
+		return
+	}
+	b.notify(certbuddy.Event{Type: certbuddy.EventExpiringSoon, Certificate: cert, Time: now})
+	record = &certbuddy.ExpiryRecord{Serial: fmt.Sprintf("%x", cert.SerialNumber), LastWarning: now}
+	if err := certbuddy.StoreExpiryRecord(recordPath, record); err != nil {
+		log.Printf("Unable to store expiry record for %s: %+v", b.Name(), err)
+	}
+}
+
+// Status summarizes the certificate for an email digest. The failure record is read
+// from disk, so it can be called while EnsureCerts runs.
+func (b *Buddy) Status() mail.Status {
+	status := mail.Status{
+		Name:        b.Name(),
+		Domains:     b.config.Domains,
+		Certificate: b.currentCert(),
+	}
+	status.ExpiringSoon = b.expiringSoon(status.Certificate)
+	failures, err := certbuddy.LoadFailureRecord(failureRecordPath(*b.config))
+	if err != nil {
+		log.Printf("Unable to load failure record for %s: %+v", b.Name(), err)
+		return status
+	}
+	status.ConsecutiveFailures = failures.ConsecutiveFailures
+	status.LastError = failures.LastError
+	status.NextAttempt = failures.NextAttempt
+	return status
+}
+
+// currentCert returns the stored leaf certificate or nil if there is none or it can't
+// be loaded.
+func (b *Buddy) currentCert() *x509.Certificate {
+	if !b.certStore.CertsExist() {
+		return nil
+	}
+	certs, err := b.certStore.LoadCerts()
+	if err != nil || len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// syncOutputs writes the stored certificate and private key to every additional output
+// which doesn't contain the current certificate yet.
+func (b *Buddy) syncOutputs() error {
+	written, err := b.outputs.SyncOutputs(b.privateKeyStore)
+	if written > 0 {
+		log.Printf("Wrote certificate for %s to %d output(s)", b.Name(), written)
+	}
+	return errors.Wrap(err, "Unable to write certificate to outputs")
+}
+
+func failureRecordPath(config BuddyConfig) string {
+	return path.Join(config.CertPath, failureRecordName)
+}
+
+func expiryRecordPath(config BuddyConfig) string {
+	return path.Join(config.CertPath, expiryRecordName)
+}
+
+func keyRecordPath(config BuddyConfig) string {
+	return path.Join(config.KeyPath, keyRecordName)
+}
+
+// getCA returns the client for the CA, which is created on first use.
+func (b *Buddy) getCA() (certbuddy.AutomatedCA, error) {
+	if b.ca == nil {
+		log.Println("Creating CA client")
+		opts := acme.Options{
+			Directory:             b.config.Directory,
+			CABundlePath:          b.config.CABundlePath,
+			WebrootPath:           b.config.WebrootPath,
+			StandaloneAddress:     b.config.StandaloneAddress,
+			TLSALPNAddress:        b.config.TLSALPNAddress,
+			TLSALPNHook:           b.config.TLSALPNHook,
+			PreferredChain:        b.config.PreferredChain,
+			DNSResolvers:          b.config.DNSResolvers,
+			DNSPropagationTimeout: b.config.DNSPropagationTimeout,
+			// The revoke command doesn't need any challenge to be configured
+			RevocationOnly: len(b.config.challengeTypes()) == 0,
 		}
-		if err := b.privateKeyStore.SaveKey(privateKey); err != nil {
-			return errors.Wrap(err, "Unable to save private key")
+		if b.config.RFC2136 != nil {
+			provider, err := rfc2136.NewDNSProvider(*b.config.RFC2136)
+			if err != nil {
+				return nil, errors.Wrap(err, "Can't create RFC 2136 DNS provider")
+			}
+			opts.DNSProvider = provider
 		}
-	} else {
-		var err error
-		privateKey, err = b.privateKeyStore.LoadKey()
+		ca, err := acme.NewAcmeClient(b.user, opts)
 		if err != nil {
-			return errors.Wrap(err, "Unable to load private key")
+			return nil, errors.Wrap(err, "Can't create ACME CA")
 		}
+		b.ca = ca
 	}
+	return b.ca, nil
+}
 
-	if !b.certStore.CertsExist() {
-		obtainCerts = true
+func (b *Buddy) ensureCerts() error {
+	log.Printf("Ensuring valid certificates for %+v", b.config.Domains)
+
+	if !b.privateKeyStore.KeyExists() {
+		log.Printf("Private key doesn't exist, generating new %s key", b.config.KeyType)
+		return b.rotateKey()
+	}
+	privateKey, err := b.privateKeyStore.LoadKey()
+	if err != nil {
+		return errors.Wrap(err, "Unable to load private key")
 	}
 
-	if obtainCerts {
+	if !b.certStore.CertsExist() {
 		log.Println("Obtaining new certificate")
-		if b.ca == nil {
-			log.Println("Creating CA client")
-			var err error
-			b.ca, err = acme.NewAcmeClient(b.user, b.config.WebrootPath)
-			if err != nil {
-				return errors.Wrap(err, "Can't create ACME CA")
-			}
+		ca, err := b.getCA()
+		if err != nil {
+			return err
 		}
-		result, errs := b.ca.ObtainCertificate(b.config.Domains, privateKey)
-		if errs != nil {
-			for domain, err := range errs {
-				log.Printf("Error for domain %s: %+v", domain, err)
-			}
-			return errors.New("Error obtaining new certificate for private key")
+		result, err := b.obtainCertificate(ca, privateKey)
+		if err != nil {
+			return errors.Wrap(err, "Error obtaining new certificate for private key")
 		}
-		if err := b.certStore.SaveCerts(result.AllCerts()); err != nil {
+		if err := b.storeCerts(privateKey, result.AllCerts(), false, certbuddy.EventIssued); err != nil {
 			return errors.Wrap(err, "Can't store obtained certificates")
 		}
 	} else {
@@ -174,20 +578,25 @@ func (b *Buddy) EnsureCerts() error {
 		if err != nil {
 			return errors.Wrap(err, "Unable to validate certificate")
 		}
+		if b.needsNewKey(valid, b.keyCreated(certs[0])) {
+			log.Printf("Rotating private key according to key rotation policy %s", b.config.KeyRotation.Mode)
+			return b.rotateKey()
+		}
 		if !valid {
 			log.Println("Renewing existing certifcate")
-			if b.ca == nil {
-				var err error
-				b.ca, err = acme.NewAcmeClient(b.user, b.config.WebrootPath)
-				if err != nil {
-					return errors.Wrap(err, "Can't create ACME CA")
-				}
+			ca, err := b.getCA()
+			if err != nil {
+				return err
 			}
-			result, err := b.ca.Renew(certs[0], privateKey)
+			var result *certbuddy.CAResult
+			err = b.withValidationHooks(func() error {
+				result, err = ca.Renew(certs[0], privateKey)
+				return err
+			})
 			if err != nil {
-				errors.Wrap(err, "Unable to renew certificate")
+				return errors.Wrap(err, "Unable to renew certificate")
 			}
-			if err := b.certStore.SaveCerts(result.AllCerts()); err != nil {
+			if err := b.storeCerts(privateKey, result.AllCerts(), false, certbuddy.EventRenewed); err != nil {
 				return errors.Wrap(err, "Unable to save renewed Certificate")
 			}
 		}
@@ -195,3 +604,200 @@ func (b *Buddy) EnsureCerts() error {
 	log.Printf("Done for %+v", b.config.Domains)
 	return nil
 }
+
+// needsNewKey decides according to the key rotation policy if the private key has to be
+// replaced. valid tells whether the current certificate is still valid long enough.
+func (b *Buddy) needsNewKey(valid bool, keyCreated time.Time) bool {
+	if !valid {
+		return b.config.KeyRotation.RotateOnRenew(keyCreated, time.Now())
+	}
+	due, rotate := b.config.KeyRotation.RotationDue(keyCreated)
+	return rotate && !time.Now().Before(due)
+}
+
+// keyCreated returns when the current private key was created. Keys created before
+// their creation was recorded are assumed to be as old as the certificate.
+func (b *Buddy) keyCreated(cert *x509.Certificate) time.Time {
+	record, err := certbuddy.LoadKeyRecord(keyRecordPath(*b.config))
+	if err != nil {
+		log.Printf("Unable to load key record for %s: %+v", b.Name(), err)
+	}
+	if record == nil {
+		return cert.NotBefore
+	}
+	return record.Created
+}
+
+// rotateKey generates a new private key and obtains a certificate for it. The key is
+// only stored together with the certificate.
+func (b *Buddy) rotateKey() error {
+	event := certbuddy.EventKeyRotated
+	if !b.privateKeyStore.KeyExists() {
+		event = certbuddy.EventIssued
+	}
+	privateKey, err := certbuddy.GenerateKey(b.config.KeyType)
+	if err != nil {
+		return errors.Wrap(err, "Unable to generate new private key")
+	}
+	ca, err := b.getCA()
+	if err != nil {
+		return err
+	}
+	log.Println("Obtaining new certificate for new private key")
+	result, err := b.obtainCertificate(ca, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "Error obtaining new certificate for new private key")
+	}
+	if err := b.storeCerts(privateKey, result.AllCerts(), true, event); err != nil {
+		return err
+	}
+	log.Printf("Done for %+v", b.config.Domains)
+	return nil
+}
+
+// obtainCertificate requests a new certificate for the private key, logging the errors
+// of every domain which couldn't be validated.
+func (b *Buddy) obtainCertificate(ca certbuddy.AutomatedCA, privateKey crypto.PrivateKey) (*certbuddy.CAResult, error) {
+	var result *certbuddy.CAResult
+	err := b.withValidationHooks(func() error {
+		var errs map[string]error
+		result, errs = ca.ObtainCertificate(b.config.Domains, privateKey)
+		if errs != nil {
+			for domain, err := range errs {
+				log.Printf("Error for domain %s: %+v", domain, err)
+			}
+			return fmt.Errorf("Validation failed for %d domain(s)", len(errs))
+		}
+		return nil
+	})
+	return result, err
+}
+
+// withValidationHooks runs a certificate request between the pre and post validation
+// hooks of the registry, if it has any. The request isn't sent if a pre hook fails, but
+// the post hooks still run, since the pre hooks which succeeded may have stopped a
+// service the post hooks start again.
+func (b *Buddy) withValidationHooks(request func() error) error {
+	hooks, ok := b.registry.(certbuddy.ValidationHook)
+	if !ok {
+		return request()
+	}
+	err := hooks.BeforeValidation(b.config.Domains)
+	if err != nil {
+		err = errors.Wrap(err, "Pre hook failed")
+	} else {
+		err = request()
+	}
+	if hookErr := hooks.AfterValidation(b.config.Domains); hookErr != nil {
+		log.Printf("Post hook failed for %s: %+v", b.Name(), hookErr)
+	}
+	return err
+}
+
+// storeCerts stores newly issued certificates together with their private key and
+// archives them as a new version if the archive is enabled. The registry is notified
+// with the given event by notifyIssued once the outputs have been written. newKey tells
+// whether the private key has just been generated.
+func (b *Buddy) storeCerts(privateKey crypto.PrivateKey, certs []*x509.Certificate, newKey bool, event certbuddy.EventType) error {
+	if b.archive != nil {
+		version, err := b.archive.Store(privateKey, certs)
+		if err != nil {
+			return errors.Wrap(err, "Unable to archive certificates")
+		}
+		log.Printf("Stored certificate %s for %s as version %d", certs[0].SerialNumber, b.Name(), version)
+	} else if newKey {
+		if err := b.saveKeyAndCerts(privateKey, certs); err != nil {
+			return err
+		}
+	} else if err := b.certStore.SaveCerts(certs); err != nil {
+		return err
+	}
+	if newKey {
+		if err := certbuddy.StoreKeyRecord(keyRecordPath(*b.config), &certbuddy.KeyRecord{Created: time.Now()}); err != nil {
+			log.Printf("Unable to store key record for %s: %+v", b.Name(), err)
+		}
+	}
+	b.issued = &certbuddy.Event{Type: event, Certificate: certs[0]}
+	return nil
+}
+
+// notifyIssued notifies the registry about a certificate stored since the last call,
+// e.g. to run deploy hooks. A failing registry doesn't affect the certificate.
+func (b *Buddy) notifyIssued() {
+	if b.issued == nil {
+		return
+	}
+	event := *b.issued
+	b.issued = nil
+	if err := b.registry.CertAvailable(event.Certificate); err != nil {
+		log.Printf("Unable to notify registry about certificate for %s: %+v", b.Name(), err)
+	}
+	b.notify(event)
+}
+
+// Flush waits until the registry has delivered all pending notifications, e.g. webhooks.
+func (b *Buddy) Flush() {
+	if registry, ok := b.registry.(certbuddy.FlushingRegistry); ok {
+		registry.Flush()
+	}
+}
+
+// notify sends a lifecycle event to the registry if it handles events.
+func (b *Buddy) notify(event certbuddy.Event) {
+	registry, ok := b.registry.(certbuddy.EventRegistry)
+	if !ok {
+		return
+	}
+	event.Name = b.Name()
+	event.Domains = b.config.Domains
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if err := registry.Notify(event); err != nil {
+		log.Printf("Unable to notify registry about %s event for %s: %+v", event.Type, b.Name(), err)
+	}
+}
+
+// saveKeyAndCerts stores a new private key together with the certificates issued for
+// it. Storages supporting transactions and file storages replace both at once, for
+// other storages the previous key is restored if the certificates can't be stored, so
+// the stored key always matches the stored certificate.
+func (b *Buddy) saveKeyAndCerts(privateKey crypto.PrivateKey, certs []*x509.Certificate) error {
+	if store, ok := b.certStore.(certbuddy.KeyCertStorage); ok && interface{}(b.certStore) == interface{}(b.privateKeyStore) {
+		if err := store.SaveKeyAndCerts(privateKey, certs); err != nil {
+			return errors.Wrap(err, "Unable to save new private key and certificates")
+		}
+		return nil
+	}
+	keyFiles, keyIsFile := b.privateKeyStore.(*file.FileStorage)
+	certFiles, certIsFile := b.certStore.(*file.FileStorage)
+	if keyIsFile && certIsFile {
+		if err := file.SaveKeyAndCerts(keyFiles, privateKey, certFiles, certs); err != nil {
+			return errors.Wrap(err, "Unable to save new private key and certificates")
+		}
+		return nil
+	}
+	return b.saveKeyThenCerts(privateKey, certs)
+}
+
+func (b *Buddy) saveKeyThenCerts(privateKey crypto.PrivateKey, certs []*x509.Certificate) error {
+	var previousKey crypto.PrivateKey
+	if b.privateKeyStore.KeyExists() {
+		var err error
+		if previousKey, err = b.privateKeyStore.LoadKey(); err != nil {
+			return errors.Wrap(err, "Unable to load previous private key")
+		}
+	}
+	if err := b.privateKeyStore.SaveKey(privateKey); err != nil {
+		return errors.Wrap(err, "Unable to save new private key")
+	}
+	if err := b.certStore.SaveCerts(certs); err != nil {
+		if previousKey != nil {
+			if restoreErr := b.privateKeyStore.SaveKey(previousKey); restoreErr != nil {
+				log.Printf("Unable to restore previous private key for %s: %+v", b.Name(), restoreErr)
+			}
+		}
+		return errors.Wrap(err, "Unable to save certificates for new private key")
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/acme/acmetest"
+	"github.com/connctd/certbuddy/file"
+	"github.com/connctd/certbuddy/hook"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func newTestBuddy(t *testing.T, server *acmetest.Server, dir string) *Buddy {
+	buddy, err := NewBuddy(BuddyConfig{
+		Name:           "test",
+		Email:          "test@example.com",
+		Domains:        []string{"example.com", "www.example.com"},
+		KeyPath:        path.Join(dir, "keys"),
+		CertPath:       path.Join(dir, "certs"),
+		AccountKeyPath: path.Join(dir, "account.key"),
+		WebrootPath:    path.Join(dir, "webroot"),
+		Directory:      server.DirectoryURL(),
+		KeyType:        certbuddy.EC256,
+		AccountKeyType: certbuddy.EC256,
+		ValidBefore:    time.Hour * 24 * defaultValidBeforeDays,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buddy
+}
+
+func TestReissueAndRevoke(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("./.letsencrypt")
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	buddy := newTestBuddy(t, server, dir)
+	buddy.config.RevokeOnReissue = true
+	if !assert.Nil(buddy.EnsureCerts()) {
+		return
+	}
+	original, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	originalKey, err := buddy.privateKeyStore.LoadKey()
+	assert.Nil(err)
+
+	assert.Nil(buddy.Reissue())
+	reissued, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	reissuedKey, err := buddy.privateKeyStore.LoadKey()
+	assert.Nil(err)
+	assert.NotEqual(original[0].SerialNumber, reissued[0].SerialNumber)
+	assert.NotEqual(originalKey, reissuedKey)
+	reason, revoked := server.Revoked(original[0])
+	assert.True(revoked)
+	assert.Equal(int(certbuddy.ReasonKeyCompromise), reason)
+	assert.True(server.RevokedWithCertKey(original[0]))
+
+	assert.Nil(buddy.Revoke(certbuddy.ReasonCessationOfOperation, true))
+	reason, revoked = server.Revoked(reissued[0])
+	assert.True(revoked)
+	assert.Equal(int(certbuddy.ReasonCessationOfOperation), reason)
+}
+
+func TestKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("./.letsencrypt")
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	buddy := newTestBuddy(t, server, dir)
+	if !assert.Nil(buddy.EnsureCerts()) {
+		return
+	}
+	original, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	originalKey, err := buddy.privateKeyStore.LoadKey()
+	assert.Nil(err)
+	record, err := certbuddy.LoadKeyRecord(keyRecordPath(*buddy.config))
+	assert.Nil(err)
+	assert.NotNil(record)
+
+	// Renew on every run, the key is reused by default
+	buddy.checker = certbuddy.TimeExpirationChecker{BestBefore: time.Hour * 24 * 365}
+	assert.Nil(buddy.EnsureCerts())
+	renewed, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	renewedKey, err := buddy.privateKeyStore.LoadKey()
+	assert.Nil(err)
+	assert.NotEqual(original[0].SerialNumber, renewed[0].SerialNumber)
+	assert.Equal(originalKey, renewedKey)
+
+	buddy.config.KeyRotation = certbuddy.KeyRotationPolicy{Mode: certbuddy.KeyRotateOnRenew}
+	assert.Nil(buddy.EnsureCerts())
+	rotated, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	rotatedKey, err := buddy.privateKeyStore.LoadKey()
+	assert.Nil(err)
+	assert.NotEqual(renewed[0].SerialNumber, rotated[0].SerialNumber)
+	assert.NotEqual(renewedKey, rotatedKey)
+}
+
+type recordingRegistry struct {
+	available []*x509.Certificate
+	expired   []*x509.Certificate
+}
+
+func (r *recordingRegistry) CertAvailable(cert *x509.Certificate) error {
+	r.available = append(r.available, cert)
+	return nil
+}
+
+func (r *recordingRegistry) CertsExpired(cert *x509.Certificate) error {
+	r.expired = append(r.expired, cert)
+	return nil
+}
+
+func TestRollback(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("./.letsencrypt")
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	buddy := newTestBuddy(t, server, dir)
+	assert.NotNil(buddy.Rollback(0))
+	buddy.archive = &file.Archive{
+		KeyStore:  buddy.privateKeyStore.(*file.FileStorage),
+		CertStore: buddy.certStore.(*file.FileStorage),
+	}
+	buddy.versions = buddy.archive
+	registry := &recordingRegistry{}
+	buddy.registry = registry
+
+	if !assert.Nil(buddy.EnsureCerts()) {
+		return
+	}
+	assert.NotNil(buddy.Rollback(0))
+	first, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	firstKey, err := buddy.privateKeyStore.LoadKey()
+	assert.Nil(err)
+	assert.Nil(buddy.Reissue())
+	second, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	if assert.Len(registry.available, 2) {
+		assert.Equal(first[0].SerialNumber, registry.available[0].SerialNumber)
+		assert.Equal(second[0].SerialNumber, registry.available[1].SerialNumber)
+	}
+
+	assert.Nil(buddy.Rollback(0))
+	restored, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	restoredKey, err := buddy.privateKeyStore.LoadKey()
+	assert.Nil(err)
+	assert.Equal(first[0].SerialNumber, restored[0].SerialNumber)
+	assert.Equal(firstKey, restoredKey)
+	if assert.Len(registry.expired, 1) && assert.Len(registry.available, 3) {
+		assert.Equal(second[0].SerialNumber, registry.expired[0].SerialNumber)
+		assert.Equal(first[0].SerialNumber, registry.available[2].SerialNumber)
+	}
+
+	assert.Nil(buddy.Rollback(2))
+	live, err := buddy.archive.Live()
+	assert.Nil(err)
+	assert.Equal(2, live)
+}
+
+// memoryStorage is an output keeping the certificates and key in memory.
+type memoryStorage struct {
+	key   crypto.PrivateKey
+	certs []*x509.Certificate
+	saves int
+}
+
+func (m *memoryStorage) LoadCerts() ([]*x509.Certificate, error) {
+	return m.certs, nil
+}
+
+func (m *memoryStorage) SaveCerts(certs []*x509.Certificate) error {
+	m.certs = certs
+	m.saves++
+	return nil
+}
+
+func (m *memoryStorage) CertsExist() bool {
+	return len(m.certs) > 0
+}
+
+func (m *memoryStorage) SaveKeyAndCerts(key crypto.PrivateKey, certs []*x509.Certificate) error {
+	m.key = key
+	return m.SaveCerts(certs)
+}
+
+func TestSyncOutputs(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("./.letsencrypt")
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	buddy := newTestBuddy(t, server, dir)
+	output := &memoryStorage{}
+	buddy.outputs = certbuddy.NewMultiOutputCertStorage(buddy.certStore, output)
+	if !assert.Nil(buddy.EnsureCerts()) {
+		return
+	}
+	certs, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	key, err := buddy.privateKeyStore.LoadKey()
+	assert.Nil(err)
+	assert.Equal(certs, output.certs)
+	assert.Equal(key, output.key)
+
+	// Unchanged certificates aren't written again
+	assert.Nil(buddy.EnsureCerts())
+	assert.Equal(1, output.saves)
+
+	assert.Nil(buddy.Reissue())
+	assert.Nil(buddy.EnsureCerts())
+	assert.Equal(2, output.saves)
+	assert.NotEqual(key, output.key)
+}
+
+func TestHooks(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("./.letsencrypt")
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	logPath := path.Join(dir, "hooks.log")
+	config := *newTestBuddy(t, server, dir).config
+	config.Hooks = hook.Config{
+		Pre:  []string{"test ! -e " + path.Join(dir, "fail")},
+		Post: []string{"echo post >> " + logPath},
+		// A failing deploy hook doesn't affect the certificate
+		Deploy: []string{"exit 1", `test -s "$CERTBUDDY_CERT_PATH" && echo "deploy $CERTBUDDY_SERIAL" >> ` + logPath},
+	}
+	buddy, err := NewBuddy(config)
+	if !assert.Nil(err) {
+		return
+	}
+
+	// A failing pre hook aborts the request, but the post hook still runs
+	assert.Nil(ioutil.WriteFile(path.Join(dir, "fail"), nil, 0600))
+	assert.NotNil(buddy.EnsureCerts())
+	assert.False(buddy.certStore.CertsExist())
+	data, err := ioutil.ReadFile(logPath)
+	assert.Nil(err)
+	assert.Equal("post\n", string(data))
+
+	assert.Nil(os.Remove(path.Join(dir, "fail")))
+	if !assert.Nil(buddy.EnsureCerts()) {
+		return
+	}
+	certs, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	data, err = ioutil.ReadFile(logPath)
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("post\npost\ndeploy %x\n", certs[0].SerialNumber), string(data))
+
+	// Nothing runs while the certificate is valid
+	assert.Nil(buddy.EnsureCerts())
+	data, err = ioutil.ReadFile(logPath)
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("post\npost\ndeploy %x\n", certs[0].SerialNumber), string(data))
+}
+
+// eventRegistry records lifecycle events.
+type eventRegistry struct {
+	recordingRegistry
+	events []certbuddy.Event
+}
+
+func (e *eventRegistry) Notify(event certbuddy.Event) error {
+	e.events = append(e.events, event)
+	return nil
+}
+
+func (e *eventRegistry) types() []certbuddy.EventType {
+	types := make([]certbuddy.EventType, 0, len(e.events))
+	for _, event := range e.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("./.letsencrypt")
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	buddy := newTestBuddy(t, server, dir)
+	registry := &eventRegistry{}
+	buddy.registry = registry
+	buddy.config.RevokeOnReissue = true
+	if !assert.Nil(buddy.EnsureCerts()) {
+		return
+	}
+	issued, err := buddy.certStore.LoadCerts()
+	assert.Nil(err)
+	if assert.Len(registry.events, 1) {
+		event := registry.events[0]
+		assert.Equal(certbuddy.EventIssued, event.Type)
+		assert.Equal("test", event.Name)
+		assert.Equal(buddy.config.Domains, event.Domains)
+		assert.Equal(issued[0].SerialNumber, event.Certificate.SerialNumber)
+		assert.False(event.Time.IsZero())
+	}
+
+	// Renewal is forced by a validity requirement the certificate can't meet
+	buddy.checker = certbuddy.TimeExpirationChecker{BestBefore: 365 * 24 * time.Hour}
+	assert.Nil(buddy.EnsureCerts())
+	assert.Nil(buddy.Reissue())
+	assert.Nil(buddy.Revoke(certbuddy.ReasonSuperseded, false))
+	assert.Equal([]certbuddy.EventType{
+		certbuddy.EventIssued,
+		certbuddy.EventRenewed,
+		certbuddy.EventKeyRotated,
+		certbuddy.EventRevoked,
+		certbuddy.EventRevoked,
+	}, registry.types())
+	assert.Equal(certbuddy.ReasonKeyCompromise, registry.events[3].Reason)
+	assert.Equal(certbuddy.ReasonSuperseded, registry.events[4].Reason)
+	assert.Len(registry.available, 3)
+
+	// A failed renewal of a certificate about to expire
+	registry.events = nil
+	buddy.config.ExpiryWarning = 365 * 24 * time.Hour
+	server.Close()
+	buddy.ca = nil
+	assert.NotNil(buddy.EnsureCerts())
+	assert.Equal([]certbuddy.EventType{certbuddy.EventRenewalFailed, certbuddy.EventExpiringSoon}, registry.types())
+	assert.Equal(1, registry.events[0].ConsecutiveFailures)
+	assert.NotNil(registry.events[0].Err)
+	assert.NotNil(registry.events[1].Certificate)
+
+	status := buddy.Status()
+	assert.Equal("test", status.Name)
+	assert.NotNil(status.Certificate)
+	assert.True(status.ExpiringSoon)
+	assert.Equal(1, status.ConsecutiveFailures)
+	assert.NotEmpty(status.LastError)
+	assert.False(status.NextAttempt.IsZero())
+
+	// The expiring-soon event isn't repeated with every check
+	registry.events = nil
+	assert.NotNil(buddy.EnsureCerts())
+	assert.Equal([]certbuddy.EventType{certbuddy.EventRenewalFailed}, registry.types())
+}
+
+func TestSelectBuddy(t *testing.T) {
+	assert := assert.New(t)
+	www := &Buddy{config: &BuddyConfig{Name: "www"}}
+	api := &Buddy{config: &BuddyConfig{Name: "api"}}
+
+	buddy, err := selectBuddy([]*Buddy{www}, "")
+	assert.Nil(err)
+	assert.Equal(www, buddy)
+	_, err = selectBuddy([]*Buddy{www, api}, "")
+	assert.NotNil(err)
+	buddy, err = selectBuddy([]*Buddy{www, api}, "api")
+	assert.Nil(err)
+	assert.Equal(api, buddy)
+	_, err = selectBuddy([]*Buddy{www, api}, "mail")
+	assert.NotNil(err)
+}
+
+func TestExpiryWarningDisabled(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	expired := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(-time.Hour)}
+	buddy := &Buddy{
+		config:    &BuddyConfig{Name: "www", CertPath: dir},
+		certStore: &memoryStorage{certs: []*x509.Certificate{expired}},
+	}
+	assert.False(buddy.expiringSoon(expired))
+	assert.False(buddy.Status().ExpiringSoon)
+
+	buddy.config.ExpiryWarning = 24 * time.Hour
+	assert.True(buddy.expiringSoon(expired))
+	assert.True(buddy.Status().ExpiringSoon)
+}
@@ -0,0 +1,1102 @@
+package main
+
+import (
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/acme"
+	"github.com/connctd/certbuddy/acme/rfc2136"
+	"github.com/connctd/certbuddy/file"
+	"github.com/connctd/certbuddy/hook"
+	"github.com/connctd/certbuddy/kubernetes"
+	"github.com/connctd/certbuddy/mail"
+	"github.com/connctd/certbuddy/vault"
+	"github.com/connctd/certbuddy/webhook"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	defaultValidBeforeDays   = 30
+	defaultExpiryWarningDays = 14
+	defaultServiceName       = "tls-certs"
+)
+
+var (
+	topLevelKeys    = []string{"account", "certificate", "email_alerts"}
+	accountKeys     = []string{"key_path", "key_type", "key_format", "key_passphrase_file", "key_passphrase_env", "directory", "ca_bundle"}
+	certificateKeys = []string{"account", "domains", "key_path", "cert_path", "webroot", "valid_before", "preferred_chain", "registry", "retry", "dns", "standalone", "tls_alpn", "revoke_on_reissue", "key_type", "key_types", "key_format", "key_passphrase_file", "key_passphrase_env", "key_rotation", "key_max_age", "archive_versions", "consul_storage", "vault", "kubernetes_secret", "cert_file_name", "key_file_name", "leaf_file_name", "chain_file_name", "permissions", "output", "hooks", "webhook", "expiry_warning"}
+	registryKeys    = []string{"address", "service_name"}
+	retryKeys       = []string{"initial_interval", "max_interval", "multiplier", "jitter"}
+	standaloneKeys  = []string{"address", "keep_running"}
+	tlsALPNKeys     = []string{"address", "hook"}
+	consulKVKeys    = []string{"address", "token", "prefix"}
+	outputKeys      = []string{"path", "key_path", "password_file", "password_env", "permissions"}
+	permissionsKeys = []string{"file_mode", "dir_mode", "owner", "group"}
+	hooksKeys       = []string{"pre", "post", "deploy", "timeout"}
+	emailAlertsKeys = []string{"server", "username", "password_file", "password_env", "from", "to", "failure_threshold", "interval", "digest"}
+	webhookKeys     = []string{"url", "secret_file", "secret_env", "events", "retries", "timeout"}
+	kubernetesKeys  = []string{"name", "namespace", "kubeconfig", "context", "include_ca", "labels", "annotations"}
+	vaultKeys       = []string{"address", "token", "role_id", "secret_id", "approle_mount", "namespace", "mount", "path", "ca_cert"}
+	dnsKeys         = []string{"provider", "nameserver", "zone", "tsig_key", "tsig_secret", "tsig_algorithm", "resolvers", "propagation_timeout"}
+)
+
+// fileConfig is the structure of a certbuddy config file. The file can be written
+// in HCL or JSON and looks like this:
+//
+//	account "admin@example.com" {
+//	  key_path  = "/user/account.key"
+//	  key_type  = "ec256"
+//	  # Encrypt the account key with the passphrase in this file
+//	  key_passphrase_file = "/run/secrets/account-passphrase"
+//	  directory = "letsencrypt"
+//	  ca_bundle = "/etc/ssl/private-ca.pem"
+//	}
+//
+//	# Optional, emails alerts about all certificates, may be repeated
+//	email_alerts "ops" {
+//	  server            = "smtp.example.com:587"
+//	  username          = "certbuddy"
+//	  password_file     = "/run/secrets/smtp-password"
+//	  from              = "certbuddy@example.com"
+//	  to                = ["ops@example.com"]
+//	  # Alert after this many failed attempts in a row and at most once a day
+//	  failure_threshold = 3
+//	  interval          = "24h"
+//	  # Send a daily summary of all certificates instead of individual alerts
+//	  digest            = "24h"
+//	}
+//
+//	certificate "www" {
+//	  account      = "admin@example.com"
+//	  domains      = ["example.com", "www.example.com"]
+//	  key_path     = "/certs/www"
+//	  cert_path    = "/certs/www"
+//	  webroot      = "/webroot"
+//	  valid_before = 30
+//	  # Revoke the old certificate after "certbuddy reissue"
+//	  revoke_on_reissue = true
+//	  # Either key_type or key_types for dual certificates
+//	  key_types = ["rsa2048", "ec256"]
+//	  # Store the private key as PKCS#8 instead of PKCS#1 or SEC 1
+//	  key_format = "pkcs8"
+//	  # Encrypt the private key with the passphrase in this environment variable
+//	  key_passphrase_env = "WWW_KEY_PASSPHRASE"
+//	  # Generate a new private key at least every 90 days
+//	  key_rotation = "rotate-after-age"
+//	  key_max_age  = 90
+//	  # Number of issued certificates kept in the archive, 0 disables the archive
+//	  archive_versions = 5
+//
+//	  # Optional, stores the certificate and key in the Consul KV store instead
+//	  consul_storage {
+//	    address = "127.0.0.1:8500"
+//	    token   = "acl-token"
+//	    prefix  = "certs/www"
+//	  }
+//
+//	  # Optional, stores the certificate and key in a Vault KV v2 secret instead
+//	  vault {
+//	    address   = "https://vault.example.com:8200"
+//	    role_id   = "certbuddy"
+//	    secret_id = "..."
+//	    mount     = "secret"
+//	    path      = "certs/www"
+//	  }
+//
+//	  # Optional, names of the certificate and key files, see cert_path and key_path.
+//	  # Names and output paths may contain {domain}, {name} and {key_type}
+//	  cert_file_name  = "fullchain.pem"
+//	  key_file_name   = "privkey.pem"
+//	  leaf_file_name  = "cert.pem"
+//	  chain_file_name = "chain.pem"
+//
+//	  # Optional, mode and owner of the files in cert_path and key_path
+//	  permissions {
+//	    file_mode = "0640"
+//	    dir_mode  = "0750"
+//	    owner     = "certbuddy"
+//	    group     = "nginx"
+//	  }
+//
+//	  # Optional, additionally writes the certificate and key in other formats. Every
+//	  # output block adds a file in one of the formats pem, pem-combined, der or pkcs12
+//	  # and uses the permissions of the certificate unless it has its own block
+//	  output "pem-combined" {
+//	    path = "/etc/haproxy/certs/{domain}.pem"
+//	    permissions {
+//	      owner = "haproxy"
+//	    }
+//	  }
+//	  output "pkcs12" {
+//	    path          = "/opt/app/keystore.p12"
+//	    password_file = "/run/secrets/keystore-password"
+//	  }
+//
+//	  # Optional, additionally writes the certificate and key to a TLS Secret
+//	  kubernetes_secret {
+//	    name       = "www-tls"
+//	    namespace  = "web"
+//	    include_ca = true
+//	    labels {
+//	      team = "web"
+//	    }
+//	  }
+//
+//	  # Optional, commands run before and after the certificate is requested and after
+//	  # it has been issued or renewed
+//	  hooks {
+//	    pre     = ["systemctl stop nginx"]
+//	    post    = ["systemctl start nginx"]
+//	    deploy  = ["systemctl reload haproxy"]
+//	    timeout = "2m"
+//	  }
+//
+//	  # Optional, POSTs lifecycle events to webhooks, may be repeated
+//	  webhook "chat" {
+//	    url         = "https://chat.example.com/hooks/certbuddy"
+//	    secret_file = "/run/secrets/webhook-secret"
+//	    events      = ["renewal-failed", "expiring-soon", "revoked"]
+//	  }
+//	  # Days before expiration from which on an expiring-soon event is emitted
+//	  expiry_warning = 14
+//
+//	  registry {
+//	    address      = "127.0.0.1:8500"
+//	    service_name = "tls-certs"
+//	  }
+//
+//	  retry {
+//	    initial_interval = "5m"
+//	    max_interval     = "24h"
+//	    multiplier       = 2
+//	    jitter           = 0.2
+//	  }
+//	}
+//
+// Instead of a webroot a standalone block can be used to answer HTTP-01 challenges:
+//
+//	standalone {
+//	  address      = ":80"
+//	  keep_running = true
+//	}
+//
+// TLS-ALPN-01 challenges are answered on a listener or handed to a hook:
+//
+//	tls_alpn {
+//	  address = ":443"
+//	}
+//
+// Instead of or in addition to HTTP-01 a dns block can be used to solve DNS-01 challenges:
+//
+//	dns {
+//	  provider            = "rfc2136"
+//	  nameserver          = "ns1.example.com:53"
+//	  tsig_key            = "certbuddy"
+//	  tsig_secret         = "c2VjcmV0"
+//	  resolvers           = ["8.8.8.8:53"]
+//	  propagation_timeout = "2m"
+//	}
+type fileConfig struct {
+	Accounts     []accountConfig     `hcl:"account"`
+	Certificates []certificateConfig `hcl:"certificate"`
+	EmailAlerts  []emailAlertsConfig `hcl:"email_alerts"`
+}
+
+type accountConfig struct {
+	Email             string `hcl:",key"`
+	KeyPath           string `hcl:"key_path"`
+	KeyType           string `hcl:"key_type"`
+	KeyFormat         string `hcl:"key_format"`
+	KeyPassphraseFile string `hcl:"key_passphrase_file"`
+	KeyPassphraseEnv  string `hcl:"key_passphrase_env"`
+	Directory         string `hcl:"directory"`
+	CABundle          string `hcl:"ca_bundle"`
+}
+
+type certificateConfig struct {
+	Name              string            `hcl:",key"`
+	Account           string            `hcl:"account"`
+	Domains           []string          `hcl:"domains"`
+	KeyPath           string            `hcl:"key_path"`
+	CertPath          string            `hcl:"cert_path"`
+	Webroot           string            `hcl:"webroot"`
+	ValidBefore       int               `hcl:"valid_before"`
+	PreferredChain    string            `hcl:"preferred_chain"`
+	RevokeOnReissue   bool              `hcl:"revoke_on_reissue"`
+	KeyType           string            `hcl:"key_type"`
+	KeyTypes          []string          `hcl:"key_types"`
+	KeyFormat         string            `hcl:"key_format"`
+	KeyPassphraseFile string            `hcl:"key_passphrase_file"`
+	KeyPassphraseEnv  string            `hcl:"key_passphrase_env"`
+	KeyRotation       string            `hcl:"key_rotation"`
+	KeyMaxAge         int               `hcl:"key_max_age"`
+	ArchiveVersions   *int              `hcl:"archive_versions"`
+	Registry          registryConfig    `hcl:"registry"`
+	Retry             retryConfig       `hcl:"retry"`
+	DNS               dnsConfig         `hcl:"dns"`
+	Standalone        standaloneConfig  `hcl:"standalone"`
+	TLSALPN           tlsALPNConfig     `hcl:"tls_alpn"`
+	ConsulStorage     consulKVConfig    `hcl:"consul_storage"`
+	Vault             vaultConfig       `hcl:"vault"`
+	KubernetesSecret  kubernetesConfig  `hcl:"kubernetes_secret"`
+	CertFileName      string            `hcl:"cert_file_name"`
+	KeyFileName       string            `hcl:"key_file_name"`
+	LeafFileName      string            `hcl:"leaf_file_name"`
+	ChainFileName     string            `hcl:"chain_file_name"`
+	Permissions       permissionsConfig `hcl:"permissions"`
+	Outputs           []outputConfig    `hcl:"output"`
+	Hooks             hooksConfig       `hcl:"hooks"`
+	Webhooks          []webhookConfig   `hcl:"webhook"`
+	ExpiryWarning     *int              `hcl:"expiry_warning"`
+}
+
+type outputConfig struct {
+	Format       string            `hcl:",key"`
+	Path         string            `hcl:"path"`
+	KeyPath      string            `hcl:"key_path"`
+	PasswordFile string            `hcl:"password_file"`
+	PasswordEnv  string            `hcl:"password_env"`
+	Permissions  permissionsConfig `hcl:"permissions"`
+}
+
+type hooksConfig struct {
+	Pre     []string `hcl:"pre"`
+	Post    []string `hcl:"post"`
+	Deploy  []string `hcl:"deploy"`
+	Timeout string   `hcl:"timeout"`
+}
+
+// apply validates the hooks block and sets the hooks of the given config.
+func (h hooksConfig) apply(config *BuddyConfig) []error {
+	var errs []error
+	for _, commands := range [][]string{h.Pre, h.Post, h.Deploy} {
+		for _, command := range commands {
+			if strings.TrimSpace(command) == "" {
+				errs = append(errs, errors.New("hooks: commands may not be empty"))
+			}
+		}
+	}
+	config.Hooks = hook.Config{Pre: h.Pre, Post: h.Post, Deploy: h.Deploy}
+	if h.Timeout != "" {
+		timeout, err := time.ParseDuration(h.Timeout)
+		if err != nil || timeout <= 0 {
+			errs = append(errs, fmt.Errorf("hooks: invalid timeout %q", h.Timeout))
+		}
+		config.Hooks.Timeout = timeout
+	}
+	return errs
+}
+
+type webhookConfig struct {
+	Name       string   `hcl:",key"`
+	URL        string   `hcl:"url"`
+	SecretFile string   `hcl:"secret_file"`
+	SecretEnv  string   `hcl:"secret_env"`
+	Events     []string `hcl:"events"`
+	Retries    int      `hcl:"retries"`
+	Timeout    string   `hcl:"timeout"`
+}
+
+// webhook validates a webhook block.
+func (w webhookConfig) webhook() (webhook.Config, []error) {
+	var errs []error
+	config := webhook.Config{
+		URL:     w.URL,
+		Secret:  certbuddy.PassphraseSource{File: w.SecretFile, Env: w.SecretEnv},
+		Retries: w.Retries,
+	}
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("invalid url %q", w.URL))
+	}
+	if w.SecretFile != "" && w.SecretEnv != "" {
+		errs = append(errs, errors.New("secret_file and secret_env can't be combined"))
+	}
+	var err error
+	if config.Events, err = parseEventTypes(w.Events); err != nil {
+		errs = append(errs, err)
+	}
+	if w.Timeout != "" {
+		timeout, err := time.ParseDuration(w.Timeout)
+		if err != nil || timeout <= 0 {
+			errs = append(errs, fmt.Errorf("invalid timeout %q", w.Timeout))
+		}
+		config.Timeout = timeout
+	}
+	return config, errs
+}
+
+type emailAlertsConfig struct {
+	Name             string   `hcl:",key"`
+	Server           string   `hcl:"server"`
+	Username         string   `hcl:"username"`
+	PasswordFile     string   `hcl:"password_file"`
+	PasswordEnv      string   `hcl:"password_env"`
+	From             string   `hcl:"from"`
+	To               []string `hcl:"to"`
+	FailureThreshold int      `hcl:"failure_threshold"`
+	Interval         string   `hcl:"interval"`
+	Digest           string   `hcl:"digest"`
+}
+
+// alerts validates an email_alerts block.
+func (a emailAlertsConfig) alerts() (mail.Config, []error) {
+	var errs []error
+	config := mail.Config{
+		Name:             a.Name,
+		Server:           a.Server,
+		Username:         a.Username,
+		Password:         certbuddy.PassphraseSource{File: a.PasswordFile, Env: a.PasswordEnv},
+		From:             a.From,
+		To:               a.To,
+		FailureThreshold: a.FailureThreshold,
+	}
+	if err := config.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if a.FailureThreshold < 0 {
+		errs = append(errs, errors.New("failure_threshold may not be negative"))
+	}
+	if a.Interval != "" {
+		interval, err := time.ParseDuration(a.Interval)
+		if err != nil || interval <= 0 {
+			errs = append(errs, fmt.Errorf("invalid interval %q", a.Interval))
+		}
+		config.Interval = interval
+	}
+	if a.Digest != "" {
+		digest, err := time.ParseDuration(a.Digest)
+		if err != nil || digest <= 0 {
+			errs = append(errs, fmt.Errorf("invalid digest %q", a.Digest))
+		}
+		config.Digest = digest
+	}
+	return config, errs
+}
+
+// parseEventTypes parses a list of event names.
+func parseEventTypes(names []string) ([]certbuddy.EventType, error) {
+	var eventTypes []certbuddy.EventType
+	for _, name := range names {
+		eventType, err := certbuddy.ParseEventType(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		eventTypes = append(eventTypes, eventType)
+	}
+	return eventTypes, nil
+}
+
+type permissionsConfig struct {
+	FileMode string `hcl:"file_mode"`
+	DirMode  string `hcl:"dir_mode"`
+	Owner    string `hcl:"owner"`
+	Group    string `hcl:"group"`
+}
+
+// permissions parses the modes of a permissions block.
+func (p permissionsConfig) permissions() (file.Permissions, []error) {
+	var errs []error
+	perm := file.Permissions{Owner: p.Owner, Group: p.Group}
+	if p.FileMode != "" {
+		mode, err := file.ParseFileMode(p.FileMode)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("permissions: invalid file_mode %q", p.FileMode))
+		}
+		perm.FileMode = mode
+	}
+	if p.DirMode != "" {
+		mode, err := file.ParseFileMode(p.DirMode)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("permissions: invalid dir_mode %q", p.DirMode))
+		}
+		perm.DirMode = mode
+	}
+	return perm, errs
+}
+
+// validateOutput checks an output before any file is written.
+func validateOutput(output file.OutputConfig) error {
+	if _, err := file.ParseFormat(string(output.Format)); err != nil {
+		return err
+	}
+	if output.Path == "" {
+		return errors.New("path may not be empty")
+	}
+	for _, template := range []string{output.Path, output.KeyPath} {
+		if err := file.ValidateTemplate(template); err != nil {
+			return err
+		}
+	}
+	if output.KeyPath != "" && output.Format != file.FormatPEM && output.Format != file.FormatDER {
+		return fmt.Errorf("key_path isn't supported by the %s format, which contains the private key", output.Format)
+	}
+	if output.Format == file.FormatPKCS12 && output.Password == (certbuddy.PassphraseSource{}) {
+		return errors.New("the pkcs12 format requires a password")
+	}
+	if output.Password.File != "" && output.Password.Env != "" {
+		return errors.New("password_file and password_env can't be combined")
+	}
+	return nil
+}
+
+type kubernetesConfig struct {
+	Name        string            `hcl:"name"`
+	Namespace   string            `hcl:"namespace"`
+	Kubeconfig  string            `hcl:"kubeconfig"`
+	Context     string            `hcl:"context"`
+	IncludeCA   bool              `hcl:"include_ca"`
+	Labels      map[string]string `hcl:"labels"`
+	Annotations map[string]string `hcl:"annotations"`
+}
+
+func (k kubernetesConfig) enabled() bool {
+	return k.Name != "" || k.Namespace != "" || k.Kubeconfig != "" || k.Context != "" || k.IncludeCA ||
+		len(k.Labels) > 0 || len(k.Annotations) > 0
+}
+
+type vaultConfig struct {
+	Address      string `hcl:"address"`
+	Token        string `hcl:"token"`
+	RoleID       string `hcl:"role_id"`
+	SecretID     string `hcl:"secret_id"`
+	AppRoleMount string `hcl:"approle_mount"`
+	Namespace    string `hcl:"namespace"`
+	Mount        string `hcl:"mount"`
+	Path         string `hcl:"path"`
+	CACert       string `hcl:"ca_cert"`
+}
+
+// apply validates the Vault block and sets the Vault storage of the given config.
+func (v vaultConfig) apply(config *BuddyConfig) []error {
+	var errs []error
+	if v.Address == "" {
+		errs = append(errs, errors.New("vault: address may not be empty"))
+	}
+	if v.Path == "" {
+		errs = append(errs, errors.New("vault: path may not be empty"))
+	}
+	if v.Token == "" && (v.RoleID == "" || v.SecretID == "") {
+		errs = append(errs, errors.New("vault: either token or role_id and secret_id have to be specified"))
+	}
+	config.Vault = &vault.Config{
+		Address:      v.Address,
+		Token:        v.Token,
+		RoleID:       v.RoleID,
+		SecretID:     v.SecretID,
+		AppRoleMount: v.AppRoleMount,
+		Namespace:    v.Namespace,
+		Mount:        v.Mount,
+		Path:         v.Path,
+		CACert:       v.CACert,
+	}
+	return errs
+}
+
+type consulKVConfig struct {
+	Address string `hcl:"address"`
+	Token   string `hcl:"token"`
+	Prefix  string `hcl:"prefix"`
+}
+
+type tlsALPNConfig struct {
+	Address string `hcl:"address"`
+	Hook    string `hcl:"hook"`
+}
+
+type standaloneConfig struct {
+	Address     string `hcl:"address"`
+	KeepRunning bool   `hcl:"keep_running"`
+}
+
+type registryConfig struct {
+	Address     string `hcl:"address"`
+	ServiceName string `hcl:"service_name"`
+}
+
+type retryConfig struct {
+	InitialInterval string  `hcl:"initial_interval"`
+	MaxInterval     string  `hcl:"max_interval"`
+	Multiplier      float64 `hcl:"multiplier"`
+	Jitter          float64 `hcl:"jitter"`
+}
+
+type dnsConfig struct {
+	Provider           string   `hcl:"provider"`
+	Nameserver         string   `hcl:"nameserver"`
+	Zone               string   `hcl:"zone"`
+	TSIGKey            string   `hcl:"tsig_key"`
+	TSIGSecret         string   `hcl:"tsig_secret"`
+	TSIGAlgorithm      string   `hcl:"tsig_algorithm"`
+	Resolvers          []string `hcl:"resolvers"`
+	PropagationTimeout string   `hcl:"propagation_timeout"`
+}
+
+func (d dnsConfig) enabled() bool {
+	return d.Provider != "" || d.Nameserver != ""
+}
+
+// apply sets the DNS challenge options of the given config.
+func (d dnsConfig) apply(config *BuddyConfig) []error {
+	var errs []error
+	if d.Provider != "" && d.Provider != "rfc2136" {
+		errs = append(errs, fmt.Errorf("dns: unsupported provider %q, expected rfc2136", d.Provider))
+	}
+	if d.Nameserver == "" {
+		errs = append(errs, errors.New("dns: nameserver may not be empty"))
+	}
+	if (d.TSIGKey == "") != (d.TSIGSecret == "") {
+		errs = append(errs, errors.New("dns: tsig_key and tsig_secret have to be specified together"))
+	}
+	if d.PropagationTimeout != "" {
+		timeout, err := time.ParseDuration(d.PropagationTimeout)
+		if err != nil || timeout <= 0 {
+			errs = append(errs, fmt.Errorf("dns: invalid propagation_timeout %q", d.PropagationTimeout))
+		}
+		config.DNSPropagationTimeout = timeout
+	}
+	config.RFC2136 = &rfc2136.Config{
+		Nameserver:    d.Nameserver,
+		Zone:          d.Zone,
+		TSIGKey:       d.TSIGKey,
+		TSIGSecret:    d.TSIGSecret,
+		TSIGAlgorithm: d.TSIGAlgorithm,
+	}
+	config.DNSResolvers = d.Resolvers
+	return errs
+}
+
+func (r retryConfig) retryPolicy() (certbuddy.RetryPolicy, []error) {
+	var errs []error
+	policy := certbuddy.DefaultRetryPolicy
+	if r.InitialInterval != "" {
+		interval, err := time.ParseDuration(r.InitialInterval)
+		if err != nil || interval <= 0 {
+			errs = append(errs, fmt.Errorf("retry: invalid initial_interval %q", r.InitialInterval))
+		}
+		policy.InitialInterval = interval
+	}
+	if r.MaxInterval != "" {
+		interval, err := time.ParseDuration(r.MaxInterval)
+		if err != nil || interval <= 0 {
+			errs = append(errs, fmt.Errorf("retry: invalid max_interval %q", r.MaxInterval))
+		}
+		policy.MaxInterval = interval
+	}
+	if len(errs) == 0 && policy.InitialInterval > policy.MaxInterval {
+		errs = append(errs, fmt.Errorf("retry: initial_interval %s may not be longer than max_interval %s", policy.InitialInterval, policy.MaxInterval))
+	}
+	if r.Multiplier != 0 {
+		if r.Multiplier < 1 {
+			errs = append(errs, errors.New("retry: multiplier must be at least 1"))
+		}
+		policy.Multiplier = r.Multiplier
+	}
+	if r.Jitter != 0 {
+		if r.Jitter < 0 || r.Jitter >= 1 {
+			errs = append(errs, errors.New("retry: jitter must be between 0 and 1"))
+		}
+		policy.Jitter = r.Jitter
+	}
+	return policy, errs
+}
+
+// configErrors collects all problems found in a config file, so the user can fix
+// them in one go instead of one by one.
+type configErrors []error
+
+func (c configErrors) Error() string {
+	msgs := make([]string, 0, len(c))
+	for _, err := range c {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d error(s) in config file:\n\t%s", len(c), strings.Join(msgs, "\n\t"))
+}
+
+// LoadConfigFile reads a HCL or JSON config file and returns a BuddyConfig for every
+// certificate defined in it.
+func LoadConfigFile(configPath string) ([]BuddyConfig, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read config file")
+	}
+	return ParseConfig(string(data))
+}
+
+// ParseConfig parses the content of a config file, validates it and maps every
+// certificate block onto a BuddyConfig.
+func ParseConfig(data string) ([]BuddyConfig, error) {
+	root, err := hcl.Parse(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse config file")
+	}
+	if errs := validateSchema(root); len(errs) > 0 {
+		return nil, errs
+	}
+
+	var fc fileConfig
+	if err := hcl.DecodeObject(&fc, root); err != nil {
+		return nil, errors.Wrap(err, "Unable to decode config file")
+	}
+	return fc.buddyConfigs()
+}
+
+func (f *fileConfig) buddyConfigs() ([]BuddyConfig, error) {
+	var errs configErrors
+
+	accounts := make(map[string]accountConfig)
+	for _, account := range f.Accounts {
+		if _, exists := accounts[account.Email]; exists {
+			errs = append(errs, fmt.Errorf("account %q: defined more than once", account.Email))
+			continue
+		}
+		if account.KeyPath == "" {
+			errs = append(errs, fmt.Errorf("account %q: key_path may not be empty", account.Email))
+		}
+		if _, err := certbuddy.ParseKeyType(account.KeyType); err != nil {
+			errs = append(errs, fmt.Errorf("account %q: %s", account.Email, err))
+		}
+		if _, err := certbuddy.ParseKeyFormat(account.KeyFormat); err != nil {
+			errs = append(errs, fmt.Errorf("account %q: %s", account.Email, err))
+		}
+		if account.KeyPassphraseFile != "" && account.KeyPassphraseEnv != "" {
+			errs = append(errs, fmt.Errorf("account %q: key_passphrase_file and key_passphrase_env can't be combined", account.Email))
+		}
+		if _, err := acme.ResolveDirectoryURL(account.Directory); err != nil {
+			errs = append(errs, fmt.Errorf("account %q: invalid directory: %s", account.Email, err))
+		}
+		accounts[account.Email] = account
+	}
+
+	if len(f.Certificates) == 0 {
+		errs = append(errs, errors.New("no certificate defined"))
+	}
+
+	var alerts []mail.Config
+	alertNames := make(map[string]bool)
+	for _, a := range f.EmailAlerts {
+		prefix := fmt.Sprintf("email_alerts %q", a.Name)
+		if alertNames[a.Name] {
+			errs = append(errs, fmt.Errorf("%s: defined more than once", prefix))
+			continue
+		}
+		alertNames[a.Name] = true
+		alertConfig, alertErrs := a.alerts()
+		for _, err := range alertErrs {
+			errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+		}
+		alerts = append(alerts, alertConfig)
+	}
+
+	names := make(map[string]bool)
+	configs := make([]BuddyConfig, 0, len(f.Certificates))
+	for _, cert := range f.Certificates {
+		prefix := fmt.Sprintf("certificate %q", cert.Name)
+		if names[cert.Name] {
+			errs = append(errs, fmt.Errorf("%s: defined more than once", prefix))
+			continue
+		}
+		names[cert.Name] = true
+
+		accountName := cert.Account
+		if accountName == "" && len(f.Accounts) == 1 {
+			accountName = f.Accounts[0].Email
+		}
+		account, found := accounts[accountName]
+		if !found {
+			if accountName == "" {
+				errs = append(errs, fmt.Errorf("%s: account must be specified if not exactly one account is defined", prefix))
+			} else {
+				errs = append(errs, fmt.Errorf("%s: unknown account %q", prefix, accountName))
+			}
+		}
+
+		if len(cert.Domains) == 0 {
+			errs = append(errs, fmt.Errorf("%s: domains may not be empty", prefix))
+		}
+		for _, domain := range cert.Domains {
+			if strings.TrimSpace(domain) == "" {
+				errs = append(errs, fmt.Errorf("%s: domains may not contain empty entries", prefix))
+				break
+			}
+		}
+		if cert.KeyPath == "" {
+			errs = append(errs, fmt.Errorf("%s: key_path may not be empty", prefix))
+		}
+		if cert.CertPath == "" {
+			errs = append(errs, fmt.Errorf("%s: cert_path may not be empty", prefix))
+		}
+		if cert.Webroot == "" && cert.Standalone.Address == "" && cert.TLSALPN == (tlsALPNConfig{}) && !cert.DNS.enabled() {
+			errs = append(errs, fmt.Errorf("%s: one of webroot, a standalone, tls_alpn or dns block has to be specified", prefix))
+		}
+		if cert.TLSALPN.Address != "" && cert.TLSALPN.Hook != "" {
+			errs = append(errs, fmt.Errorf("%s: tls_alpn: address and hook can't be combined", prefix))
+		}
+		if cert.Webroot != "" && cert.Standalone.Address != "" {
+			errs = append(errs, fmt.Errorf("%s: webroot and standalone can't be combined", prefix))
+		}
+		if cert.ConsulStorage != (consulKVConfig{}) && cert.ConsulStorage.Prefix == "" {
+			errs = append(errs, fmt.Errorf("%s: consul_storage: prefix may not be empty", prefix))
+		}
+		if cert.Standalone.KeepRunning && cert.Standalone.Address == "" {
+			errs = append(errs, fmt.Errorf("%s: standalone: address may not be empty", prefix))
+		}
+		if cert.KeyPassphraseFile != "" && cert.KeyPassphraseEnv != "" {
+			errs = append(errs, fmt.Errorf("%s: key_passphrase_file and key_passphrase_env can't be combined", prefix))
+		}
+		if cert.ValidBefore < 0 {
+			errs = append(errs, fmt.Errorf("%s: valid_before may not be negative", prefix))
+		}
+
+		retryPolicy, retryErrs := cert.Retry.retryPolicy()
+		for _, err := range retryErrs {
+			errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+		}
+
+		keyTypeNames := cert.KeyTypes
+		if cert.KeyType != "" {
+			if len(keyTypeNames) > 0 {
+				errs = append(errs, fmt.Errorf("%s: key_type and key_types can't be combined", prefix))
+			}
+			keyTypeNames = []string{cert.KeyType}
+		}
+		keyTypes, err := parseKeyTypes(keyTypeNames)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+		}
+		accountKeyType, _ := certbuddy.ParseKeyType(account.KeyType)
+		accountKeyFormat, _ := certbuddy.ParseKeyFormat(account.KeyFormat)
+		keyFormat, err := certbuddy.ParseKeyFormat(cert.KeyFormat)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+		}
+		keyRotation, err := keyRotationPolicy(cert.KeyRotation, cert.KeyMaxAge)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+		}
+		archiveVersions := 0
+		if cert.ArchiveVersions != nil {
+			archiveVersions = *cert.ArchiveVersions
+		}
+		if archiveVersions < 0 {
+			errs = append(errs, fmt.Errorf("%s: archive_versions may not be negative", prefix))
+		}
+
+		validBefore := cert.ValidBefore
+		if validBefore == 0 {
+			validBefore = defaultValidBeforeDays
+		}
+
+		config := BuddyConfig{
+			Name:                  cert.Name,
+			Email:                 account.Email,
+			AccountKeyPath:        account.KeyPath,
+			Directory:             account.Directory,
+			CABundlePath:          account.CABundle,
+			Domains:               cert.Domains,
+			KeyPath:               cert.KeyPath,
+			CertPath:              cert.CertPath,
+			WebrootPath:           cert.Webroot,
+			StandaloneAddress:     cert.Standalone.Address,
+			StandaloneKeepRunning: cert.Standalone.KeepRunning,
+			TLSALPNAddress:        cert.TLSALPN.Address,
+			TLSALPNHook:           cert.TLSALPN.Hook,
+			ValidBefore:           time.Hour * 24 * time.Duration(validBefore),
+			ServiceName:           defaultServiceName,
+			RetryPolicy:           retryPolicy,
+			PreferredChain:        cert.PreferredChain,
+			RevokeOnReissue:       cert.RevokeOnReissue,
+			AccountKeyType:        accountKeyType,
+			AccountKeyFormat:      accountKeyFormat,
+			KeyFormat:             keyFormat,
+			AccountKeyPassphrase:  certbuddy.PassphraseSource{File: account.KeyPassphraseFile, Env: account.KeyPassphraseEnv},
+			KeyPassphrase:         certbuddy.PassphraseSource{File: cert.KeyPassphraseFile, Env: cert.KeyPassphraseEnv},
+			KeyRotation:           keyRotation,
+			ArchiveVersions:       archiveVersions,
+		}
+		if cert.DNS.enabled() {
+			for _, err := range cert.DNS.apply(&config) {
+				errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+			}
+		}
+		if len(config.challengeTypes()) > 0 {
+			if err := acme.ValidateDomains(cert.Domains, config.challengeTypes()); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+			}
+		}
+		config.RegistryAddress = cert.Registry.Address
+		config.ConsulKVAddress = cert.ConsulStorage.Address
+		config.ConsulKVToken = cert.ConsulStorage.Token
+		config.ConsulKVPrefix = cert.ConsulStorage.Prefix
+		if cert.KubernetesSecret.enabled() {
+			if cert.KubernetesSecret.Name == "" {
+				errs = append(errs, fmt.Errorf("%s: kubernetes_secret: name may not be empty", prefix))
+			}
+			config.KubernetesSecret = &kubernetes.Config{
+				Name:        cert.KubernetesSecret.Name,
+				Namespace:   cert.KubernetesSecret.Namespace,
+				IncludeCA:   cert.KubernetesSecret.IncludeCA,
+				Labels:      cert.KubernetesSecret.Labels,
+				Annotations: cert.KubernetesSecret.Annotations,
+			}
+			config.Kubeconfig = cert.KubernetesSecret.Kubeconfig
+			config.KubeContext = cert.KubernetesSecret.Context
+		}
+		if cert.Vault != (vaultConfig{}) {
+			if cert.ConsulStorage != (consulKVConfig{}) {
+				errs = append(errs, fmt.Errorf("%s: vault and consul_storage can't be combined", prefix))
+			}
+			for _, err := range cert.Vault.apply(&config) {
+				errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+			}
+		}
+		if cert.Registry.ServiceName != "" {
+			config.ServiceName = cert.Registry.ServiceName
+		}
+		for _, err := range cert.Hooks.apply(&config) {
+			errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+		}
+		config.EmailAlerts = alerts
+		for _, w := range cert.Webhooks {
+			target, targetErrs := w.webhook()
+			for _, err := range targetErrs {
+				errs = append(errs, fmt.Errorf("%s: webhook %q: %s", prefix, w.Name, err))
+			}
+			config.Webhooks = append(config.Webhooks, target)
+		}
+		expiryWarning := defaultExpiryWarningDays
+		if cert.ExpiryWarning != nil {
+			expiryWarning = *cert.ExpiryWarning
+		}
+		if expiryWarning < 0 {
+			errs = append(errs, fmt.Errorf("%s: expiry_warning may not be negative", prefix))
+		}
+		config.ExpiryWarning = time.Hour * 24 * time.Duration(expiryWarning)
+		config.CertFileName = cert.CertFileName
+		config.KeyFileName = cert.KeyFileName
+		config.LeafFileName = cert.LeafFileName
+		config.ChainFileName = cert.ChainFileName
+		for _, name := range []string{cert.CertFileName, cert.KeyFileName, cert.LeafFileName, cert.ChainFileName} {
+			if err := file.ValidateTemplate(name); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+			}
+		}
+		var permErrs []error
+		config.Permissions, permErrs = cert.Permissions.permissions()
+		for _, err := range permErrs {
+			errs = append(errs, fmt.Errorf("%s: %s", prefix, err))
+		}
+		for i, o := range cert.Outputs {
+			output := file.OutputConfig{
+				Format:      file.Format(strings.ToLower(o.Format)),
+				Path:        o.Path,
+				KeyPath:     o.KeyPath,
+				Password:    certbuddy.PassphraseSource{File: o.PasswordFile, Env: o.PasswordEnv},
+				Permissions: config.Permissions,
+			}
+			if err := validateOutput(output); err != nil {
+				errs = append(errs, fmt.Errorf("%s: output %d: %s", prefix, i+1, err))
+			}
+			if o.Permissions != (permissionsConfig{}) {
+				output.Permissions, permErrs = o.Permissions.permissions()
+				for _, err := range permErrs {
+					errs = append(errs, fmt.Errorf("%s: output %d: %s", prefix, i+1, err))
+				}
+			}
+			config.Outputs = append(config.Outputs, output)
+		}
+		configs = append(configs, expandKeyTypes(config, keyTypes)...)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return configs, nil
+}
+
+// keyRotationPolicy creates the key rotation policy for the given mode and maximum age
+// in days.
+func keyRotationPolicy(mode string, maxAgeDays int) (certbuddy.KeyRotationPolicy, error) {
+	policy := certbuddy.KeyRotationPolicy{MaxAge: time.Hour * 24 * time.Duration(maxAgeDays)}
+	var err error
+	if policy.Mode, err = certbuddy.ParseKeyRotationMode(mode); err != nil {
+		return policy, err
+	}
+	if maxAgeDays < 0 {
+		return policy, errors.New("The maximum key age may not be negative")
+	}
+	if policy.Mode == certbuddy.KeyRotateAfterAge && maxAgeDays == 0 {
+		return policy, fmt.Errorf("A maximum key age is required for %s", certbuddy.KeyRotateAfterAge)
+	}
+	return policy, nil
+}
+
+// parseKeyTypes parses a list of key type names, defaulting to DefaultKeyType.
+func parseKeyTypes(names []string) ([]certbuddy.KeyType, error) {
+	if len(names) == 0 {
+		return []certbuddy.KeyType{certbuddy.DefaultKeyType}, nil
+	}
+	keyTypes := make([]certbuddy.KeyType, 0, len(names))
+	for _, name := range names {
+		keyType, err := certbuddy.ParseKeyType(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		for _, existing := range keyTypes {
+			if existing == keyType {
+				return nil, fmt.Errorf("Key type %s is specified more than once", keyType)
+			}
+		}
+		keyTypes = append(keyTypes, keyType)
+	}
+	return keyTypes, nil
+}
+
+// expandKeyTypes returns a config for every key type. If there is more than one, each
+// certificate is stored in a subdirectory named after its key type, so for example dual
+// RSA and ECDSA certificates can be issued for the same domains.
+func expandKeyTypes(config BuddyConfig, keyTypes []certbuddy.KeyType) []BuddyConfig {
+	if len(keyTypes) == 1 {
+		config.KeyType = keyTypes[0]
+		return []BuddyConfig{config}
+	}
+	configs := make([]BuddyConfig, 0, len(keyTypes))
+	for _, keyType := range keyTypes {
+		c := config
+		c.Name = fmt.Sprintf("%s-%s", config.Name, keyType)
+		c.KeyType = keyType
+		c.KeyPath = path.Join(config.KeyPath, string(keyType))
+		c.CertPath = path.Join(config.CertPath, string(keyType))
+		if config.ConsulKVPrefix != "" {
+			c.ConsulKVPrefix = path.Join(config.ConsulKVPrefix, string(keyType))
+		}
+		if config.KubernetesSecret != nil {
+			secretConfig := *config.KubernetesSecret
+			secretConfig.Name = fmt.Sprintf("%s-%s", secretConfig.Name, keyType)
+			c.KubernetesSecret = &secretConfig
+		}
+		if config.Vault != nil {
+			vaultConfig := *config.Vault
+			vaultConfig.Path = path.Join(vaultConfig.Path, string(keyType))
+			c.Vault = &vaultConfig
+		}
+		c.Outputs = nil
+		for _, output := range config.Outputs {
+			if strings.Contains(output.Path, "{key_type}") {
+				// The template already separates the outputs of the key types
+				c.Outputs = append(c.Outputs, output)
+				continue
+			}
+			output.Path = path.Join(path.Dir(output.Path), string(keyType), path.Base(output.Path))
+			if output.KeyPath != "" {
+				output.KeyPath = path.Join(path.Dir(output.KeyPath), string(keyType), path.Base(output.KeyPath))
+			}
+			c.Outputs = append(c.Outputs, output)
+		}
+		configs = append(configs, c)
+	}
+	return configs
+}
+
+// validateSchema checks that only known blocks and keys are used in the config file,
+// so typos don't silently fall back to default values.
+func validateSchema(root *ast.File) configErrors {
+	var errs configErrors
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return append(errs, errors.New("config file has to be an object"))
+	}
+	for _, item := range list.Items {
+		key := item.Keys[0].Token.Value().(string)
+		if !contains(topLevelKeys, key) {
+			errs = append(errs, fmt.Errorf("line %d: unknown block %q", item.Pos().Line, key))
+			continue
+		}
+		if len(item.Keys) != 2 {
+			errs = append(errs, fmt.Errorf("line %d: %s block needs exactly one name", item.Pos().Line, key))
+			continue
+		}
+		name := fmt.Sprintf("%s %q", key, item.Keys[1].Token.Value().(string))
+		switch key {
+		case "account":
+			errs = append(errs, checkKeys(name, item.Val, accountKeys)...)
+		case "email_alerts":
+			errs = append(errs, checkKeys(name, item.Val, emailAlertsKeys)...)
+		case "certificate":
+			errs = append(errs, checkKeys(name, item.Val, certificateKeys)...)
+			if obj, ok := item.Val.(*ast.ObjectType); ok {
+				errs = append(errs, checkBlock(name, obj, "registry", registryKeys)...)
+				errs = append(errs, checkBlock(name, obj, "retry", retryKeys)...)
+				errs = append(errs, checkBlock(name, obj, "dns", dnsKeys)...)
+				errs = append(errs, checkBlock(name, obj, "standalone", standaloneKeys)...)
+				errs = append(errs, checkBlock(name, obj, "tls_alpn", tlsALPNKeys)...)
+				errs = append(errs, checkBlock(name, obj, "consul_storage", consulKVKeys)...)
+				errs = append(errs, checkBlock(name, obj, "vault", vaultKeys)...)
+				errs = append(errs, checkBlock(name, obj, "kubernetes_secret", kubernetesKeys)...)
+				errs = append(errs, checkBlock(name, obj, "permissions", permissionsKeys)...)
+				errs = append(errs, checkBlock(name, obj, "hooks", hooksKeys)...)
+				for _, item := range obj.List.Filter("webhook").Items {
+					if len(item.Keys) != 1 {
+						errs = append(errs, fmt.Errorf("line %d: %s: webhook block needs exactly one name", item.Pos().Line, name))
+						continue
+					}
+					errs = append(errs, checkKeys(name+": webhook", item.Val, webhookKeys)...)
+				}
+				for _, output := range obj.List.Filter("output").Items {
+					if len(output.Keys) != 1 {
+						errs = append(errs, fmt.Errorf("line %d: %s: output block needs exactly one format", output.Pos().Line, name))
+						continue
+					}
+					errs = append(errs, checkKeys(name+": output", output.Val, outputKeys)...)
+					if outputObj, ok := output.Val.(*ast.ObjectType); ok {
+						errs = append(errs, checkBlock(name+": output", outputObj, "permissions", permissionsKeys)...)
+					}
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// checkBlock validates the keys of an optional nested block, which may appear only once.
+func checkBlock(name string, obj *ast.ObjectType, block string, allowed []string) configErrors {
+	var errs configErrors
+	items := obj.List.Filter(block).Items
+	if len(items) > 1 {
+		errs = append(errs, fmt.Errorf("line %d: %s: only one %s block is allowed", items[1].Pos().Line, name, block))
+	}
+	for _, item := range items {
+		errs = append(errs, checkKeys(name+": "+block, item.Val, allowed)...)
+	}
+	return errs
+}
+
+func checkKeys(name string, node ast.Node, allowed []string) configErrors {
+	var errs configErrors
+	obj, ok := node.(*ast.ObjectType)
+	if !ok {
+		return append(errs, fmt.Errorf("line %d: %s has to be a block", node.Pos().Line, name))
+	}
+	for _, item := range obj.List.Items {
+		key := item.Keys[0].Token.Value().(string)
+		if !contains(allowed, key) {
+			errs = append(errs, fmt.Errorf("line %d: %s: unknown key %q, expected one of %s",
+				item.Pos().Line, name, key, strings.Join(allowed, ", ")))
+		}
+	}
+	return errs
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1109 @@
+package main
+
+import (
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/acme"
+	"github.com/connctd/certbuddy/file"
+	"github.com/connctd/certbuddy/hook"
+	"github.com/connctd/certbuddy/kubernetes"
+	"github.com/connctd/certbuddy/mail"
+	"github.com/connctd/certbuddy/vault"
+	"github.com/connctd/certbuddy/webhook"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var testConfig = `
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com", "www.example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+}
+
+certificate "api" {
+  account      = "admin@example.com"
+  domains      = ["api.example.com"]
+  key_path     = "/certs/api"
+  cert_path    = "/certs/api"
+  webroot      = "/webroot"
+  valid_before = 10
+
+  registry {
+    address      = "127.0.0.1:8500"
+    service_name = "api-certs"
+  }
+
+  retry {
+    initial_interval = "1m"
+    max_interval     = "1h"
+  }
+}
+`
+
+func TestParseConfig(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(testConfig)
+	assert.Nil(err)
+	assert.Len(configs, 2)
+
+	assert.Equal("admin@example.com", configs[0].Email)
+	assert.Equal("/user/account.key", configs[0].AccountKeyPath)
+	assert.Equal([]string{"example.com", "www.example.com"}, configs[0].Domains)
+	assert.Equal(time.Hour*24*30, configs[0].ValidBefore)
+	assert.Equal("tls-certs", configs[0].ServiceName)
+	assert.Equal("", configs[0].RegistryAddress)
+
+	assert.Equal(time.Hour*24*10, configs[1].ValidBefore)
+	assert.Equal("127.0.0.1:8500", configs[1].RegistryAddress)
+	assert.Equal("api-certs", configs[1].ServiceName)
+
+	assert.Equal(certbuddy.DefaultRetryPolicy, configs[0].RetryPolicy)
+	assert.Equal(time.Minute, configs[1].RetryPolicy.InitialInterval)
+	assert.Equal(time.Hour, configs[1].RetryPolicy.MaxInterval)
+	assert.Equal(certbuddy.DefaultRetryPolicy.Multiplier, configs[1].RetryPolicy.Multiplier)
+}
+
+func TestParseJsonConfig(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`{
+  "account": {"admin@example.com": {"key_path": "/user/account.key"}},
+  "certificate": {
+    "www": {
+      "domains": ["example.com"],
+      "key_path": "/certs/www",
+      "cert_path": "/certs/www",
+      "webroot": "/webroot"
+    }
+  }
+}`)
+	assert.Nil(err)
+	assert.Len(configs, 1)
+	assert.Equal("admin@example.com", configs[0].Email)
+	assert.Equal([]string{"example.com"}, configs[0].Domains)
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	assert := assert.New(t)
+	_, err := ParseConfig(`
+account "admin@example.com" {
+  key_pth = "/user/account.key"
+}
+
+certificate "www" {
+  account   = "other@example.com"
+  key_path  = "/certs/www"
+}
+`)
+	errs, ok := err.(configErrors)
+	assert.True(ok)
+	assert.Len(errs, 1)
+	assert.Contains(errs[0].Error(), `unknown key "key_pth"`)
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  account   = "other@example.com"
+  key_path  = "/certs/www"
+}
+`)
+	errs, ok = err.(configErrors)
+	assert.True(ok)
+	assert.Len(errs, 4)
+	assert.Contains(err.Error(), `certificate "www": unknown account "other@example.com"`)
+	assert.Contains(err.Error(), `certificate "www": domains may not be empty`)
+	assert.Contains(err.Error(), `certificate "www": cert_path may not be empty`)
+	assert.Contains(err.Error(), `certificate "www": one of webroot, a standalone, tls_alpn or dns block has to be specified`)
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  retry {
+    initial_interval = "2h"
+    max_interval     = "1h"
+  }
+}
+`)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `certificate "www": retry: initial_interval 2h0m0s may not be longer than max_interval 1h0m0s`)
+	}
+}
+
+func TestParseConfigStandalone(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+
+  standalone {
+    address      = ":8080"
+    keep_running = true
+  }
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 1) {
+		assert.Equal(":8080", configs[0].StandaloneAddress)
+		assert.True(configs[0].StandaloneKeepRunning)
+		assert.Equal([]string{acme.ChallengeHTTP01}, configs[0].challengeTypes())
+	}
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  standalone {
+    address = ":8080"
+  }
+}
+`)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `certificate "www": webroot and standalone can't be combined`)
+}
+
+func TestParseConfigTLSALPN(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "edge" {
+  domains   = ["edge.example.com"]
+  key_path  = "/certs/edge"
+  cert_path = "/certs/edge"
+
+  tls_alpn {
+    hook = "/usr/local/bin/alpn-hook"
+  }
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 1) {
+		assert.Equal("/usr/local/bin/alpn-hook", configs[0].TLSALPNHook)
+		assert.Equal([]string{acme.ChallengeTLSALPN01}, configs[0].challengeTypes())
+	}
+}
+
+func TestParseConfigKeyTypes(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+  key_type = "ec384"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+  key_types = ["rsa2048", "ec256"]
+}
+
+certificate "api" {
+  domains   = ["api.example.com"]
+  key_path  = "/certs/api"
+  cert_path = "/certs/api"
+  webroot   = "/webroot"
+}
+`)
+	if !assert.Nil(err) || !assert.Len(configs, 3) {
+		return
+	}
+	assert.Equal("www-rsa2048", configs[0].Name)
+	assert.Equal(certbuddy.RSA2048, configs[0].KeyType)
+	assert.Equal("/certs/www/rsa2048", configs[0].KeyPath)
+	assert.Equal("/certs/www/rsa2048", configs[0].CertPath)
+	assert.Equal("www-ec256", configs[1].Name)
+	assert.Equal(certbuddy.EC256, configs[1].KeyType)
+	assert.Equal("/certs/www/ec256", configs[1].CertPath)
+	assert.Equal("api", configs[2].Name)
+	assert.Equal(certbuddy.DefaultKeyType, configs[2].KeyType)
+	assert.Equal("/certs/api", configs[2].CertPath)
+	for _, config := range configs {
+		assert.Equal(certbuddy.EC384, config.AccountKeyType)
+	}
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+  key_type = "dsa"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+  key_type  = "ec256"
+  key_types = ["rsa2048", "ec256"]
+}
+
+certificate "api" {
+  domains   = ["api.example.com"]
+  key_path  = "/certs/api"
+  cert_path = "/certs/api"
+  webroot   = "/webroot"
+  key_types = ["ec256", "ec256"]
+}
+`)
+	errs, ok := err.(configErrors)
+	assert.True(ok)
+	assert.Len(errs, 3)
+	assert.Contains(err.Error(), `account "admin@example.com": Unknown key type dsa`)
+	assert.Contains(err.Error(), `certificate "www": key_type and key_types can't be combined`)
+	assert.Contains(err.Error(), `certificate "api": Key type ec256 is specified more than once`)
+}
+
+func TestParseConfigKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains      = ["example.com"]
+  key_path     = "/certs/www"
+  cert_path    = "/certs/www"
+  webroot      = "/webroot"
+  key_rotation = "rotate-after-age"
+  key_max_age  = 90
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 1) {
+		assert.Equal(certbuddy.KeyRotationPolicy{Mode: certbuddy.KeyRotateAfterAge, MaxAge: time.Hour * 24 * 90}, configs[0].KeyRotation)
+		// The archive is opt-in
+		assert.Equal(0, configs[0].ArchiveVersions)
+	}
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains      = ["example.com"]
+  key_path     = "/certs/www"
+  cert_path    = "/certs/www"
+  webroot      = "/webroot"
+  key_rotation = "rotate-after-age"
+}
+`)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `certificate "www": A maximum key age is required for rotate-after-age`)
+}
+
+func TestParseConfigKeyPassphrase(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path            = "/user/account.key"
+  key_passphrase_file = "/run/secrets/account-passphrase"
+}
+
+certificate "www" {
+  domains            = ["example.com"]
+  key_path           = "/certs/www"
+  cert_path          = "/certs/www"
+  webroot            = "/webroot"
+  key_format         = "pkcs8"
+  key_passphrase_env = "WWW_KEY_PASSPHRASE"
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 1) {
+		assert.Equal(certbuddy.KeyFormatPKCS8, configs[0].KeyFormat)
+		assert.Equal(certbuddy.KeyFormatPKCS1, configs[0].AccountKeyFormat)
+		assert.Equal(certbuddy.PassphraseSource{File: "/run/secrets/account-passphrase"}, configs[0].AccountKeyPassphrase)
+		assert.Equal(certbuddy.PassphraseSource{Env: "WWW_KEY_PASSPHRASE"}, configs[0].KeyPassphrase)
+	}
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains             = ["example.com"]
+  key_path            = "/certs/www"
+  cert_path           = "/certs/www"
+  webroot             = "/webroot"
+  key_passphrase_file = "/run/secrets/www-passphrase"
+  key_passphrase_env  = "WWW_KEY_PASSPHRASE"
+}
+`)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `certificate "www": key_passphrase_file and key_passphrase_env can't be combined`)
+}
+
+func TestParseConfigConsulStorage(t *testing.T) {
+	assert := assert.New(t)
+	_, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+  key_types = ["rsa2048", "ec256"]
+
+  consul_storage {
+    address = "127.0.0.1:8500"
+    token   = "secret"
+    prefix  = "certs/www"
+  }
+}
+
+certificate "api" {
+  domains   = ["api.example.com"]
+  key_path  = "/certs/api"
+  cert_path = "/certs/api"
+  webroot   = "/webroot"
+
+  consul_storage {
+    token = "secret"
+  }
+}
+`)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `certificate "api": consul_storage: prefix may not be empty`)
+	assert.NotContains(err.Error(), `certificate "www"`)
+
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+  key_types = ["rsa2048", "ec256"]
+
+  consul_storage {
+    address = "127.0.0.1:8500"
+    token   = "secret"
+    prefix  = "certs/www"
+  }
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 2) {
+		assert.Equal("127.0.0.1:8500", configs[0].ConsulKVAddress)
+		assert.Equal("secret", configs[0].ConsulKVToken)
+		assert.Equal("certs/www/rsa2048", configs[0].ConsulKVPrefix)
+		assert.Equal("certs/www/ec256", configs[1].ConsulKVPrefix)
+	}
+}
+
+func TestParseConfigVault(t *testing.T) {
+	assert := assert.New(t)
+	_, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  vault {
+    address = "https://vault.example.com:8200"
+    role_id = "certbuddy"
+  }
+}
+`)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `certificate "www": vault: path may not be empty`)
+		assert.Contains(err.Error(), `certificate "www": vault: either token or role_id and secret_id have to be specified`)
+	}
+
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+  key_types = ["rsa2048", "ec256"]
+
+  vault {
+    address   = "https://vault.example.com:8200"
+    role_id   = "certbuddy"
+    secret_id = "secret"
+    namespace = "team"
+    path      = "certs/www"
+  }
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 2) {
+		assert.Equal(vault.Config{
+			Address:   "https://vault.example.com:8200",
+			RoleID:    "certbuddy",
+			SecretID:  "secret",
+			Namespace: "team",
+			Path:      "certs/www/rsa2048",
+		}, *configs[0].Vault)
+		assert.Equal("certs/www/ec256", configs[1].Vault.Path)
+	}
+}
+
+func TestParseConfigKubernetesSecret(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  kubernetes_secret {
+    name       = "www-tls"
+    namespace  = "web"
+    kubeconfig = "/etc/kubeconfig"
+    include_ca = true
+    labels {
+      team = "web"
+    }
+  }
+}
+
+certificate "api" {
+  domains   = ["api.example.com"]
+  key_path  = "/certs/api"
+  cert_path = "/certs/api"
+  webroot   = "/webroot"
+
+  kubernetes_secret {
+    namespace = "api"
+    owner     = "api"
+  }
+}
+`)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `certificate "api": kubernetes_secret: unknown key "owner"`)
+	}
+
+	configs, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  kubernetes_secret {
+    name       = "www-tls"
+    namespace  = "web"
+    kubeconfig = "/etc/kubeconfig"
+    include_ca = true
+    labels {
+      team = "web"
+    }
+  }
+}
+
+certificate "api" {
+  domains   = ["api.example.com"]
+  key_path  = "/certs/api"
+  cert_path = "/certs/api"
+  webroot   = "/webroot"
+
+  kubernetes_secret {
+    namespace = "api"
+  }
+}
+`)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `certificate "api": kubernetes_secret: name may not be empty`)
+		assert.NotContains(err.Error(), `certificate "www"`)
+	}
+
+	configs, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  kubernetes_secret {
+    name       = "www-tls"
+    namespace  = "web"
+    kubeconfig = "/etc/kubeconfig"
+    include_ca = true
+    labels {
+      team = "web"
+    }
+  }
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 1) {
+		assert.Equal(&kubernetes.Config{
+			Name:      "www-tls",
+			Namespace: "web",
+			IncludeCA: true,
+			Labels:    map[string]string{"team": "web"},
+		}, configs[0].KubernetesSecret)
+		assert.Equal("/etc/kubeconfig", configs[0].Kubeconfig)
+	}
+}
+
+func TestParseConfigWildcard(t *testing.T) {
+	assert := assert.New(t)
+	_, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com", "*.example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+}
+`)
+	errs, ok := err.(configErrors)
+	assert.True(ok)
+	assert.Len(errs, 1)
+	assert.Contains(err.Error(), `certificate "www": Wildcard domain *.example.com requires a DNS challenge provider`)
+}
+
+func TestParseConfigWithDNSAndWebroot(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "internal" {
+  domains   = ["internal.example.com", "*.internal.example.com"]
+  key_path  = "/certs/internal"
+  cert_path = "/certs/internal"
+  webroot   = "/webroot"
+
+  dns {
+    provider   = "rfc2136"
+    nameserver = "ns1.example.com"
+  }
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 1) {
+		assert.Equal("/webroot", configs[0].WebrootPath)
+		assert.Equal([]string{acme.ChallengeHTTP01, acme.ChallengeDNS01}, configs[0].challengeTypes())
+	}
+}
+
+func TestParseConfigWithDNS(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "internal" {
+  domains   = ["*.internal.example.com"]
+  key_path  = "/certs/internal"
+  cert_path = "/certs/internal"
+
+  dns {
+    provider            = "rfc2136"
+    nameserver          = "ns1.example.com"
+    tsig_key            = "certbuddy"
+    tsig_secret         = "c2VjcmV0"
+    resolvers           = ["127.0.0.1:53"]
+    propagation_timeout = "30s"
+  }
+}
+`)
+	if !assert.Nil(err) || !assert.Len(configs, 1) {
+		return
+	}
+	config := configs[0]
+	assert.Equal("", config.WebrootPath)
+	if assert.NotNil(config.RFC2136) {
+		assert.Equal("ns1.example.com", config.RFC2136.Nameserver)
+		assert.Equal("certbuddy", config.RFC2136.TSIGKey)
+		assert.Equal("c2VjcmV0", config.RFC2136.TSIGSecret)
+	}
+	assert.Equal([]string{"127.0.0.1:53"}, config.DNSResolvers)
+	assert.Equal(time.Second*30, config.DNSPropagationTimeout)
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "internal" {
+  domains   = ["internal.example.com"]
+  key_path  = "/certs/internal"
+  cert_path = "/certs/internal"
+
+  dns {
+    provider = "route53"
+    tsig_key = "certbuddy"
+  }
+}
+`)
+	errs, ok := err.(configErrors)
+	assert.True(ok)
+	assert.Len(errs, 3)
+	assert.Contains(err.Error(), `dns: unsupported provider "route53"`)
+	assert.Contains(err.Error(), `dns: nameserver may not be empty`)
+	assert.Contains(err.Error(), `dns: tsig_key and tsig_secret have to be specified together`)
+}
+
+func TestParseConfigOutputs(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains        = ["example.com"]
+  key_path       = "/certs/www"
+  cert_path      = "/certs/www"
+  webroot        = "/webroot"
+  key_types      = ["rsa2048", "ec256"]
+  cert_file_name = "fullchain.pem"
+  key_file_name  = "privkey.pem"
+
+  output "pem-combined" {
+    path = "/etc/haproxy/certs/www.pem"
+  }
+
+  output "pkcs12" {
+    path          = "/opt/app/keystore.p12"
+    password_file = "/run/secrets/keystore-password"
+  }
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 2) {
+		assert.Equal("fullchain.pem", configs[0].CertFileName)
+		assert.Equal("privkey.pem", configs[0].KeyFileName)
+		assert.Equal([]file.OutputConfig{
+			{Format: file.FormatCombinedPEM, Path: "/etc/haproxy/certs/rsa2048/www.pem"},
+			{Format: file.FormatPKCS12, Path: "/opt/app/rsa2048/keystore.p12", Password: certbuddy.PassphraseSource{File: "/run/secrets/keystore-password"}},
+		}, configs[0].Outputs)
+		assert.Equal("/etc/haproxy/certs/ec256/www.pem", configs[1].Outputs[0].Path)
+	}
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  output "pkcs12" {
+    path = "/opt/app/keystore.p12"
+  }
+
+  output "jks" {
+    path = "/opt/app/keystore.jks"
+  }
+}
+`)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `certificate "www": output 1: the pkcs12 format requires a password`)
+	assert.Contains(err.Error(), `certificate "www": output 2: Unknown output format jks`)
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  output "pkcs12" {
+    path     = "/opt/app/keystore.p12"
+    password = "changeit"
+  }
+}
+`)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `certificate "www": output: unknown key "password"`)
+}
+
+func TestParseConfigPermissions(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains         = ["example.com"]
+  key_path        = "/certs/www"
+  cert_path       = "/certs/www"
+  webroot         = "/webroot"
+  key_types       = ["rsa2048", "ec256"]
+  cert_file_name  = "{domain}.crt"
+  leaf_file_name  = "cert.pem"
+  chain_file_name = "chain.pem"
+
+  permissions {
+    file_mode = "0640"
+    dir_mode  = "0750"
+    group     = "nginx"
+  }
+
+  output "pem" {
+    path = "/etc/nginx/certs/{key_type}/{domain}.pem"
+  }
+
+  output "pem-combined" {
+    path = "/etc/haproxy/certs/www.pem"
+    permissions {
+      owner = "haproxy"
+    }
+  }
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 2) {
+		perm := file.Permissions{FileMode: 0640, DirMode: 0750, Group: "nginx"}
+		assert.Equal("{domain}.crt", configs[0].CertFileName)
+		assert.Equal("cert.pem", configs[0].LeafFileName)
+		assert.Equal("chain.pem", configs[0].ChainFileName)
+		assert.Equal(perm, configs[0].Permissions)
+		assert.Equal(perm, configs[0].Outputs[0].Permissions)
+		assert.Equal("/etc/nginx/certs/{key_type}/{domain}.pem", configs[0].Outputs[0].Path)
+		assert.Equal(file.Permissions{Owner: "haproxy"}, configs[0].Outputs[1].Permissions)
+		assert.Equal("/etc/haproxy/certs/rsa2048/www.pem", configs[0].Outputs[1].Path)
+		assert.Equal("/etc/nginx/certs/ec256/example.com.pem", configs[1].placeholders().Expand(configs[1].Outputs[0].Path))
+	}
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains        = ["example.com"]
+  key_path       = "/certs/www"
+  cert_path      = "/certs/www"
+  webroot        = "/webroot"
+  cert_file_name = "{host}.crt"
+
+  permissions {
+    file_mode = "rw-r-----"
+    user      = "nginx"
+  }
+
+  output "pem" {
+    path = "/etc/nginx/certs/www.pem"
+    permissions {
+      dir_mode = "0999"
+    }
+  }
+}
+`)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `certificate "www": permissions: unknown key "user"`)
+	}
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains        = ["example.com"]
+  key_path       = "/certs/www"
+  cert_path      = "/certs/www"
+  webroot        = "/webroot"
+  cert_file_name = "{host}.crt"
+
+  permissions {
+    file_mode = "rw-r-----"
+  }
+
+  output "pem" {
+    path = "/etc/nginx/certs/www.pem"
+    permissions {
+      dir_mode = "0999"
+    }
+  }
+}
+`)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `certificate "www": Unknown placeholder {host}`)
+		assert.Contains(err.Error(), `certificate "www": permissions: invalid file_mode "rw-r-----"`)
+		assert.Contains(err.Error(), `certificate "www": output 1: permissions: invalid dir_mode "0999"`)
+	}
+}
+
+func TestParseConfigHooks(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  hooks {
+    pre     = ["systemctl stop nginx"]
+    post    = ["systemctl start nginx"]
+    deploy  = ["systemctl reload haproxy", "/usr/local/bin/notify"]
+    timeout = "2m"
+  }
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 1) {
+		assert.Equal(hook.Config{
+			Pre:     []string{"systemctl stop nginx"},
+			Post:    []string{"systemctl start nginx"},
+			Deploy:  []string{"systemctl reload haproxy", "/usr/local/bin/notify"},
+			Timeout: 2 * time.Minute,
+		}, configs[0].Hooks)
+	}
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  hooks {
+    deploy  = [""]
+    timeout = "forever"
+  }
+}
+`)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `certificate "www": hooks: commands may not be empty`)
+		assert.Contains(err.Error(), `certificate "www": hooks: invalid timeout "forever"`)
+	}
+}
+
+func TestParseConfigWebhooks(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  webhook "chat" {
+    url         = "https://chat.example.com/hooks/certbuddy"
+    secret_file = "/run/secrets/webhook-secret"
+    events      = ["renewal-failed", "expiring-soon"]
+    retries     = 5
+    timeout     = "30s"
+  }
+  webhook "monitoring" {
+    url = "https://monitoring.example.com/certbuddy"
+  }
+  expiry_warning = 7
+}
+
+certificate "api" {
+  domains   = ["api.example.com"]
+  key_path  = "/certs/api"
+  cert_path = "/certs/api"
+  webroot   = "/webroot"
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 2) {
+		assert.Equal([]webhook.Config{
+			{
+				URL:     "https://chat.example.com/hooks/certbuddy",
+				Secret:  certbuddy.PassphraseSource{File: "/run/secrets/webhook-secret"},
+				Events:  []certbuddy.EventType{certbuddy.EventRenewalFailed, certbuddy.EventExpiringSoon},
+				Retries: 5,
+				Timeout: 30 * time.Second,
+			},
+			{URL: "https://monitoring.example.com/certbuddy"},
+		}, configs[0].Webhooks)
+		assert.Equal(7*24*time.Hour, configs[0].ExpiryWarning)
+		assert.Empty(configs[1].Webhooks)
+		assert.Equal(defaultExpiryWarningDays*24*time.Hour, configs[1].ExpiryWarning)
+	}
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+
+  webhook "chat" {
+    url        = "ftp://example.com"
+    secret_env = "SECRET"
+    events     = ["renewed", "exploded"]
+  }
+  expiry_warning = -1
+}
+`)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `certificate "www": webhook "chat": invalid url "ftp://example.com"`)
+		assert.Contains(err.Error(), `certificate "www": webhook "chat": Unknown event exploded`)
+		assert.Contains(err.Error(), `certificate "www": expiry_warning may not be negative`)
+	}
+}
+
+func TestParseConfigEmailAlerts(t *testing.T) {
+	assert := assert.New(t)
+	configs, err := ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+email_alerts "ops" {
+  server            = "smtp.example.com:587"
+  username          = "certbuddy"
+  password_env      = "SMTP_PASSWORD"
+  from              = "certbuddy@example.com"
+  to                = ["ops@example.com"]
+  failure_threshold = 5
+  interval          = "12h"
+}
+
+email_alerts "team" {
+  server = "localhost:25"
+  from   = "certbuddy@example.com"
+  to     = ["team@example.com"]
+  digest = "168h"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+}
+
+certificate "api" {
+  domains   = ["api.example.com"]
+  key_path  = "/certs/api"
+  cert_path = "/certs/api"
+  webroot   = "/webroot"
+}
+`)
+	if assert.Nil(err) && assert.Len(configs, 2) {
+		alerts := []mail.Config{
+			{
+				Name:             "ops",
+				Server:           "smtp.example.com:587",
+				Username:         "certbuddy",
+				Password:         certbuddy.PassphraseSource{Env: "SMTP_PASSWORD"},
+				From:             "certbuddy@example.com",
+				To:               []string{"ops@example.com"},
+				FailureThreshold: 5,
+				Interval:         12 * time.Hour,
+			},
+			{
+				Name:   "team",
+				Server: "localhost:25",
+				From:   "certbuddy@example.com",
+				To:     []string{"team@example.com"},
+				Digest: 7 * 24 * time.Hour,
+			},
+		}
+		assert.Equal(alerts, configs[0].EmailAlerts)
+		assert.Equal(alerts, configs[1].EmailAlerts)
+		assert.Equal(alerts[1:], digestConfigs(configs))
+	}
+
+	_, err = ParseConfig(`
+account "admin@example.com" {
+  key_path = "/user/account.key"
+}
+
+email_alerts "ops" {
+  server   = "smtp.example.com"
+  from     = "certbuddy@example.com"
+  interval = "daily"
+}
+
+email_alerts "ops" {
+  server = "localhost:25"
+}
+
+certificate "www" {
+  domains   = ["example.com"]
+  key_path  = "/certs/www"
+  cert_path = "/certs/www"
+  webroot   = "/webroot"
+}
+`)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `email_alerts "ops": Invalid SMTP server "smtp.example.com", expected host:port`)
+		assert.Contains(err.Error(), `email_alerts "ops": invalid interval "daily"`)
+		assert.Contains(err.Error(), `email_alerts "ops": defined more than once`)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/connctd/certbuddy/mail"
+	"log"
+	"time"
+)
+
+// digestConfigs returns the email alert configs in digest mode. Email alerts are
+// configured for all certificates, so the configs of the first certificate apply.
+func digestConfigs(configs []BuddyConfig) []mail.Config {
+	var digests []mail.Config
+	if len(configs) == 0 {
+		return digests
+	}
+	for _, alertConfig := range configs[0].EmailAlerts {
+		if alertConfig.Digest > 0 {
+			digests = append(digests, alertConfig)
+		}
+	}
+	return digests
+}
+
+// sendDigest emails the status of all certificates.
+func sendDigest(config mail.Config, buddies []*Buddy) {
+	statuses := make([]mail.Status, 0, len(buddies))
+	for _, buddy := range buddies {
+		statuses = append(statuses, buddy.Status())
+	}
+	if err := mail.SendDigest(config, statuses); err != nil {
+		log.Printf("Unable to send digest to %v: %+v", config.To, err)
+	}
+}
+
+// runDigest sends a digest after every interval of the config until stop is closed.
+func runDigest(config mail.Config, buddies []*Buddy, stop <-chan struct{}) {
+	ticker := time.NewTicker(config.Digest)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			sendDigest(config, buddies)
+		}
+	}
+}
@@ -3,6 +3,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/acme"
+	"github.com/connctd/certbuddy/acme/rfc2136"
+	"github.com/connctd/certbuddy/file"
+	"github.com/connctd/certbuddy/hook"
+	"github.com/connctd/certbuddy/kubernetes"
+	"github.com/connctd/certbuddy/mail"
+	"github.com/connctd/certbuddy/vault"
+	"github.com/connctd/certbuddy/webhook"
+	"github.com/pkg/errors"
 	"log"
 	"os"
 	"os/signal"
@@ -12,82 +22,214 @@ import (
 )
 
 var (
-	email          = flag.String("email", "", "Specify the email address for the letsencrypt account")
-	domains        = flag.String("domains", "", "Specify a comma seperated list of domains to get a certificate for")
-	keyPath        = flag.String("keyPath", "", "Path to the private domain key")
-	certPath       = flag.String("certPath", "", "Path to the domain certificte")
-	validBefore    = flag.Int("validBefore", 30, "Renew before Duration before expiration in days")
-	webrootPath    = flag.String("webroot", "", "Path to the webroot for the HTTP challenge")
-	accountKeyPath = flag.String("accountKey", "", "Path to the private key for the account")
-	consulAddr     = flag.String("consul", "", "Address of the consul agent to connect to (optional)")
-	background     = flag.Bool("background", false, "Don't keep running in the background")
-	serviceName    = flag.String("serviceName", "tls-certs", "Specify a service name for your service registry")
-	config         = flag.String("config", "", "Specify a config file for multiple accounts (unused at the moment)")
+	email                 = flag.String("email", "", "Specify the email address for the letsencrypt account")
+	domains               = flag.String("domains", "", "Specify a comma seperated list of domains to get a certificate for")
+	keyPath               = flag.String("keyPath", "", "Path to the private domain key")
+	certPath              = flag.String("certPath", "", "Path to the domain certificte")
+	validBefore           = flag.Int("validBefore", 30, "Renew before Duration before expiration in days")
+	webrootPath           = flag.String("webroot", "", "Path to the webroot for the HTTP challenge")
+	accountKeyPath        = flag.String("accountKey", "", "Path to the private key for the account")
+	consulAddr            = flag.String("consul", "", "Address of the consul agent to connect to (optional)")
+	background            = flag.Bool("background", false, "Keep running in the background and renew certificates when necessary")
+	serviceName           = flag.String("serviceName", "tls-certs", "Specify a service name for your service registry")
+	retryInterval         = flag.Duration("retryInterval", certbuddy.DefaultRetryPolicy.InitialInterval, "Time to wait before retrying after the first failure, doubled with every further failure")
+	maxRetryInterval      = flag.Duration("maxRetryInterval", certbuddy.DefaultRetryPolicy.MaxInterval, "Maximum time to wait before retrying after a failure")
+	preferredChain        = flag.String("preferredChain", "", "Common name of an issuer in the preferred certificate chain, if the CA offers alternate chains (optional)")
+	acmeDirectory         = flag.String("acmeDirectory", acme.DefaultDirectory, "Name of a known ACME CA (letsencrypt, letsencrypt-staging) or URL of an ACME directory")
+	acmeCABundle          = flag.String("acmeCABundle", "", "PEM file with root certificates to trust when talking to the ACME CA (optional)")
+	rfc2136Nameserver     = flag.String("rfc2136Nameserver", "", "Name server accepting RFC 2136 dynamic updates, enables the DNS challenge (optional)")
+	rfc2136Zone           = flag.String("rfc2136Zone", "", "DNS zone to update, determined via SOA queries if empty (optional)")
+	rfc2136TsigKey        = flag.String("rfc2136TsigKey", "", "Name of the TSIG key used to sign DNS updates (optional)")
+	rfc2136TsigSecret     = flag.String("rfc2136TsigSecret", os.Getenv("RFC2136_TSIG_SECRET"), "Base64 encoded TSIG secret, defaults to $RFC2136_TSIG_SECRET (optional)")
+	rfc2136TsigAlgorithm  = flag.String("rfc2136TsigAlgorithm", "hmac-sha256", "TSIG algorithm (hmac-md5, hmac-sha1, hmac-sha256, hmac-sha512)")
+	dnsResolvers          = flag.String("dnsResolvers", "", "Comma separated list of resolvers to check for the propagation of DNS challenge records, defaults to the system resolvers")
+	dnsPropagationTimeout = flag.Duration("dnsPropagationTimeout", 2*time.Minute, "Maximum time to wait for DNS challenge records to propagate")
+	standaloneAddr        = flag.String("standalone", "", "Address to answer HTTP challenges on without a separate web server, e.g. :80 (optional)")
+	standaloneKeepRunning = flag.Bool("standaloneKeepRunning", false, "Keep the standalone server running in background mode and redirect all other requests to HTTPS")
+	tlsAlpnAddr           = flag.String("tlsAlpn", "", "Address to answer TLS-ALPN challenges on, e.g. :443 (optional)")
+	tlsAlpnHook           = flag.String("tlsAlpnHook", "", "Command handing TLS-ALPN challenge certificates to an external TLS terminator (optional)")
+	revokeReason          = flag.String("reason", "", "Reason for the revoke command (unspecified, keyCompromise, affiliationChanged, superseded, cessationOfOperation)")
+	revokeWithCertKey     = flag.Bool("revokeWithCertKey", false, "Sign the revocation with the private key of the certificate instead of the account key")
+	revokeOnReissue       = flag.Bool("revokeOnReissue", false, "Revoke the old certificate after the reissue command replaced it")
+	certificateName       = flag.String("certificate", "", "Name of the certificate in the config file the revoke and reissue commands apply to")
+	keyType               = flag.String("keyType", string(certbuddy.DefaultKeyType), "Type of the private key (rsa2048, rsa3072, rsa4096, ec256, ec384, ed25519), a comma separated list issues a certificate per key type")
+	accountKeyType        = flag.String("accountKeyType", string(certbuddy.DefaultKeyType), "Type of a newly generated account key (rsa2048, rsa3072, rsa4096, ec256, ec384, ed25519)")
+	keyRotation           = flag.String("keyRotation", string(certbuddy.KeyReuse), "When to generate a new private key (reuse, rotate-on-renew, rotate-after-age)")
+	keyMaxAge             = flag.Int("keyMaxAge", 0, "Maximum age of the private key in days if keyRotation is rotate-after-age")
+	archiveVersions       = flag.Int("archiveVersions", 0, "Number of issued certificates and keys to keep in the archive, 0 disables the archive")
+	rollbackVersion       = flag.Int("rollbackVersion", 0, "Archived version the rollback command restores, defaults to the version before the live one")
+	consulKVPrefix        = flag.String("consulKVPrefix", "", "Store the certificate and private key in the Consul KV store below this prefix")
+	consulKVAddress       = flag.String("consulKVAddress", "", "Address of the consul agent used for the KV storage, defaults to $CONSUL_HTTP_ADDR or 127.0.0.1:8500")
+	consulKVToken         = flag.String("consulKVToken", "", "ACL token for the Consul KV storage, defaults to $CONSUL_HTTP_TOKEN")
+	vaultPath             = flag.String("vaultPath", "", "Store the certificate and private key in this Vault KV v2 secret")
+	vaultAddress          = flag.String("vaultAddress", os.Getenv("VAULT_ADDR"), "Address of the Vault server, defaults to $VAULT_ADDR")
+	vaultToken            = flag.String("vaultToken", os.Getenv("VAULT_TOKEN"), "Vault token, defaults to $VAULT_TOKEN")
+	vaultRoleID           = flag.String("vaultRoleId", "", "Role ID for the Vault AppRole auth method")
+	vaultSecretID         = flag.String("vaultSecretId", os.Getenv("VAULT_SECRET_ID"), "Secret ID for the Vault AppRole auth method, defaults to $VAULT_SECRET_ID")
+	vaultNamespace        = flag.String("vaultNamespace", os.Getenv("VAULT_NAMESPACE"), "Vault Enterprise namespace, defaults to $VAULT_NAMESPACE")
+	vaultMount            = flag.String("vaultMount", "secret", "Mount path of the Vault KV v2 secrets engine")
+	vaultCACert           = flag.String("vaultCACert", os.Getenv("VAULT_CACERT"), "PEM file with the CA certificates of the Vault server, defaults to $VAULT_CACERT")
+	k8sSecret             = flag.String("k8sSecret", "", "Name of a Kubernetes TLS Secret the certificate and private key are additionally written to")
+	k8sNamespace          = flag.String("k8sNamespace", "", "Namespace of the Kubernetes Secret, defaults to the namespace of the credentials")
+	k8sIncludeCA          = flag.Bool("k8sIncludeCA", false, "Store the issuer certificates as ca.crt in the Kubernetes Secret")
+	kubeconfig            = flag.String("kubeconfig", "", "Path to a kubeconfig in JSON, required outside of a Kubernetes cluster, defaults to the in-cluster credentials")
+	kubeContext           = flag.String("kubeContext", "", "Context in the kubeconfig, defaults to the current context")
+	keyPassphraseFile     = flag.String("keyPassphraseFile", "", "File containing the passphrase the private keys are encrypted with (optional)")
+	keyPassphraseEnv      = flag.String("keyPassphraseEnv", "", "Environment variable containing the passphrase the private keys are encrypted with (optional)")
+	newKeyPassphraseFile  = flag.String("newKeyPassphraseFile", "", "File containing the new passphrase for the reencrypt command")
+	newKeyPassphraseEnv   = flag.String("newKeyPassphraseEnv", "", "Environment variable containing the new passphrase for the reencrypt command")
+	keyFormat             = flag.String("keyFormat", string(certbuddy.DefaultKeyFormat), "Format of stored private keys (pkcs1, pkcs8), pkcs1 writes EC keys in SEC 1 format")
+	certFileName          = flag.String("certFileName", "", "Name of the certificate file in certPath, defaults to server.crt, file names may contain {domain}, {name} and {key_type}")
+	keyFileName           = flag.String("keyFileName", "", "Name of the private key file in keyPath, defaults to private.key")
+	leafFileName          = flag.String("leafFileName", "", "Name of an additional file in certPath containing only the leaf certificate, e.g. cert.pem (optional)")
+	chainFileName         = flag.String("chainFileName", "", "Name of an additional file in certPath containing only the issuer certificates, e.g. chain.pem (optional)")
+	fileMode              = flag.String("fileMode", "", "Octal mode of written certificate, key and output files, defaults to 0600")
+	dirMode               = flag.String("dirMode", "", "Octal mode of the directories certificate, key and output files are written to, defaults to 0700 for new directories")
+	fileOwner             = flag.String("fileOwner", "", "User name or id owning the written files, defaults to the certbuddy user")
+	fileGroup             = flag.String("fileGroup", "", "Group name or id owning the written files, defaults to the group of the certbuddy user")
+	outputs               = flag.String("outputs", "", "Comma separated list of additional output files as format:path[:keyPath], formats are pem, pem-combined, der and pkcs12")
+	outputPasswordFile    = flag.String("outputPasswordFile", "", "File containing the password of pkcs12 outputs")
+	outputPasswordEnv     = flag.String("outputPasswordEnv", "", "Environment variable containing the password of pkcs12 outputs")
+	preHook               = flag.String("preHook", "", "Command run with /bin/sh before a certificate is requested, e.g. to stop a web server (optional)")
+	postHook              = flag.String("postHook", "", "Command run with /bin/sh after a certificate has been requested, whether it succeeded or not (optional)")
+	deployHook            = flag.String("deployHook", "", "Command run with /bin/sh after a certificate has been issued or renewed, e.g. to reload a web server (optional)")
+	hookTimeout           = flag.Duration("hookTimeout", hook.DefaultTimeout, "Maximum time a hook command may run")
+	webhookURL            = flag.String("webhookURL", "", "URL lifecycle events of the certificates are POSTed to as JSON (optional)")
+	webhookSecretFile     = flag.String("webhookSecretFile", "", "File containing the secret the webhook payload is signed with (optional)")
+	webhookSecretEnv      = flag.String("webhookSecretEnv", "", "Environment variable containing the secret the webhook payload is signed with (optional)")
+	webhookEvents         = flag.String("webhookEvents", "", "Comma separated list of events sent to the webhook (issued, renewed, renewal-failed, expiring-soon, revoked, key-rotated), defaults to all")
+	smtpServer            = flag.String("smtpServer", "", "SMTP server as host:port email alerts are sent with, enables email alerts (optional)")
+	smtpUsername          = flag.String("smtpUsername", "", "User name for the SMTP server, no authentication if empty")
+	smtpPasswordFile      = flag.String("smtpPasswordFile", "", "File containing the password for the SMTP server")
+	smtpPasswordEnv       = flag.String("smtpPasswordEnv", "", "Environment variable containing the password for the SMTP server")
+	alertFrom             = flag.String("alertFrom", "", "Sender address of email alerts")
+	alertTo               = flag.String("alertTo", "", "Comma separated list of recipients of email alerts")
+	alertFailureThreshold = flag.Int("alertFailureThreshold", mail.DefaultFailureThreshold, "Send an email alert after this many failed attempts in a row")
+	alertInterval         = flag.Duration("alertInterval", mail.DefaultInterval, "Minimum time between two email alerts of the same kind about the same certificate")
+	alertDigest           = flag.Duration("alertDigest", 0, "Send a summary of all certificates with this interval, or after every run without background mode, instead of individual alerts (optional)")
+	expiryWarning         = flag.Int("expiryWarning", defaultExpiryWarningDays, "Emit an expiring-soon event, at most once a day, if the certificate expires within this many days")
+	config                = flag.String("config", "", "Specify a HCL or JSON config file for multiple accounts and certificates")
 
 	flagNameMap = map[string]*string{
 		"email":          email,
 		"domains":        domains,
 		"certPath":       certPath,
-		"webrootPath":    webrootPath,
 		"accountKeyPath": accountKeyPath,
 	}
 )
 
+const (
+	commandEnsure    = ""
+	commandRevoke    = "revoke"
+	commandReissue   = "reissue"
+	commandRollback  = "rollback"
+	commandReencrypt = "reencrypt"
+)
+
 func main() {
-	flag.Parse()
-	if err := verifyFlags(); err != nil {
+	// An optional command precedes the flags, e.g. certbuddy revoke -config ...
+	command, args := commandEnsure, os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if command != commandEnsure && command != commandRevoke && command != commandReissue && command != commandRollback && command != commandReencrypt {
+		log.Fatalf("Unknown command %s, expected %s, %s, %s or %s", command, commandRevoke, commandReissue, commandRollback, commandReencrypt)
+	}
+	flag.CommandLine.Parse(args)
+	if err := verifyFlags(command); err != nil {
 		log.Fatalf("Specified invalid or too few flags: %+v", err)
 	}
 
-	errc := make(chan error)
-
-	go func() {
-		errc <- interrupt()
-	}()
+	var configs []BuddyConfig
+	if *config == "" {
+		var err error
+		configs, err = buddyConfigsFromFlags()
+		if err == nil && command != commandRevoke && command != commandRollback && command != commandReencrypt {
+			err = acme.ValidateDomains(configs[0].Domains, configs[0].challengeTypes())
+		}
+		if err != nil {
+			log.Fatalf("Can't create valid config from flags and no config file is specified: %+v", err)
+		}
+	} else {
+		var err error
+		configs, err = LoadConfigFile(*config)
+		if err != nil {
+			log.Fatalf("Can't load config file %s: %+v", *config, err)
+		}
+	}
 
-	go func() {
-		var configs []BuddyConfig
-		if *config == "" {
-			config, err := buddyConfigFromFlags()
-			if err != nil {
-				log.Fatalf("Can't create valid config from flags and no config file is specified: %+v", err)
-			}
-			configs = []BuddyConfig{config}
+	buddies := make([]*Buddy, 0, 10)
+	for _, config := range configs {
+		buddy, err := NewBuddy(config)
+		if err != nil {
+			log.Fatalf("Unable to create certbuddy instance: %+v", err)
 		}
+		buddies = append(buddies, buddy)
+	}
 
-		buddies := make([]*Buddy, 0, 10)
-		for _, config := range configs {
-			buddy, err := NewBuddy(config)
-			if err != nil {
-				log.Fatalf("Unable to create certbuddy instance: %+v", err)
-			}
-			buddies = append(buddies, buddy)
+	if command != commandEnsure {
+		buddy, err := selectBuddy(buddies, *certificateName)
+		if err != nil {
+			log.Fatalf("Can't select certificate: %+v", err)
+		}
+		err = runCommand(command, buddy)
+		buddy.Flush()
+		if err != nil {
+			log.Fatalf("Command %s failed for %s: %+v", command, buddy.Name(), err)
 		}
+		return
+	}
 
+	// We want to run continously, for example in Docker
+	if *background {
+		jobs := make([]renewalJob, 0, len(buddies))
 		for _, buddy := range buddies {
-			if err := buddy.EnsureCerts(); err != nil {
-				log.Printf("Error ensuring valid certificates: %+v", err)
-				errc <- err
+			if err := buddy.Start(); err != nil {
+				log.Fatalf("Unable to start %s: %+v", buddy.Name(), err)
 			}
+			jobs = append(jobs, buddy)
 		}
-
-		// We want to run continously, for example in Docker
-		if *background {
-			log.Println("Sleeping for 24 hours")
-			time.Sleep(time.Hour * 24)
-			for _, buddy := range buddies {
-				if err := buddy.EnsureCerts(); err != nil {
-					errc <- err
-				}
-			}
+		stop := make(chan struct{})
+		go func() {
+			log.Printf("Received %s, shutting down", interrupt())
+			close(stop)
+		}()
+		for _, digest := range digestConfigs(configs) {
+			go runDigest(digest, buddies, stop)
 		}
-		os.Exit(0)
-	}()
+		NewScheduler(jobs...).Run(stop)
+		for _, buddy := range buddies {
+			buddy.Flush()
+		}
+		log.Println("Stopped")
+		return
+	}
 
-	shutdown(<-errc)
+	failed := false
+	for _, buddy := range buddies {
+		if retryAt, pending := buddy.RetryAt(); pending {
+			log.Printf("Skipping %s, last attempt failed and next attempt is due at %s", buddy.Name(), retryAt.Format(time.RFC3339))
+			failed = true
+			continue
+		}
+		if err := buddy.EnsureCerts(); err != nil {
+			log.Printf("Error ensuring valid certificates for %s: %+v", buddy.Name(), err)
+			failed = true
+		}
+	}
+	for _, digest := range digestConfigs(configs) {
+		sendDigest(digest, buddies)
+	}
+	for _, buddy := range buddies {
+		buddy.Flush()
+	}
+	if failed {
+		os.Exit(1)
+	}
 }
 
-func buddyConfigFromFlags() (BuddyConfig, error) {
+// buddyConfigsFromFlags returns a config for every key type specified via flags.
+func buddyConfigsFromFlags() ([]BuddyConfig, error) {
 	var issueDomains []string
 	if strings.Contains(*domains, ",") {
 		issueDomains = strings.Split(*domains, ",")
@@ -97,37 +239,277 @@ func buddyConfigFromFlags() (BuddyConfig, error) {
 	}
 
 	buddyConfig := BuddyConfig{}
+	buddyConfig.Name = issueDomains[0]
 	buddyConfig.Email = *email
 	buddyConfig.Domains = issueDomains
 	buddyConfig.KeyPath = *keyPath
 	buddyConfig.CertPath = *certPath
 	buddyConfig.WebrootPath = *webrootPath
+	buddyConfig.StandaloneAddress = *standaloneAddr
+	buddyConfig.StandaloneKeepRunning = *standaloneKeepRunning
+	buddyConfig.TLSALPNAddress = *tlsAlpnAddr
+	buddyConfig.TLSALPNHook = *tlsAlpnHook
 	buddyConfig.AccountKeyPath = *accountKeyPath
 	buddyConfig.ServiceName = *serviceName
 	buddyConfig.RegistryAddress = *consulAddr
 	buddyConfig.ValidBefore = time.Hour * 24 * time.Duration(*validBefore)
-	return buddyConfig, nil
+	buddyConfig.Directory = *acmeDirectory
+	buddyConfig.CABundlePath = *acmeCABundle
+	buddyConfig.PreferredChain = *preferredChain
+	buddyConfig.RetryPolicy = certbuddy.DefaultRetryPolicy
+	buddyConfig.RetryPolicy.InitialInterval = *retryInterval
+	buddyConfig.RetryPolicy.MaxInterval = *maxRetryInterval
+	if *rfc2136Nameserver != "" {
+		buddyConfig.RFC2136 = &rfc2136.Config{
+			Nameserver:    *rfc2136Nameserver,
+			Zone:          *rfc2136Zone,
+			TSIGKey:       *rfc2136TsigKey,
+			TSIGSecret:    *rfc2136TsigSecret,
+			TSIGAlgorithm: *rfc2136TsigAlgorithm,
+		}
+	}
+	if *dnsResolvers != "" {
+		buddyConfig.DNSResolvers = strings.Split(*dnsResolvers, ",")
+	}
+	buddyConfig.DNSPropagationTimeout = *dnsPropagationTimeout
+	buddyConfig.RevokeOnReissue = *revokeOnReissue
+	buddyConfig.KeyPassphrase = certbuddy.PassphraseSource{File: *keyPassphraseFile, Env: *keyPassphraseEnv}
+	buddyConfig.AccountKeyPassphrase = buddyConfig.KeyPassphrase
+	var err error
+	if buddyConfig.AccountKeyType, err = certbuddy.ParseKeyType(*accountKeyType); err != nil {
+		return nil, err
+	}
+	if buddyConfig.KeyFormat, err = certbuddy.ParseKeyFormat(*keyFormat); err != nil {
+		return nil, err
+	}
+	buddyConfig.AccountKeyFormat = buddyConfig.KeyFormat
+	buddyConfig.ArchiveVersions = *archiveVersions
+	buddyConfig.CertFileName = *certFileName
+	buddyConfig.KeyFileName = *keyFileName
+	buddyConfig.LeafFileName = *leafFileName
+	buddyConfig.ChainFileName = *chainFileName
+	for _, name := range []string{*certFileName, *keyFileName, *leafFileName, *chainFileName} {
+		if err := file.ValidateTemplate(name); err != nil {
+			return nil, err
+		}
+	}
+	if buddyConfig.Permissions, err = permissionsFromFlags(); err != nil {
+		return nil, err
+	}
+	if buddyConfig.Outputs, err = parseOutputs(*outputs, certbuddy.PassphraseSource{File: *outputPasswordFile, Env: *outputPasswordEnv}); err != nil {
+		return nil, err
+	}
+	for i := range buddyConfig.Outputs {
+		buddyConfig.Outputs[i].Permissions = buddyConfig.Permissions
+	}
+	buddyConfig.Hooks = hook.Config{Timeout: *hookTimeout}
+	if *preHook != "" {
+		buddyConfig.Hooks.Pre = []string{*preHook}
+	}
+	if *postHook != "" {
+		buddyConfig.Hooks.Post = []string{*postHook}
+	}
+	if *deployHook != "" {
+		buddyConfig.Hooks.Deploy = []string{*deployHook}
+	}
+	buddyConfig.ExpiryWarning = time.Hour * 24 * time.Duration(*expiryWarning)
+	if *webhookURL != "" {
+		webhookConfig := webhook.Config{
+			URL:    *webhookURL,
+			Secret: certbuddy.PassphraseSource{File: *webhookSecretFile, Env: *webhookSecretEnv},
+		}
+		if *webhookEvents != "" {
+			if webhookConfig.Events, err = parseEventTypes(strings.Split(*webhookEvents, ",")); err != nil {
+				return nil, err
+			}
+		}
+		buddyConfig.Webhooks = []webhook.Config{webhookConfig}
+	}
+	if *smtpServer != "" {
+		buddyConfig.EmailAlerts = []mail.Config{{
+			Server:           *smtpServer,
+			Username:         *smtpUsername,
+			Password:         certbuddy.PassphraseSource{File: *smtpPasswordFile, Env: *smtpPasswordEnv},
+			From:             *alertFrom,
+			To:               strings.Split(*alertTo, ","),
+			FailureThreshold: *alertFailureThreshold,
+			Interval:         *alertInterval,
+			Digest:           *alertDigest,
+		}}
+		for i, to := range buddyConfig.EmailAlerts[0].To {
+			buddyConfig.EmailAlerts[0].To[i] = strings.TrimSpace(to)
+		}
+		if err := buddyConfig.EmailAlerts[0].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	buddyConfig.ConsulKVAddress = *consulKVAddress
+	buddyConfig.ConsulKVToken = *consulKVToken
+	buddyConfig.ConsulKVPrefix = *consulKVPrefix
+	if *k8sSecret != "" {
+		buddyConfig.KubernetesSecret = &kubernetes.Config{
+			Name:      *k8sSecret,
+			Namespace: *k8sNamespace,
+			IncludeCA: *k8sIncludeCA,
+		}
+		buddyConfig.Kubeconfig = *kubeconfig
+		buddyConfig.KubeContext = *kubeContext
+	}
+	if *vaultPath != "" {
+		buddyConfig.Vault = &vault.Config{
+			Address:   *vaultAddress,
+			Token:     *vaultToken,
+			RoleID:    *vaultRoleID,
+			SecretID:  *vaultSecretID,
+			Namespace: *vaultNamespace,
+			Mount:     *vaultMount,
+			Path:      *vaultPath,
+			CACert:    *vaultCACert,
+		}
+	}
+	if buddyConfig.KeyRotation, err = keyRotationPolicy(*keyRotation, *keyMaxAge); err != nil {
+		return nil, err
+	}
+	keyTypes, err := parseKeyTypes(strings.Split(*keyType, ","))
+	if err != nil {
+		return nil, err
+	}
+	return expandKeyTypes(buddyConfig, keyTypes), nil
 }
 
-func verifyFlags() error {
+// permissionsFromFlags returns the permissions of written files specified via flags.
+func permissionsFromFlags() (file.Permissions, error) {
+	perm := file.Permissions{Owner: *fileOwner, Group: *fileGroup}
+	var err error
+	if *fileMode != "" {
+		if perm.FileMode, err = file.ParseFileMode(*fileMode); err != nil {
+			return perm, err
+		}
+	}
+	if *dirMode != "" {
+		if perm.DirMode, err = file.ParseFileMode(*dirMode); err != nil {
+			return perm, err
+		}
+	}
+	return perm, nil
+}
+
+// parseOutputs parses a comma separated list of outputs in the form format:path[:keyPath].
+func parseOutputs(spec string, password certbuddy.PassphraseSource) ([]file.OutputConfig, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var outputConfigs []file.OutputConfig
+	for _, value := range strings.Split(spec, ",") {
+		parts := strings.Split(value, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("Invalid output %s, expected format:path[:keyPath]", value)
+		}
+		output := file.OutputConfig{Format: file.Format(strings.ToLower(parts[0])), Path: parts[1], Password: password}
+		if len(parts) == 3 {
+			output.KeyPath = parts[2]
+		}
+		if err := validateOutput(output); err != nil {
+			return nil, fmt.Errorf("Invalid output %s: %s", value, err)
+		}
+		outputConfigs = append(outputConfigs, output)
+	}
+	return outputConfigs, nil
+}
+
+func verifyFlags(command string) error {
+	if *revokeReason != "" {
+		if _, err := certbuddy.ParseRevocationReason(*revokeReason); err != nil {
+			return err
+		}
+	}
+	if *keyPassphraseFile != "" && *keyPassphraseEnv != "" {
+		return errors.New("The flags keyPassphraseFile and keyPassphraseEnv can't be combined")
+	}
+	if *webhookSecretFile != "" && *webhookSecretEnv != "" {
+		return errors.New("The flags webhookSecretFile and webhookSecretEnv can't be combined")
+	}
+	if *newKeyPassphraseFile != "" && *newKeyPassphraseEnv != "" {
+		return errors.New("The flags newKeyPassphraseFile and newKeyPassphraseEnv can't be combined")
+	}
 	if *config != "" {
 		// We have to parse a config file
 		return nil
 	}
+	if _, err := acme.ResolveDirectoryURL(*acmeDirectory); err != nil {
+		return err
+	}
 	for name, value := range flagNameMap {
 		if *value == "" {
 			return fmt.Errorf("The flag %s may not be empty", name)
 		}
 	}
+	if *vaultPath != "" && *consulKVPrefix != "" {
+		return errors.New("The flags vaultPath and consulKVPrefix can't be combined")
+	}
+	if *retryInterval > *maxRetryInterval {
+		return errors.New("The flag retryInterval may not be longer than maxRetryInterval")
+	}
+	if *archiveVersions < 0 {
+		return errors.New("The flag archiveVersions may not be negative")
+	}
+	if command == commandRevoke || command == commandRollback || command == commandReencrypt {
+		// Revocation, rollback and re-encryption don't need any challenge
+		return nil
+	}
+	if *webrootPath == "" && *standaloneAddr == "" && *tlsAlpnAddr == "" && *tlsAlpnHook == "" && *rfc2136Nameserver == "" {
+		return errors.New("One of the flags webroot, standalone, tlsAlpn, tlsAlpnHook or rfc2136Nameserver has to be specified")
+	}
+	if *tlsAlpnAddr != "" && *tlsAlpnHook != "" {
+		return errors.New("The flags tlsAlpn and tlsAlpnHook can't be combined")
+	}
+	if *webrootPath != "" && *standaloneAddr != "" {
+		return errors.New("The flags webroot and standalone can't be combined")
+	}
 	return nil
 }
 
-func shutdown(err error) {
-	log.Fatalf("Fatal: %v", err)
+func interrupt() os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	return <-c
 }
 
-func interrupt() error {
-	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	return fmt.Errorf("%s", <-c)
+// selectBuddy returns the buddy for the certificate with the given name. The name may
+// be empty if there is only one certificate.
+func selectBuddy(buddies []*Buddy, name string) (*Buddy, error) {
+	if name == "" {
+		if len(buddies) != 1 {
+			return nil, errors.New("The flag certificate is required if more than one certificate is configured")
+		}
+		return buddies[0], nil
+	}
+	for _, buddy := range buddies {
+		if buddy.Name() == name {
+			return buddy, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown certificate %s", name)
+}
+
+func runCommand(command string, buddy *Buddy) error {
+	switch command {
+	case commandRevoke:
+		reason := certbuddy.ReasonUnspecified
+		if *revokeReason != "" {
+			reason, _ = certbuddy.ParseRevocationReason(*revokeReason)
+		}
+		return buddy.Revoke(reason, *revokeWithCertKey)
+	case commandReissue:
+		return buddy.Reissue()
+	case commandRollback:
+		return buddy.Rollback(*rollbackVersion)
+	case commandReencrypt:
+		passphrase, err := certbuddy.PassphraseSource{File: *newKeyPassphraseFile, Env: *newKeyPassphraseEnv}.Load()
+		if err != nil {
+			return errors.Wrap(err, "Unable to load new passphrase")
+		}
+		return buddy.Reencrypt(passphrase)
+	}
+	return fmt.Errorf("Unknown command %s", command)
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/connctd/certbuddy"
+	"github.com/pkg/errors"
+	"log"
+)
+
+// Reencrypt encrypts the private key of the certificate, including archived keys, and
+// the account key with a new passphrase. If the passphrase is empty the keys are stored
+// unencrypted.
+func (b *Buddy) Reencrypt(passphrase []byte) error {
+	if b.archive != nil {
+		if err := b.archive.Reencrypt(passphrase); err != nil {
+			return errors.Wrap(err, "Unable to re-encrypt private keys")
+		}
+		log.Printf("Re-encrypted live and archived private keys of %s", b.Name())
+	} else if store, ok := b.privateKeyStore.(certbuddy.EncryptedKeyStorage); !ok {
+		log.Printf("The storage of %s doesn't encrypt private keys, only the account key is re-encrypted", b.Name())
+	} else if b.privateKeyStore.KeyExists() {
+		if err := store.Reencrypt(passphrase); err != nil {
+			return errors.Wrap(err, "Unable to re-encrypt private key")
+		}
+		log.Printf("Re-encrypted private key of %s", b.Name())
+	}
+
+	store, ok := b.accountKeyStore.(certbuddy.EncryptedKeyStorage)
+	if !ok {
+		return errors.New("The account key storage doesn't support encryption")
+	}
+	if err := store.Reencrypt(passphrase); err != nil {
+		return errors.Wrap(err, "Unable to re-encrypt account key")
+	}
+	log.Printf("Re-encrypted account key %s", b.config.AccountKeyPath)
+	return nil
+}
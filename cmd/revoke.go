@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"github.com/connctd/certbuddy"
+	"github.com/pkg/errors"
+	"log"
+)
+
+// Revoke revokes the stored certificate. The request is signed with the private key of
+// the certificate if withCertKey is true, otherwise with the account key.
+func (b *Buddy) Revoke(reason certbuddy.RevocationReason, withCertKey bool) error {
+	certs, err := b.certStore.LoadCerts()
+	if err != nil {
+		return errors.Wrap(err, "Unable to load certificates")
+	}
+	if len(certs) == 0 {
+		return errors.New("No certificate to revoke")
+	}
+	var privateKey crypto.PrivateKey
+	if withCertKey {
+		if privateKey, err = b.privateKeyStore.LoadKey(); err != nil {
+			return errors.Wrap(err, "Unable to load private key")
+		}
+	}
+	ca, err := b.getCA()
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoking certificate %s for %+v (%s)", certs[0].SerialNumber, certs[0].DNSNames, reason)
+	if err := ca.Revoke(certs[0], privateKey, reason); err != nil {
+		return err
+	}
+	b.notify(certbuddy.Event{Type: certbuddy.EventRevoked, Certificate: certs[0], Reason: reason})
+	return nil
+}
+
+// Reissue replaces a compromised private key. A new key is generated and a new
+// certificate is obtained for it. If configured, the old certificate is revoked
+// afterwards with the reason keyCompromise.
+func (b *Buddy) Reissue() error {
+	var oldCerts []*x509.Certificate
+	if b.certStore.CertsExist() {
+		certs, err := b.certStore.LoadCerts()
+		if err != nil {
+			return errors.Wrap(err, "Unable to load certificates")
+		}
+		oldCerts = certs
+	}
+	// The revocation is signed with the compromised key, which proves its possession
+	// and allows the CA to block the key for future certificates. The key has to be
+	// loaded before it is replaced.
+	var oldKey crypto.PrivateKey
+	if b.config.RevokeOnReissue && len(oldCerts) > 0 && b.privateKeyStore.KeyExists() {
+		key, err := b.privateKeyStore.LoadKey()
+		if err != nil {
+			log.Printf("Unable to load the replaced private key, revoking with the account key: %+v", err)
+		} else {
+			oldKey = key
+		}
+	}
+
+	log.Printf("Reissuing certificate for %+v with a new private key", b.config.Domains)
+	if err := b.rotateKey(); err != nil {
+		return err
+	}
+	err := b.syncOutputs()
+	b.notifyIssued()
+	if err != nil {
+		return err
+	}
+
+	if b.config.RevokeOnReissue && len(oldCerts) > 0 {
+		log.Printf("Revoking replaced certificate %s", oldCerts[0].SerialNumber)
+		ca, err := b.getCA()
+		if err != nil {
+			return err
+		}
+		if err := ca.Revoke(oldCerts[0], oldKey, certbuddy.ReasonKeyCompromise); err != nil {
+			return errors.Wrap(err, "Certificate was reissued, but the old certificate could not be revoked")
+		}
+		b.notify(certbuddy.Event{Type: certbuddy.EventRevoked, Certificate: oldCerts[0], Reason: certbuddy.ReasonKeyCompromise})
+	}
+	return nil
+}
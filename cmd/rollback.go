@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+)
+
+// Rollback makes a previous version of the certificate and its private key live again.
+// If version is 0, the version before the live version is restored. The registry is
+// notified that the replaced certificate is gone and the restored one is available.
+func (b *Buddy) Rollback(version int) error {
+	if b.versions == nil {
+		return errors.New("The storage doesn't keep versions, there is no version to roll back to")
+	}
+	live, err := b.versions.Live()
+	if err != nil {
+		return err
+	}
+	versions, err := b.versions.Versions()
+	if err != nil {
+		return err
+	}
+	log.Printf("Archived versions for %s: %v, live version: %d", b.Name(), versions, live)
+	if version == 0 {
+		for _, v := range versions {
+			if v < live {
+				version = v
+			}
+		}
+		if version == 0 {
+			return fmt.Errorf("No version before the live version %d in the archive", live)
+		}
+	}
+	if version == live {
+		return fmt.Errorf("Version %d is already live", version)
+	}
+
+	replaced, err := b.certStore.LoadCerts()
+	if err != nil {
+		return errors.Wrap(err, "Unable to load live certificates")
+	}
+	if err := b.versions.Activate(version); err != nil {
+		return errors.Wrapf(err, "Unable to roll back to version %d", version)
+	}
+	// The age of the restored key is unknown, so it is derived from the certificate
+	if err := os.Remove(keyRecordPath(*b.config)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to remove key record for %s: %+v", b.Name(), err)
+	}
+	restored, err := b.certStore.LoadCerts()
+	if err != nil {
+		return errors.Wrap(err, "Unable to load restored certificates")
+	}
+	log.Printf("Rolled back %s to version %d, certificate %s", b.Name(), version, restored[0].SerialNumber)
+
+	if len(replaced) > 0 && replaced[0].SerialNumber.Cmp(restored[0].SerialNumber) != 0 {
+		if err := b.registry.CertsExpired(replaced[0]); err != nil {
+			log.Printf("Unable to deregister replaced certificate for %s: %+v", b.Name(), err)
+		}
+	}
+	if err := b.syncOutputs(); err != nil {
+		return err
+	}
+	if err := b.registry.CertAvailable(restored[0]); err != nil {
+		return errors.Wrap(err, "Rolled back, but unable to notify registry")
+	}
+	return nil
+}
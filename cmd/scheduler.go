@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxCheckInterval = time.Hour * 24
+	defaultRetryInterval    = time.Hour
+	defaultJitter           = time.Minute * 30
+)
+
+// renewalJob is something the scheduler can run periodically. Buddy implements it.
+type renewalJob interface {
+	Name() string
+	EnsureCerts() error
+	// NextRenewal returns the point in time at which the managed certificate should be
+	// renewed.
+	NextRenewal() (time.Time, error)
+	// RetryAt returns the time of the next attempt if the last attempt failed and the
+	// retry is not due yet.
+	RetryAt() (time.Time, bool)
+}
+
+// Scheduler runs EnsureCerts for every job and then waits until the certificate of the
+// job needs to be renewed. Every job is scheduled independently, so a failing job doesn't
+// influence the others.
+type Scheduler struct {
+	// MaxCheckInterval is the maximum time between two checks of a certificate, even if the
+	// certificate is valid for much longer. This catches externally deleted or modified
+	// certificates.
+	MaxCheckInterval time.Duration
+	// RetryInterval is the time to wait if the renewal time of a job can't be determined.
+	// Failed jobs are retried according to their own retry policy.
+	RetryInterval time.Duration
+	// Jitter is the upper bound of a random duration added to every wait, so renewals
+	// of many certificates don't hit the CA at the same time.
+	Jitter time.Duration
+
+	jobs []renewalJob
+	now  func() time.Time
+}
+
+func NewScheduler(jobs ...renewalJob) *Scheduler {
+	return &Scheduler{
+		MaxCheckInterval: defaultMaxCheckInterval,
+		RetryInterval:    defaultRetryInterval,
+		Jitter:           defaultJitter,
+		jobs:             jobs,
+		now:              time.Now,
+	}
+}
+
+// Run schedules all jobs until stop is closed. It returns after all currently running
+// jobs have finished.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, job := range s.jobs {
+		wg.Add(1)
+		go func(job renewalJob) {
+			defer wg.Done()
+			s.runJob(job, stop)
+		}(job)
+	}
+	wg.Wait()
+}
+
+func (s *Scheduler) runJob(job renewalJob, stop <-chan struct{}) {
+	for {
+		// A previous attempt might have failed, possibly before a restart, so we only
+		// run the job if no retry is pending.
+		if _, pending := job.RetryAt(); !pending {
+			if err := job.EnsureCerts(); err != nil {
+				log.Printf("Error ensuring valid certificates for %s: %+v", job.Name(), err)
+			}
+		}
+
+		var wait time.Duration
+		if retryAt, pending := job.RetryAt(); pending {
+			wait = retryAt.Sub(s.now())
+			log.Printf("Retry for %s is due in %s", job.Name(), wait.String())
+		} else {
+			wait = s.nextCheckIn(job) + s.jitter()
+			log.Printf("Next check for %s in %s", job.Name(), wait.String())
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// nextCheckIn calculates the duration until the certificate of the given job needs to
+// be checked again.
+func (s *Scheduler) nextCheckIn(job renewalJob) time.Duration {
+	renewAt, err := job.NextRenewal()
+	if err != nil {
+		log.Printf("Unable to determine renewal time for %s: %+v", job.Name(), err)
+		return s.RetryInterval
+	}
+	wait := renewAt.Sub(s.now())
+	if wait < 0 {
+		// The certificate should already be renewed, but EnsureCerts succeeded. Don't
+		// spin, but try again a bit later.
+		return s.RetryInterval
+	}
+	if wait > s.MaxCheckInterval {
+		return s.MaxCheckInterval
+	}
+	return wait
+}
+
+func (s *Scheduler) jitter() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.Jitter)))
+}
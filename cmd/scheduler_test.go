@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type fakeJob struct {
+	runs      chan struct{}
+	err       error
+	renewalAt time.Time
+}
+
+func (f *fakeJob) Name() string {
+	return "fake"
+}
+
+func (f *fakeJob) EnsureCerts() error {
+	f.runs <- struct{}{}
+	return f.err
+}
+
+func (f *fakeJob) NextRenewal() (time.Time, error) {
+	return f.renewalAt, nil
+}
+
+func (f *fakeJob) RetryAt() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func TestNextCheckIn(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewScheduler()
+	s.now = func() time.Time { return now }
+
+	job := &fakeJob{renewalAt: now.Add(time.Hour * 5)}
+	assert.Equal(time.Hour*5, s.nextCheckIn(job))
+
+	job.renewalAt = now.Add(time.Hour * 24 * 60)
+	assert.Equal(s.MaxCheckInterval, s.nextCheckIn(job))
+
+	job.renewalAt = now.Add(-time.Hour)
+	assert.Equal(s.RetryInterval, s.nextCheckIn(job))
+}
+
+func TestSchedulerSurvivesFailuresAndStops(t *testing.T) {
+	assert := assert.New(t)
+	failing := &fakeJob{runs: make(chan struct{}, 10), err: errors.New("failed")}
+	working := &fakeJob{runs: make(chan struct{}, 10), renewalAt: time.Now().Add(time.Millisecond * 10)}
+
+	s := NewScheduler(failing, working)
+	s.RetryInterval = time.Millisecond * 10
+	s.Jitter = 0
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Run(stop)
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		<-failing.runs
+		<-working.runs
+	}
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("Scheduler did not stop")
+	}
+}
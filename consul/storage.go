@@ -0,0 +1,213 @@
+package consul
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+)
+
+var (
+	CertKeyName       = "server.crt"
+	PrivateKeyKeyName = "private.key"
+)
+
+// KVStorage stores the concatenated certificate chain and the private key in the Consul
+// KV store below a prefix, so TLS terminators on several hosts can read them from
+// Consul. Updates are check-and-set operations against the index the storage last read
+// or wrote, so changes made by another instance in the meantime aren't overwritten.
+type KVStorage struct {
+	client *api.Client
+	Prefix string
+	// KeyFormat of the stored private key, defaults to PKCS#1 and SEC 1
+	KeyFormat certbuddy.KeyFormat
+	// Passphrase encrypts the private key if not empty
+	Passphrase []byte
+
+	lock    sync.Mutex
+	indexes map[string]uint64
+}
+
+// NewKVStorage creates a storage using the Consul agent at consulAddr. token is the ACL
+// token used for all requests and may be empty.
+func NewKVStorage(consulAddr, token, prefix string) (*KVStorage, error) {
+	config := api.DefaultConfig()
+	if consulAddr != "" {
+		config.Address = consulAddr
+	}
+	if token != "" {
+		config.Token = token
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't create Consul client")
+	}
+	return &KVStorage{
+		client:  client,
+		Prefix:  strings.Trim(prefix, "/"),
+		indexes: make(map[string]uint64),
+	}, nil
+}
+
+func (c *KVStorage) LoadCerts() ([]*x509.Certificate, error) {
+	data, err := c.get(CertKeyName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read certificates from Consul")
+	}
+	if len(data) == 0 {
+		return nil, errors.New("Empty certificate value")
+	}
+	return certbuddy.ParseCertificateChain(data)
+}
+
+func (c *KVStorage) SaveCerts(certs []*x509.Certificate) error {
+	data, err := certbuddy.CertificatesToPem(certs)
+	if err != nil {
+		return err
+	}
+	return c.cas(map[string][]byte{CertKeyName: data})
+}
+
+func (c *KVStorage) CertsExist() bool {
+	return c.exists(CertKeyName)
+}
+
+func (c *KVStorage) LoadKey() (crypto.PrivateKey, error) {
+	data, err := c.get(PrivateKeyKeyName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read private key from Consul")
+	}
+	return certbuddy.DecodePrivateKey(data, c.Passphrase)
+}
+
+func (c *KVStorage) SaveKey(key crypto.PrivateKey) error {
+	data, err := certbuddy.EncodePrivateKey(key, c.KeyFormat, c.Passphrase)
+	if err != nil {
+		return err
+	}
+	return c.cas(map[string][]byte{PrivateKeyKeyName: data})
+}
+
+// Reencrypt stores the private key encrypted with a new passphrase, or unencrypted if
+// the passphrase is empty.
+func (c *KVStorage) Reencrypt(passphrase []byte) error {
+	key, err := c.LoadKey()
+	if err != nil {
+		return err
+	}
+	data, err := certbuddy.EncodePrivateKey(key, c.KeyFormat, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := c.cas(map[string][]byte{PrivateKeyKeyName: data}); err != nil {
+		return err
+	}
+	c.Passphrase = passphrase
+	return nil
+}
+
+func (c *KVStorage) KeyExists() bool {
+	return c.exists(PrivateKeyKeyName)
+}
+
+// SaveKeyAndCerts stores a private key together with the certificates issued for it in
+// a single transaction.
+func (c *KVStorage) SaveKeyAndCerts(key crypto.PrivateKey, certs []*x509.Certificate) error {
+	keyData, err := certbuddy.EncodePrivateKey(key, c.KeyFormat, c.Passphrase)
+	if err != nil {
+		return err
+	}
+	certData, err := certbuddy.CertificatesToPem(certs)
+	if err != nil {
+		return err
+	}
+	return c.cas(map[string][]byte{PrivateKeyKeyName: keyData, CertKeyName: certData})
+}
+
+func (c *KVStorage) key(name string) string {
+	if c.Prefix == "" {
+		return name
+	}
+	return c.Prefix + "/" + name
+}
+
+func (c *KVStorage) get(name string) ([]byte, error) {
+	pair, _, err := c.client.KV().Get(c.key(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, fmt.Errorf("Key %s doesn't exist", c.key(name))
+	}
+	c.lock.Lock()
+	c.indexes[name] = pair.ModifyIndex
+	c.lock.Unlock()
+	return pair.Value, nil
+}
+
+func (c *KVStorage) exists(name string) bool {
+	pair, _, err := c.client.KV().Get(c.key(name), nil)
+	return err == nil && pair != nil && len(pair.Value) > 0
+}
+
+// index returns the modify index the value is expected to have. Values not read or
+// written before are looked up, values which don't exist yet have the index 0.
+func (c *KVStorage) index(name string) (uint64, error) {
+	c.lock.Lock()
+	index, known := c.indexes[name]
+	c.lock.Unlock()
+	if known {
+		return index, nil
+	}
+	pair, _, err := c.client.KV().Get(c.key(name), nil)
+	if err != nil {
+		return 0, err
+	}
+	if pair == nil {
+		return 0, nil
+	}
+	return pair.ModifyIndex, nil
+}
+
+// cas writes all values in one transaction, which fails if any of them has been
+// modified since it was last read or written.
+func (c *KVStorage) cas(values map[string][]byte) error {
+	ops := make(api.KVTxnOps, 0, len(values))
+	names := make([]string, 0, len(values))
+	for name, value := range values {
+		index, err := c.index(name)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read %s from Consul", c.key(name))
+		}
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVCAS, Key: c.key(name), Value: value, Index: index})
+		names = append(names, name)
+	}
+	ok, response, _, err := c.client.KV().Txn(ops, nil)
+	if err != nil {
+		return errors.Wrap(err, "Unable to write to Consul")
+	}
+	if !ok {
+		c.lock.Lock()
+		for _, name := range names {
+			delete(c.indexes, name)
+		}
+		c.lock.Unlock()
+		what := make([]string, 0, len(response.Errors))
+		for _, txnErr := range response.Errors {
+			what = append(what, txnErr.What)
+		}
+		return fmt.Errorf("Consul rejected the update, the values were modified concurrently: %s", strings.Join(what, ", "))
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, result := range response.Results {
+		if result != nil && i < len(names) {
+			c.indexes[names[i]] = result.ModifyIndex
+		}
+	}
+	return nil
+}
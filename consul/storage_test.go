@@ -0,0 +1,120 @@
+package consul
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/connctd/certbuddy/certtest"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKV implements the parts of the Consul KV and transaction API used by KVStorage.
+type fakeKV struct {
+	lock   sync.Mutex
+	index  uint64
+	pairs  map[string]*api.KVPair
+	tokens []string
+}
+
+func newFakeKV() (*fakeKV, *httptest.Server) {
+	kv := &fakeKV{pairs: make(map[string]*api.KVPair)}
+	return kv, httptest.NewServer(kv)
+}
+
+func (f *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.tokens = append(f.tokens, r.URL.Query().Get("token"))
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		pair, exists := f.pairs[strings.TrimPrefix(r.URL.Path, "/v1/kv/")]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(api.KVPairs{pair})
+	case r.Method == "PUT" && r.URL.Path == "/v1/txn":
+		var ops api.TxnOps
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var errs api.TxnErrors
+		for i, op := range ops {
+			var index uint64
+			if pair, exists := f.pairs[op.KV.Key]; exists {
+				index = pair.ModifyIndex
+			}
+			if op.KV.Verb != api.KVCAS || op.KV.Index != index {
+				errs = append(errs, &api.TxnError{OpIndex: i, What: fmt.Sprintf("index mismatch for %s", op.KV.Key)})
+			}
+		}
+		if len(errs) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(api.TxnResponse{Errors: errs})
+			return
+		}
+		var results api.TxnResults
+		for _, op := range ops {
+			f.index++
+			f.pairs[op.KV.Key] = &api.KVPair{Key: op.KV.Key, Value: op.KV.Value, ModifyIndex: f.index}
+			results = append(results, &api.TxnResult{KV: &api.KVPair{Key: op.KV.Key, ModifyIndex: f.index}})
+		}
+		json.NewEncoder(w).Encode(api.TxnResponse{Results: results})
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+func TestKVStorage(t *testing.T) {
+	assert := assert.New(t)
+	kv, server := newFakeKV()
+	defer server.Close()
+
+	storage, err := NewKVStorage(strings.TrimPrefix(server.URL, "http://"), "secret", "/certs/www/")
+	if !assert.Nil(err) {
+		return
+	}
+	assert.False(storage.CertsExist())
+	assert.False(storage.KeyExists())
+
+	chain, key := certtest.Chain(t, 2, "example.com")
+	assert.Nil(storage.SaveKeyAndCerts(key, chain))
+	assert.True(storage.CertsExist())
+	assert.True(storage.KeyExists())
+	assert.Contains(kv.pairs, "certs/www/server.crt")
+	assert.Contains(kv.pairs, "certs/www/private.key")
+	assert.Equal("secret", kv.tokens[0])
+
+	loadedKey, err := storage.LoadKey()
+	assert.Nil(err)
+	assert.Equal(key, loadedKey)
+	certs, err := storage.LoadCerts()
+	assert.Nil(err)
+	if assert.Len(certs, 2) {
+		assert.Equal(chain[0].SerialNumber, certs[0].SerialNumber)
+	}
+
+	// Another instance reading the current values can update them
+	other, err := NewKVStorage(strings.TrimPrefix(server.URL, "http://"), "secret", "certs/www")
+	assert.Nil(err)
+	renewed, _ := certtest.Cert(t, "example.com", false, nil, nil)
+	assert.Nil(other.SaveCerts([]*x509.Certificate{renewed}))
+
+	// The first instance doesn't overwrite the change it hasn't seen
+	stale, _ := certtest.Cert(t, "example.com", false, nil, nil)
+	err = storage.SaveCerts([]*x509.Certificate{stale})
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "modified concurrently")
+	}
+	certs, err = storage.LoadCerts()
+	assert.Nil(err)
+	assert.Equal(renewed.SerialNumber, certs[0].SerialNumber)
+	assert.Nil(storage.SaveCerts([]*x509.Certificate{stale}))
+}
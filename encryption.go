@@ -0,0 +1,268 @@
+package certbuddy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"hash"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const encryptedKeyPemType = "ENCRYPTED PRIVATE KEY"
+
+var (
+	MissingPassphrase   = errors.New("Private key is encrypted, but no passphrase is configured")
+	IncorrectPassphrase = errors.New("Unable to decrypt private key, the passphrase is incorrect")
+
+	// pbkdf2Iterations is the PBKDF2 iteration count of newly encrypted keys.
+	pbkdf2Iterations = 600000
+)
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encryptedPrivateKeyInfo, pbes2Params and pbkdf2Params are the ASN.1 structures of
+// an encrypted PKCS#8 key as defined in RFC 5958 and RFC 8018.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// PassphraseSource names a file or an environment variable containing the passphrase
+// private keys are encrypted with.
+type PassphraseSource struct {
+	File string
+	Env  string
+}
+
+// Load returns the passphrase, or nil if neither a file nor an environment variable is
+// configured. A trailing newline in the file is ignored.
+func (s PassphraseSource) Load() ([]byte, error) {
+	var passphrase string
+	if s.File != "" {
+		data, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+		if passphrase == "" {
+			return nil, fmt.Errorf("Passphrase file %s is empty", s.File)
+		}
+	} else if s.Env != "" {
+		passphrase = os.Getenv(s.Env)
+		if passphrase == "" {
+			return nil, fmt.Errorf("Environment variable %s containing the passphrase is empty", s.Env)
+		}
+	} else {
+		return nil, nil
+	}
+	return []byte(passphrase), nil
+}
+
+// EncodePrivateKey returns the PEM encoded private key in the given format. If a
+// passphrase is given the key is always stored as encrypted PKCS#8 (PBES2 with
+// PBKDF2-HMAC-SHA256 and AES-256-CBC).
+func EncodePrivateKey(key crypto.PrivateKey, format KeyFormat, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return MarshalPrivateKey(key, format)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	der, err := encryptPKCS8(keyBytes, passphrase, pbkdf2Iterations)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedKeyPemType, Bytes: der}), nil
+}
+
+// encryptPKCS8 returns the DER encoded EncryptedPrivateKeyInfo of a PKCS#8 key.
+func encryptPKCS8(keyBytes, passphrase []byte, iterations int) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	derivedKey := pbkdf2.Key(passphrase, salt, iterations, 32, sha256.New)
+	block, err := aes.NewCipher(derivedKey)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(keyBytes)%aes.BlockSize
+	plaintext := append(keyBytes, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	encrypted := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plaintext)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	schemeParams, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: schemeParams}},
+		EncryptedData: encrypted,
+	})
+}
+
+// DecodePrivateKey parses a PEM encoded private key, which is decrypted with the
+// passphrase if it is stored as encrypted PKCS#8.
+func DecodePrivateKey(pemBlockData, passphrase []byte) (crypto.PrivateKey, error) {
+	pemBlock, _ := pem.Decode(pemBlockData)
+	if pemBlock == nil || pemBlock.Type != encryptedKeyPemType {
+		return PemBlockToPrivateKey(pemBlockData)
+	}
+	if len(passphrase) == 0 {
+		return nil, MissingPassphrase
+	}
+	keyBytes, err := decryptPKCS8(pemBlock.Bytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBytes)
+	if err != nil {
+		// The padding of a wrong key is valid by chance every now and then
+		return nil, IncorrectPassphrase
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, UnsupportedPrivateKey
+}
+
+// IsEncryptedPrivateKey returns true if the PEM data contains an encrypted PKCS#8 key.
+func IsEncryptedPrivateKey(pemBlockData []byte) bool {
+	pemBlock, _ := pem.Decode(pemBlockData)
+	return pemBlock != nil && pemBlock.Type == encryptedKeyPemType
+}
+
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	info := encryptedPrivateKeyInfo{}
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("Invalid encrypted private key: %s", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported private key encryption %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	scheme := pbes2Params{}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &scheme); err != nil {
+		return nil, fmt.Errorf("Invalid PBES2 parameters: %s", err)
+	}
+	if !scheme.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("Unsupported key derivation function %s, only PBKDF2 is supported", scheme.KeyDerivationFunc.Algorithm)
+	}
+	kdf := pbkdf2Params{}
+	if _, err := asn1.Unmarshal(scheme.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("Invalid PBKDF2 parameters: %s", err)
+	}
+	if kdf.IterationCount < 1 {
+		return nil, errors.New("Invalid PBKDF2 iteration count of encrypted private key")
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0 || kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA384):
+		prf = sha512.New384
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("Unsupported PBKDF2 pseudorandom function %s", kdf.PRF.Algorithm)
+	}
+	var keyLength int
+	switch {
+	case scheme.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLength = 16
+	case scheme.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLength = 24
+	case scheme.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, fmt.Errorf("Unsupported private key cipher %s, only AES-CBC is supported", scheme.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(scheme.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("Invalid initialization vector of encrypted private key")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("Invalid length of encrypted private key")
+	}
+
+	derivedKey := pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keyLength, prf)
+	block, err := aes.NewCipher(derivedKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, IncorrectPassphrase
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, IncorrectPassphrase
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
@@ -0,0 +1,106 @@
+package certbuddy
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EventType is a stage in the lifecycle of a certificate.
+type EventType string
+
+const (
+	// EventIssued is emitted when a certificate has been obtained for the first time.
+	EventIssued EventType = "issued"
+	// EventRenewed is emitted when a certificate has been renewed with the same key.
+	EventRenewed EventType = "renewed"
+	// EventRenewalFailed is emitted when obtaining or renewing a certificate failed.
+	EventRenewalFailed EventType = "renewal-failed"
+	// EventExpiringSoon is emitted when a certificate expires within the expiry warning
+	// period, which usually means renewals have been failing for a while. It isn't
+	// repeated after every check, see ExpiryRecord.
+	EventExpiringSoon EventType = "expiring-soon"
+	// EventRevoked is emitted when a certificate has been revoked.
+	EventRevoked EventType = "revoked"
+	// EventKeyRotated is emitted when a certificate has been issued for a new private
+	// key, replacing a certificate for the previous key.
+	EventKeyRotated EventType = "key-rotated"
+)
+
+// EventTypes are all known event types.
+var EventTypes = []EventType{EventIssued, EventRenewed, EventRenewalFailed, EventExpiringSoon, EventRevoked, EventKeyRotated}
+
+// ParseEventType returns the event type with the given name.
+func ParseEventType(name string) (EventType, error) {
+	for _, eventType := range EventTypes {
+		if string(eventType) == name {
+			return eventType, nil
+		}
+	}
+	names := make([]string, 0, len(EventTypes))
+	for _, eventType := range EventTypes {
+		names = append(names, string(eventType))
+	}
+	return "", fmt.Errorf("Unknown event %s, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// Event describes something that happened to a managed certificate.
+type Event struct {
+	Type EventType
+	// Name of the certificate in the configuration
+	Name    string
+	Domains []string
+	Time    time.Time
+	// Certificate is the new certificate, or the current one for renewal-failed,
+	// expiring-soon and revoked events. It is nil if no certificate exists yet.
+	Certificate *x509.Certificate
+	// Err is the cause of a renewal-failed event.
+	Err error
+	// ConsecutiveFailures is the number of failed attempts in a row for renewal-failed
+	// events.
+	ConsecutiveFailures int
+	// Reason of a revoked event.
+	Reason RevocationReason
+}
+
+// EventRegistry is implemented by registries which want to be notified about all
+// lifecycle events, not only about available and expired certificates.
+type EventRegistry interface {
+	Notify(event Event) error
+}
+
+// ExpiryRecord stores when the last expiring-soon event about a certificate has been
+// emitted, so the event isn't repeated after every check or restart.
+type ExpiryRecord struct {
+	Serial      string    `json:"serial"`
+	LastWarning time.Time `json:"lastWarning"`
+}
+
+// WarningDue tells whether an expiring-soon event about the certificate is due, which is
+// the case if no event has been emitted about it within the interval. A nil record
+// hasn't emitted any event yet.
+func (r *ExpiryRecord) WarningDue(cert *x509.Certificate, interval time.Duration, now time.Time) bool {
+	return r == nil || r.Serial != fmt.Sprintf("%x", cert.SerialNumber) || now.Sub(r.LastWarning) >= interval
+}
+
+// LoadExpiryRecord loads the expiry record stored at the given path. If no record
+// exists, nil is returned.
+func LoadExpiryRecord(recordPath string) (*ExpiryRecord, error) {
+	if !FileExists(recordPath) {
+		return nil, nil
+	}
+	record := &ExpiryRecord{}
+	if err := LoadJsonFromDisk(recordPath, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// StoreExpiryRecord persists the expiry record.
+func StoreExpiryRecord(recordPath string, record *ExpiryRecord) error {
+	if err := EnsureParentPathExists(recordPath); err != nil {
+		return err
+	}
+	return StoreJsonToDisk(recordPath, record)
+}
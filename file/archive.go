@@ -0,0 +1,219 @@
+package file
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+var (
+	archiveDirName = "archive"
+	liveRecordName = "live.json"
+
+	// DefaultRetention is the number of versions an archive keeps by default.
+	DefaultRetention = 5
+)
+
+// Archive keeps every certificate and its private key as a numbered version in the
+// archive subdirectory of the key and certificate storages. The live files of the
+// storages are a copy of the current version, which is recorded in archive/live.json.
+type Archive struct {
+	KeyStore  *FileStorage
+	CertStore *FileStorage
+	// Retention is the number of versions kept. Older versions are pruned, except the
+	// live version.
+	Retention int
+}
+
+type liveRecord struct {
+	Version int `json:"version"`
+}
+
+// Store archives the key and certificates as a new version and makes it the live version.
+func (a *Archive) Store(key crypto.PrivateKey, certs []*x509.Certificate) (int, error) {
+	versions, err := a.Versions()
+	if err != nil {
+		return 0, err
+	}
+	version := 1
+	if len(versions) > 0 {
+		version = versions[len(versions)-1] + 1
+	}
+	keyStore, certStore := a.versionStores(version)
+
+	tx := &transaction{}
+	if err := a.stage(tx, keyStore, certStore, key, certs, version); err != nil {
+		tx.abort()
+		return 0, err
+	}
+	if err := tx.commit(); err != nil {
+		return 0, err
+	}
+	a.prune(version)
+	return version, nil
+}
+
+// Activate makes an archived version the live version.
+func (a *Archive) Activate(version int) error {
+	keyStore, certStore := a.versionStores(version)
+	if !keyStore.KeyExists() || !certStore.CertsExist() {
+		return fmt.Errorf("Version %d doesn't exist in the archive", version)
+	}
+	key, err := keyStore.LoadKey()
+	if err != nil {
+		return errors.Wrapf(err, "Unable to load private key of version %d", version)
+	}
+	certs, err := certStore.LoadCerts()
+	if err != nil {
+		return errors.Wrapf(err, "Unable to load certificates of version %d", version)
+	}
+
+	tx := &transaction{}
+	if err := a.stage(tx, nil, nil, key, certs, version); err != nil {
+		tx.abort()
+		return err
+	}
+	return tx.commit()
+}
+
+// stage stages the archived files if the version stores are given, the live files and
+// the live record.
+func (a *Archive) stage(tx *transaction, keyStore, certStore *FileStorage, key crypto.PrivateKey, certs []*x509.Certificate, version int) error {
+	if keyStore != nil && certStore != nil {
+		if err := keyStore.stageKey(tx, key); err != nil {
+			return errors.Wrap(err, "Unable to archive private key")
+		}
+		if err := certStore.stageCerts(tx, certs); err != nil {
+			return errors.Wrap(err, "Unable to archive certificates")
+		}
+	}
+	if err := a.KeyStore.stageKey(tx, key); err != nil {
+		return err
+	}
+	if err := a.CertStore.stageCerts(tx, certs); err != nil {
+		return err
+	}
+	record, err := json.Marshal(liveRecord{Version: version})
+	if err != nil {
+		return err
+	}
+	return tx.stage(a.liveRecordPath(), record, Permissions{})
+}
+
+// Reencrypt encrypts the live private key and the keys of all archived versions with a
+// new passphrase, or stores them unencrypted if the passphrase is empty. Either all keys
+// are replaced or none.
+func (a *Archive) Reencrypt(passphrase []byte) error {
+	versions, err := a.Versions()
+	if err != nil {
+		return err
+	}
+	stores := []*FileStorage{a.KeyStore}
+	for _, version := range versions {
+		keyStore, _ := a.versionStores(version)
+		stores = append(stores, keyStore)
+	}
+
+	tx := &transaction{}
+	for _, store := range stores {
+		if !store.KeyExists() {
+			continue
+		}
+		key, err := store.LoadKey()
+		if err != nil {
+			tx.abort()
+			return errors.Wrapf(err, "Unable to load private key %s", store.BasePath)
+		}
+		reencrypted := *store
+		reencrypted.Passphrase = passphrase
+		if err := reencrypted.stageKey(tx, key); err != nil {
+			tx.abort()
+			return err
+		}
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	a.KeyStore.Passphrase = passphrase
+	return nil
+}
+
+// Live returns the live version or 0 if nothing has been archived yet.
+func (a *Archive) Live() (int, error) {
+	if !certbuddy.FileExists(a.liveRecordPath()) {
+		return 0, nil
+	}
+	record := &liveRecord{}
+	if err := certbuddy.LoadJsonFromDisk(a.liveRecordPath(), record); err != nil {
+		return 0, errors.Wrap(err, "Unable to load live version")
+	}
+	return record.Version, nil
+}
+
+// Versions returns the archived versions in ascending order.
+func (a *Archive) Versions() ([]int, error) {
+	entries, err := ioutil.ReadDir(path.Join(a.CertStore.BasePath, archiveDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Unable to read archive")
+	}
+	versions := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if version, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// LoadCerts loads the certificates of an archived version.
+func (a *Archive) LoadCerts(version int) ([]*x509.Certificate, error) {
+	_, certStore := a.versionStores(version)
+	return certStore.LoadCerts()
+}
+
+// prune removes the oldest versions exceeding the retention, but never the live version.
+func (a *Archive) prune(live int) {
+	retention := a.Retention
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	versions, err := a.Versions()
+	if err != nil || len(versions) <= retention {
+		return
+	}
+	for _, version := range versions[:len(versions)-retention] {
+		if version == live {
+			continue
+		}
+		keyStore, certStore := a.versionStores(version)
+		for _, dir := range []string{keyStore.BasePath, certStore.BasePath} {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("Unable to prune archived version %s: %v", dir, err)
+			}
+		}
+	}
+}
+
+func (a *Archive) versionStores(version int) (*FileStorage, *FileStorage) {
+	name := strconv.Itoa(version)
+	keyStore, certStore := *a.KeyStore, *a.CertStore
+	keyStore.BasePath = path.Join(a.KeyStore.BasePath, archiveDirName, name)
+	certStore.BasePath = path.Join(a.CertStore.BasePath, archiveDirName, name)
+	return &keyStore, &certStore
+}
+
+func (a *Archive) liveRecordPath() string {
+	return path.Join(a.CertStore.BasePath, archiveDirName, liveRecordName)
+}
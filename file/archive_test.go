@@ -0,0 +1,102 @@
+package file
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/certtest"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestArchiveRetentionAndActivate(t *testing.T) {
+	os.MkdirAll(testBasePath, 0700)
+	defer os.RemoveAll(testBasePath)
+	assert := assert.New(t)
+	archive := &Archive{
+		KeyStore:  &FileStorage{BasePath: path.Join(testBasePath, "keys"), Concat: false},
+		CertStore: &FileStorage{BasePath: path.Join(testBasePath, "certs"), Concat: true},
+		Retention: 3,
+	}
+	live, err := archive.Live()
+	assert.Nil(err)
+	assert.Equal(0, live)
+
+	keys := make([]*ecdsa.PrivateKey, 0, 5)
+	for i := 1; i <= 5; i++ {
+		certs, key := certtest.Chain(t, 2, "example.com")
+		keys = append(keys, key)
+		version, err := archive.Store(key, certs)
+		assert.Nil(err)
+		assert.Equal(i, version)
+	}
+	versions, err := archive.Versions()
+	assert.Nil(err)
+	assert.Equal([]int{3, 4, 5}, versions)
+	live, err = archive.Live()
+	assert.Nil(err)
+	assert.Equal(5, live)
+
+	assert.Nil(archive.Activate(3))
+	live, err = archive.Live()
+	assert.Nil(err)
+	assert.Equal(3, live)
+	key, err := archive.KeyStore.LoadKey()
+	assert.Nil(err)
+	assert.Equal(keys[2], key)
+	archived, err := archive.LoadCerts(3)
+	assert.Nil(err)
+	certs, err := archive.CertStore.LoadCerts()
+	assert.Nil(err)
+	assert.Equal(archived, certs)
+	assert.NotNil(archive.Activate(1))
+
+	// New versions continue after the latest version, not the live one
+	for i := 0; i < 3; i++ {
+		certs, _ := certtest.Chain(t, 1, "example.com")
+		_, err := archive.Store(keys[0], certs)
+		assert.Nil(err)
+	}
+	versions, err = archive.Versions()
+	assert.Nil(err)
+	assert.Equal([]int{6, 7, 8}, versions)
+}
+
+func TestArchiveReencrypt(t *testing.T) {
+	os.MkdirAll(testBasePath, 0700)
+	defer os.RemoveAll(testBasePath)
+	assert := assert.New(t)
+	archive := &Archive{
+		KeyStore:  &FileStorage{BasePath: path.Join(testBasePath, "keys")},
+		CertStore: &FileStorage{BasePath: path.Join(testBasePath, "certs"), Concat: true},
+	}
+	keys := make([]*ecdsa.PrivateKey, 2)
+	for i := range keys {
+		var certs []*x509.Certificate
+		certs, keys[i] = certtest.Chain(t, 1, "example.com")
+		_, err := archive.Store(keys[i], certs)
+		assert.Nil(err)
+	}
+
+	assert.Nil(archive.Reencrypt([]byte("secret")))
+	data, err := ioutil.ReadFile(path.Join(testBasePath, "keys", defaultKeyName))
+	assert.Nil(err)
+	assert.True(certbuddy.IsEncryptedPrivateKey(data))
+	_, err = (&FileStorage{BasePath: archive.KeyStore.BasePath}).LoadKey()
+	assert.Equal(certbuddy.MissingPassphrase, err)
+
+	// Archived keys are encrypted as well, so a rollback still works
+	assert.Nil(archive.Activate(1))
+	key, err := archive.KeyStore.LoadKey()
+	assert.Nil(err)
+	assert.Equal(keys[0], key)
+
+	// An empty passphrase decrypts the keys again
+	assert.Nil(archive.Reencrypt(nil))
+	key, err = (&FileStorage{BasePath: path.Join(testBasePath, "keys", archiveDirName, "2")}).LoadKey()
+	assert.Nil(err)
+	assert.Equal(keys[1], key)
+}
@@ -0,0 +1,217 @@
+package file
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Format is the file format of an Output.
+type Format string
+
+const (
+	// FormatPEM writes the certificate chain as PEM and the private key to a separate
+	// PEM file if a key path is given.
+	FormatPEM Format = "pem"
+	// FormatCombinedPEM writes the private key followed by the certificate chain into a
+	// single PEM file, as expected by HAProxy.
+	FormatCombinedPEM Format = "pem-combined"
+	// FormatDER writes the leaf certificate DER encoded and the private key as DER
+	// encoded PKCS#8 to a separate file if a key path is given.
+	FormatDER Format = "der"
+	// FormatPKCS12 writes the private key and the certificate chain into a password
+	// protected PKCS#12 file, which can be used as Java keystore.
+	FormatPKCS12 Format = "pkcs12"
+)
+
+var formats = []Format{FormatPEM, FormatCombinedPEM, FormatDER, FormatPKCS12}
+
+// ParseFormat returns the output format with the given name.
+func ParseFormat(name string) (Format, error) {
+	for _, format := range formats {
+		if string(format) == strings.ToLower(name) {
+			return format, nil
+		}
+	}
+	names := make([]string, 0, len(formats))
+	for _, format := range formats {
+		names = append(names, string(format))
+	}
+	return "", fmt.Errorf("Unknown output format %s, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// Encoder encodes a private key and its certificate chain into the files of an Output.
+type Encoder interface {
+	// Encode returns the content of the certificate file and of the key file. keyData
+	// is nil if the key is part of the certificate file.
+	Encode(key crypto.PrivateKey, certs []*x509.Certificate) (certData, keyData []byte, err error)
+	// Certificates returns the certificates contained in a certificate file.
+	Certificates(certData []byte) ([]*x509.Certificate, error)
+}
+
+// OutputConfig defines a file written in addition to the storage of a certificate.
+type OutputConfig struct {
+	Format Format
+	// Path of the certificate file.
+	Path string
+	// KeyPath of a separate private key file, only supported by the pem and der formats.
+	KeyPath string
+	// Password protects PKCS#12 files.
+	Password certbuddy.PassphraseSource
+	// Permissions of the written files and their directory.
+	Permissions Permissions
+}
+
+// Output writes a private key and its certificate chain to files in the format another
+// application expects. Either all files are replaced or none. The key is only written
+// together with the certificates, so SaveCerts fails.
+type Output struct {
+	Path        string
+	KeyPath     string
+	Encoder     Encoder
+	Permissions Permissions
+}
+
+// NewOutput returns an Output with the encoder of the configured format.
+func NewOutput(config OutputConfig) (*Output, error) {
+	if config.Path == "" {
+		return nil, errors.New("Path of the output may not be empty")
+	}
+	output := &Output{Path: config.Path, KeyPath: config.KeyPath, Permissions: config.Permissions}
+	switch config.Format {
+	case FormatPEM, "":
+		output.Encoder = pemEncoder{}
+	case FormatCombinedPEM:
+		output.Encoder = combinedPEMEncoder{}
+	case FormatDER:
+		output.Encoder = derEncoder{}
+	case FormatPKCS12:
+		password, err := config.Password.Load()
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to load PKCS#12 password")
+		}
+		if len(password) == 0 {
+			return nil, errors.New("The pkcs12 output format requires a password")
+		}
+		name := strings.TrimSuffix(path.Base(config.Path), path.Ext(config.Path))
+		output.Encoder = pkcs12Encoder{password: string(password), friendlyName: name}
+	default:
+		return nil, fmt.Errorf("Unknown output format %s", config.Format)
+	}
+	if config.KeyPath != "" && (config.Format == FormatCombinedPEM || config.Format == FormatPKCS12) {
+		return nil, fmt.Errorf("The %s output format contains the private key, a separate key path isn't supported", config.Format)
+	}
+	return output, nil
+}
+
+func (o *Output) LoadCerts() ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(o.Path)
+	if err != nil {
+		return nil, err
+	}
+	return o.Encoder.Certificates(data)
+}
+
+func (o *Output) SaveCerts(certs []*x509.Certificate) error {
+	return fmt.Errorf("Output %s can only be written together with the private key", o.Path)
+}
+
+func (o *Output) CertsExist() bool {
+	return certbuddy.FileExists(o.Path)
+}
+
+// SaveKeyAndCerts writes the private key and certificates to the files of the output.
+func (o *Output) SaveKeyAndCerts(key crypto.PrivateKey, certs []*x509.Certificate) error {
+	certData, keyData, err := o.Encoder.Encode(key, certs)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to encode output %s", o.Path)
+	}
+	tx := &transaction{}
+	if err := tx.stage(o.Path, certData, o.Permissions); err != nil {
+		tx.abort()
+		return err
+	}
+	if o.KeyPath != "" && keyData != nil {
+		if err := tx.stage(o.KeyPath, keyData, o.Permissions); err != nil {
+			tx.abort()
+			return err
+		}
+	}
+	return tx.commit()
+}
+
+type pemEncoder struct{}
+
+func (pemEncoder) Encode(key crypto.PrivateKey, certs []*x509.Certificate) ([]byte, []byte, error) {
+	certData, err := certbuddy.CertificatesToPem(certs)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyData, err := certbuddy.ToPemBlock(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certData, keyData, nil
+}
+
+func (pemEncoder) Certificates(certData []byte) ([]*x509.Certificate, error) {
+	return certbuddy.ParseCertificateChain(certData)
+}
+
+type combinedPEMEncoder struct{}
+
+func (combinedPEMEncoder) Encode(key crypto.PrivateKey, certs []*x509.Certificate) ([]byte, []byte, error) {
+	keyData, err := certbuddy.ToPemBlock(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certData, err := certbuddy.CertificatesToPem(certs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(keyData, certData...), nil, nil
+}
+
+func (combinedPEMEncoder) Certificates(certData []byte) ([]*x509.Certificate, error) {
+	return certbuddy.ParseCertificateChain(certData)
+}
+
+type derEncoder struct{}
+
+func (derEncoder) Encode(key crypto.PrivateKey, certs []*x509.Certificate) ([]byte, []byte, error) {
+	if len(certs) == 0 {
+		return nil, nil, certbuddy.NoCertificates
+	}
+	keyData, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs[0].Raw, keyData, nil
+}
+
+func (derEncoder) Certificates(certData []byte) ([]*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(certData)
+	if err != nil {
+		return nil, &certbuddy.CertificateError{Block: 1, Err: err}
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
+type pkcs12Encoder struct {
+	password     string
+	friendlyName string
+}
+
+func (p pkcs12Encoder) Encode(key crypto.PrivateKey, certs []*x509.Certificate) ([]byte, []byte, error) {
+	data, err := certbuddy.EncodePKCS12(key, certs, p.password, p.friendlyName)
+	return data, nil, err
+}
+
+func (p pkcs12Encoder) Certificates(certData []byte) ([]*x509.Certificate, error) {
+	return certbuddy.PKCS12Certificates(certData)
+}
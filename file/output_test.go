@@ -0,0 +1,79 @@
+package file
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/certtest"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestOutputFormats(t *testing.T) {
+	os.MkdirAll(testBasePath, 0700)
+	defer os.RemoveAll(testBasePath)
+	assert := assert.New(t)
+	certs, key := certtest.Chain(t, 2, "example.com")
+	passwordPath := path.Join(testBasePath, "password")
+	assert.Nil(ioutil.WriteFile(passwordPath, []byte("changeit\n"), 0600))
+
+	configs := []OutputConfig{
+		{Format: FormatPEM, Path: path.Join(testBasePath, "cert.pem"), KeyPath: path.Join(testBasePath, "key.pem")},
+		{Format: FormatCombinedPEM, Path: path.Join(testBasePath, "haproxy.pem")},
+		{Format: FormatDER, Path: path.Join(testBasePath, "cert.der"), KeyPath: path.Join(testBasePath, "key.der")},
+		{Format: FormatPKCS12, Path: path.Join(testBasePath, "keystore.p12"), Password: certbuddy.PassphraseSource{File: passwordPath}},
+	}
+	for _, config := range configs {
+		output, err := NewOutput(config)
+		if !assert.Nil(err, string(config.Format)) {
+			continue
+		}
+		assert.False(output.CertsExist())
+		assert.NotNil(output.SaveCerts(certs))
+		assert.Nil(output.SaveKeyAndCerts(key, certs), string(config.Format))
+		assert.True(output.CertsExist())
+		loaded, err := output.LoadCerts()
+		if assert.Nil(err, string(config.Format)) && assert.NotEmpty(loaded) {
+			assert.Equal(certs[0].Raw, loaded[0].Raw)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path.Join(testBasePath, "haproxy.pem"))
+	assert.Nil(err)
+	block, rest := pem.Decode(data)
+	assert.Equal("EC PRIVATE KEY", block.Type)
+	loaded, err := certbuddy.PemBlockToX509Certificate(rest)
+	assert.Nil(err)
+	assert.Len(loaded, 2)
+
+	data, err = ioutil.ReadFile(path.Join(testBasePath, "key.der"))
+	assert.Nil(err)
+	derKey, err := x509.ParsePKCS8PrivateKey(data)
+	assert.Nil(err)
+	assert.Equal(key, derKey)
+
+	data, err = ioutil.ReadFile(path.Join(testBasePath, "keystore.p12"))
+	assert.Nil(err)
+	loaded, err = certbuddy.PKCS12Certificates(data)
+	assert.Nil(err)
+	assert.Len(loaded, 2)
+}
+
+func TestNewOutputErrors(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewOutput(OutputConfig{Format: FormatCombinedPEM, Path: "haproxy.pem", KeyPath: "key.pem"})
+	assert.NotNil(err)
+	_, err = NewOutput(OutputConfig{Format: FormatPKCS12, Path: "keystore.p12"})
+	assert.NotNil(err)
+	_, err = NewOutput(OutputConfig{Format: "jks", Path: "keystore.jks"})
+	assert.NotNil(err)
+	_, err = NewOutput(OutputConfig{Format: FormatPEM})
+	assert.NotNil(err)
+
+	format, err := ParseFormat("PKCS12")
+	assert.Nil(err)
+	assert.Equal(FormatPKCS12, format)
+}
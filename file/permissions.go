@@ -0,0 +1,148 @@
+package file
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	defaultFileMode os.FileMode = 0600
+	defaultDirMode  os.FileMode = 0700
+
+	placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+	placeholderNames   = []string{"{domain}", "{name}", "{key_type}"}
+)
+
+// Permissions of the files written by a storage or an output. The zero value writes
+// files only the certbuddy user can read, like 0600 files in 0700 directories.
+type Permissions struct {
+	// FileMode of written files, defaults to 0600.
+	FileMode os.FileMode
+	// DirMode of the directory files are written to. Missing directories are created
+	// with 0700 by default, the mode of existing directories is only changed if set.
+	DirMode os.FileMode
+	// Owner and Group of written files and their directory as name or numeric id. Empty
+	// values keep the owner and group of the certbuddy process.
+	Owner string
+	Group string
+}
+
+// ParseFileMode parses an octal file mode like 0640.
+func ParseFileMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0777 {
+		return 0, fmt.Errorf("Invalid file mode %s, expected an octal mode like 0640", mode)
+	}
+	return os.FileMode(value), nil
+}
+
+func (p Permissions) fileMode() os.FileMode {
+	if p.FileMode == 0 {
+		return defaultFileMode
+	}
+	return p.FileMode
+}
+
+// ids returns the numeric user and group id, -1 if they should be left unchanged.
+func (p Permissions) ids() (int, int, error) {
+	uid, gid := -1, -1
+	if p.Owner != "" {
+		id, err := strconv.Atoi(p.Owner)
+		if err != nil {
+			u, lookupErr := user.Lookup(p.Owner)
+			if lookupErr != nil {
+				return 0, 0, errors.Wrapf(lookupErr, "Unknown owner %s", p.Owner)
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+	if p.Group != "" {
+		id, err := strconv.Atoi(p.Group)
+		if err != nil {
+			g, lookupErr := user.LookupGroup(p.Group)
+			if lookupErr != nil {
+				return 0, 0, errors.Wrapf(lookupErr, "Unknown group %s", p.Group)
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+	return uid, gid, nil
+}
+
+func (p Permissions) chown(filePath string) error {
+	uid, gid, err := p.ids()
+	if err != nil {
+		return err
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	return os.Chown(filePath, uid, gid)
+}
+
+// ensureDir creates the directory of target if necessary and applies the directory
+// mode, owner and group.
+func (p Permissions) ensureDir(target string) error {
+	dir := filepath.Dir(target)
+	dirMode := p.DirMode
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if dirMode == 0 {
+			dirMode = defaultDirMode
+		}
+		if err := os.MkdirAll(dir, dirMode); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if dirMode != 0 {
+		// MkdirAll is subject to the umask
+		if err := os.Chmod(dir, dirMode); err != nil {
+			return err
+		}
+	}
+	return p.chown(dir)
+}
+
+// Placeholders are the values of the placeholders in file name templates like
+// {domain}.crt.
+type Placeholders struct {
+	// Domain is the first domain of the certificate. A wildcard is written as _, so
+	// *.example.com becomes _.example.com.
+	Domain  string
+	Name    string
+	KeyType string
+}
+
+// Expand replaces the placeholders {domain}, {name} and {key_type} in a file name or
+// path template.
+func (p Placeholders) Expand(template string) string {
+	return strings.NewReplacer(
+		"{domain}", strings.Replace(p.Domain, "*", "_", -1),
+		"{name}", p.Name,
+		"{key_type}", p.KeyType,
+	).Replace(template)
+}
+
+// ValidateTemplate checks that a file name or path template only contains known
+// placeholders.
+func ValidateTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		known := false
+		for _, name := range placeholderNames {
+			known = known || placeholder == name
+		}
+		if !known {
+			return fmt.Errorf("Unknown placeholder %s in %s, expected one of %s", placeholder, template, strings.Join(placeholderNames, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package file
+
+import (
+	"github.com/connctd/certbuddy/certtest"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	os.MkdirAll(testBasePath, 0700)
+	defer os.RemoveAll(testBasePath)
+	assert := assert.New(t)
+	perm := Permissions{
+		FileMode: 0640,
+		DirMode:  0750,
+		Owner:    strconv.Itoa(os.Getuid()),
+		Group:    strconv.Itoa(os.Getgid()),
+	}
+	keyStor := &FileStorage{BasePath: path.Join(testBasePath, "key"), Permissions: perm}
+	certStor := &FileStorage{BasePath: path.Join(testBasePath, "cert"), Concat: true}
+	certs, key := certtest.Chain(t, 2, "example.com")
+	assert.Nil(SaveKeyAndCerts(keyStor, key, certStor, certs))
+
+	info, err := os.Stat(keyStor.keyPath())
+	if assert.Nil(err) {
+		assert.Equal(os.FileMode(0640), info.Mode().Perm())
+	}
+	info, err = os.Stat(keyStor.BasePath)
+	if assert.Nil(err) {
+		assert.Equal(os.FileMode(0750), info.Mode().Perm())
+	}
+	info, err = os.Stat(certStor.concatPath())
+	if assert.Nil(err) {
+		assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	}
+
+	keyStor.Permissions.Owner = "no-such-user-certbuddy"
+	assert.NotNil(keyStor.SaveKey(key))
+	loaded, err := keyStor.LoadKey()
+	assert.Nil(err)
+	assert.Equal(key, loaded)
+}
+
+func TestParseFileMode(t *testing.T) {
+	assert := assert.New(t)
+	mode, err := ParseFileMode("0640")
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0640), mode)
+	mode, err = ParseFileMode("644")
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0644), mode)
+	for _, invalid := range []string{"", "0980", "rw-r-----", "01777"} {
+		_, err = ParseFileMode(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	assert := assert.New(t)
+	names := Placeholders{Domain: "*.example.com", Name: "www", KeyType: "ec256"}
+	assert.Equal("_.example.com.crt", names.Expand("{domain}.crt"))
+	assert.Equal("/etc/ssl/www/ec256/fullchain.pem", names.Expand("/etc/ssl/{name}/{key_type}/fullchain.pem"))
+	assert.Equal("privkey.pem", names.Expand("privkey.pem"))
+
+	assert.Nil(ValidateTemplate("{domain}-{key_type}.pem"))
+	assert.Nil(ValidateTemplate(""))
+	err := ValidateTemplate("{domian}.crt")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "Unknown placeholder {domian}")
+	}
+}
@@ -9,36 +9,50 @@ import (
 	"io/ioutil"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 var (
-	defaultCertExtension = "crt"
-	defaultCertBaseName  = "server"
-
-	defaultKeyName = "private.key"
+	defaultCertName = "server.crt"
+	defaultKeyName  = "private.key"
 )
 
 type FileStorage struct {
 	BasePath string
 	Concat   bool
+	// CertFileName is the name of the concatenated certificate file, defaults to
+	// server.crt. Without Concat the chain files are numbered, e.g. server0.crt.
+	CertFileName string
+	// KeyFileName is the name of the private key file, defaults to private.key
+	KeyFileName string
+	// KeyFormat of the stored private key, defaults to PKCS#1 and SEC 1
+	KeyFormat certbuddy.KeyFormat
+	// Passphrase encrypts the private key if not empty
+	Passphrase []byte
+	// LeafFileName and ChainFileName additionally write the leaf certificate and the
+	// issuer certificates to separate files if not empty, e.g. cert.pem and chain.pem.
+	// They are only written, certificates are always loaded from the certificate file.
+	LeafFileName  string
+	ChainFileName string
+	// Permissions of the written files and their directory
+	Permissions Permissions
 }
 
 func (c *FileStorage) LoadCerts() ([]*x509.Certificate, error) {
 	if c.Concat {
-		certPath := path.Join(c.BasePath, fmt.Sprintf("%s.%s", defaultCertBaseName, defaultCertExtension))
-		data, err := ioutil.ReadFile(certPath)
+		data, err := ioutil.ReadFile(c.concatPath())
 		if err != nil {
 			return nil, errors.Wrap(err, "Unable to read concatenated certificate file")
 		}
 		if len(data) == 0 {
 			return nil, errors.New("Empty file")
 		}
-		return certbuddy.PemBlockToX509Certificate(data)
+		return certbuddy.ParseCertificateChain(data)
 	} else {
-		certFiles, _ := filepath.Glob(path.Join(c.BasePath, fmt.Sprintf("%s*.%s", defaultCertBaseName, defaultCertExtension)))
 		certs := make([]*x509.Certificate, 0, 2)
-		for _, certFile := range certFiles {
-			data, err := ioutil.ReadFile(path.Join(c.BasePath, certFile))
+		for i := 0; certbuddy.FileExists(c.chainPath(i)); i++ {
+			data, err := ioutil.ReadFile(c.chainPath(i))
 			if err != nil {
 				return nil, err
 			}
@@ -48,76 +62,185 @@ func (c *FileStorage) LoadCerts() ([]*x509.Certificate, error) {
 			}
 			certs = append(certs, cert...)
 		}
-		return certs, nil
+		return certbuddy.OrderChain(certs)
 	}
 }
 
 func (c *FileStorage) SaveCerts(certs []*x509.Certificate) error {
+	tx := &transaction{}
+	if err := c.stageCerts(tx, certs); err != nil {
+		tx.abort()
+		return err
+	}
+	return tx.commit()
+}
+
+// stageCerts stages the certificate files. Chain files of a previous, longer chain are
+// removed on commit.
+func (c *FileStorage) stageCerts(tx *transaction, certs []*x509.Certificate) error {
 	if c.Concat {
-		pemBytes := make([]byte, 0, 2048)
-		for _, cert := range certs {
-			data, err := certbuddy.ToPemBlock(cert)
-			if err != nil {
-				return err
-			}
-			pemBytes = append(pemBytes, data...)
-		}
-		certPath := path.Join(c.BasePath, fmt.Sprintf("%s.%s", defaultCertBaseName, defaultCertExtension))
-		if err := certbuddy.EnsureParentPathExists(certPath); err != nil {
-			return errors.Wrap(err, "Unable to create parent path for certificate file")
+		pemBytes, err := certbuddy.CertificatesToPem(certs)
+		if err != nil {
+			return err
 		}
-		if err := ioutil.WriteFile(certPath, pemBytes, 0600); err != nil {
+		if err := tx.stage(c.concatPath(), pemBytes, c.Permissions); err != nil {
 			return errors.Wrap(err, "Unable to write concatenated certificate file")
 		}
-	} else {
-		for i, cert := range certs {
-			certFile := path.Join(c.BasePath, fmt.Sprintf("%s%d.%s", defaultCertBaseName, i, defaultCertExtension))
-			if err := certbuddy.EnsureParentPathExists(certFile); err != nil {
-				return errors.Wrap(err, "Unable to create parent path for certificate")
-			}
-			pemBytes, err := certbuddy.ToPemBlock(cert)
-			if err != nil {
-				return errors.Wrap(err, "Unable to convert certificate to PEM block")
-			}
-			if err := ioutil.WriteFile(certFile, pemBytes, 0600); err != nil {
-				return errors.Wrap(err, "Unable to write certificate file")
-			}
+		return c.stageLeafAndChain(tx, certs)
+	}
+	for i, cert := range certs {
+		pemBytes, err := certbuddy.ToPemBlock(cert)
+		if err != nil {
+			return errors.Wrap(err, "Unable to convert certificate to PEM block")
+		}
+		if err := tx.stage(c.chainPath(i), pemBytes, c.Permissions); err != nil {
+			return errors.Wrap(err, "Unable to write certificate file")
+		}
+	}
+	if err := c.stageLeafAndChain(tx, certs); err != nil {
+		return err
+	}
+	base, ext := c.chainName()
+	staleFiles, _ := filepath.Glob(path.Join(c.BasePath, base+"*"+ext))
+	for _, staleFile := range staleFiles {
+		i, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path.Base(staleFile), base), ext))
+		if err == nil && i >= len(certs) {
+			tx.removeOnCommit(staleFile)
+		}
+	}
+	return nil
+}
+
+// stageLeafAndChain stages the separate leaf and issuer certificate files if configured.
+func (c *FileStorage) stageLeafAndChain(tx *transaction, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return nil
+	}
+	if c.LeafFileName != "" {
+		pemBytes, err := certbuddy.ToPemBlock(certs[0])
+		if err != nil {
+			return errors.Wrap(err, "Unable to convert certificate to PEM block")
+		}
+		if err := tx.stage(path.Join(c.BasePath, c.LeafFileName), pemBytes, c.Permissions); err != nil {
+			return errors.Wrap(err, "Unable to write leaf certificate file")
+		}
+	}
+	if c.ChainFileName != "" {
+		pemBytes, err := certbuddy.CertificatesToPem(certs[1:])
+		if err != nil {
+			return err
+		}
+		if err := tx.stage(path.Join(c.BasePath, c.ChainFileName), pemBytes, c.Permissions); err != nil {
+			return errors.Wrap(err, "Unable to write chain certificate file")
 		}
 	}
 	return nil
 }
 
+// CertFilePath returns the path of the concatenated certificate file.
+func (c *FileStorage) CertFilePath() string {
+	return c.concatPath()
+}
+
+func (c *FileStorage) concatPath() string {
+	if c.CertFileName == "" {
+		return path.Join(c.BasePath, defaultCertName)
+	}
+	return path.Join(c.BasePath, c.CertFileName)
+}
+
+// chainName returns the name of the certificate file split into base name and extension.
+func (c *FileStorage) chainName() (string, string) {
+	name := path.Base(c.concatPath())
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext), ext
+}
+
+func (c *FileStorage) chainPath(i int) string {
+	base, ext := c.chainName()
+	return path.Join(c.BasePath, fmt.Sprintf("%s%d%s", base, i, ext))
+}
+
+// KeyFilePath returns the path of the private key file.
+func (c *FileStorage) KeyFilePath() string {
+	return c.keyPath()
+}
+
+func (c *FileStorage) keyPath() string {
+	if c.KeyFileName == "" {
+		return path.Join(c.BasePath, defaultKeyName)
+	}
+	return path.Join(c.BasePath, c.KeyFileName)
+}
+
 func (c *FileStorage) LoadKey() (crypto.PrivateKey, error) {
-	keyPath := path.Join(c.BasePath, defaultKeyName)
+	keyPath := c.keyPath()
 	data, err := ioutil.ReadFile(keyPath)
 	if err != nil {
 		return nil, err
 	}
-	return certbuddy.PemBlockToPrivateKey(data)
+	return certbuddy.DecodePrivateKey(data, c.Passphrase)
 }
 
 func (c *FileStorage) SaveKey(key crypto.PrivateKey) error {
-	keyPath := path.Join(c.BasePath, defaultKeyName)
-	pemBlockData, err := certbuddy.ToPemBlock(key)
-	if err != nil {
+	tx := &transaction{}
+	if err := c.stageKey(tx, key); err != nil {
+		tx.abort()
 		return err
 	}
-	if err := certbuddy.EnsureParentPathExists(keyPath); err != nil {
-		return errors.Wrap(err, "Unable to create parent path to store key file")
+	return tx.commit()
+}
+
+func (c *FileStorage) stageKey(tx *transaction, key crypto.PrivateKey) error {
+	pemBlockData, err := certbuddy.EncodePrivateKey(key, c.KeyFormat, c.Passphrase)
+	if err != nil {
+		return err
 	}
-	if err := ioutil.WriteFile(keyPath, pemBlockData, 0600); err != nil {
+	if err := tx.stage(c.keyPath(), pemBlockData, c.Permissions); err != nil {
 		return errors.Wrap(err, "Unable to write private key file")
 	}
 	return nil
 }
 
+// Reencrypt stores the private key encrypted with a new passphrase, or unencrypted if
+// the passphrase is empty.
+func (c *FileStorage) Reencrypt(passphrase []byte) error {
+	key, err := c.LoadKey()
+	if err != nil {
+		return errors.Wrap(err, "Unable to load private key")
+	}
+	reencrypted := *c
+	reencrypted.Passphrase = passphrase
+	if err := reencrypted.SaveKey(key); err != nil {
+		return err
+	}
+	c.Passphrase = passphrase
+	return nil
+}
+
+// SaveKeyAndCerts stores a private key together with the certificates issued for it.
+// Either all files are replaced or, if writing any of them fails, none.
+func SaveKeyAndCerts(keyStore *FileStorage, key crypto.PrivateKey, certStore *FileStorage, certs []*x509.Certificate) error {
+	tx := &transaction{}
+	if err := keyStore.stageKey(tx, key); err != nil {
+		tx.abort()
+		return err
+	}
+	if err := certStore.stageCerts(tx, certs); err != nil {
+		tx.abort()
+		return err
+	}
+	return tx.commit()
+}
+
 func (c *FileStorage) CertsExist() bool {
-	certFiles, _ := filepath.Glob(path.Join(c.BasePath, fmt.Sprintf("%s*.%s", defaultCertBaseName, defaultCertExtension)))
+	base, ext := c.chainName()
+	certFiles, _ := filepath.Glob(path.Join(c.BasePath, base+"*"+ext))
 	// TODO probably check if certificates are valid
 	// TODO check fir empty file
 	return len(certFiles) > 0
 }
 
 func (c *FileStorage) KeyExists() bool {
-	return certbuddy.FileExists(path.Join(c.BasePath, defaultKeyName))
+	return certbuddy.FileExists(c.keyPath())
 }
@@ -2,10 +2,13 @@ package file
 
 import (
 	"crypto/x509"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/certtest"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path"
 	"path/filepath"
+	"syscall"
 	"testing"
 )
 
@@ -16,7 +19,7 @@ var (
 func TestStorCertFilesConcated(t *testing.T) {
 	os.MkdirAll(testBasePath, 0700)
 	assert := assert.New(t)
-	stor := FileStorage{testBasePath, true}
+	stor := FileStorage{BasePath: testBasePath, Concat: true}
 	assert.False(stor.CertsExist())
 	certs := make([]*x509.Certificate, 0, 3)
 	for i := 0; i < 3; i++ {
@@ -33,7 +36,7 @@ func TestStorCertFilesConcated(t *testing.T) {
 func TestStoreCertFilesNonConcated(t *testing.T) {
 	os.MkdirAll(testBasePath, 0700)
 	assert := assert.New(t)
-	stor := FileStorage{testBasePath, false}
+	stor := FileStorage{BasePath: testBasePath, Concat: false}
 	assert.False(stor.CertsExist())
 	certs := make([]*x509.Certificate, 0, 3)
 	for i := 0; i < 3; i++ {
@@ -46,3 +49,158 @@ func TestStoreCertFilesNonConcated(t *testing.T) {
 	assert.Len(certFiles, 3)
 	os.RemoveAll(testBasePath)
 }
+
+func TestStaleChainFilesRemoved(t *testing.T) {
+	os.MkdirAll(testBasePath, 0700)
+	defer os.RemoveAll(testBasePath)
+	assert := assert.New(t)
+	stor := FileStorage{BasePath: testBasePath, Concat: false}
+	long, _ := certtest.Chain(t, 12, "example.com")
+	assert.Nil(stor.SaveCerts(long))
+	loaded, err := stor.LoadCerts()
+	if assert.Nil(err) && assert.Len(loaded, 12) {
+		for i := range long {
+			assert.Equal(long[i].SerialNumber, loaded[i].SerialNumber)
+		}
+	}
+
+	short, _ := certtest.Chain(t, 2, "example.com")
+	assert.Nil(stor.SaveCerts(short))
+	certFiles, _ := filepath.Glob(path.Join(testBasePath, "*"))
+	assert.Len(certFiles, 2)
+	loaded, err = stor.LoadCerts()
+	assert.Nil(err)
+	assert.Len(loaded, 2)
+}
+
+func TestSaveKeyAndCertsIsAtomic(t *testing.T) {
+	os.MkdirAll(testBasePath, 0700)
+	defer os.RemoveAll(testBasePath)
+	assert := assert.New(t)
+	keyStor := &FileStorage{BasePath: path.Join(testBasePath, "keys"), Concat: false}
+	certStor := &FileStorage{BasePath: path.Join(testBasePath, "certs"), Concat: true}
+	oldCerts, oldKey := certtest.Chain(t, 2, "example.com")
+	assert.Nil(SaveKeyAndCerts(keyStor, oldKey, certStor, oldCerts))
+
+	// The certificate file can't be replaced by a file, so the key has to be restored
+	certPath := path.Join(certStor.BasePath, "server.crt")
+	assert.Nil(os.Remove(certPath))
+	assert.Nil(os.MkdirAll(path.Join(certPath, "blocker"), 0700))
+	newCerts, newKey := certtest.Chain(t, 1, "example.com")
+	assert.NotNil(SaveKeyAndCerts(keyStor, newKey, certStor, newCerts))
+	key, err := keyStor.LoadKey()
+	assert.Nil(err)
+	assert.Equal(oldKey, key)
+	leftovers, _ := filepath.Glob(path.Join(testBasePath, "*", ".*"))
+	assert.Empty(leftovers)
+
+	assert.Nil(os.RemoveAll(certPath))
+	assert.Nil(SaveKeyAndCerts(keyStor, newKey, certStor, newCerts))
+	key, err = keyStor.LoadKey()
+	assert.Nil(err)
+	assert.Equal(newKey, key)
+	certs, err := certStor.LoadCerts()
+	assert.Nil(err)
+	assert.Len(certs, 1)
+}
+
+func TestSaveKeyAndCertsWithoutHardLinks(t *testing.T) {
+	os.MkdirAll(testBasePath, 0700)
+	defer os.RemoveAll(testBasePath)
+	defer func(original func(string, string) error) { link = original }(link)
+	link = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	assert := assert.New(t)
+	keyStor := &FileStorage{BasePath: path.Join(testBasePath, "keys"), Concat: false}
+	certStor := &FileStorage{BasePath: path.Join(testBasePath, "certs"), Concat: true}
+	oldCerts, oldKey := certtest.Chain(t, 2, "example.com")
+	assert.Nil(SaveKeyAndCerts(keyStor, oldKey, certStor, oldCerts))
+
+	// The key is replaced before the certificate fails, so it's restored from the copy
+	certPath := path.Join(certStor.BasePath, "server.crt")
+	assert.Nil(os.Remove(certPath))
+	assert.Nil(os.MkdirAll(path.Join(certPath, "blocker"), 0700))
+	newCerts, newKey := certtest.Chain(t, 1, "example.com")
+	assert.NotNil(SaveKeyAndCerts(keyStor, newKey, certStor, newCerts))
+	key, err := keyStor.LoadKey()
+	assert.Nil(err)
+	assert.Equal(oldKey, key)
+	leftovers, _ := filepath.Glob(path.Join(testBasePath, "*", ".*"))
+	assert.Empty(leftovers)
+
+	assert.Nil(os.RemoveAll(certPath))
+	assert.Nil(SaveKeyAndCerts(keyStor, newKey, certStor, newCerts))
+	key, err = keyStor.LoadKey()
+	assert.Nil(err)
+	assert.Equal(newKey, key)
+}
+
+func TestCustomFileNames(t *testing.T) {
+	os.MkdirAll(testBasePath, 0700)
+	defer os.RemoveAll(testBasePath)
+	assert := assert.New(t)
+	keyStor := &FileStorage{BasePath: testBasePath, KeyFileName: "privkey.pem"}
+	certStor := &FileStorage{BasePath: testBasePath, Concat: true, CertFileName: "fullchain.pem"}
+	certs, key := certtest.Chain(t, 2, "example.com")
+	assert.Nil(SaveKeyAndCerts(keyStor, key, certStor, certs))
+	assert.FileExists(path.Join(testBasePath, "privkey.pem"))
+	assert.FileExists(path.Join(testBasePath, "fullchain.pem"))
+
+	chainStor := &FileStorage{BasePath: path.Join(testBasePath, "chain"), CertFileName: "cert.pem"}
+	os.MkdirAll(chainStor.BasePath, 0700)
+	long, _ := certtest.Chain(t, 3, "example.com")
+	assert.Nil(chainStor.SaveCerts(long))
+	assert.Nil(chainStor.SaveCerts(certs))
+	certFiles, _ := filepath.Glob(path.Join(chainStor.BasePath, "*"))
+	assert.Equal([]string{path.Join(chainStor.BasePath, "cert0.pem"), path.Join(chainStor.BasePath, "cert1.pem")}, certFiles)
+	assert.True(chainStor.CertsExist())
+}
+
+func TestLeafAndChainFiles(t *testing.T) {
+	os.MkdirAll(testBasePath, 0700)
+	defer os.RemoveAll(testBasePath)
+	assert := assert.New(t)
+	stor := &FileStorage{BasePath: testBasePath, Concat: true, CertFileName: "fullchain.pem", LeafFileName: "cert.pem", ChainFileName: "chain.pem"}
+	certs, _ := certtest.Chain(t, 3, "example.com")
+	assert.Nil(stor.SaveCerts(certs))
+
+	leaf, err := certbuddy.LoadCertificateFromDisk(path.Join(testBasePath, "cert.pem"))
+	if assert.Nil(err) && assert.Len(leaf, 1) {
+		assert.Equal(certs[0].Raw, leaf[0].Raw)
+	}
+	chain, err := certbuddy.LoadCertificateFromDisk(path.Join(testBasePath, "chain.pem"))
+	if assert.Nil(err) && assert.Len(chain, 2) {
+		assert.Equal(certs[1].Raw, chain[0].Raw)
+		assert.Equal(certs[2].Raw, chain[1].Raw)
+	}
+	loaded, err := stor.LoadCerts()
+	assert.Nil(err)
+	assert.Len(loaded, 3)
+}
+
+func TestLoadCertsOrdersChain(t *testing.T) {
+	os.MkdirAll(testBasePath, 0700)
+	defer os.RemoveAll(testBasePath)
+	assert := assert.New(t)
+	certs, _ := certtest.Chain(t, 3, "example.com")
+	for _, stor := range []*FileStorage{
+		{BasePath: path.Join(testBasePath, "concat"), Concat: true},
+		{BasePath: path.Join(testBasePath, "chain"), Concat: false},
+	} {
+		os.MkdirAll(stor.BasePath, 0700)
+		assert.Nil(stor.SaveCerts([]*x509.Certificate{certs[2], certs[0], certs[1]}))
+		loaded, err := stor.LoadCerts()
+		if assert.Nil(err) && assert.Len(loaded, 3) {
+			assert.Equal(certs[0].Raw, loaded[0].Raw)
+			assert.Equal(certs[1].Raw, loaded[1].Raw)
+			assert.Equal(certs[2].Raw, loaded[2].Raw)
+		}
+
+		// Certificates which don't belong to the chain aren't loaded
+		other, _ := certtest.Chain(t, 1, "other.example.com")
+		assert.Nil(stor.SaveCerts(append(certs, other...)))
+		_, err = stor.LoadCerts()
+		assert.NotNil(err)
+	}
+}
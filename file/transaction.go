@@ -0,0 +1,174 @@
+package file
+
+import (
+	"github.com/connctd/certbuddy"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// transaction replaces several files at once. All files are written to temporary files
+// first, so nothing is changed if one of them can't be written. Replaced files are kept
+// as backups until all renames succeeded and are restored otherwise.
+type transaction struct {
+	staged []stagedFile
+	remove []string
+}
+
+type stagedFile struct {
+	target  string
+	tmpPath string
+}
+
+// stage writes data to a temporary file with the given permissions, which replaces
+// target on commit.
+func (t *transaction) stage(target string, data []byte, perm Permissions) error {
+	if err := perm.ensureDir(target); err != nil {
+		return errors.Wrapf(err, "Unable to create parent path for %s", target)
+	}
+	removeLeftovers(target)
+	tmpPath, err := certbuddy.WriteTempFile(target, data, perm.fileMode())
+	if err != nil {
+		return errors.Wrapf(err, "Unable to write %s", target)
+	}
+	if err := perm.chown(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "Unable to change owner of %s", target)
+	}
+	t.staged = append(t.staged, stagedFile{target: target, tmpPath: tmpPath})
+	return nil
+}
+
+// removeLeftovers removes temporary files of target left behind by an interrupted
+// transaction.
+func removeLeftovers(target string) {
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".tmp*"))
+	for _, leftover := range leftovers {
+		os.Remove(leftover)
+	}
+}
+
+// removeOnCommit removes a file after all staged files have been renamed.
+func (t *transaction) removeOnCommit(target string) {
+	t.remove = append(t.remove, target)
+}
+
+// abort removes all temporary files.
+func (t *transaction) abort() {
+	for _, file := range t.staged {
+		os.Remove(file.tmpPath)
+	}
+	t.staged = nil
+	t.remove = nil
+}
+
+// commit renames all temporary files to their targets. If a rename fails, the files
+// replaced so far are restored from their backups.
+func (t *transaction) commit() error {
+	defer t.abort()
+	backups := make(map[string]string)
+	committed := make([]stagedFile, 0, len(t.staged))
+	var err error
+	for _, file := range t.staged {
+		if certbuddy.FileExists(file.target) {
+			backup := file.tmpPath + ".bak"
+			if err = backUp(file.target, backup); err != nil {
+				err = errors.Wrapf(err, "Unable to back up %s", file.target)
+				break
+			}
+			backups[file.target] = backup
+		}
+		if err = os.Rename(file.tmpPath, file.target); err != nil {
+			err = errors.Wrapf(err, "Unable to replace %s", file.target)
+			break
+		}
+		committed = append(committed, file)
+	}
+	if err != nil {
+		t.rollback(committed, backups)
+	}
+	for _, backup := range backups {
+		os.Remove(backup)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, target := range t.remove {
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to remove stale file %s: %v", target, err)
+		}
+	}
+	return t.sync()
+}
+
+// link creates the hard links for backups, tests replace it to simulate file systems
+// without hard links.
+var link = os.Link
+
+// backUp keeps the current content of target at backup. A hard link is used where
+// possible, file systems without hard links like vfat, SMB or some FUSE mounts get a copy.
+func backUp(target, backup string) error {
+	if err := link(target, backup); err == nil {
+		return nil
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(target)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(backup)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(backup)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(backup)
+		return err
+	}
+	return nil
+}
+
+func (t *transaction) rollback(committed []stagedFile, backups map[string]string) {
+	for _, file := range committed {
+		backup, exists := backups[file.target]
+		if !exists {
+			os.Remove(file.target)
+			continue
+		}
+		if err := os.Rename(backup, file.target); err != nil {
+			log.Printf("Unable to restore %s: %v", file.target, err)
+		}
+	}
+}
+
+// sync makes the renames durable by syncing every affected directory.
+func (t *transaction) sync() error {
+	dirs := make(map[string]bool)
+	for _, file := range t.staged {
+		dirs[filepath.Dir(file.target)] = true
+	}
+	for _, target := range t.remove {
+		dirs[filepath.Dir(target)] = true
+	}
+	for dir := range dirs {
+		if err := certbuddy.SyncDir(dir); err != nil {
+			return errors.Wrapf(err, "Unable to sync %s", dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package hook
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var (
+	// DefaultTimeout is the time a command may run if no timeout is configured.
+	DefaultTimeout = 5 * time.Minute
+	// Shell runs the commands.
+	Shell = "/bin/sh"
+)
+
+// Kinds of hooks, passed to the commands as $CERTBUDDY_HOOK.
+const (
+	Pre    = "pre"
+	Post   = "post"
+	Deploy = "deploy"
+)
+
+// Config of the commands run by a Registry. Every command is run with the shell, so
+// it may contain arguments, pipes and so on.
+type Config struct {
+	// Pre commands run before a certificate is requested. If one fails, the request is
+	// aborted and retried later.
+	Pre []string
+	// Post commands run after a certificate has been requested, whether the request
+	// succeeded or not.
+	Post []string
+	// Deploy commands run after a certificate has been issued or renewed and stored,
+	// e.g. to reload a web server. A failing command doesn't affect the certificate.
+	Deploy []string
+	// Timeout of a single command, defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Name of the certificate and the paths of its files, passed to the commands.
+	// The paths are empty if the certificate isn't stored in local files.
+	Name     string
+	CertPath string
+	KeyPath  string
+}
+
+// Enabled returns whether any command is configured.
+func (c Config) Enabled() bool {
+	return len(c.Pre) > 0 || len(c.Post) > 0 || len(c.Deploy) > 0
+}
+
+// Registry runs commands when a certificate is requested and when a new certificate
+// is available. Certificates are described by environment variables:
+//
+//	CERTBUDDY_HOOK       pre, post or deploy
+//	CERTBUDDY_NAME       name of the certificate
+//	CERTBUDDY_DOMAINS    space separated list of domains
+//	CERTBUDDY_CERT_PATH  certificate file
+//	CERTBUDDY_KEY_PATH   private key file
+//
+// Deploy commands additionally get CERTBUDDY_SERIAL with the hex encoded serial number
+// and CERTBUDDY_NOT_BEFORE and CERTBUDDY_NOT_AFTER in RFC 3339 format. The output of
+// every command is logged.
+type Registry struct {
+	config Config
+}
+
+// NewRegistry returns a Registry running the configured commands.
+func NewRegistry(config Config) *Registry {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	return &Registry{config: config}
+}
+
+func (r *Registry) BeforeValidation(domains []string) error {
+	for _, command := range r.config.Pre {
+		if err := r.run(Pre, command, r.env(Pre, domains)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) AfterValidation(domains []string) error {
+	return r.runAll(Post, r.config.Post, r.env(Post, domains))
+}
+
+// CertAvailable runs the deploy commands. All commands are run even if one of them
+// fails, the first error is returned.
+func (r *Registry) CertAvailable(cert *x509.Certificate) error {
+	env := append(r.env(Deploy, cert.DNSNames),
+		"CERTBUDDY_SERIAL="+fmt.Sprintf("%x", cert.SerialNumber),
+		"CERTBUDDY_NOT_BEFORE="+cert.NotBefore.UTC().Format(time.RFC3339),
+		"CERTBUDDY_NOT_AFTER="+cert.NotAfter.UTC().Format(time.RFC3339),
+	)
+	return r.runAll(Deploy, r.config.Deploy, env)
+}
+
+func (r *Registry) CertsExpired(cert *x509.Certificate) error {
+	return nil
+}
+
+func (r *Registry) env(kind string, domains []string) []string {
+	return []string{
+		"CERTBUDDY_HOOK=" + kind,
+		"CERTBUDDY_NAME=" + r.config.Name,
+		"CERTBUDDY_DOMAINS=" + strings.Join(domains, " "),
+		"CERTBUDDY_CERT_PATH=" + r.config.CertPath,
+		"CERTBUDDY_KEY_PATH=" + r.config.KeyPath,
+	}
+}
+
+func (r *Registry) runAll(kind string, commands []string, env []string) error {
+	var firstErr error
+	for _, command := range commands {
+		if err := r.run(kind, command, env); err != nil {
+			log.Printf("%+v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// run runs a command with the shell and logs its output. The command is killed when it
+// exceeds the timeout.
+func (r *Registry) run(kind, command string, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, Shell, "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	// Don't wait for background processes of the command which keep its output open
+	cmd.WaitDelay = time.Second
+	log.Printf("Running %s hook for %s: %s", kind, r.config.Name, command)
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line != "" {
+			log.Printf("[%s hook %s] %s", kind, r.config.Name, line)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook %q for %s timed out after %s", kind, command, r.config.Name, r.config.Timeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "%s hook %q for %s failed", kind, command, r.config.Name)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package hook
+
+import (
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeployHooks(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy-hooks")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	envPath := path.Join(dir, "env")
+	registry := NewRegistry(Config{
+		Deploy:   []string{"exit 3", "env | grep ^CERTBUDDY_ | sort > " + envPath},
+		Name:     "www",
+		CertPath: "/certs/www/server.crt",
+		KeyPath:  "/certs/www/private.key",
+	})
+	notAfter := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(0xcafe),
+		DNSNames:     []string{"example.com", "www.example.com"},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	err = registry.CertAvailable(cert)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `deploy hook "exit 3" for www failed`)
+	}
+
+	// The second command runs although the first one failed
+	data, err := ioutil.ReadFile(envPath)
+	if assert.Nil(err) {
+		assert.Equal([]string{
+			"CERTBUDDY_CERT_PATH=/certs/www/server.crt",
+			"CERTBUDDY_DOMAINS=example.com www.example.com",
+			"CERTBUDDY_HOOK=deploy",
+			"CERTBUDDY_KEY_PATH=/certs/www/private.key",
+			"CERTBUDDY_NAME=www",
+			"CERTBUDDY_NOT_AFTER=2030-01-02T03:04:05Z",
+			"CERTBUDDY_NOT_BEFORE=2029-10-04T03:04:05Z",
+			"CERTBUDDY_SERIAL=cafe",
+		}, strings.Split(strings.TrimSpace(string(data)), "\n"))
+	}
+}
+
+func TestValidationHooks(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy-hooks")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "log")
+	registry := NewRegistry(Config{
+		Pre:  []string{`echo "$CERTBUDDY_HOOK $CERTBUDDY_DOMAINS" >> ` + logPath, "false", "echo unreachable >> " + logPath},
+		Post: []string{`echo "$CERTBUDDY_HOOK $CERTBUDDY_DOMAINS" >> ` + logPath},
+		Name: "www",
+	})
+	domains := []string{"example.com"}
+	assert.NotNil(registry.BeforeValidation(domains))
+	assert.Nil(registry.AfterValidation(domains))
+	data, err := ioutil.ReadFile(logPath)
+	if assert.Nil(err) {
+		assert.Equal("pre example.com\npost example.com\n", string(data))
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	assert := assert.New(t)
+	registry := NewRegistry(Config{Deploy: []string{"sleep 10"}, Timeout: 100 * time.Millisecond, Name: "www"})
+	start := time.Now()
+	err := registry.CertAvailable(&x509.Certificate{SerialNumber: big.NewInt(1)})
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "timed out after 100ms")
+	}
+	assert.True(time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,133 @@
+package certbuddy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// KeyType specifies the algorithm and size of a private key.
+type KeyType string
+
+const (
+	RSA2048 KeyType = "rsa2048"
+	RSA3072 KeyType = "rsa3072"
+	RSA4096 KeyType = "rsa4096"
+	EC256   KeyType = "ec256"
+	EC384   KeyType = "ec384"
+	Ed25519 KeyType = "ed25519"
+
+	DefaultKeyType = RSA4096
+)
+
+var keyTypes = []KeyType{RSA2048, RSA3072, RSA4096, EC256, EC384, Ed25519}
+
+// ParseKeyType returns the key type with the given name. An empty name results in
+// DefaultKeyType.
+func ParseKeyType(name string) (KeyType, error) {
+	if name == "" {
+		return DefaultKeyType, nil
+	}
+	for _, keyType := range keyTypes {
+		if string(keyType) == strings.ToLower(name) {
+			return keyType, nil
+		}
+	}
+	names := make([]string, 0, len(keyTypes))
+	for _, keyType := range keyTypes {
+		names = append(names, string(keyType))
+	}
+	return "", fmt.Errorf("Unknown key type %s, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// KeyFormat is the encoding of stored private keys.
+type KeyFormat string
+
+const (
+	// KeyFormatPKCS1 stores RSA keys as PKCS#1 and EC keys as SEC 1. Ed25519 keys can
+	// only be stored as PKCS#8.
+	KeyFormatPKCS1 KeyFormat = "pkcs1"
+	// KeyFormatPKCS8 stores all keys as PKCS#8.
+	KeyFormatPKCS8 KeyFormat = "pkcs8"
+
+	DefaultKeyFormat = KeyFormatPKCS1
+)
+
+// ParseKeyFormat returns the key format with the given name. An empty name results in
+// DefaultKeyFormat.
+func ParseKeyFormat(name string) (KeyFormat, error) {
+	switch KeyFormat(strings.ToLower(name)) {
+	case "":
+		return DefaultKeyFormat, nil
+	case KeyFormatPKCS1:
+		return KeyFormatPKCS1, nil
+	case KeyFormatPKCS8:
+		return KeyFormatPKCS8, nil
+	}
+	return "", fmt.Errorf("Unknown key format %s, expected %s or %s", name, KeyFormatPKCS1, KeyFormatPKCS8)
+}
+
+// MarshalPrivateKey returns the PEM encoded private key in the given format.
+func MarshalPrivateKey(key crypto.PrivateKey, format KeyFormat) ([]byte, error) {
+	if format != KeyFormatPKCS8 {
+		return ToPemBlock(key)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), nil
+}
+
+// GenerateKey generates a new private key of the given type.
+func GenerateKey(keyType KeyType) (crypto.PrivateKey, error) {
+	switch keyType {
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case RSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case RSA4096, "":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case EC256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EC384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("Unknown key type %s", keyType)
+}
+
+// KeyTypeOf returns the type of the given private key or an empty string if the key
+// doesn't match any of the known types.
+func KeyTypeOf(key crypto.PrivateKey) KeyType {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return RSA2048
+		case 3072:
+			return RSA3072
+		case 4096:
+			return RSA4096
+		}
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return EC256
+		case elliptic.P384():
+			return EC384
+		}
+	case ed25519.PrivateKey:
+		return Ed25519
+	}
+	return ""
+}
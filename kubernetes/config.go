@@ -0,0 +1,220 @@
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// ClusterConfig contains the address of the API server and the credentials to access it.
+type ClusterConfig struct {
+	Server string
+	// Token is a bearer token, e.g. of a service account.
+	Token string
+	// CACert contains the PEM encoded certificates to trust for the API server.
+	CACert []byte
+	// ClientCert and ClientKey are a PEM encoded client certificate and key.
+	ClientCert []byte
+	ClientKey  []byte
+	// InsecureSkipVerify disables the verification of the API server certificate.
+	InsecureSkipVerify bool
+	// Namespace is the default namespace of the credentials.
+	Namespace string
+}
+
+// InClusterConfig returns the config of the service account certbuddy runs as inside
+// a pod.
+func InClusterConfig() (*ClusterConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST is not set")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read service account token")
+	}
+	caCert, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read service account CA certificate")
+	}
+	namespace, _ := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	return &ClusterConfig{
+		Server:    "https://" + net.JoinHostPort(host, port),
+		Token:     strings.TrimSpace(string(token)),
+		CACert:    caCert,
+		Namespace: strings.TrimSpace(string(namespace)),
+	}, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData string `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData string `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         string `json:"client-key-data"`
+		} `json:"user"`
+	} `json:"users"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster   string `json:"cluster"`
+			User      string `json:"user"`
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+}
+
+// LoadKubeconfig returns the config of a context in a kubeconfig file, or of the current
+// context if context is empty. Only kubeconfig files in JSON are supported, YAML files
+// can be converted with "kubectl config view --raw -o json".
+func LoadKubeconfig(kubeconfigPath, context string) (*ClusterConfig, error) {
+	data, err := ioutil.ReadFile(kubeconfigPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read kubeconfig")
+	}
+	return parseKubeconfig(data, context, filepath.Dir(kubeconfigPath))
+}
+
+// parseKubeconfig parses a kubeconfig in JSON. Relative file names are resolved against dir.
+func parseKubeconfig(data []byte, context, dir string) (*ClusterConfig, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil, errors.New("Kubeconfig is not in JSON, convert it with \"kubectl config view --raw -o json\"")
+	}
+	config := &kubeconfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, errors.Wrap(err, "Unable to parse kubeconfig")
+	}
+	if context == "" {
+		context = config.CurrentContext
+	}
+	result := &ClusterConfig{}
+	var clusterName, userName string
+	found := false
+	for _, c := range config.Contexts {
+		if c.Name == context {
+			clusterName, userName, result.Namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Context %q doesn't exist in kubeconfig", context)
+	}
+
+	found = false
+	for _, c := range config.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		result.Server = c.Cluster.Server
+		result.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		var err error
+		if result.CACert, err = dataOrFile(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority, dir); err != nil {
+			return nil, errors.Wrap(err, "Unable to load cluster CA certificate")
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Cluster %q doesn't exist in kubeconfig", clusterName)
+	}
+
+	for _, u := range config.Users {
+		if u.Name != userName {
+			continue
+		}
+		result.Token = u.User.Token
+		if u.User.TokenFile != "" {
+			token, err := ioutil.ReadFile(resolve(u.User.TokenFile, dir))
+			if err != nil {
+				return nil, errors.Wrap(err, "Unable to read token file")
+			}
+			result.Token = strings.TrimSpace(string(token))
+		}
+		var err error
+		if result.ClientCert, err = dataOrFile(u.User.ClientCertificateData, u.User.ClientCertificate, dir); err != nil {
+			return nil, errors.Wrap(err, "Unable to load client certificate")
+		}
+		if result.ClientKey, err = dataOrFile(u.User.ClientKeyData, u.User.ClientKey, dir); err != nil {
+			return nil, errors.Wrap(err, "Unable to load client key")
+		}
+	}
+	return result, nil
+}
+
+func dataOrFile(data, file, dir string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(resolve(file, dir))
+	}
+	return nil, nil
+}
+
+func resolve(file, dir string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+func (c *ClusterConfig) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if len(c.CACert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(c.CACert) {
+			return nil, errors.New("Invalid cluster CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(c.ClientCert) > 0 {
+		cert, err := tls.X509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		Timeout:   time.Second * 30,
+	}, nil
+}
+
+// LoadClusterConfig returns the in-cluster config if kubeconfigPath is empty. Outside
+// of a pod a kubeconfig in JSON has to be given explicitly, $KUBECONFIG and
+// ~/.kube/config aren't used since they are usually written in YAML.
+func LoadClusterConfig(kubeconfigPath, context string) (*ClusterConfig, error) {
+	if kubeconfigPath != "" {
+		return LoadKubeconfig(kubeconfigPath, context)
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return nil, errors.New("Not running in a Kubernetes cluster, a kubeconfig in JSON is required, e.g. from \"kubectl config view --raw -o json\"")
+	}
+	return InClusterConfig()
+}
@@ -0,0 +1,287 @@
+// Package kubernetes writes issued certificates and their private keys to Secrets of
+// type kubernetes.io/tls, which can be used by ingress controllers and pods directly.
+package kubernetes
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	secretType = "kubernetes.io/tls"
+
+	certField = "tls.crt"
+	keyField  = "tls.key"
+	caField   = "ca.crt"
+
+	managedByLabel     = "app.kubernetes.io/managed-by"
+	domainsAnnotation  = "certbuddy/domains"
+	notAfterAnnotation = "certbuddy/not-after"
+)
+
+type Config struct {
+	Cluster ClusterConfig
+	// Namespace of the Secret, defaults to the namespace of the cluster config.
+	Namespace string
+	// Name of the Secret.
+	Name string
+	// IncludeCA additionally stores the issuer certificates of the chain as ca.crt.
+	IncludeCA bool
+	// KeyFormat of the stored private key, defaults to PKCS#1 and SEC 1.
+	KeyFormat certbuddy.KeyFormat
+	// Labels and Annotations are added to the Secret.
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// SecretStorage stores the certificate chain and private key in a Secret of type
+// kubernetes.io/tls. Updates are based on the resourceVersion of the Secret, so changes
+// made in the meantime aren't overwritten. The domains and expiry of the certificate are
+// recorded in annotations.
+type SecretStorage struct {
+	config Config
+	client *http.Client
+}
+
+// secret is a Secret as returned by the API server. Fields certbuddy doesn't manage are
+// kept as they are, so updates don't drop them.
+type secret map[string]interface{}
+
+func (s secret) object(name string) map[string]interface{} {
+	object, ok := s[name].(map[string]interface{})
+	if !ok {
+		object = make(map[string]interface{})
+		s[name] = object
+	}
+	return object
+}
+
+func (s secret) setMetadata(field, name, value string) {
+	values, ok := s.object("metadata")[field].(map[string]interface{})
+	if !ok {
+		values = make(map[string]interface{})
+		s.object("metadata")[field] = values
+	}
+	values[name] = value
+}
+
+func (s secret) data(name string) []byte {
+	value, _ := s.object("data")[name].(string)
+	data, _ := base64.StdEncoding.DecodeString(value)
+	return data
+}
+
+func (s secret) setData(name string, value []byte) {
+	s.object("data")[name] = base64.StdEncoding.EncodeToString(value)
+}
+
+// NewSecretStorage validates the config and returns a storage.
+func NewSecretStorage(config Config) (*SecretStorage, error) {
+	if config.Name == "" {
+		return nil, errors.New("Name of the Kubernetes Secret may not be empty")
+	}
+	if config.Cluster.Server == "" {
+		return nil, errors.New("Kubernetes API server may not be empty")
+	}
+	if config.Namespace == "" {
+		config.Namespace = config.Cluster.Namespace
+	}
+	if config.Namespace == "" {
+		config.Namespace = "default"
+	}
+	client, err := config.Cluster.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	return &SecretStorage{config: config, client: client}, nil
+}
+
+func (s *SecretStorage) LoadCerts() ([]*x509.Certificate, error) {
+	sec, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	if sec == nil || len(sec.data(certField)) == 0 {
+		return nil, fmt.Errorf("Secret %s doesn't contain a certificate", s.name())
+	}
+	return certbuddy.ParseCertificateChain(sec.data(certField))
+}
+
+func (s *SecretStorage) SaveCerts(certs []*x509.Certificate) error {
+	return s.update(nil, certs)
+}
+
+func (s *SecretStorage) CertsExist() bool {
+	sec, err := s.get()
+	return err == nil && sec != nil && len(sec.data(certField)) > 0
+}
+
+func (s *SecretStorage) LoadKey() (crypto.PrivateKey, error) {
+	sec, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	if sec == nil || len(sec.data(keyField)) == 0 {
+		return nil, fmt.Errorf("Secret %s doesn't contain a private key", s.name())
+	}
+	return certbuddy.PemBlockToPrivateKey(sec.data(keyField))
+}
+
+func (s *SecretStorage) SaveKey(key crypto.PrivateKey) error {
+	return s.update(key, nil)
+}
+
+func (s *SecretStorage) KeyExists() bool {
+	sec, err := s.get()
+	return err == nil && sec != nil && len(sec.data(keyField)) > 0
+}
+
+// SaveKeyAndCerts stores a private key together with the certificates issued for it in
+// one update of the Secret.
+func (s *SecretStorage) SaveKeyAndCerts(key crypto.PrivateKey, certs []*x509.Certificate) error {
+	return s.update(key, certs)
+}
+
+// update creates or updates the Secret with the key and certificates which aren't nil.
+func (s *SecretStorage) update(key crypto.PrivateKey, certs []*x509.Certificate) error {
+	sec, err := s.get()
+	if err != nil {
+		return err
+	}
+	create := sec == nil
+	if create {
+		sec = secret{"metadata": map[string]interface{}{"name": s.config.Name, "namespace": s.config.Namespace}}
+		sec.setData(certField, nil)
+		sec.setData(keyField, nil)
+	}
+	sec["apiVersion"], sec["kind"], sec["type"] = "v1", "Secret", secretType
+	for name, value := range s.config.Labels {
+		sec.setMetadata("labels", name, value)
+	}
+	for name, value := range s.config.Annotations {
+		sec.setMetadata("annotations", name, value)
+	}
+	sec.setMetadata("labels", managedByLabel, "certbuddy")
+
+	if key != nil {
+		keyData, err := certbuddy.MarshalPrivateKey(key, s.config.KeyFormat)
+		if err != nil {
+			return err
+		}
+		sec.setData(keyField, keyData)
+	}
+	if len(certs) > 0 {
+		chain, err := certbuddy.CertificatesToPem(certs)
+		if err != nil {
+			return err
+		}
+		sec.setData(certField, chain)
+		if s.config.IncludeCA {
+			caCerts, err := certbuddy.CertificatesToPem(certs[1:])
+			if err != nil {
+				return err
+			}
+			sec.setData(caField, caCerts)
+		}
+		sec.setMetadata("annotations", domainsAnnotation, strings.Join(certs[0].DNSNames, ","))
+		sec.setMetadata("annotations", notAfterAnnotation, certs[0].NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	if create {
+		_, err = s.do("POST", s.collectionPath(), sec, nil)
+	} else {
+		_, err = s.do("PUT", s.secretPath(), sec, nil)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to write Secret %s", s.name())
+	}
+	return nil
+}
+
+// get returns the Secret or nil if it doesn't exist.
+func (s *SecretStorage) get() (secret, error) {
+	sec := secret{}
+	found, err := s.do("GET", s.secretPath(), nil, &sec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read Secret %s", s.name())
+	}
+	if !found {
+		return nil, nil
+	}
+	return sec, nil
+}
+
+func (s *SecretStorage) name() string {
+	return s.config.Namespace + "/" + s.config.Name
+}
+
+func (s *SecretStorage) collectionPath() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/secrets", url.PathEscape(s.config.Namespace))
+}
+
+func (s *SecretStorage) secretPath() string {
+	return s.collectionPath() + "/" + url.PathEscape(s.config.Name)
+}
+
+// do sends a request to the API server and decodes the response into out. It returns
+// false if the Secret doesn't exist.
+func (s *SecretStorage) do(method, apiPath string, in, out interface{}) (bool, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return false, err
+		}
+		body = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, strings.TrimSuffix(s.config.Cluster.Server, "/")+apiPath, body)
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Accept", "application/json")
+	if in != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if s.config.Cluster.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+s.config.Cluster.Token)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+	if response.StatusCode == http.StatusNotFound && method == "GET" {
+		return false, nil
+	}
+	if response.StatusCode >= 300 {
+		status := &struct {
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(data, status) == nil && status.Message != "" {
+			return false, fmt.Errorf("Kubernetes API returned %d: %s", response.StatusCode, status.Message)
+		}
+		return false, fmt.Errorf("Kubernetes API returned %d", response.StatusCode)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return false, errors.Wrap(err, "Unable to decode Kubernetes API response")
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,188 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/certtest"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPIServer stores Secrets like the Kubernetes API server, including the optimistic
+// concurrency control via resourceVersion.
+type fakeAPIServer struct {
+	lock    sync.Mutex
+	version int
+	secrets map[string]map[string]interface{}
+}
+
+func newFakeAPIServer() (*fakeAPIServer, *httptest.Server) {
+	f := &fakeAPIServer{secrets: make(map[string]map[string]interface{})}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		writeStatus(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	if len(parts) < 2 || parts[1] != "secrets" {
+		writeStatus(w, http.StatusNotFound, "not found")
+		return
+	}
+	namespace := parts[0]
+	var body map[string]interface{}
+	if r.Method == "POST" || r.Method == "PUT" {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	switch {
+	case r.Method == "POST" && len(parts) == 2:
+		name := body["metadata"].(map[string]interface{})["name"].(string)
+		if _, exists := f.secrets[namespace+"/"+name]; exists {
+			writeStatus(w, http.StatusConflict, "secrets \""+name+"\" already exists")
+			return
+		}
+		f.store(namespace+"/"+name, body)
+		json.NewEncoder(w).Encode(body)
+	case r.Method == "GET" && len(parts) == 3:
+		secret, exists := f.secrets[namespace+"/"+parts[2]]
+		if !exists {
+			writeStatus(w, http.StatusNotFound, "secrets \""+parts[2]+"\" not found")
+			return
+		}
+		json.NewEncoder(w).Encode(secret)
+	case r.Method == "PUT" && len(parts) == 3:
+		current, exists := f.secrets[namespace+"/"+parts[2]]
+		if !exists {
+			writeStatus(w, http.StatusNotFound, "secrets \""+parts[2]+"\" not found")
+			return
+		}
+		if body["metadata"].(map[string]interface{})["resourceVersion"] != current["metadata"].(map[string]interface{})["resourceVersion"] {
+			writeStatus(w, http.StatusConflict, "the object has been modified")
+			return
+		}
+		f.store(namespace+"/"+parts[2], body)
+		json.NewEncoder(w).Encode(body)
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (f *fakeAPIServer) store(name string, secret map[string]interface{}) {
+	f.version++
+	secret["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.version)
+	f.secrets[name] = secret
+}
+
+func writeStatus(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "code": code, "message": message})
+}
+
+func TestSecretStorage(t *testing.T) {
+	assert := assert.New(t)
+	fake, server := newFakeAPIServer()
+	defer server.Close()
+
+	storage, err := NewSecretStorage(Config{
+		Cluster:   ClusterConfig{Server: server.URL, Token: "token", Namespace: "web"},
+		Name:      "www-tls",
+		IncludeCA: true,
+		Labels:    map[string]string{"team": "web"},
+	})
+	if !assert.Nil(err) {
+		return
+	}
+	assert.False(storage.CertsExist())
+
+	certs, key := certtest.Chain(t, 2, "example.com", "example.com", "www.example.com")
+	assert.Nil(storage.SaveKeyAndCerts(key, certs))
+	assert.True(storage.CertsExist())
+	assert.True(storage.KeyExists())
+	loadedKey, err := storage.LoadKey()
+	assert.Nil(err)
+	assert.Equal(key, loadedKey)
+	loaded, err := storage.LoadCerts()
+	assert.Nil(err)
+	assert.Len(loaded, 2)
+
+	secret := secret(fake.secrets["web/www-tls"])
+	assert.Equal("kubernetes.io/tls", secret["type"])
+	metadata := secret.object("metadata")
+	assert.Equal(map[string]interface{}{"team": "web", "app.kubernetes.io/managed-by": "certbuddy"}, metadata["labels"])
+	annotations := metadata["annotations"].(map[string]interface{})
+	assert.Equal("example.com,www.example.com", annotations["certbuddy/domains"])
+	assert.Equal(certs[0].NotAfter.UTC().Format(time.RFC3339), annotations["certbuddy/not-after"])
+	caCerts, err := certbuddy.PemBlockToX509Certificate(secret.data("ca.crt"))
+	if assert.Nil(err) && assert.Len(caCerts, 1) {
+		assert.Equal(certtest.RootName, caCerts[0].Subject.CommonName)
+	}
+
+	// Fields certbuddy doesn't manage are kept
+	metadata["ownerReferences"] = []interface{}{map[string]interface{}{"name": "owner"}}
+	renewed, _ := certtest.Chain(t, 2, "example.com", "example.com", "www.example.com")
+	assert.Nil(storage.SaveCerts(renewed))
+	assert.NotNil(fake.secrets["web/www-tls"]["metadata"].(map[string]interface{})["ownerReferences"])
+	loadedKey, err = storage.LoadKey()
+	assert.Nil(err)
+	assert.Equal(key, loadedKey)
+
+	unauthorized, _ := NewSecretStorage(Config{Cluster: ClusterConfig{Server: server.URL}, Name: "www-tls"})
+	err = unauthorized.SaveCerts(renewed)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "Unauthorized")
+	}
+}
+
+func TestParseKubeconfig(t *testing.T) {
+	assert := assert.New(t)
+	kubeconfig := `{
+  "current-context": "prod",
+  "clusters": [
+    {"name": "prod", "cluster": {"server": "https://k8s.example.com", "insecure-skip-tls-verify": true}},
+    {"name": "dev", "cluster": {"server": "https://dev.example.com"}}
+  ],
+  "users": [{"name": "admin", "user": {"token": "secret"}}],
+  "contexts": [
+    {"name": "prod", "context": {"cluster": "prod", "user": "admin", "namespace": "web"}},
+    {"name": "dev", "context": {"cluster": "dev", "user": "admin"}}
+  ]
+}`
+	config, err := parseKubeconfig([]byte(kubeconfig), "", "/")
+	if assert.Nil(err) {
+		assert.Equal(&ClusterConfig{Server: "https://k8s.example.com", Token: "secret", InsecureSkipVerify: true, Namespace: "web"}, config)
+	}
+	config, err = parseKubeconfig([]byte(kubeconfig), "dev", "/")
+	if assert.Nil(err) {
+		assert.Equal("https://dev.example.com", config.Server)
+		assert.Equal("", config.Namespace)
+	}
+	_, err = parseKubeconfig([]byte(kubeconfig), "staging", "/")
+	assert.NotNil(err)
+	_, err = parseKubeconfig([]byte("apiVersion: v1\nkind: Config\n"), "", "/")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "not in JSON")
+	}
+}
+
+func TestLoadClusterConfigRequiresKubeconfig(t *testing.T) {
+	assert := assert.New(t)
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	defer os.Setenv("KUBERNETES_SERVICE_HOST", host)
+
+	_, err := LoadClusterConfig("", "")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "kubectl config view --raw -o json")
+	}
+}
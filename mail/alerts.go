@@ -0,0 +1,258 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// DefaultFailureThreshold is the number of consecutive failed attempts after which
+	// an alert is sent.
+	DefaultFailureThreshold = 3
+	// DefaultInterval is the minimum time between two alerts of the same kind about
+	// the same certificate.
+	DefaultInterval = 24 * time.Hour
+
+	// sendMail delivers a message, replaced in tests.
+	sendMail = smtp.SendMail
+)
+
+// Config of the SMTP server and the recipients of alerts.
+type Config struct {
+	// Name distinguishes several alert configs in the alert record.
+	Name string
+	// Server is the address of the SMTP server as host:port. STARTTLS is used if the
+	// server supports it.
+	Server string
+	// Username and Password authenticate with PLAIN auth, no auth is used if Username
+	// is empty.
+	Username string
+	Password certbuddy.PassphraseSource
+	From     string
+	To       []string
+	// FailureThreshold is the number of consecutive failed attempts after which an
+	// alert is sent, defaults to DefaultFailureThreshold.
+	FailureThreshold int
+	// Interval is the minimum time between two alerts of the same kind about the same
+	// certificate, defaults to DefaultInterval.
+	Interval time.Duration
+	// Digest sends a summary of all certificates with this interval instead of
+	// individual alerts, see SendDigest.
+	Digest time.Duration
+	// RecordPath is the file remembering when alerts have been sent, so restarts don't
+	// send them again. Alerts are only rate limited in memory if it is empty.
+	RecordPath string
+}
+
+// Validate checks that the server, sender and recipients are set.
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		return fmt.Errorf("Invalid SMTP server %q, expected host:port", c.Server)
+	}
+	if c.From == "" {
+		return errors.New("Sender may not be empty")
+	}
+	if len(c.To) == 0 {
+		return errors.New("No recipient configured")
+	}
+	for _, to := range c.To {
+		if strings.TrimSpace(to) == "" {
+			return errors.New("Recipient may not be empty")
+		}
+	}
+	if c.Password.File != "" && c.Password.Env != "" {
+		return errors.New("Password file and environment variable can't be combined")
+	}
+	return nil
+}
+
+// Record remembers the last alerts sent about a certificate.
+type Record struct {
+	LastFailureAlert time.Time `json:"lastFailureAlert,omitempty"`
+	LastExpiryAlert  time.Time `json:"lastExpiryAlert,omitempty"`
+}
+
+func (r Record) empty() bool {
+	return r.LastFailureAlert.IsZero() && r.LastExpiryAlert.IsZero()
+}
+
+// Registry emails alerts about a single certificate. An alert is sent when the
+// certificate couldn't be renewed FailureThreshold times in a row or expires soon, and
+// once it has been renewed after an alert. Alerts of the same kind are sent at most once
+// per Interval, not after every retry.
+type Registry struct {
+	config   Config
+	password string
+	record   Record
+	now      func() time.Time
+}
+
+// NewRegistry returns a Registry sending alerts according to config.
+func NewRegistry(config Config) (*Registry, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	password, err := config.Password.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load SMTP password")
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultFailureThreshold
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	return &Registry{config: config, password: string(password), now: time.Now}, nil
+}
+
+func (r *Registry) CertAvailable(cert *x509.Certificate) error {
+	return nil
+}
+
+func (r *Registry) CertsExpired(cert *x509.Certificate) error {
+	return nil
+}
+
+// Notify sends an alert if the event requires one. In digest mode no individual alerts
+// are sent.
+func (r *Registry) Notify(event certbuddy.Event) error {
+	if r.config.Digest > 0 {
+		return nil
+	}
+	if err := r.loadRecord(); err != nil {
+		log.Printf("Unable to load alert record for %s: %+v", event.Name, err)
+	}
+	now := r.now()
+	record := r.record
+	var subject, body string
+	switch event.Type {
+	case certbuddy.EventRenewalFailed:
+		if event.ConsecutiveFailures < r.config.FailureThreshold || now.Sub(r.record.LastFailureAlert) < r.config.Interval {
+			return nil
+		}
+		subject = fmt.Sprintf("certbuddy: %s could not be renewed %d times in a row", event.Name, event.ConsecutiveFailures)
+		body = fmt.Sprintf("Obtaining or renewing the certificate %s failed %d times in a row.\n\nLast error: %s\n", event.Name, event.ConsecutiveFailures, event.Err)
+		record.LastFailureAlert = now
+	case certbuddy.EventExpiringSoon:
+		if now.Sub(r.record.LastExpiryAlert) < r.config.Interval {
+			return nil
+		}
+		subject = fmt.Sprintf("certbuddy: %s expires soon", event.Name)
+		body = fmt.Sprintf("The certificate %s expires soon and hasn't been renewed yet.\n", event.Name)
+		record.LastExpiryAlert = now
+	case certbuddy.EventIssued, certbuddy.EventRenewed, certbuddy.EventKeyRotated:
+		if r.record.empty() {
+			return nil
+		}
+		subject = fmt.Sprintf("certbuddy: %s has been renewed", event.Name)
+		body = fmt.Sprintf("The certificate %s has been renewed after an alert.\n", event.Name)
+		record = Record{}
+	default:
+		return nil
+	}
+	body += "\n" + describe(event.Domains, event.Certificate, now)
+	if err := send(r.config, r.password, subject, body, now); err != nil {
+		return errors.Wrapf(err, "Unable to send alert about %s", event.Name)
+	}
+	r.record = record
+	if err := r.storeRecord(); err != nil {
+		log.Printf("Unable to store alert record for %s: %+v", event.Name, err)
+	}
+	return nil
+}
+
+// loadRecord reads the alerts sent by this config from the alert record, which is
+// shared by all alert configs of the certificate.
+func (r *Registry) loadRecord() error {
+	if r.config.RecordPath == "" || !certbuddy.FileExists(r.config.RecordPath) {
+		return nil
+	}
+	records := make(map[string]Record)
+	if err := certbuddy.LoadJsonFromDisk(r.config.RecordPath, &records); err != nil {
+		return err
+	}
+	r.record = records[r.config.Name]
+	return nil
+}
+
+// storeRecord persists the alerts sent by this config. The record is removed once no
+// config has sent an alert which hasn't been resolved.
+func (r *Registry) storeRecord() error {
+	if r.config.RecordPath == "" {
+		return nil
+	}
+	records := make(map[string]Record)
+	if certbuddy.FileExists(r.config.RecordPath) {
+		if err := certbuddy.LoadJsonFromDisk(r.config.RecordPath, &records); err != nil {
+			return err
+		}
+	}
+	if r.record.empty() {
+		delete(records, r.config.Name)
+	} else {
+		records[r.config.Name] = r.record
+	}
+	if len(records) == 0 {
+		if err := os.Remove(r.config.RecordPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := certbuddy.EnsureParentPathExists(r.config.RecordPath); err != nil {
+		return err
+	}
+	return certbuddy.StoreJsonToDisk(r.config.RecordPath, records)
+}
+
+// describe lists the domains and validity of a certificate.
+func describe(domains []string, cert *x509.Certificate, now time.Time) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Domains:     %s\n", strings.Join(domains, ", "))
+	if cert == nil {
+		b.WriteString("Certificate: none\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Serial:      %x\n", cert.SerialNumber)
+	fmt.Fprintf(&b, "Not after:   %s (%s)\n", cert.NotAfter.UTC().Format(time.RFC3339), remaining(cert.NotAfter, now))
+	return b.String()
+}
+
+// remaining describes the time until expiration in days.
+func remaining(notAfter, now time.Time) string {
+	days := int(notAfter.Sub(now).Hours() / 24)
+	switch {
+	case !notAfter.After(now):
+		return "expired"
+	case days == 1:
+		return "1 day left"
+	default:
+		return fmt.Sprintf("%d days left", days)
+	}
+}
+
+// send delivers a plain text message to all recipients.
+func send(config Config, password, subject, body string, now time.Time) error {
+	var auth smtp.Auth
+	if config.Username != "" {
+		host, _, _ := net.SplitHostPort(config.Server)
+		auth = smtp.PlainAuth("", config.Username, password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return sendMail(config.Server, auth, config.From, config.To, msg.Bytes())
+}
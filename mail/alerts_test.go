@@ -0,0 +1,209 @@
+package mail
+
+import (
+	"crypto/x509"
+	"errors"
+	"github.com/connctd/certbuddy"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/smtp"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type message struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+	msg  string
+}
+
+// recordMails replaces sendMail and returns the sent messages. The returned function
+// restores sendMail.
+func recordMails(err error) (*[]message, func()) {
+	var messages []message
+	sendMail = func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		messages = append(messages, message{addr, auth, from, to, string(msg)})
+		return err
+	}
+	return &messages, func() { sendMail = smtp.SendMail }
+}
+
+var testConfig = Config{
+	Server: "smtp.example.com:587",
+	From:   "certbuddy@example.com",
+	To:     []string{"ops@example.com", "oncall@example.com"},
+}
+
+func TestAlerts(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certbuddy")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	messages, reset := recordMails(nil)
+	defer reset()
+
+	config := testConfig
+	config.Name = "ops"
+	config.RecordPath = path.Join(dir, ".alerts.json")
+	registry, err := NewRegistry(config)
+	if !assert.Nil(err) {
+		return
+	}
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	registry.now = func() time.Time { return now }
+	cert := &x509.Certificate{SerialNumber: big.NewInt(0xcafe), NotAfter: now.Add(5 * 24 * time.Hour)}
+	failed := certbuddy.Event{
+		Type:        certbuddy.EventRenewalFailed,
+		Name:        "www",
+		Domains:     []string{"example.com", "www.example.com"},
+		Certificate: cert,
+		Err:         errors.New("rate limited"),
+	}
+
+	// Below the threshold
+	for failed.ConsecutiveFailures = 1; failed.ConsecutiveFailures < DefaultFailureThreshold; failed.ConsecutiveFailures++ {
+		assert.Nil(registry.Notify(failed))
+	}
+	assert.Empty(*messages)
+
+	assert.Nil(registry.Notify(failed))
+	if assert.Len(*messages, 1) {
+		m := (*messages)[0]
+		assert.Equal("smtp.example.com:587", m.addr)
+		assert.Nil(m.auth)
+		assert.Equal("certbuddy@example.com", m.from)
+		assert.Equal(config.To, m.to)
+		assert.Contains(m.msg, "To: ops@example.com, oncall@example.com\r\n")
+		assert.Contains(m.msg, "Subject: certbuddy: www could not be renewed 3 times in a row\r\n")
+		assert.Contains(m.msg, "Last error: rate limited\r\n")
+		assert.Contains(m.msg, "Domains:     example.com, www.example.com\r\n")
+		assert.Contains(m.msg, "Serial:      cafe\r\n")
+		assert.Contains(m.msg, "Not after:   2030-01-06T12:00:00Z (5 days left)\r\n")
+	}
+	assert.True(certbuddy.FileExists(config.RecordPath))
+
+	// Further retries don't send alerts until the interval has passed, not even after
+	// a restart
+	registry, _ = NewRegistry(config)
+	registry.now = func() time.Time { return now }
+	failed.ConsecutiveFailures++
+	now = now.Add(time.Hour)
+	assert.Nil(registry.Notify(failed))
+	assert.Len(*messages, 1)
+	now = now.Add(DefaultInterval)
+	assert.Nil(registry.Notify(failed))
+	assert.Len(*messages, 2)
+
+	// Expiry alerts are rate limited independently
+	expiring := certbuddy.Event{Type: certbuddy.EventExpiringSoon, Name: "www", Certificate: cert}
+	assert.Nil(registry.Notify(expiring))
+	assert.Nil(registry.Notify(expiring))
+	if assert.Len(*messages, 3) {
+		assert.Contains((*messages)[2].msg, "Subject: certbuddy: www expires soon\r\n")
+	}
+
+	// A renewal resolves the alerts
+	renewed := certbuddy.Event{Type: certbuddy.EventRenewed, Name: "www", Certificate: cert}
+	assert.Nil(registry.Notify(renewed))
+	if assert.Len(*messages, 4) {
+		assert.Contains((*messages)[3].msg, "Subject: certbuddy: www has been renewed\r\n")
+	}
+	assert.False(certbuddy.FileExists(config.RecordPath))
+	assert.Nil(registry.Notify(renewed))
+	assert.Len(*messages, 4)
+}
+
+func TestAlertsFailedDelivery(t *testing.T) {
+	assert := assert.New(t)
+	messages, reset := recordMails(errors.New("connection refused"))
+	defer reset()
+	config := testConfig
+	config.FailureThreshold = 1
+	config.Username = "certbuddy"
+	registry, err := NewRegistry(config)
+	if !assert.Nil(err) {
+		return
+	}
+	failed := certbuddy.Event{Type: certbuddy.EventRenewalFailed, Name: "www", ConsecutiveFailures: 1, Err: errors.New("failed")}
+	assert.NotNil(registry.Notify(failed))
+	// An alert which couldn't be delivered is sent again with the next failure
+	assert.NotNil(registry.Notify(failed))
+	if assert.Len(*messages, 2) {
+		assert.NotNil((*messages)[0].auth)
+		assert.Contains((*messages)[0].msg, "Certificate: none\r\n")
+	}
+}
+
+func TestAlertsDigestMode(t *testing.T) {
+	assert := assert.New(t)
+	messages, reset := recordMails(nil)
+	defer reset()
+	config := testConfig
+	config.FailureThreshold = 1
+	config.Digest = 24 * time.Hour
+	registry, err := NewRegistry(config)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Nil(registry.Notify(certbuddy.Event{Type: certbuddy.EventRenewalFailed, Name: "www", ConsecutiveFailures: 5}))
+	assert.Nil(registry.Notify(certbuddy.Event{Type: certbuddy.EventExpiringSoon, Name: "www"}))
+	assert.Empty(*messages)
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(testConfig.Validate())
+	config := testConfig
+	config.Server = "smtp.example.com"
+	assert.NotNil(config.Validate())
+	config = testConfig
+	config.From = ""
+	assert.NotNil(config.Validate())
+	config = testConfig
+	config.To = []string{""}
+	assert.NotNil(config.Validate())
+	_, err := NewRegistry(Config{})
+	assert.NotNil(err)
+}
+
+func TestSendDigest(t *testing.T) {
+	assert := assert.New(t)
+	messages, reset := recordMails(nil)
+	defer reset()
+	notAfter := time.Now().Add(60*24*time.Hour + time.Hour)
+	statuses := []Status{
+		{Name: "www", Domains: []string{"example.com"}, Certificate: &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: notAfter}},
+		{
+			Name:                "api",
+			Domains:             []string{"api.example.com"},
+			Certificate:         &x509.Certificate{SerialNumber: big.NewInt(2), NotAfter: notAfter},
+			ConsecutiveFailures: 4,
+			LastError:           "timeout",
+			NextAttempt:         time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{Name: "new", Domains: []string{"new.example.com"}},
+	}
+	assert.Nil(SendDigest(testConfig, statuses))
+	if assert.Len(*messages, 1) {
+		msg := (*messages)[0].msg
+		assert.Contains(msg, "Subject: certbuddy digest: 2 of 3 certificates need attention\r\n")
+		assert.Contains(msg, "Need attention:\r\n\r\napi\r\n")
+		assert.Contains(msg, "Failures:    4 in a row, next attempt at 2030-01-01T00:00:00Z\r\nLast error:  timeout\r\n")
+		assert.Contains(msg, "new\r\nDomains:     new.example.com\r\nCertificate: none\r\n")
+		assert.Contains(msg, "Fine:\r\n\r\nwww\r\n")
+		assert.Contains(msg, "(60 days left)")
+	}
+
+	assert.Nil(SendDigest(testConfig, statuses[:1]))
+	if assert.Len(*messages, 2) {
+		assert.Contains((*messages)[1].msg, "Subject: certbuddy digest: all 1 certificates are fine\r\n")
+		assert.NotContains((*messages)[1].msg, "Need attention")
+	}
+}
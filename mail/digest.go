@@ -0,0 +1,74 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Status describes a managed certificate in a digest.
+type Status struct {
+	Name    string
+	Domains []string
+	// Certificate is the current leaf certificate, nil if none has been issued yet.
+	Certificate *x509.Certificate
+	// ExpiringSoon tells whether the certificate is within its expiry warning period.
+	ExpiringSoon        bool
+	ConsecutiveFailures int
+	LastError           string
+	NextAttempt         time.Time
+}
+
+// SendDigest emails a summary of all certificates. Certificates which couldn't be
+// renewed FailureThreshold times in a row, expire soon or haven't been issued yet are
+// listed first.
+func SendDigest(config Config, statuses []Status) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	password, err := config.Password.Load()
+	if err != nil {
+		return errors.Wrap(err, "Unable to load SMTP password")
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultFailureThreshold
+	}
+	now := time.Now()
+	var attention, fine []Status
+	for _, status := range statuses {
+		if status.Certificate == nil || status.ExpiringSoon || status.ConsecutiveFailures >= config.FailureThreshold {
+			attention = append(attention, status)
+		} else {
+			fine = append(fine, status)
+		}
+	}
+
+	subject := fmt.Sprintf("certbuddy digest: all %d certificates are fine", len(statuses))
+	if len(attention) > 0 {
+		subject = fmt.Sprintf("certbuddy digest: %d of %d certificates need attention", len(attention), len(statuses))
+	}
+	var body bytes.Buffer
+	if len(attention) > 0 {
+		body.WriteString("Need attention:\n\n")
+		writeStatuses(&body, attention, now)
+	}
+	if len(fine) > 0 {
+		body.WriteString("Fine:\n\n")
+		writeStatuses(&body, fine, now)
+	}
+	return errors.Wrap(send(config, string(password), subject, body.String(), now), "Unable to send digest")
+}
+
+func writeStatuses(body *bytes.Buffer, statuses []Status, now time.Time) {
+	for _, status := range statuses {
+		fmt.Fprintf(body, "%s\n", status.Name)
+		body.WriteString(describe(status.Domains, status.Certificate, now))
+		if status.ConsecutiveFailures > 0 {
+			fmt.Fprintf(body, "Failures:    %d in a row, next attempt at %s\n", status.ConsecutiveFailures, status.NextAttempt.UTC().Format(time.RFC3339))
+			fmt.Fprintf(body, "Last error:  %s\n", status.LastError)
+		}
+		body.WriteString("\n")
+	}
+}
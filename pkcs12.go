@@ -0,0 +1,300 @@
+package certbuddy
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// pkcs12Iterations is the iteration count of the key encryption and the MAC of PKCS#12
+// files, the default of Java's keytool.
+var pkcs12Iterations = 10000
+
+var (
+	oidDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidShroudedKeyBag  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+)
+
+// pkcs12MACKeyID is the ID of the PKCS#12 key derivation producing the MAC key.
+const pkcs12MACKeyID byte = 3
+
+// The ASN.1 structures of a PKCS#12 file as defined in RFC 7292.
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// EncodePKCS12 returns a PKCS#12 file containing the private key and the certificate
+// chain, which can be read by Java, openssl and most other tools. The key is encrypted
+// with PBES2 and AES-256-CBC and the file is protected by an HMAC-SHA256, both derived
+// from the password. The certificates aren't encrypted. The friendly name becomes the
+// alias of the key entry in a Java keystore.
+func EncodePKCS12(key crypto.PrivateKey, certs []*x509.Certificate, password, friendlyName string) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, NoCertificates
+	}
+	if password == "" {
+		return nil, errors.New("PKCS#12 files require a password")
+	}
+	localKeyID := sha1.Sum(certs[0].Raw)
+	attributes, err := pkcs12Attributes(localKeyID[:], friendlyName)
+	if err != nil {
+		return nil, err
+	}
+
+	certBags := make([]safeBag, 0, len(certs))
+	for i, cert := range certs {
+		data, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: cert.Raw})
+		if err != nil {
+			return nil, err
+		}
+		bag := safeBag{ID: oidCertBag, Value: explicitValue(data)}
+		if i == 0 {
+			bag.Attributes = attributes
+		}
+		certBags = append(certBags, bag)
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := encryptPKCS8(keyBytes, []byte(password), pkcs12Iterations)
+	if err != nil {
+		return nil, err
+	}
+	keyBags := []safeBag{{ID: oidShroudedKeyBag, Value: explicitValue(encryptedKey), Attributes: attributes}}
+
+	var safes []contentInfo
+	for _, bags := range [][]safeBag{certBags, keyBags} {
+		data, err := asn1.Marshal(bags)
+		if err != nil {
+			return nil, err
+		}
+		info, err := dataContentInfo(data)
+		if err != nil {
+			return nil, err
+		}
+		safes = append(safes, info)
+	}
+	authSafe, err := asn1.Marshal(safes)
+	if err != nil {
+		return nil, err
+	}
+	pfx := pfxPdu{Version: 3}
+	if pfx.AuthSafe, err = dataContentInfo(authSafe); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, pkcs12KDF(sha256.Size, pkcs12MACKeyID, bmpString(password), salt, pkcs12Iterations))
+	mac.Write(authSafe)
+	pfx.MacData = macData{
+		Mac: digestInfo{
+			Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			Digest:    mac.Sum(nil),
+		},
+		MacSalt:    salt,
+		Iterations: pkcs12Iterations,
+	}
+	return asn1.Marshal(pfx)
+}
+
+// PKCS12Certificates returns the unencrypted certificates of a PKCS#12 file, as written
+// by EncodePKCS12. The password isn't needed and the MAC isn't verified.
+func PKCS12Certificates(data []byte) ([]*x509.Certificate, error) {
+	pfx := pfxPdu{}
+	if _, err := asn1.Unmarshal(data, &pfx); err != nil {
+		return nil, fmt.Errorf("Invalid PKCS#12 file: %s", err)
+	}
+	authSafe, err := contentData(pfx.AuthSafe)
+	if err != nil {
+		return nil, err
+	}
+	var safes []contentInfo
+	if _, err := asn1.Unmarshal(authSafe, &safes); err != nil {
+		return nil, fmt.Errorf("Invalid PKCS#12 content: %s", err)
+	}
+	var certs []*x509.Certificate
+	for _, safe := range safes {
+		if !safe.ContentType.Equal(oidDataContentType) {
+			// Encrypted content requires the password
+			continue
+		}
+		data, err := contentData(safe)
+		if err != nil {
+			return nil, err
+		}
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(data, &bags); err != nil {
+			return nil, fmt.Errorf("Invalid PKCS#12 safe contents: %s", err)
+		}
+		for _, bag := range bags {
+			if !bag.ID.Equal(oidCertBag) {
+				continue
+			}
+			certData := certBag{}
+			if _, err := asn1.Unmarshal(bag.Value.Bytes, &certData); err != nil {
+				return nil, fmt.Errorf("Invalid PKCS#12 certificate bag: %s", err)
+			}
+			cert, err := x509.ParseCertificate(certData.Data)
+			if err != nil {
+				return nil, &CertificateError{Block: len(certs) + 1, Err: err}
+			}
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, NoCertificates
+	}
+	return certs, nil
+}
+
+func pkcs12Attributes(localKeyID []byte, friendlyName string) ([]pkcs12Attribute, error) {
+	keyID, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	attributes := []pkcs12Attribute{{ID: oidLocalKeyID, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: keyID}}}
+	if friendlyName != "" {
+		bmpName := bmpString(friendlyName)
+		name, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagBMPString, Bytes: bmpName[:len(bmpName)-2]})
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, pkcs12Attribute{ID: oidFriendlyName, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: name}})
+	}
+	return attributes, nil
+}
+
+// explicitValue wraps DER data in an explicit context specific tag 0.
+func explicitValue(data []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: data}
+}
+
+func dataContentInfo(data []byte) (contentInfo, error) {
+	octets, err := asn1.Marshal(data)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{ContentType: oidDataContentType, Content: explicitValue(octets)}, nil
+}
+
+func contentData(info contentInfo) ([]byte, error) {
+	if !info.ContentType.Equal(oidDataContentType) {
+		return nil, fmt.Errorf("Unsupported PKCS#12 content type %s", info.ContentType)
+	}
+	var data []byte
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &data); err != nil {
+		return nil, fmt.Errorf("Invalid PKCS#12 content: %s", err)
+	}
+	return data, nil
+}
+
+// bmpString returns the password encoding of PKCS#12: UTF-16 big endian with a
+// terminating zero.
+func bmpString(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	data := make([]byte, 0, len(encoded)*2+2)
+	for _, c := range encoded {
+		data = append(data, byte(c>>8), byte(c))
+	}
+	return append(data, 0, 0)
+}
+
+// pkcs12KDF derives a key of length size from the password as defined in RFC 7292
+// appendix B.2, using SHA-256 with a block size of 64 bytes.
+func pkcs12KDF(size int, id byte, password, salt []byte, iterations int) []byte {
+	const v = 64
+	fill := func(data []byte) []byte {
+		if len(data) == 0 {
+			return nil
+		}
+		filled := make([]byte, v*((len(data)+v-1)/v))
+		for i := range filled {
+			filled[i] = data[i%len(data)]
+		}
+		return filled
+	}
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+	input := append(fill(salt), fill(password)...)
+
+	var result []byte
+	for len(result) < size {
+		h := sha256.New()
+		h.Write(d)
+		h.Write(input)
+		a := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			sum := sha256.Sum256(a)
+			a = sum[:]
+		}
+		result = append(result, a...)
+		if len(result) >= size {
+			break
+		}
+		// Add B + 1 to every block of the input, with B being A repeated to v bytes
+		b := fill(a)
+		for j := 0; j < len(input); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(input[j+k]) + int(b[k]) + carry
+				input[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return result[:size]
+}
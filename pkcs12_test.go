@@ -0,0 +1,66 @@
+package certbuddy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"github.com/connctd/certbuddy/certtest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEncodePKCS12(t *testing.T) {
+	iterations := pkcs12Iterations
+	pkcs12Iterations = 100
+	defer func() { pkcs12Iterations = iterations }()
+	assert := assert.New(t)
+	root, rootKey := certtest.Cert(t, "root", true, nil, nil)
+	leaf, leafKey := certtest.Cert(t, "leaf", false, root, rootKey)
+
+	data, err := EncodePKCS12(leafKey, []*x509.Certificate{leaf, root}, "changeit", "www")
+	if !assert.Nil(err) {
+		return
+	}
+	certs, err := PKCS12Certificates(data)
+	if assert.Nil(err) && assert.Len(certs, 2) {
+		assert.Equal(leaf.Raw, certs[0].Raw)
+		assert.Equal(root.Raw, certs[1].Raw)
+	}
+
+	pfx := pfxPdu{}
+	_, err = asn1.Unmarshal(data, &pfx)
+	assert.Nil(err)
+	authSafe, err := contentData(pfx.AuthSafe)
+	assert.Nil(err)
+	macKey := func(password string) []byte {
+		return pkcs12KDF(sha256.Size, pkcs12MACKeyID, bmpString(password), pfx.MacData.MacSalt, pfx.MacData.Iterations)
+	}
+	mac := hmac.New(sha256.New, macKey("changeit"))
+	mac.Write(authSafe)
+	assert.Equal(pfx.MacData.Mac.Digest, mac.Sum(nil))
+	mac = hmac.New(sha256.New, macKey("wrong"))
+	mac.Write(authSafe)
+	assert.NotEqual(pfx.MacData.Mac.Digest, mac.Sum(nil))
+
+	var safes []contentInfo
+	_, err = asn1.Unmarshal(authSafe, &safes)
+	assert.Nil(err)
+	keySafe, err := contentData(safes[1])
+	assert.Nil(err)
+	var bags []safeBag
+	_, err = asn1.Unmarshal(keySafe, &bags)
+	if assert.Nil(err) && assert.Len(bags, 1) {
+		assert.True(bags[0].ID.Equal(oidShroudedKeyBag))
+		keyBytes, err := decryptPKCS8(bags[0].Value.Bytes, []byte("changeit"))
+		assert.Nil(err)
+		key, err := x509.ParsePKCS8PrivateKey(keyBytes)
+		assert.Nil(err)
+		assert.Equal(leafKey, key)
+	}
+
+	_, err = EncodePKCS12(leafKey, nil, "changeit", "www")
+	assert.Equal(NoCertificates, err)
+	_, err = EncodePKCS12(leafKey, []*x509.Certificate{leaf}, "", "www")
+	assert.NotNil(err)
+}
@@ -8,3 +8,94 @@ type Registry interface {
 	CertAvailable(cert *x509.Certificate) error
 	CertsExpired(cert *x509.Certificate) error
 }
+
+// ValidationHook is implemented by registries which have to act while the CA validates
+// the domains, e.g. to stop a web server occupying the port of a standalone challenge
+// server and to start it again afterwards.
+type ValidationHook interface {
+	// BeforeValidation is called before a certificate is requested. An error aborts
+	// the request.
+	BeforeValidation(domains []string) error
+	// AfterValidation is called after the request, whether it succeeded or not. It is
+	// also called if BeforeValidation failed, so it can undo what has been done so far.
+	AfterValidation(domains []string) error
+}
+
+// FlushingRegistry is implemented by registries which deliver notifications in the
+// background.
+type FlushingRegistry interface {
+	// Flush waits until all pending notifications have been delivered or given up.
+	Flush()
+}
+
+// MultiRegistry notifies several registries. Every registry is notified even if
+// another one fails, the first error is returned.
+type MultiRegistry []Registry
+
+func (m MultiRegistry) CertAvailable(cert *x509.Certificate) error {
+	var firstErr error
+	for _, registry := range m {
+		if err := registry.CertAvailable(cert); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m MultiRegistry) CertsExpired(cert *x509.Certificate) error {
+	var firstErr error
+	for _, registry := range m {
+		if err := registry.CertsExpired(cert); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Notify forwards the event to every registry implementing EventRegistry.
+func (m MultiRegistry) Notify(event Event) error {
+	var firstErr error
+	for _, registry := range m {
+		if eventRegistry, ok := registry.(EventRegistry); ok {
+			if err := eventRegistry.Notify(event); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Flush waits for every registry implementing FlushingRegistry.
+func (m MultiRegistry) Flush() {
+	for _, registry := range m {
+		if flusher, ok := registry.(FlushingRegistry); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// BeforeValidation calls the registries implementing ValidationHook and stops at the
+// first error.
+func (m MultiRegistry) BeforeValidation(domains []string) error {
+	for _, registry := range m {
+		if hook, ok := registry.(ValidationHook); ok {
+			if err := hook.BeforeValidation(domains); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AfterValidation calls every registry implementing ValidationHook.
+func (m MultiRegistry) AfterValidation(domains []string) error {
+	var firstErr error
+	for _, registry := range m {
+		if hook, ok := registry.(ValidationHook); ok {
+			if err := hook.AfterValidation(domains); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,92 @@
+package certbuddy
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"time"
+)
+
+var DefaultRetryPolicy = RetryPolicy{
+	InitialInterval: time.Minute * 5,
+	MaxInterval:     time.Hour * 24,
+	Multiplier:      2,
+	Jitter:          0.2,
+}
+
+// RetryPolicy describes how long to wait before retrying a failed attempt to obtain or
+// renew a certificate. The wait time grows exponentially with the number of consecutive
+// failures, but never exceeds MaxInterval.
+type RetryPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter is the fraction of the interval by which it is randomly increased or
+	// decreased, e.g. 0.2 means +/- 20%.
+	Jitter float64
+}
+
+// Backoff returns the duration to wait after the given number of consecutive failures.
+func (r RetryPolicy) Backoff(failures int) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+	interval := float64(r.InitialInterval) * math.Pow(r.Multiplier, float64(failures-1))
+	if r.MaxInterval > 0 && interval > float64(r.MaxInterval) {
+		interval = float64(r.MaxInterval)
+	}
+	if r.Jitter > 0 {
+		interval += interval * r.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(interval)
+}
+
+// FailureRecord keeps track of consecutive failures to obtain or renew a certificate.
+// It is persisted so a restart of certbuddy doesn't result in hammering the CA.
+type FailureRecord struct {
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastFailure         time.Time `json:"lastFailure"`
+	LastError           string    `json:"lastError"`
+	NextAttempt         time.Time `json:"nextAttempt"`
+}
+
+// Failed records a failed attempt and calculates the time of the next attempt.
+func (f *FailureRecord) Failed(err error, policy RetryPolicy) {
+	f.ConsecutiveFailures++
+	f.LastFailure = time.Now()
+	f.LastError = err.Error()
+	f.NextAttempt = f.LastFailure.Add(policy.Backoff(f.ConsecutiveFailures))
+}
+
+// Pending returns true if the last attempt failed and the next attempt isn't due yet.
+func (f *FailureRecord) Pending() bool {
+	return f.ConsecutiveFailures > 0 && time.Now().Before(f.NextAttempt)
+}
+
+// LoadFailureRecord loads the failure record stored at the given path. If no record
+// exists, an empty record is returned.
+func LoadFailureRecord(recordPath string) (*FailureRecord, error) {
+	record := &FailureRecord{}
+	if !FileExists(recordPath) {
+		return record, nil
+	}
+	if err := LoadJsonFromDisk(recordPath, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// StoreFailureRecord persists the failure record. A record without failures is
+// removed from disk.
+func StoreFailureRecord(recordPath string, record *FailureRecord) error {
+	if record.ConsecutiveFailures == 0 {
+		if err := os.Remove(recordPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := EnsureParentPathExists(recordPath); err != nil {
+		return err
+	}
+	return StoreJsonToDisk(recordPath, record)
+}
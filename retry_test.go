@@ -0,0 +1,55 @@
+package certbuddy
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	policy := RetryPolicy{
+		InitialInterval: time.Minute,
+		MaxInterval:     time.Minute * 10,
+		Multiplier:      2,
+	}
+	assert.Equal(time.Duration(0), policy.Backoff(0))
+	assert.Equal(time.Minute, policy.Backoff(1))
+	assert.Equal(time.Minute*2, policy.Backoff(2))
+	assert.Equal(time.Minute*8, policy.Backoff(4))
+	assert.Equal(time.Minute*10, policy.Backoff(5))
+	assert.Equal(time.Minute*10, policy.Backoff(100))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(2)
+		assert.True(backoff >= time.Minute && backoff <= time.Minute*3)
+	}
+}
+
+func TestFailureRecordPersistence(t *testing.T) {
+	assert := assert.New(t)
+	basePath := "./retrytest"
+	defer os.RemoveAll(basePath)
+	recordPath := path.Join(basePath, "failures.json")
+
+	record, err := LoadFailureRecord(recordPath)
+	assert.Nil(err)
+	assert.False(record.Pending())
+
+	record.Failed(errors.New("CA unavailable"), RetryPolicy{InitialInterval: time.Hour, Multiplier: 2})
+	record.Failed(errors.New("CA unavailable"), RetryPolicy{InitialInterval: time.Hour, Multiplier: 2})
+	assert.Nil(StoreFailureRecord(recordPath, record))
+
+	loaded, err := LoadFailureRecord(recordPath)
+	assert.Nil(err)
+	assert.Equal(2, loaded.ConsecutiveFailures)
+	assert.Equal("CA unavailable", loaded.LastError)
+	assert.True(loaded.Pending())
+
+	assert.Nil(StoreFailureRecord(recordPath, &FailureRecord{}))
+	assert.False(FileExists(recordPath))
+}
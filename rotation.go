@@ -0,0 +1,84 @@
+package certbuddy
+
+import (
+	"fmt"
+	"time"
+)
+
+// KeyRotationMode defines when the private key of a certificate is replaced.
+type KeyRotationMode string
+
+const (
+	// KeyReuse keeps the private key forever.
+	KeyReuse KeyRotationMode = "reuse"
+	// KeyRotateOnRenew generates a new private key for every renewal.
+	KeyRotateOnRenew KeyRotationMode = "rotate-on-renew"
+	// KeyRotateAfterAge generates a new private key once it is older than the maximum
+	// age, even if the certificate doesn't need to be renewed yet.
+	KeyRotateAfterAge KeyRotationMode = "rotate-after-age"
+)
+
+// ParseKeyRotationMode returns the mode with the given name. An empty name results in
+// KeyReuse.
+func ParseKeyRotationMode(name string) (KeyRotationMode, error) {
+	switch mode := KeyRotationMode(name); mode {
+	case "":
+		return KeyReuse, nil
+	case KeyReuse, KeyRotateOnRenew, KeyRotateAfterAge:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Unknown key rotation %s, expected one of %s, %s, %s", name, KeyReuse, KeyRotateOnRenew, KeyRotateAfterAge)
+}
+
+// KeyRotationPolicy describes when a new private key is generated for a certificate.
+type KeyRotationPolicy struct {
+	Mode KeyRotationMode
+	// MaxAge is the maximum age of a key if Mode is KeyRotateAfterAge.
+	MaxAge time.Duration
+}
+
+// RotationDue returns the point in time at which a key created at the given time has
+// to be replaced. If the key never has to be replaced, false is returned.
+func (p KeyRotationPolicy) RotationDue(keyCreated time.Time) (time.Time, bool) {
+	if p.Mode != KeyRotateAfterAge || p.MaxAge <= 0 {
+		return time.Time{}, false
+	}
+	return keyCreated.Add(p.MaxAge), true
+}
+
+// RotateOnRenew returns true if a new key has to be generated when the certificate is
+// renewed at the given time.
+func (p KeyRotationPolicy) RotateOnRenew(keyCreated, now time.Time) bool {
+	if p.Mode == KeyRotateOnRenew {
+		return true
+	}
+	due, rotate := p.RotationDue(keyCreated)
+	return rotate && !now.Before(due)
+}
+
+// KeyRecord stores when a private key was created, so its age is known even if the
+// storage doesn't keep track of it.
+type KeyRecord struct {
+	Created time.Time `json:"created"`
+}
+
+// LoadKeyRecord loads the key record stored at the given path. If no record exists,
+// nil is returned.
+func LoadKeyRecord(recordPath string) (*KeyRecord, error) {
+	if !FileExists(recordPath) {
+		return nil, nil
+	}
+	record := &KeyRecord{}
+	if err := LoadJsonFromDisk(recordPath, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// StoreKeyRecord persists the key record.
+func StoreKeyRecord(recordPath string, record *KeyRecord) error {
+	if err := EnsureParentPathExists(recordPath); err != nil {
+		return err
+	}
+	return StoreJsonToDisk(recordPath, record)
+}
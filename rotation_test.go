@@ -0,0 +1,55 @@
+package certbuddy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeyRotationPolicy(t *testing.T) {
+	assert := assert.New(t)
+	created := time.Now().Add(-time.Hour * 24 * 10)
+	now := time.Now()
+
+	reuse := KeyRotationPolicy{Mode: KeyReuse}
+	_, due := reuse.RotationDue(created)
+	assert.False(due)
+	assert.False(reuse.RotateOnRenew(created, now))
+
+	onRenew := KeyRotationPolicy{Mode: KeyRotateOnRenew}
+	_, due = onRenew.RotationDue(created)
+	assert.False(due)
+	assert.True(onRenew.RotateOnRenew(created, now))
+
+	afterAge := KeyRotationPolicy{Mode: KeyRotateAfterAge, MaxAge: time.Hour * 24 * 30}
+	at, due := afterAge.RotationDue(created)
+	assert.True(due)
+	assert.Equal(created.Add(afterAge.MaxAge), at)
+	assert.False(afterAge.RotateOnRenew(created, now))
+	assert.True(afterAge.RotateOnRenew(created, at))
+
+	mode, err := ParseKeyRotationMode("")
+	assert.Nil(err)
+	assert.Equal(KeyReuse, mode)
+	_, err = ParseKeyRotationMode("always")
+	assert.NotNil(err)
+}
+
+func TestKeyRecord(t *testing.T) {
+	assert := assert.New(t)
+	recordPath := "./recordtest/.key.json"
+	defer os.RemoveAll("./recordtest")
+
+	record, err := LoadKeyRecord(recordPath)
+	assert.Nil(err)
+	assert.Nil(record)
+
+	created := time.Now().Round(time.Second)
+	assert.Nil(StoreKeyRecord(recordPath, &KeyRecord{Created: created}))
+	record, err = LoadKeyRecord(recordPath)
+	assert.Nil(err)
+	if assert.NotNil(record) {
+		assert.True(created.Equal(record.Created))
+	}
+}
@@ -17,12 +17,39 @@ type KeyStorage interface {
 	KeyExists() bool
 }
 
+// KeyCertStorage is implemented by storages which store a private key together with the
+// certificates issued for it in one transaction.
+type KeyCertStorage interface {
+	SaveKeyAndCerts(key crypto.PrivateKey, certs []*x509.Certificate) error
+}
+
+// VersionedStorage is implemented by storages which keep previous versions of the
+// certificate and its private key.
+type VersionedStorage interface {
+	// Live returns the current version or 0 if nothing has been stored yet.
+	Live() (int, error)
+	// Versions returns the available versions in ascending order.
+	Versions() ([]int, error)
+	// Activate makes a previous version the current one.
+	Activate(version int) error
+}
+
+// EncryptedKeyStorage is implemented by storages which can encrypt private keys with a
+// passphrase.
+type EncryptedKeyStorage interface {
+	// Reencrypt encrypts the stored private keys with a new passphrase, or stores them
+	// unencrypted if the passphrase is empty.
+	Reencrypt(passphrase []byte) error
+}
+
+// MultiOutputCertStorage loads certificates from a main storage and writes them to
+// additional outputs as well.
 type MultiOutputCertStorage struct {
 	stor     CertStorage
 	outStors []CertStorage
 }
 
-func NewMultiOutputCertStorage(mainStore CertStorage, outputStores ...CertStorage) CertStorage {
+func NewMultiOutputCertStorage(mainStore CertStorage, outputStores ...CertStorage) *MultiOutputCertStorage {
 	return &MultiOutputCertStorage{
 		stor:     mainStore,
 		outStors: outputStores,
@@ -48,3 +75,41 @@ func (m *MultiOutputCertStorage) SaveCerts(certs []*x509.Certificate) error {
 func (m *MultiOutputCertStorage) CertsExist() bool {
 	return m.stor.CertsExist()
 }
+
+// SyncOutputs writes the certificates of the main storage to every output which doesn't
+// contain the current certificate yet, e.g. because it has just been renewed or the
+// output has been deleted. Outputs which accept keys also receive the private key,
+// which is only loaded from keys if such an output has to be written. It returns the
+// number of outputs written.
+func (m *MultiOutputCertStorage) SyncOutputs(keys KeyStorage) (int, error) {
+	if len(m.outStors) == 0 {
+		return 0, nil
+	}
+	certs, err := m.stor.LoadCerts()
+	if err != nil {
+		return 0, err
+	}
+	var key crypto.PrivateKey
+	written := 0
+	for _, stor := range m.outStors {
+		current, err := stor.LoadCerts()
+		if err == nil && len(current) > 0 && current[0].SerialNumber.Cmp(certs[0].SerialNumber) == 0 {
+			continue
+		}
+		if keyStor, ok := stor.(KeyCertStorage); ok {
+			if key == nil {
+				if key, err = keys.LoadKey(); err != nil {
+					return written, err
+				}
+			}
+			err = keyStor.SaveKeyAndCerts(key, certs)
+		} else {
+			err = stor.SaveCerts(certs)
+		}
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
@@ -3,11 +3,13 @@ package certbuddy
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -16,6 +18,10 @@ import (
 var (
 	UnknownPemHeader       = errors.New("Unknown PEM header value")
 	UnparseableCertificate = errors.New("Unparseable certificate")
+	NoPemData              = errors.New("No PEM encoded data found")
+	NoCertificates         = errors.New("No certificate found in PEM data")
+	UnsupportedPrivateKey  = errors.New("Unsupported private key, expected an RSA, ECDSA or Ed25519 key")
+	LegacyEncryptedKey     = errors.New("Legacy encrypted PEM keys aren't supported, convert the key with openssl pkcs8 -topk8")
 )
 
 func FileExists(name string) bool {
@@ -43,20 +49,43 @@ func ToPemBlock(data interface{}) ([]byte, error) {
 	case *rsa.PrivateKey:
 		pemBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
 		break
+	case ed25519.PrivateKey:
+		// Ed25519 keys can only be encoded as PKCS#8
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pemBlock = &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}
 	case *x509.Certificate:
 		pemBlock = &pem.Block{Type: "CERTIFICATE", Bytes: key.Raw}
+	default:
+		return nil, fmt.Errorf("Unable to PEM encode %T", data)
 	}
 
 	pemBytes := pem.EncodeToMemory(pemBlock)
 	return pemBytes, nil
 }
 
+// CertificatesToPem encodes certificates as consecutive PEM blocks, e.g. for a file
+// containing a certificate and its issuer chain.
+func CertificatesToPem(certs []*x509.Certificate) ([]byte, error) {
+	pemBytes := make([]byte, 0, 2048)
+	for _, cert := range certs {
+		data, err := ToPemBlock(cert)
+		if err != nil {
+			return nil, err
+		}
+		pemBytes = append(pemBytes, data...)
+	}
+	return pemBytes, nil
+}
+
 func WritePEMBlock(data interface{}, keyPath string) error {
 	pemBytes, err := ToPemBlock(data)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(keyPath, pemBytes, 0600)
+	return WriteFileAtomic(keyPath, pemBytes, 0600)
 }
 
 func LoadPrivateKey(path string) (crypto.PrivateKey, error) {
@@ -67,35 +96,72 @@ func LoadPrivateKey(path string) (crypto.PrivateKey, error) {
 	return PemBlockToPrivateKey(fileData)
 }
 
+// PemBlockToPrivateKey parses a PKCS#1 RSA, SEC 1 EC or PKCS#8 private key. EC
+// parameters preceding the key, as written by openssl ecparam -genkey, are skipped.
 func PemBlockToPrivateKey(pemBlockData []byte) (crypto.PrivateKey, error) {
-	pemBlock, _ := pem.Decode(pemBlockData)
+	pemBlock, rest := pem.Decode(pemBlockData)
+	for pemBlock != nil && pemBlock.Type == "EC PARAMETERS" {
+		pemBlock, rest = pem.Decode(rest)
+	}
+	if pemBlock == nil {
+		return nil, NoPemData
+	}
+	if pemBlock.Headers["Proc-Type"] == "4,ENCRYPTED" {
+		return nil, LegacyEncryptedKey
+	}
 	switch pemBlock.Type {
 	case "RSA PRIVATE KEY":
-		return x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+		key, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse PKCS#1 private key: %s", err)
+		}
+		return key, nil
 	case "EC PRIVATE KEY":
-		return x509.ParseECPrivateKey(pemBlock.Bytes)
+		key, err := x509.ParseECPrivateKey(pemBlock.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse EC private key: %s", err)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse PKCS#8 private key: %s", err)
+		}
+		switch key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+			return key, nil
+		}
+		return nil, UnsupportedPrivateKey
+	case encryptedKeyPemType:
+		return nil, MissingPassphrase
 	default:
 		return nil, UnknownPemHeader
 	}
 }
 
+// PemBlockToX509Certificate parses all certificates in the PEM data in the order they
+// appear. Text around the PEM blocks, like comments or trailing whitespace, and blocks
+// of other types are ignored.
 func PemBlockToX509Certificate(pemBlockData []byte) ([]*x509.Certificate, error) {
 	var pemBlock *pem.Block
 	var remaining = pemBlockData
 	certs := make([]*x509.Certificate, 0, 2)
 
-	for {
+	for block := 1; ; block++ {
 		pemBlock, remaining = pem.Decode(remaining)
+		if pemBlock == nil {
+			break
+		}
 		if pemBlock.Type == "CERTIFICATE" {
 			cert, err := x509.ParseCertificate(pemBlock.Bytes)
 			if err != nil {
-				return certs, UnparseableCertificate
+				return certs, &CertificateError{Block: block, Err: err}
 			}
 			certs = append(certs, cert)
 		}
-		if len(remaining) == 0 {
-			break
-		}
+	}
+	if len(certs) == 0 {
+		return nil, NoCertificates
 	}
 	return certs, nil
 }
@@ -121,7 +187,64 @@ func StoreJsonToDisk(jsonPath string, data interface{}) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(jsonPath, jsonBytes, 0600)
+	return WriteFileAtomic(jsonPath, jsonBytes, 0600)
+}
+
+// WriteFileAtomic writes data to a temporary file next to filename, syncs it to disk
+// and renames it to filename, so readers see either the old or the complete new file.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpPath, err := WriteTempFile(filename, data, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filename); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return SyncDir(filepath.Dir(filename))
+}
+
+// WriteTempFile writes data to a new temporary file in the directory of filename and
+// syncs it to disk. It returns the path of the temporary file.
+func WriteTempFile(filename string, data []byte, perm os.FileMode) (string, error) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmpFile.Name()
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// SyncDir syncs a directory to disk, which makes renames within it durable.
+func SyncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	return nil
 }
 
 func EnsureParentPathExists(targetPath string) error {
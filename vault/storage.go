@@ -0,0 +1,445 @@
+// Package vault implements certificate and key storage in the KV version 2 secrets
+// engine of HashiCorp Vault. The certificate chain and the private key are stored
+// together in one secret, so every version of the secret contains a matching pair.
+package vault
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMount        = "secret"
+	defaultAppRoleMount = "approle"
+	defaultTimeout      = time.Second * 30
+
+	certificateField = "certificate"
+	privateKeyField  = "private_key"
+)
+
+type Config struct {
+	// Address of the Vault server, e.g. https://vault.example.com:8200
+	Address string
+	// Token used to authenticate. Either Token or RoleID and SecretID are required.
+	Token string
+	// RoleID and SecretID authenticate via the AppRole auth method.
+	RoleID   string
+	SecretID string
+	// AppRoleMount is the mount path of the AppRole auth method, defaults to approle.
+	AppRoleMount string
+	// Namespace is the Vault Enterprise namespace, empty for the root namespace.
+	Namespace string
+	// Mount is the mount path of the KV v2 secrets engine, defaults to secret.
+	Mount string
+	// Path of the secret within the secrets engine.
+	Path string
+	// CACert is a PEM file with the certificates to trust for the Vault server.
+	CACert string
+	// KeyFormat of the stored private key, defaults to PKCS#1 and SEC 1.
+	KeyFormat certbuddy.KeyFormat
+	// Passphrase encrypts the private key if not empty
+	Passphrase []byte
+}
+
+// Storage stores the certificate chain and private key in a KV v2 secret. Every update
+// creates a new version of the secret and is a check-and-set operation against the
+// version the storage last read, so changes made by another instance in the meantime
+// aren't overwritten.
+type Storage struct {
+	config Config
+	client *http.Client
+
+	lock    sync.Mutex
+	token   string
+	version int
+}
+
+type secret struct {
+	Data     map[string]string `json:"data"`
+	Metadata struct {
+		Version int `json:"version"`
+	} `json:"metadata"`
+}
+
+// NewStorage validates the config and returns a storage. With AppRole credentials it
+// logs in lazily on the first request.
+func NewStorage(config Config) (*Storage, error) {
+	if config.Address == "" {
+		return nil, errors.New("Vault address may not be empty")
+	}
+	if config.Path == "" {
+		return nil, errors.New("Vault secret path may not be empty")
+	}
+	if config.Token == "" && (config.RoleID == "" || config.SecretID == "") {
+		return nil, errors.New("Either a Vault token or an AppRole role and secret ID are required")
+	}
+	if config.Mount == "" {
+		config.Mount = defaultMount
+	}
+	if config.AppRoleMount == "" {
+		config.AppRoleMount = defaultAppRoleMount
+	}
+	config.Address = strings.TrimSuffix(config.Address, "/")
+	config.Mount = strings.Trim(config.Mount, "/")
+	config.Path = strings.Trim(config.Path, "/")
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if config.CACert != "" {
+		pool := x509.NewCertPool()
+		certs, err := certbuddy.LoadCertificateFromDisk(config.CACert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to load Vault CA certificate %s", config.CACert)
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &Storage{
+		config: config,
+		client: &http.Client{Transport: transport, Timeout: defaultTimeout},
+		token:  config.Token,
+	}, nil
+}
+
+func (s *Storage) LoadCerts() ([]*x509.Certificate, error) {
+	data, err := s.read(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read certificates from Vault")
+	}
+	if data == nil || data[certificateField] == "" {
+		return nil, errors.New("Vault secret doesn't contain a certificate")
+	}
+	return certbuddy.ParseCertificateChain([]byte(data[certificateField]))
+}
+
+func (s *Storage) SaveCerts(certs []*x509.Certificate) error {
+	certData, err := certbuddy.CertificatesToPem(certs)
+	if err != nil {
+		return err
+	}
+	return s.update(map[string]string{certificateField: string(certData)})
+}
+
+func (s *Storage) CertsExist() bool {
+	data, err := s.read(0)
+	return err == nil && data[certificateField] != ""
+}
+
+func (s *Storage) LoadKey() (crypto.PrivateKey, error) {
+	data, err := s.read(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read private key from Vault")
+	}
+	if data == nil || data[privateKeyField] == "" {
+		return nil, errors.New("Vault secret doesn't contain a private key")
+	}
+	return certbuddy.DecodePrivateKey([]byte(data[privateKeyField]), s.config.Passphrase)
+}
+
+func (s *Storage) SaveKey(key crypto.PrivateKey) error {
+	keyData, err := certbuddy.EncodePrivateKey(key, s.config.KeyFormat, s.config.Passphrase)
+	if err != nil {
+		return err
+	}
+	return s.update(map[string]string{privateKeyField: string(keyData)})
+}
+
+// Reencrypt stores the private key encrypted with a new passphrase, or unencrypted if
+// the passphrase is empty, as a new version of the secret. Previous versions keep the
+// passphrase they have been written with.
+func (s *Storage) Reencrypt(passphrase []byte) error {
+	key, err := s.LoadKey()
+	if err != nil {
+		return err
+	}
+	keyData, err := certbuddy.EncodePrivateKey(key, s.config.KeyFormat, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := s.update(map[string]string{privateKeyField: string(keyData)}); err != nil {
+		return err
+	}
+	s.config.Passphrase = passphrase
+	return nil
+}
+
+func (s *Storage) KeyExists() bool {
+	data, err := s.read(0)
+	return err == nil && data[privateKeyField] != ""
+}
+
+// SaveKeyAndCerts stores a private key together with the certificates issued for it as
+// one new version of the secret.
+func (s *Storage) SaveKeyAndCerts(key crypto.PrivateKey, certs []*x509.Certificate) error {
+	keyData, err := certbuddy.EncodePrivateKey(key, s.config.KeyFormat, s.config.Passphrase)
+	if err != nil {
+		return err
+	}
+	certData, err := certbuddy.CertificatesToPem(certs)
+	if err != nil {
+		return err
+	}
+	return s.update(map[string]string{privateKeyField: string(keyData), certificateField: string(certData)})
+}
+
+// Live returns the current version of the secret or 0 if it doesn't exist.
+func (s *Storage) Live() (int, error) {
+	metadata, err := s.metadata()
+	if err != nil {
+		return 0, err
+	}
+	return metadata.CurrentVersion, nil
+}
+
+// Versions returns the versions of the secret which haven't been deleted or destroyed
+// in ascending order.
+func (s *Storage) Versions() ([]int, error) {
+	metadata, err := s.metadata()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]int, 0, len(metadata.Versions))
+	for name, version := range metadata.Versions {
+		number, err := strconv.Atoi(name)
+		if err != nil || version.Destroyed || version.DeletionTime != "" {
+			continue
+		}
+		versions = append(versions, number)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// Activate writes the content of a previous version as the new current version, like
+// "vault kv rollback" does.
+func (s *Storage) Activate(version int) error {
+	data, err := s.read(version)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read version %d from Vault", version)
+	}
+	if data == nil {
+		return fmt.Errorf("Version %d doesn't exist in Vault", version)
+	}
+	current, err := s.Live()
+	if err != nil {
+		return err
+	}
+	return s.write(data, current)
+}
+
+type metadata struct {
+	CurrentVersion int `json:"current_version"`
+	Versions       map[string]struct {
+		DeletionTime string `json:"deletion_time"`
+		Destroyed    bool   `json:"destroyed"`
+	} `json:"versions"`
+}
+
+func (s *Storage) metadata() (*metadata, error) {
+	response := &struct {
+		Data metadata `json:"data"`
+	}{}
+	found, err := s.do("GET", s.apiPath("metadata"), nil, response)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read secret metadata from Vault")
+	}
+	if !found {
+		return &metadata{}, nil
+	}
+	return &response.Data, nil
+}
+
+// read returns the data of the given version of the secret, or of the current version
+// if version is 0. It returns nil if the secret doesn't exist.
+func (s *Storage) read(version int) (map[string]string, error) {
+	apiPath := s.apiPath("data")
+	if version > 0 {
+		apiPath += "?version=" + strconv.Itoa(version)
+	}
+	response := &struct {
+		Data *secret `json:"data"`
+	}{}
+	found, err := s.do("GET", apiPath, nil, response)
+	if err != nil || !found || response.Data == nil {
+		return nil, err
+	}
+	if version == 0 {
+		s.lock.Lock()
+		s.version = response.Data.Metadata.Version
+		s.lock.Unlock()
+	}
+	return response.Data.Data, nil
+}
+
+// update merges the fields into the current data of the secret and writes them as a
+// new version.
+func (s *Storage) update(fields map[string]string) error {
+	s.lock.Lock()
+	version := s.version
+	s.lock.Unlock()
+	var data map[string]string
+	var err error
+	if version == 0 {
+		data, err = s.read(0)
+		s.lock.Lock()
+		version = s.version
+		s.lock.Unlock()
+	} else {
+		data, err = s.read(version)
+	}
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = make(map[string]string)
+	}
+	for name, value := range fields {
+		data[name] = value
+	}
+	return s.write(data, version)
+}
+
+// write stores data as a new version, if the current version is still cas.
+func (s *Storage) write(data map[string]string, cas int) error {
+	request := map[string]interface{}{
+		"options": map[string]int{"cas": cas},
+		"data":    data,
+	}
+	response := &struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+	}{}
+	if _, err := s.do("POST", s.apiPath("data"), request, response); err != nil {
+		s.lock.Lock()
+		s.version = 0
+		s.lock.Unlock()
+		return errors.Wrap(err, "Unable to write secret to Vault")
+	}
+	s.lock.Lock()
+	s.version = response.Data.Version
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Storage) apiPath(kind string) string {
+	return fmt.Sprintf("/v1/%s/%s/%s", s.config.Mount, kind, s.config.Path)
+}
+
+// do sends a request to Vault and decodes the response into out. It returns false if
+// the path doesn't exist. With AppRole credentials it logs in again once if the token
+// was rejected.
+func (s *Storage) do(method, apiPath string, in, out interface{}) (bool, error) {
+	token, err := s.getToken(false)
+	if err != nil {
+		return false, err
+	}
+	status, body, err := s.send(method, apiPath, token, in)
+	if err == nil && status == http.StatusForbidden && s.config.RoleID != "" {
+		if token, err = s.getToken(true); err != nil {
+			return false, err
+		}
+		status, body, err = s.send(method, apiPath, token, in)
+	}
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return false, nil
+	case status == http.StatusNoContent:
+		return true, nil
+	case status >= 300:
+		return false, vaultError(status, body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return false, errors.Wrap(err, "Unable to decode Vault response")
+		}
+	}
+	return true, nil
+}
+
+func (s *Storage) send(method, apiPath, token string, in interface{}) (int, []byte, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, s.config.Address+apiPath, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if token != "" {
+		request.Header.Set("X-Vault-Token", token)
+	}
+	if s.config.Namespace != "" {
+		request.Header.Set("X-Vault-Namespace", s.config.Namespace)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	return response.StatusCode, data, err
+}
+
+// getToken returns the token for requests, logging in via AppRole if necessary.
+func (s *Storage) getToken(renew bool) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.token != "" && !renew {
+		return s.token, nil
+	}
+	if s.config.RoleID == "" {
+		return s.token, nil
+	}
+	login := map[string]string{"role_id": s.config.RoleID, "secret_id": s.config.SecretID}
+	status, body, err := s.send("POST", "/v1/auth/"+url.PathEscape(s.config.AppRoleMount)+"/login", "", login)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to log in to Vault")
+	}
+	if status >= 300 {
+		return "", errors.Wrap(vaultError(status, body), "Unable to log in to Vault")
+	}
+	response := &struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}{}
+	if err := json.Unmarshal(body, response); err != nil || response.Auth.ClientToken == "" {
+		return "", errors.New("Vault login response doesn't contain a token")
+	}
+	s.token = response.Auth.ClientToken
+	return s.token, nil
+}
+
+func vaultError(status int, body []byte) error {
+	response := &struct {
+		Errors []string `json:"errors"`
+	}{}
+	if err := json.Unmarshal(body, response); err == nil && len(response.Errors) > 0 {
+		return fmt.Errorf("Vault returned %d: %s", status, strings.Join(response.Errors, ", "))
+	}
+	return fmt.Errorf("Vault returned %d", status)
+}
@@ -0,0 +1,220 @@
+package vault
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/connctd/certbuddy/certtest"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeVault implements the parts of the KV v2 and AppRole API used by Storage.
+type fakeVault struct {
+	lock       sync.Mutex
+	versions   map[string][]map[string]string
+	tokens     map[string]bool
+	logins     int
+	namespaces []string
+}
+
+func newFakeVault() (*fakeVault, *httptest.Server) {
+	v := &fakeVault{versions: make(map[string][]map[string]string), tokens: map[string]bool{"root": true}}
+	return v, httptest.NewServer(v)
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.namespaces = append(v.namespaces, r.Header.Get("X-Vault-Namespace"))
+	if r.URL.Path == "/v1/auth/approle/login" {
+		var login map[string]string
+		json.NewDecoder(r.Body).Decode(&login)
+		if login["role_id"] != "role" || login["secret_id"] != "secret" {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid role or secret ID"}})
+			return
+		}
+		v.logins++
+		token := fmt.Sprintf("approle-%d", v.logins)
+		v.tokens[token] = true
+		writeJSON(w, http.StatusOK, map[string]interface{}{"auth": map[string]string{"client_token": token}})
+		return
+	}
+	if !v.tokens[r.Header.Get("X-Vault-Token")] {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		versions := v.versions[name]
+		if r.Method == "GET" {
+			version := len(versions)
+			if requested := r.URL.Query().Get("version"); requested != "" {
+				version, _ = strconv.Atoi(requested)
+			}
+			if version == 0 || version > len(versions) {
+				writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+				"data":     versions[version-1],
+				"metadata": map[string]int{"version": version},
+			}})
+			return
+		}
+		var request struct {
+			Options struct {
+				CAS *int `json:"cas"`
+			} `json:"options"`
+			Data map[string]string `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.Options.CAS == nil || *request.Options.CAS != len(versions) {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"check-and-set parameter did not match the current version"}})
+			return
+		}
+		v.versions[name] = append(versions, request.Data)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]int{"version": len(v.versions[name])}})
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		versions, exists := v.versions[strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")]
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		metadata := make(map[string]interface{})
+		for i := range versions {
+			metadata[strconv.Itoa(i+1)] = map[string]interface{}{"deletion_time": "", "destroyed": false}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"current_version": len(versions),
+			"versions":        metadata,
+		}})
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func TestStorageVersions(t *testing.T) {
+	assert := assert.New(t)
+	fake, server := newFakeVault()
+	defer server.Close()
+
+	_, err := NewStorage(Config{Address: server.URL, Path: "certs/www"})
+	assert.NotNil(err)
+	storage, err := NewStorage(Config{Address: server.URL, Token: "root", Namespace: "team", Path: "/certs/www/"})
+	if !assert.Nil(err) {
+		return
+	}
+	assert.False(storage.CertsExist())
+	assert.False(storage.KeyExists())
+	live, err := storage.Live()
+	assert.Nil(err)
+	assert.Equal(0, live)
+
+	cert, key := certtest.Cert(t, "example.com", false, nil, nil)
+	assert.Nil(storage.SaveKeyAndCerts(key, []*x509.Certificate{cert}))
+	renewed, _ := certtest.Chain(t, 2, "example.com")
+	assert.Nil(storage.SaveCerts(renewed))
+	loadedKey, err := storage.LoadKey()
+	assert.Nil(err)
+	assert.Equal(key, loadedKey)
+	certs, err := storage.LoadCerts()
+	assert.Nil(err)
+	if assert.Len(certs, 2) {
+		assert.Equal(renewed[0].SerialNumber, certs[0].SerialNumber)
+	}
+	assert.Equal("team", fake.namespaces[0])
+
+	versions, err := storage.Versions()
+	assert.Nil(err)
+	assert.Equal([]int{1, 2}, versions)
+	assert.Nil(storage.Activate(1))
+	live, err = storage.Live()
+	assert.Nil(err)
+	assert.Equal(3, live)
+	certs, err = storage.LoadCerts()
+	assert.Nil(err)
+	if assert.Len(certs, 1) {
+		assert.Equal(cert.SerialNumber, certs[0].SerialNumber)
+	}
+
+	// Changes by another instance aren't overwritten
+	other, _ := NewStorage(Config{Address: server.URL, Token: "root", Path: "certs/www"})
+	assert.Nil(other.SaveCerts(renewed))
+	err = storage.SaveCerts([]*x509.Certificate{cert})
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "check-and-set")
+	}
+	certs, err = storage.LoadCerts()
+	assert.Nil(err)
+	assert.Equal(renewed[0].SerialNumber, certs[0].SerialNumber)
+}
+
+func TestStorageAppRole(t *testing.T) {
+	assert := assert.New(t)
+	fake, server := newFakeVault()
+	defer server.Close()
+
+	storage, err := NewStorage(Config{Address: server.URL, RoleID: "role", SecretID: "secret", Path: "certs/api"})
+	if !assert.Nil(err) {
+		return
+	}
+	cert, key := certtest.Cert(t, "example.com", false, nil, nil)
+	assert.Nil(storage.SaveKeyAndCerts(key, []*x509.Certificate{cert}))
+	assert.Equal(1, fake.logins)
+
+	// An expired token is replaced by logging in again
+	fake.lock.Lock()
+	fake.tokens = map[string]bool{}
+	fake.lock.Unlock()
+	assert.True(storage.CertsExist())
+	assert.Equal(2, fake.logins)
+
+	invalid, _ := NewStorage(Config{Address: server.URL, RoleID: "role", SecretID: "wrong", Path: "certs/api"})
+	_, err = invalid.LoadCerts()
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "invalid role or secret ID")
+	}
+}
+
+func TestStorageEncryption(t *testing.T) {
+	assert := assert.New(t)
+	_, server := newFakeVault()
+	defer server.Close()
+
+	storage, err := NewStorage(Config{Address: server.URL, Token: "root", Path: "certs/www", Passphrase: []byte("secret")})
+	if !assert.Nil(err) {
+		return
+	}
+	cert, key := certtest.Cert(t, "example.com", false, nil, nil)
+	assert.Nil(storage.SaveKeyAndCerts(key, []*x509.Certificate{cert}))
+	data, err := storage.read(0)
+	assert.Nil(err)
+	assert.True(certbuddy.IsEncryptedPrivateKey([]byte(data[privateKeyField])))
+	loadedKey, err := storage.LoadKey()
+	assert.Nil(err)
+	assert.Equal(key, loadedKey)
+	unencrypted, _ := NewStorage(Config{Address: server.URL, Token: "root", Path: "certs/www"})
+	_, err = unencrypted.LoadKey()
+	assert.Equal(certbuddy.MissingPassphrase, err)
+
+	// Reencrypting with an empty passphrase stores the key unencrypted
+	assert.Nil(storage.Reencrypt(nil))
+	loadedKey, err = unencrypted.LoadKey()
+	assert.Nil(err)
+	assert.Equal(key, loadedKey)
+}
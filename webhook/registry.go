@@ -0,0 +1,242 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/connctd/certbuddy"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// SignatureHeader contains the hex encoded HMAC-SHA256 of the request body, prefixed
+	// with sha256=.
+	SignatureHeader = "X-Certbuddy-Signature"
+	// EventHeader contains the type of the event.
+	EventHeader = "X-Certbuddy-Event"
+)
+
+var (
+	// DefaultRetries is the number of retries of a failed delivery.
+	DefaultRetries = 3
+	// DefaultRetryInterval is the time to wait before the first retry, doubled for
+	// every further retry.
+	DefaultRetryInterval = time.Second
+	// DefaultTimeout of a single request.
+	DefaultTimeout = 10 * time.Second
+	// QueueSize is the number of events which can wait for delivery. Further events are
+	// dropped until the queue has room again.
+	QueueSize = 100
+)
+
+// Config of a webhook.
+type Config struct {
+	URL string
+	// Secret signs the payload if set, see SignatureHeader.
+	Secret certbuddy.PassphraseSource
+	// Events which are sent, all events if empty.
+	Events []certbuddy.EventType
+	// Retries of a failed delivery, defaults to DefaultRetries. Negative values disable
+	// retries.
+	Retries int
+	// RetryInterval before the first retry, defaults to DefaultRetryInterval.
+	RetryInterval time.Duration
+	// Timeout of a single request, defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Payload is the JSON document POSTed for every event.
+type Payload struct {
+	Event               certbuddy.EventType `json:"event"`
+	Certificate         string              `json:"certificate"`
+	Domains             []string            `json:"domains"`
+	Time                time.Time           `json:"time"`
+	Serial              string              `json:"serial,omitempty"`
+	NotBefore           *time.Time          `json:"not_before,omitempty"`
+	NotAfter            *time.Time          `json:"not_after,omitempty"`
+	Error               string              `json:"error,omitempty"`
+	ConsecutiveFailures int                 `json:"consecutive_failures,omitempty"`
+	Reason              string              `json:"reason,omitempty"`
+}
+
+// NewPayload describes an event.
+func NewPayload(event certbuddy.Event) Payload {
+	payload := Payload{
+		Event:               event.Type,
+		Certificate:         event.Name,
+		Domains:             event.Domains,
+		Time:                event.Time.UTC(),
+		ConsecutiveFailures: event.ConsecutiveFailures,
+	}
+	if cert := event.Certificate; cert != nil {
+		notBefore, notAfter := cert.NotBefore.UTC(), cert.NotAfter.UTC()
+		payload.Serial = fmt.Sprintf("%x", cert.SerialNumber)
+		payload.NotBefore, payload.NotAfter = &notBefore, &notAfter
+	}
+	if event.Err != nil {
+		payload.Error = event.Err.Error()
+	}
+	if event.Type == certbuddy.EventRevoked {
+		payload.Reason = event.Reason.String()
+	}
+	return payload
+}
+
+// Registry POSTs lifecycle events as JSON to a webhook. Events are delivered in the
+// background in the order they occurred, so a slow or unreachable webhook doesn't delay
+// renewals.
+type Registry struct {
+	config  Config
+	secret  []byte
+	client  *http.Client
+	queue   chan certbuddy.Event
+	pending sync.WaitGroup
+}
+
+// NewRegistry returns a Registry for the webhook. The secret is loaded immediately.
+func NewRegistry(config Config) (*Registry, error) {
+	if config.URL == "" {
+		return nil, errors.New("URL of the webhook may not be empty")
+	}
+	secret, err := config.Secret.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load webhook secret")
+	}
+	if config.Retries == 0 {
+		config.Retries = DefaultRetries
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = DefaultRetryInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	r := &Registry{
+		config: config,
+		secret: secret,
+		client: &http.Client{Timeout: config.Timeout},
+		queue:  make(chan certbuddy.Event, QueueSize),
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *Registry) CertAvailable(cert *x509.Certificate) error {
+	return nil
+}
+
+func (r *Registry) CertsExpired(cert *x509.Certificate) error {
+	return nil
+}
+
+// Notify queues the event for delivery if it is one of the configured events. An error
+// is only returned if the queue is full and the event has been dropped.
+func (r *Registry) Notify(event certbuddy.Event) error {
+	if !r.subscribed(event.Type) {
+		return nil
+	}
+	r.pending.Add(1)
+	select {
+	case r.queue <- event:
+		return nil
+	default:
+		r.pending.Done()
+		return fmt.Errorf("Webhook queue is full, dropped %s event for %s", event.Type, event.Name)
+	}
+}
+
+// Flush waits until all queued events have been delivered or given up, e.g. before
+// certbuddy exits.
+func (r *Registry) Flush() {
+	r.pending.Wait()
+}
+
+// run delivers the queued events one after another.
+func (r *Registry) run() {
+	for event := range r.queue {
+		if err := r.deliver(event); err != nil {
+			log.Printf("%+v", err)
+		}
+		r.pending.Done()
+	}
+}
+
+// deliver sends an event. Failed deliveries are retried with exponential backoff.
+func (r *Registry) deliver(event certbuddy.Event) error {
+	body, err := json.Marshal(NewPayload(event))
+	if err != nil {
+		return err
+	}
+	interval := r.config.RetryInterval
+	for attempt := 0; ; attempt++ {
+		retry, err := r.post(event.Type, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= r.config.Retries {
+			return errors.Wrapf(err, "Unable to deliver %s event for %s to webhook", event.Type, event.Name)
+		}
+		log.Printf("Delivering %s event for %s to webhook failed, retrying in %s: %v", event.Type, event.Name, interval, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+func (r *Registry) subscribed(eventType certbuddy.EventType) bool {
+	if len(r.config.Events) == 0 {
+		return true
+	}
+	for _, subscribed := range r.config.Events {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// post sends the payload once. It returns whether a failed request should be retried,
+// which isn't the case for client errors except 408 and 429.
+func (r *Registry) post(eventType certbuddy.EventType, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, r.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(eventType))
+	if len(r.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(r.secret, body))
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return true, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("Webhook responded with %s", resp.Status)
+}
+
+// Sign returns the value of the SignatureHeader for a payload.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the SignatureHeader of a received payload in constant time.
+func Verify(secret, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
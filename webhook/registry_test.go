@@ -0,0 +1,148 @@
+package webhook
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"github.com/connctd/certbuddy"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receiver struct {
+	lock     sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func TestNotify(t *testing.T) {
+	assert := assert.New(t)
+	recv := &receiver{}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	os.Setenv("CERTBUDDY_TEST_WEBHOOK_SECRET", "s3cret")
+	defer os.Unsetenv("CERTBUDDY_TEST_WEBHOOK_SECRET")
+
+	registry, err := NewRegistry(Config{
+		URL:    server.URL,
+		Secret: certbuddy.PassphraseSource{Env: "CERTBUDDY_TEST_WEBHOOK_SECRET"},
+		Events: []certbuddy.EventType{certbuddy.EventRenewed, certbuddy.EventRenewalFailed},
+	})
+	if !assert.Nil(err) {
+		return
+	}
+	notAfter := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	cert := &x509.Certificate{SerialNumber: big.NewInt(0xcafe), NotBefore: notAfter.Add(-time.Hour), NotAfter: notAfter}
+	event := certbuddy.Event{
+		Type:                certbuddy.EventRenewalFailed,
+		Name:                "www",
+		Domains:             []string{"example.com"},
+		Time:                notAfter.Add(-time.Minute),
+		Certificate:         cert,
+		Err:                 errors.New("rate limited"),
+		ConsecutiveFailures: 2,
+	}
+	assert.Nil(registry.Notify(event))
+	// Not subscribed
+	assert.Nil(registry.Notify(certbuddy.Event{Type: certbuddy.EventIssued, Name: "www"}))
+	registry.Flush()
+
+	if assert.Len(recv.requests, 1) {
+		req, body := recv.requests[0], recv.bodies[0]
+		assert.Equal("application/json", req.Header.Get("Content-Type"))
+		assert.Equal("renewal-failed", req.Header.Get(EventHeader))
+		assert.True(Verify([]byte("s3cret"), body, req.Header.Get(SignatureHeader)))
+		assert.False(Verify([]byte("wrong"), body, req.Header.Get(SignatureHeader)))
+
+		var payload map[string]interface{}
+		assert.Nil(json.Unmarshal(body, &payload))
+		assert.Equal(map[string]interface{}{
+			"event":                "renewal-failed",
+			"certificate":          "www",
+			"domains":              []interface{}{"example.com"},
+			"time":                 "2030-01-02T03:03:05Z",
+			"serial":               "cafe",
+			"not_before":           "2030-01-02T02:04:05Z",
+			"not_after":            "2030-01-02T03:04:05Z",
+			"error":                "rate limited",
+			"consecutive_failures": float64(2),
+		}, payload)
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	assert := assert.New(t)
+	recv := &receiver{statuses: []int{http.StatusBadGateway, http.StatusTooManyRequests, http.StatusOK}}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+
+	registry, err := NewRegistry(Config{URL: server.URL, RetryInterval: time.Millisecond})
+	if !assert.Nil(err) {
+		return
+	}
+	event := certbuddy.Event{Type: certbuddy.EventRevoked, Name: "www", Reason: certbuddy.ReasonKeyCompromise}
+	assert.Nil(registry.deliver(event))
+	assert.Len(recv.requests, 3)
+	assert.Empty(recv.requests[0].Header.Get(SignatureHeader))
+
+	// Client errors aren't retried
+	recv.statuses = []int{http.StatusBadRequest}
+	err = registry.deliver(event)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "400 Bad Request")
+	}
+	assert.Len(recv.requests, 4)
+
+	// Give up after the configured retries
+	registry.config.Retries = 1
+	recv.statuses = []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK}
+	assert.NotNil(registry.deliver(event))
+	assert.Len(recv.requests, 6)
+}
+
+func TestNotifyInBackground(t *testing.T) {
+	assert := assert.New(t)
+	recv := &receiver{}
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		recv.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+
+	registry, err := NewRegistry(Config{URL: server.URL, RetryInterval: time.Millisecond})
+	if !assert.Nil(err) {
+		return
+	}
+	// Notify doesn't wait for the webhook
+	for _, eventType := range []certbuddy.EventType{certbuddy.EventRenewalFailed, certbuddy.EventExpiringSoon} {
+		assert.Nil(registry.Notify(certbuddy.Event{Type: eventType, Name: "www"}))
+	}
+	close(release)
+	registry.Flush()
+	if assert.Len(recv.requests, 2) {
+		assert.Equal("renewal-failed", recv.requests[0].Header.Get(EventHeader))
+		assert.Equal("expiring-soon", recv.requests[1].Header.Get(EventHeader))
+	}
+}